@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// authConfig is the auth section of the config file, which says who's
+// asking.  Users sign in with HTTP basic auth, or with their SSO
+// (oidc), or, with header, a proxy in front of the server has already
+// signed them in and says who they are (and, with groups_header, what
+// groups they're in).
+type authConfig struct {
+	Users        map[string]authUser `yaml:"users"`
+	OIDC         oidcConfig          `yaml:"oidc"`
+	Header       string              `yaml:"header"`        // e.g. X-Forwarded-User
+	GroupsHeader string              `yaml:"groups_header"` // comma-separated
+}
+
+type authUser struct {
+	Password string   `yaml:"password"` // sha256:<hex digest>
+	Groups   []string `yaml:"groups"`
+	Keys     []string `yaml:"keys"` // SSH public keys, as in authorized_keys, for -sftp
+}
+
+// An aclRule says who may read and who may edit (which includes
+// reading) the pages below a path prefix.  Each entry is a user name,
+// group:<name> for the members of a group, or * for everyone, signed
+// in or not.  The rule with the longest matching prefix applies; where
+// none does, everyone may read and edit (everyone signed in, with
+// oidc, which is there to keep the whole preview private).
+type aclRule struct {
+	Path string   `yaml:"path"`
+	Read []string `yaml:"read"`
+	Edit []string `yaml:"edit"`
+}
+
+// A principal is a signed-in user.
+type principal struct {
+	Name   string
+	Groups []string
+}
+
+type principalKey struct{}
+
+// the URL prefixes of the endpoints that serve something about one
+// page, followed by the page's path
+var pageEndpoints = []string{
+	"/_api/pages/", "/_api/backlinks/", "/_api/related/", "/_api/spelling/",
+	"/_api/preview/", "/_diff/",
+}
+
+func authEnabled() bool {
+	return len(cfg.Auth.Users) > 0 || cfg.Auth.Header != "" || oidcEnabled()
+}
+
+// readablePages returns the paths in rels that the request's user may
+// read.
+func readablePages(r *http.Request, rels []string) []string {
+	readable := []string{}
+	for _, rel := range rels {
+		if canRead(r, rel) {
+			readable = append(readable, rel)
+		}
+	}
+	return readable
+}
+
+// checkACL checks the config file's auth and acl sections.
+func checkACL() error {
+	if err := checkOIDC(); err != nil {
+		return err
+	}
+	for name, u := range cfg.Auth.Users {
+		digest := strings.TrimPrefix(u.Password, "sha256:")
+		if u.Password == "" && len(u.Keys) > 0 {
+			continue
+		}
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size || digest == u.Password {
+			return fmt.Errorf("auth: user %s: the password must be sha256:<hex digest>", name)
+		}
+	}
+	for i, rule := range cfg.ACL {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("acl rule %d: the path must start with /", i+1)
+		}
+	}
+	if len(cfg.ACL) > 0 && !authEnabled() {
+		log.Warning("there are acl rules but no auth, so nobody is signed in")
+	}
+	return nil
+}
+
+// requestPrincipal returns who's making the request, nil if nobody
+// has signed in.
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// aclFor returns the rule that applies to rel, nil if none does.
+func aclFor(rel string) *aclRule {
+	name := path.Clean("/" + rel)
+	var best *aclRule
+	for i, rule := range cfg.ACL {
+		prefix := strings.TrimSuffix(rule.Path, "/")
+		if (name == prefix || strings.HasPrefix(name, prefix+"/") || prefix == "") &&
+			(best == nil || len(rule.Path) > len(best.Path)) {
+			best = &cfg.ACL[i]
+		}
+	}
+	return best
+}
+
+// listed reports whether p is among entries.
+func listed(p *principal, entries []string) bool {
+	for _, e := range entries {
+		if e == "*" {
+			return true
+		}
+		if p == nil {
+			continue
+		}
+		if e == p.Name {
+			return true
+		}
+		for _, g := range p.Groups {
+			if e == "group:"+g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayRead reports whether p (nil if nobody's signed in) may read rel.
+func mayRead(p *principal, rel string) bool {
+	rule := aclFor(rel)
+	if rule == nil {
+		return !oidcEnabled() || p != nil
+	}
+	return listed(p, rule.Read) || listed(p, rule.Edit)
+}
+
+// mayEdit reports whether p may change rel.
+func mayEdit(p *principal, rel string) bool {
+	rule := aclFor(rel)
+	if rule == nil {
+		return !oidcEnabled() || p != nil
+	}
+	return listed(p, rule.Edit)
+}
+
+// canRead reports whether the request's user may read rel.
+func canRead(r *http.Request, rel string) bool {
+	return mayRead(requestPrincipal(r), rel)
+}
+
+// canEdit reports whether the request's user may change rel (preview
+// it, or move it, or move something to it).
+func canEdit(r *http.Request, rel string) bool {
+	return mayEdit(requestPrincipal(r), rel)
+}
+
+// requestedPage returns the path, relative to the content directory,
+// of the file a request is for (or about), and false if it isn't for
+// one in particular.
+func requestedPage(r *http.Request) (string, bool) {
+	name := r.URL.Path
+	if m := thumbPathRegexp.FindStringSubmatch(name); m != nil {
+		name = m[3]
+	}
+	for _, prefix := range pageEndpoints {
+		if strings.HasPrefix(name, prefix) {
+			name = "/" + strings.TrimPrefix(name, prefix)
+			break
+		}
+	}
+	if strings.HasPrefix(name, "/_") {
+		return "", false
+	}
+	return strings.TrimPrefix(path.Clean(name), "/"), true
+}
+
+// passwordMatches checks a basic auth password against a sha256 digest.
+func passwordMatches(password string, digest string) bool {
+	sum := sha256.Sum256([]byte(password))
+	want, err := hex.DecodeString(strings.TrimPrefix(digest, "sha256:"))
+	return err == nil && subtle.ConstantTimeCompare(sum[:], want) == 1
+}
+
+// authenticate wraps a handler that, with auth or ACL rules
+// configured, works out who's asking and turns away requests for pages
+// they may not read:
+// with a 401, asking them to sign in, if they haven't (or, with oidc,
+// a redirect to the provider), and a 403 if they have.  With oidc,
+// nothing but pages the ACL rules make public is served to those who
+// haven't.  The handlers check edits, and filter lists of pages,
+// themselves.
+func authenticate(h http.Handler) http.Handler {
+	if !authEnabled() && len(cfg.ACL) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p *principal
+		if cfg.Auth.Header != "" {
+			if name := r.Header.Get(cfg.Auth.Header); name != "" {
+				p = &principal{Name: name}
+				if cfg.Auth.GroupsHeader != "" {
+					for _, g := range strings.Split(r.Header.Get(cfg.Auth.GroupsHeader), ",") {
+						if g = strings.TrimSpace(g); g != "" {
+							p.Groups = append(p.Groups, g)
+						}
+					}
+				}
+			}
+		} else if name, password, ok := r.BasicAuth(); ok {
+			u, known := cfg.Auth.Users[name]
+			if !known || !passwordMatches(password, u.Password) {
+				log.Warning("bad password for %s from %s", name, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Basic realm="mdwiki-dev-server"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			p = &principal{Name: name, Groups: u.Groups}
+		} else if oidcEnabled() {
+			p = sessionPrincipal(r)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		// agents have their own token
+		if strings.HasPrefix(r.URL.Path, "/_auth/") || r.URL.Path == "/_healthz" || r.URL.Path == "/_agent" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rel, ok := requestedPage(r)
+		if ok && !canRead(r, rel) || !ok && p == nil && oidcEnabled() {
+			if p == nil && oidcEnabled() && r.Method == "GET" {
+				http.Redirect(w, r, "/_auth/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+				return
+			}
+			if p == nil && len(cfg.Auth.Users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mdwiki-dev-server"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// The server's own endpoints leave out, and won't act on, pages the
+// ACL rules say the user may not read.
+func TestACLEndpoints(t *testing.T) {
+	s := startServer(t)
+	const secret = "acl/secret/page.md"
+	s.touch(t, secret, "---\nreview_by: 2000-01-01\n---\n# Secret\n")
+	recordHistory(fsnotify.Event{Op: fsnotify.Write}, secret)
+	snap, err := takeSnapshot(s.dir, "before the ACL test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.touch(t, secret, "---\nreview_by: 2000-01-01\n---\n# Secret, changed\n")
+
+	c := s.dial(t)
+	c.send(t, map[string]interface{}{"page": secret})
+	var id int
+	for deadline := time.Now().Add(messageTimeout); id == 0; time.Sleep(10 * time.Millisecond) {
+		for _, rc := range clientsSnapshot() {
+			if rc.Page == secret {
+				id = rc.ID
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the server never noted the client's page")
+		}
+	}
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.Auth = authConfig{Header: "X-Test-User"}
+	cfg.ACL = []aclRule{{Path: "/acl/secret", Read: []string{"alice"}, Edit: []string{"alice"}}}
+	h := authenticate(http.DefaultServeMux)
+
+	for _, tc := range []struct {
+		method, url string
+	}{
+		{"GET", "/_history"},
+		{"GET", "/_api/history"},
+		{"GET", "/_api/reviews"},
+		{"GET", "/_api/stats"},
+		{"GET", "/_api/snapshots/" + snap.ID},
+		{"GET", "/_api/clients"},
+		{"POST", "/_api/clients/" + strconv.Itoa(id) + "/reload"},
+	} {
+		for user, allowed := range map[string]bool{"bob": false, "alice": true} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.url, nil)
+			r.Header.Set("X-Test-User", user)
+			h.ServeHTTP(w, r)
+			if tc.method == "POST" {
+				if got := w.Code == http.StatusNoContent; got != allowed {
+					t.Errorf("%s %s as %s: %d %s", tc.method, tc.url, user, w.Code, w.Body)
+				}
+				continue
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("%s %s as %s: %d %s", tc.method, tc.url, user, w.Code, w.Body)
+			}
+			if got := strings.Contains(w.Body.String(), secret); got != allowed {
+				t.Errorf("%s %s as %s: mentions %s is %t, want %t", tc.method, tc.url, user, secret, got, allowed)
+			}
+		}
+	}
+}
+
+// A move that would rewrite a link in a page the user may not edit is
+// refused, and changes nothing.
+func TestACLMove(t *testing.T) {
+	s := startServer(t)
+	s.touch(t, "aclmove/open.md", "# Open\n")
+	s.touch(t, "aclmove/secret/page.md", "See [the open page](../open.md).\n")
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.Auth = authConfig{Header: "X-Test-User"}
+	cfg.ACL = []aclRule{{Path: "/aclmove/secret", Read: []string{"*"}, Edit: []string{"alice"}}}
+	h := authenticate(http.DefaultServeMux)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/_api/mv", strings.NewReader(`{"from": "aclmove/open.md", "to": "aclmove/moved.md"}`))
+	r.Header.Set("X-Test-User", "bob")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("moving a page linked to from one bob may not edit: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "aclmove", "open.md")); err != nil {
+		t.Errorf("the refused move moved the page: %s", err)
+	}
+}
+
+// Only those who may edit every page in it may take a snapshot.
+func TestACLSnapshot(t *testing.T) {
+	s := startServer(t)
+	s.touch(t, "aclsnapshot/secret/page.md", "# Secret\n")
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.Auth = authConfig{Header: "X-Test-User"}
+	cfg.ACL = []aclRule{{Path: "/aclsnapshot/secret", Read: []string{"*"}, Edit: []string{"alice"}}}
+	h := authenticate(http.DefaultServeMux)
+
+	before, err := listSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/_api/snapshots", strings.NewReader(`{"note": "bob's"}`))
+	r.Header.Set("X-Test-User", "bob")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("bob taking a snapshot: %d %s", w.Code, w.Body)
+	}
+	if after, _ := listSnapshots(); len(after) != len(before) {
+		t.Errorf("bob took a snapshot: %d snapshots, then %d", len(before), len(after))
+	}
+}
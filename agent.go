@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"gopkg.in/fsnotify.v1"
+)
+
+// The agent command watches the content where it's edited and tells a
+// server elsewhere, at /_agent, what changed, for when the server
+// can't see the changes itself: it serves the same files from a
+// network filesystem, say, that doesn't report changes.  The server
+// treats what an agent tells it as it would its own watcher's news.
+// Both ends need the same -agent-token.  With -sync it sends the files
+// too (see sync.go).
+
+// An agentMessage is a change an agent reports, or, with -sync, part
+// of sending a file.
+type agentMessage struct {
+	Type  string            `json:"type,omitempty"` // "" for a change; manifest, offer, delta or remove
+	Rel   string            `json:"rel,omitempty"`
+	Op    fsnotify.Op       `json:"op,omitempty"`
+	Files map[string]string `json:"files,omitempty"` // manifest: each file's sha256
+	Delta []deltaOp         `json:"delta,omitempty"`
+	Sum   string            `json:"sum,omitempty"` // delta: the sha256 of the file it makes
+}
+
+// agentEvents are the changes the connected agents have reported.
+var agentEvents = make(chan fsnotify.Event)
+
+// withAgents merges the changes agents report into those w sees.
+func withAgents(w treeWatcher) treeWatcher {
+	events := make(chan fsnotify.Event)
+	shutdown := make(chan interface{})
+	go func() {
+		defer w.Close()
+		for {
+			var event fsnotify.Event
+			var ok bool
+			select {
+			case event, ok = <-w.Events():
+				if !ok {
+					close(events)
+					return
+				}
+			case event = <-agentEvents:
+			case <-shutdown:
+				return
+			}
+			select {
+			case events <- event:
+			case <-shutdown:
+				return
+			}
+		}
+	}()
+	return &chanTreeWatcher{events: events, shutdown: shutdown}
+}
+
+// agentEndpoint serves /_agent to agents with the -agent-token.
+func agentEndpoint(w http.ResponseWriter, r *http.Request) {
+	if *flagAgentToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(*flagAgentToken)) != 1 {
+		log.Warning("agent from %s refused: bad token", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	websocket.Handler(agentHandler).ServeHTTP(w, r)
+}
+
+// agentHandler takes the changes an agent reports.
+func agentHandler(ws *websocket.Conn) {
+	remote := ws.Request().RemoteAddr
+	log.Notice("agent connected from %s", remote)
+	for {
+		var m string
+		if err := receiveMessage(ws, &m); err != nil {
+			log.Notice("agent at %s went away: %s", remote, err)
+			return
+		}
+		var change agentMessage
+		if err := json.Unmarshal([]byte(m), &change); err != nil {
+			log.Warning("ignoring a bad message from the agent at %s: %s", remote, err)
+			continue
+		}
+		if change.Type != "" {
+			b, err := json.Marshal(handleSync(remote, change))
+			maybeBail(err)
+			if err := sendMessage(ws, string(b)); err != nil {
+				log.Notice("agent at %s went away: %s", remote, err)
+				return
+			}
+			continue
+		}
+		rel := strings.TrimPrefix(path.Clean("/"+change.Rel), "/")
+		if rel == "" || protectedPath(rel) {
+			continue
+		}
+		log.Info("agent at %s saw %s change", remote, rel)
+		agentEvents <- fsnotify.Event{Name: filepath.Join(*flagContentDir, filepath.FromSlash(rel)), Op: change.Op}
+	}
+}
+
+// agent implements the agent command.
+func agent(args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	connect := flags.String("connect", "", "the server's /_agent URL, e.g. wss://wiki.example.com/_agent")
+	sync := flags.Bool("sync", false, "send the files themselves, for a server that can't see them")
+	flags.Parse(args)
+	if *connect == "" || flags.NArg() != 0 {
+		return fmt.Errorf("usage: agent [-sync] -connect wss://server/_agent")
+	}
+	if *flagAgentToken == "" {
+		return fmt.Errorf("agent: -agent-token must be set, to the server's")
+	}
+	config, err := agentConfig(*connect)
+	if err != nil {
+		return err
+	}
+
+	dir := *flagContentDir
+	w := newTreeWatcher(dir, ".")
+	defer w.Close()
+	wait := time.Second
+	for {
+		start := time.Now()
+		err := forwardChanges(config, dir, w, *sync)
+		if err == nil {
+			return nil
+		}
+		if time.Since(start) > time.Minute {
+			wait = time.Second
+		}
+		log.Error("lost the server, trying again in %s: %s", wait, err)
+		time.Sleep(wait)
+		if wait < 30*time.Second {
+			wait *= 2
+		}
+	}
+}
+
+// agentConfig is how the agent connects to the server at raw.
+func agentConfig(raw string) (*websocket.Config, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		return nil, fmt.Errorf("agent: -connect must be a ws:// or wss:// URL, not %q", raw)
+	}
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+	config, err := websocket.NewConfig(raw, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set("Authorization", "Bearer "+*flagAgentToken)
+	return config, nil
+}
+
+// forwardChanges connects to the server and sends it the changes w
+// sees below dir, or with sync the changed files, until the connection
+// fails, or w stops.
+func forwardChanges(config *websocket.Config, dir string, w treeWatcher, sync bool) error {
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	log.Notice("forwarding changes below %s to %s", dir, config.Location)
+	if sync {
+		if err := syncAll(ws, dir); err != nil {
+			return err
+		}
+	}
+	for event := range w.Events() {
+		rel, err := filepath.Rel(dir, event.Name)
+		maybeBail(err)
+		rel = filepath.ToSlash(rel)
+		if settingsFor(rel).ignored(rel) || sync && protectedPath(rel) {
+			continue
+		}
+		if sync {
+			if err := syncFile(ws, dir, rel); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := json.Marshal(agentMessage{Rel: rel, Op: event.Op})
+		maybeBail(err)
+		// not sendMessage: this isn't the server's traffic to record
+		if err := websocket.Message.Send(ws, string(b)); err != nil {
+			return err
+		}
+		log.Info("forwarded %s", event)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many requests /_analytics remembers
+const accessLimit = 10000
+
+// An accessEntry is a request in the access log.
+type accessEntry struct {
+	Time     time.Time
+	Remote   string
+	Method   string
+	Path     string
+	Status   int
+	Referrer string
+}
+
+// accessLog is a ring buffer of the latest requests for content, for
+// /_analytics.
+var accessLog struct {
+	sync.Mutex
+	entries []accessEntry
+	next    int
+}
+
+func recordAccess(e accessEntry) {
+	accessLog.Lock()
+	if len(accessLog.entries) < accessLimit {
+		accessLog.entries = append(accessLog.entries, e)
+	} else {
+		accessLog.entries[accessLog.next] = e
+	}
+	accessLog.next = (accessLog.next + 1) % accessLimit
+	accessLog.Unlock()
+}
+
+// accessSnapshot returns the access log, newest first.
+func accessSnapshot() []accessEntry {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	n := len(accessLog.entries)
+	entries := make([]accessEntry, n)
+	for i := range entries {
+		entries[i] = accessLog.entries[(accessLog.next-1-i+n)%n]
+	}
+	return entries
+}
+
+// an accessWriter notes the status of the response.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if code < 200 {
+		// informational, e.g. 103 Early Hints: the response is to come
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack lets the reloader's websocket through.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("can't hijack the connection")
+	}
+	return h.Hijack()
+}
+
+// logAccess wraps a handler so that requests for content, but not the
+// server's own /_ endpoints, go in the access log.
+func logAccess(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		aw := &accessWriter{ResponseWriter: w}
+		h.ServeHTTP(aw, r)
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		recordAccess(accessEntry{time.Now(), remote, r.Method, r.URL.Path, aw.status, r.Referer()})
+	})
+}
+
+// a count of something in the access log
+type accessCount struct {
+	Name  string
+	Count int
+}
+
+func topCounts(counts map[string]int) []accessCount {
+	list := []accessCount{}
+	for name, n := range counts {
+		list = append(list, accessCount{name, n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// externalReferrer returns the host of a referrer from outside the
+// server, or "".
+func externalReferrer(referrer string, host string) string {
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" || u.Host == host {
+		return ""
+	}
+	return u.Host
+}
+
+var analyticsTmpl = template.Must(template.New("analytics").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Analytics</title>
+<style>
+body { font-family: sans-serif; }
+td { padding: 2px 8px; vertical-align: top; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Requests since {{.Since.Format "15:04:05 Jan 2"}}</h1>
+{{if not .Recent}}<p>Nothing has been read yet.</p>{{else}}
+<h2>Pages</h2>
+<table>
+{{range .Pages}}<tr><td class="n">{{.Count}}</td><td><a href="/{{.Name}}">{{.Name}}</a></td></tr>
+{{end}}</table>
+<h2>Referrers</h2>
+{{if not .Referrers}}<p>None from outside the server.</p>{{end}}
+<table>
+{{range .Referrers}}<tr><td class="n">{{.Count}}</td><td>{{.Name}}</td></tr>
+{{end}}</table>
+<h2>Recent activity</h2>
+<table>
+{{range .Recent}}<tr>
+<td>{{.Time.Format "15:04:05"}}</td>
+<td>{{.Remote}}</td>
+<td>{{.Method}}</td>
+<td>{{.Status}}</td>
+<td>{{.Path}}</td>
+</tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
+
+// analyticsHandler serves /_analytics, what's been read from the
+// server, and by whom, as far as the access log goes back, leaving out
+// the pages the user may not read.
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	all := accessSnapshot()
+	since := sessionStarted
+	if len(all) == accessLimit {
+		since = all[len(all)-1].Time
+	}
+	entries := []accessEntry{}
+	for _, e := range all {
+		if canRead(r, strings.TrimPrefix(path.Clean(e.Path), "/")) {
+			entries = append(entries, e)
+		}
+	}
+	pages := make(map[string]int)
+	referrers := make(map[string]int)
+	for _, e := range entries {
+		if e.Status == http.StatusOK && path.Ext(e.Path) == ".md" {
+			pages[strings.TrimPrefix(e.Path, "/")]++
+		}
+		if host := externalReferrer(e.Referrer, r.Host); host != "" {
+			referrers[host]++
+		}
+	}
+	recent := entries
+	if len(recent) > 100 {
+		recent = recent[:100]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := analyticsTmpl.Execute(w, struct {
+		Since     time.Time
+		Pages     []accessCount
+		Referrers []accessCount
+		Recent    []accessEntry
+	}{since, topCounts(pages), topCounts(referrers), recent})
+	if err != nil {
+		log.Error("unable to render analytics: %s", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// serializes asset builds, which may be triggered from several watchers
+var assetsLock sync.Mutex
+
+// watchAssets bundles the configured assets at startup and again
+// whenever a script in one of their entry points' directories
+// changes.  A successful rebuild reloads the clients.
+func watchAssets(dir string) {
+	buildAssets(dir)
+
+	outputs := make(map[string]bool)
+	watched := make(map[string]bool)
+	for _, a := range cfg.Assets {
+		out := filepath.Join(dir, a.Out)
+		outputs[out] = true
+		outputs[out+".map"] = true
+		watched[filepath.Dir(filepath.Join(dir, a.Entry))] = true
+	}
+
+	for d := range watched {
+		notifier, _ := newWatcher(d, `\.(js|jsx|ts|tsx|mjs|json)$`)
+		go func() {
+			for note := range notifier {
+				if outputs[note.Name] {
+					continue
+				}
+				log.Notice("rebuilding assets because: %s", note)
+				if buildAssets(dir) {
+					broadcast(newReloadMessage("assets rebuilt"))
+				}
+			}
+		}()
+	}
+}
+
+// buildAssets runs esbuild over each configured entry point, writing
+// the bundle and its sourcemap.  It returns true if they all built.
+func buildAssets(dir string) bool {
+	assetsLock.Lock()
+	defer assetsLock.Unlock()
+
+	var failures []string
+	for _, a := range cfg.Assets {
+		log.Info("bundling %s into %s", a.Entry, a.Out)
+		err := runTool(*flagEsbuild, filepath.Join(dir, a.Entry), "--bundle",
+			"--sourcemap", "--outfile="+filepath.Join(dir, a.Out))
+		if err != nil {
+			log.Error("unable to bundle %s: %s", a.Entry, err)
+			failures = append(failures, err.Error())
+		}
+	}
+	setBuildError("esbuild", strings.Join(failures, "\n\n"))
+	return len(failures) == 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pages that are entry points and so are never orphans
+var auditEntryPoints = map[string]bool{"index.md": true, "navigation.md": true}
+
+var auditMarkerRegexp = regexp.MustCompile(`\b(TODO|FIXME|XXX)\b`)
+
+type auditMarker struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type auditStale struct {
+	Path     string    `json:"path"`
+	Modified time.Time `json:"modified"`
+	Days     int       `json:"days"`
+}
+
+type auditReport struct {
+	Orphans []string      `json:"orphans"`
+	Stale   []auditStale  `json:"stale"`
+	Markers []auditMarker `json:"markers"`
+}
+
+// lastModified returns when a file was last committed to git, falling
+// back to its modification time if it isn't tracked (or there's no git).
+func lastModified(dir string, p *page) time.Time {
+	out, err := exec.Command("git", "-C", dir, "log", "-1", "--format=%ct", "--",
+		filepath.FromSlash(p.Path)).Output()
+	if err == nil {
+		if secs, err := strconv.ParseInt(string(bytes.TrimSpace(out)), 10, 64); err == nil {
+			return time.Unix(secs, 0)
+		}
+	}
+	return p.ModTime
+}
+
+// audit implements the audit command, a review-meeting report of
+// orphan pages (that nothing links to), stale pages and pages with
+// TODO/FIXME markers.
+func audit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	days := flags.Int("stale-days", 180, "pages unchanged for this many days are stale")
+	format := flags.String("format", "markdown", "output format, markdown or json")
+	flags.Parse(args)
+
+	index, err := newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	pages := index.sortedPages()
+
+	report := auditReport{Orphans: []string{}, Stale: []auditStale{}, Markers: []auditMarker{}}
+
+	linked := make(map[string]bool)
+	for _, p := range pages {
+		for _, l := range p.Links {
+			if target := index.resolveLink(p.Path, l); target != "" && target != p.Path {
+				linked[target] = true
+			}
+		}
+	}
+	for _, p := range pages {
+		if !linked[p.Path] && !auditEntryPoints[p.Path] {
+			report.Orphans = append(report.Orphans, p.Path)
+		}
+	}
+
+	now := time.Now()
+	for _, p := range pages {
+		modified := lastModified(*flagContentDir, p)
+		if age := int(now.Sub(modified).Hours() / 24); age >= *days {
+			report.Stale = append(report.Stale, auditStale{p.Path, modified, age})
+		}
+	}
+
+	err = walkMarkdown(*flagContentDir, func(rel string, md []byte) error {
+		for i, line := range strings.Split(string(md), "\n") {
+			if auditMarkerRegexp.MatchString(line) {
+				report.Markers = append(report.Markers,
+					auditMarker{rel, i + 1, strings.TrimSpace(line)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	case "markdown":
+		fmt.Printf("# Documentation audit, %s\n\n", now.Format("2006-01-02"))
+		fmt.Printf("## Orphan pages (%d)\n\n", len(report.Orphans))
+		for _, o := range report.Orphans {
+			fmt.Printf("- [%s](%s)\n", o, o)
+		}
+		fmt.Printf("\n## Pages unchanged for %d days or more (%d)\n\n", *days, len(report.Stale))
+		for _, s := range report.Stale {
+			fmt.Printf("- [%s](%s), %d days (%s)\n", s.Path, s.Path, s.Days,
+				s.Modified.Format("2006-01-02"))
+		}
+		fmt.Printf("\n## TODO/FIXME markers (%d)\n\n", len(report.Markers))
+		for _, m := range report.Markers {
+			fmt.Printf("- %s:%d: `%s`\n", m.Path, m.Line, strings.Replace(m.Text, "`", "'", -1))
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// A mutation is a change someone made through the server, for the
+// audit log.
+type mutation struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user,omitempty"` // "" if nobody signed in
+	Remote  string    `json:"remote"`
+	Action  string    `json:"action"` // preview, discard, move; upload, remove, mkdir (-sftp); sync (agents); rollback, restore
+	Path    string    `json:"path"`
+	To      string    `json:"to,omitempty"`      // where a page moved
+	Added   int       `json:"added,omitempty"`   // lines
+	Removed int       `json:"removed,omitempty"` // lines
+	Links   int       `json:"links,omitempty"`   // rewritten by a move
+}
+
+// mutations is this session's audit log, appended to -audit-log too if
+// it's set.
+var mutations struct {
+	sync.Mutex
+	entries []mutation
+}
+
+// lineChanges counts the lines added and removed in changing old to
+// new.
+func lineChanges(old []byte, new []byte) (added int, removed int) {
+	for _, op := range diffLines(splitLines(string(old)), splitLines(string(new))) {
+		switch op.kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// recordMutation writes a change made by the request's user to the
+// audit log.
+func recordMutation(r *http.Request, m mutation) {
+	m.Time = time.Now()
+	m.Remote = r.RemoteAddr
+	if p := requestPrincipal(r); p != nil {
+		m.User = p.Name
+	}
+	logMutation(m)
+}
+
+// logMutation appends m, with its user, remote address and time filled
+// in, to the audit log.
+func logMutation(m mutation) {
+	mutations.Lock()
+	defer mutations.Unlock()
+	mutations.entries = append(mutations.entries, m)
+	if len(mutations.entries) > historyLimit {
+		mutations.entries = mutations.entries[len(mutations.entries)-historyLimit:]
+	}
+	if *flagAuditLog == "" {
+		return
+	}
+	f, err := os.OpenFile(*flagAuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("unable to write the audit log: %s", err)
+		return
+	}
+	defer f.Close()
+	b, err := json.Marshal(m)
+	maybeBail(err)
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Error("unable to write the audit log: %s", err)
+	}
+}
+
+// auditLog returns the audit log, newest first: all of -audit-log, if
+// it's set, and this session's otherwise.
+func auditLog() ([]mutation, error) {
+	var entries []mutation
+	if *flagAuditLog == "" {
+		mutations.Lock()
+		entries = append(entries, mutations.entries...)
+		mutations.Unlock()
+	} else {
+		mutations.Lock()
+		defer mutations.Unlock()
+		f, err := os.Open(*flagAuditLog)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var m mutation
+				if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+					log.Warning("skipping a bad line in the audit log: %s", err)
+					continue
+				}
+				entries = append(entries, m)
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// auditHandler serves /_api/audit, the audit log, leaving out changes
+// to pages the user may not read.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := auditLog()
+	if err != nil {
+		log.Error("unable to read the audit log: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readable := []mutation{}
+	for _, m := range entries {
+		if canRead(r, m.Path) && (m.To == "" || canRead(r, m.To)) {
+			readable = append(readable, m)
+		}
+	}
+
+	b, err := json.MarshalIndent(readable, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
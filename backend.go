@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// the -watch-backend choices
+const (
+	backendFsnotify = "fsnotify"
+	backendPoll     = "poll"
+	backendFSEvents = "fsevents" // macOS only
+	backendAuto     = "auto"     // poll in a container, fsnotify otherwise
+)
+
+// A treeWatcher reports changes to the files below a directory,
+// however it finds out about them.  Events name the file with dir
+// leading, as fsnotify does.
+type treeWatcher interface {
+	Events() <-chan fsnotify.Event
+	Close() error
+}
+
+// checkWatchBackend makes sure -watch-backend names a backend this
+// build has.
+func checkWatchBackend(backend string) error {
+	switch backend {
+	case backendFsnotify, backendPoll, backendAuto:
+		return nil
+	case backendFSEvents:
+		if !haveFSEvents {
+			return fmt.Errorf("-watch-backend fsevents is only available on macOS")
+		}
+		return nil
+	}
+	return fmt.Errorf("-watch-backend must be auto, fsnotify, poll or fsevents, not %q", backend)
+}
+
+// newTreeWatcher watches dir and everything below it, other than dot
+// directories, with the -watch-backend, passing on changes to files
+// whose names match matchPattern.  A -source snapshot of the content
+// directory is watched for new versions instead.
+func newTreeWatcher(dir string, matchPattern string) treeWatcher {
+	matcher := regexp.MustCompile(matchPattern)
+	var notifier chan fsnotify.Event
+	var shutdown chan interface{}
+	snapshot, isSnapshot := content.(*snapshotSource)
+	switch {
+	case isSnapshot && dir == *flagContentDir:
+		notifier, shutdown = newSnapshotWatcher(snapshot, dir, matcher, *flagPollInterval)
+	case *flagWatchBackend == backendFSEvents:
+		notifier, shutdown = newFSEventsTreeWatcher(dir, matcher)
+	case *flagWatchBackend == backendPoll:
+		notifier, shutdown = newPollingTreeWatcher(dir, matcher, *flagPollInterval)
+	default:
+		notifier, shutdown = newFsnotifyTreeWatcher(dir, matcher)
+	}
+	return &chanTreeWatcher{events: notifier, shutdown: shutdown}
+}
+
+// a chanTreeWatcher is a treeWatcher made from the channels of one of
+// the goroutine-based watchers.
+type chanTreeWatcher struct {
+	events   chan fsnotify.Event
+	shutdown chan interface{}
+	once     sync.Once
+}
+
+func (w *chanTreeWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *chanTreeWatcher) Close() error {
+	w.once.Do(func() { close(w.shutdown) })
+	return nil
+}
+
+// A fakeTreeWatcher reports the events it's told to, so that what
+// happens on a change can be tried out without a real filesystem.
+type fakeTreeWatcher struct {
+	events chan fsnotify.Event
+	once   sync.Once
+}
+
+func newFakeTreeWatcher() *fakeTreeWatcher {
+	return &fakeTreeWatcher{events: make(chan fsnotify.Event)}
+}
+
+// Send reports an event, waiting until it's been taken.
+func (w *fakeTreeWatcher) Send(event fsnotify.Event) {
+	w.events <- event
+}
+
+func (w *fakeTreeWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *fakeTreeWatcher) Close() error {
+	w.once.Do(func() { close(w.events) })
+	return nil
+}
+
+// a polled file, as it was the last time we looked
+type polledFile struct {
+	mtime time.Time
+	size  int64
+}
+
+// pollTree returns the files below dir, other than those in dot
+// directories or behind symbolic links the policy doesn't allow.  A
+// link is polled as the file it leads to, so that a ConfigMap's keys
+// change when the kubelet swaps its ..data link.
+func pollTree(dir string) map[string]polledFile {
+	files := make(map[string]polledFile)
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".") && name != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !symlinkAllowed(name) || kubeletOwned(name) {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(name); err != nil || info.IsDir() {
+				return nil
+			}
+		}
+		files[name] = polledFile{info.ModTime(), info.Size()}
+		return nil
+	})
+	return files
+}
+
+// newPollingTreeWatcher finds changes below dir by looking at every
+// file every interval, for filesystems, like some network and
+// container mounts, that don't report changes.
+func newPollingTreeWatcher(dir string, matcher *regexp.Regexp, interval time.Duration) (chan fsnotify.Event, chan interface{}) {
+	notifier := make(chan fsnotify.Event)
+	notifierShutdown := make(chan interface{})
+	before := pollTree(dir)
+	log.Info("polling %d files below %s every %s", len(before), dir, interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-notifierShutdown:
+				return
+			}
+			after := pollTree(dir)
+			var events []fsnotify.Event
+			for name, f := range after {
+				if old, ok := before[name]; !ok {
+					events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Create})
+				} else if old != f {
+					events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Write})
+				}
+			}
+			for name := range before {
+				if _, ok := after[name]; !ok {
+					events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+				}
+			}
+			before = after
+			swapped := make(map[string]int)
+			for _, event := range events {
+				if event.Op == fsnotify.Write && configMapKey(event.Name) {
+					swapped[filepath.Dir(event.Name)]++
+				}
+			}
+			for volume, n := range swapped {
+				noteConfigMapSwap(volume, n)
+			}
+			for _, event := range events {
+				if !watchMatches(matcher, event.Name) {
+					continue
+				}
+				select {
+				case notifier <- event:
+				case <-notifierShutdown:
+					return
+				}
+			}
+		}
+	}()
+	return notifier, notifierShutdown
+}
+
+// inDotDir reports whether name, below dir, is in a dot directory,
+// which tree watchers leave alone.
+func inDotDir(dir string, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for _, part := range parts[:len(parts)-1] {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// Changes from the watcher reach the content handlers as paths
+// relative to the content directory, ignored ones excepted.
+func TestDispatchChanges(t *testing.T) {
+	dir := t.TempDir()
+	*flagContentDir = dir
+	if err := compileNotifyRegexp(); err != nil {
+		t.Fatal(err)
+	}
+	savedCfg, savedHandlers := cfg, contentHandlers
+	defer func() { cfg, contentHandlers = savedCfg, savedHandlers }()
+	cfg = config{}
+	cfg.Ignore = []string{"scratch"}
+
+	var got []string
+	contentHandlers = nil
+	onContentChange(func(event fsnotify.Event, rel string) {
+		got = append(got, event.Op.String()+" "+rel)
+	})
+
+	w := newFakeTreeWatcher()
+	done := make(chan struct{})
+	go func() {
+		dispatchChanges(dir, w)
+		close(done)
+	}()
+	w.Send(fsnotify.Event{Name: filepath.Join(dir, "index.md"), Op: fsnotify.Write})
+	w.Send(fsnotify.Event{Name: filepath.Join(dir, "scratch", "notes.md"), Op: fsnotify.Create})
+	w.Send(fsnotify.Event{Name: filepath.Join(dir, "docs", "a.md"), Op: fsnotify.Remove})
+	w.Close()
+	<-done
+
+	want := []string{"WRITE index.md", "REMOVE docs/a.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handlers saw %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// backlinksHandler serves /_api/backlinks/<path>, the pages that link
+// to a page, which is what's affected by renaming or deleting it.
+func backlinksHandler(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(r.URL.Path, "/_api/backlinks/")
+	b, err := json.MarshalIndent(readablePages(r, site.backlinks(rel)), "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
+
+// processBacklinks adds (with -backlinks) a "Pages linking here"
+// section to the end of a page.  The navigation neither has one nor is
+// listed in them, since it links to nearly everything.
+func processBacklinks(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if !*flagBacklinks || path.Base(ctx.Path) == "navigation.md" {
+		return in, nil
+	}
+	var from []string
+	for _, rel := range site.backlinks(ctx.Path) {
+		if path.Base(rel) != "navigation.md" {
+			from = append(from, rel)
+		}
+	}
+	if len(from) == 0 {
+		return in, nil
+	}
+
+	var b bytes.Buffer
+	b.Write(bytes.TrimRight(in, "\r\n"))
+	b.WriteString("\n\n## Pages linking here\n\n")
+	for _, rel := range from {
+		ctx.Depends(rel)
+		title := rel
+		site.RLock()
+		if p := site.pages[rel]; p != nil {
+			title = p.Title
+		}
+		site.RUnlock()
+		fmt.Fprintf(&b, "- [%s](#!%s)\n", title, rel)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// A benchResult is one request made by the bench command.
+type benchResult struct {
+	kind    string // how the server handled it (X-Via-FilteringFileServer)
+	elapsed time.Duration
+	size    int64
+	err     bool
+}
+
+// benchSample returns up to n of the content files, spread across the
+// tree, as URL paths.
+func benchSample(dir string, n int) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && strings.HasPrefix(path.Base(rel), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !protectedPath(rel) {
+			files = append(files, "/"+rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) <= n {
+		return files, nil
+	}
+	sample := make([]string, n)
+	for i := range sample {
+		sample[i] = files[i*len(files)/n]
+	}
+	return sample, nil
+}
+
+// percentile returns the p'th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// benchRun requests the sample n times over with c requests at a time,
+// asking for gzip or not.
+func benchRun(client *http.Client, base string, sample []string, n int, c int, gzip bool) ([]benchResult, time.Duration) {
+	jobs := make(chan string)
+	results := make(chan benchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				results <- benchRequest(client, base+p, gzip)
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			jobs <- sample[i%len(sample)]
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	var all []benchResult
+	for r := range results {
+		all = append(all, r)
+	}
+	return all, time.Since(start)
+}
+
+func benchRequest(client *http.Client, url string, gzip bool) benchResult {
+	req, err := http.NewRequest("GET", url, nil)
+	maybeBail(err)
+	if gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchResult{kind: "error", elapsed: time.Since(start), err: true}
+	}
+	size, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	r := benchResult{
+		kind:    resp.Header.Get("X-Via-FilteringFileServer"),
+		elapsed: time.Since(start),
+		size:    size,
+		err:     err != nil || resp.StatusCode >= 400,
+	}
+	if r.kind == "" {
+		r.kind = "other"
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		r.kind += "+gzip"
+	}
+	return r
+}
+
+// bench implements the bench command, which requests a sample of the
+// content from a running server, or one of its own, and reports the
+// latency and throughput for each way the server handles a file
+// (injecting the snippet, processing Markdown, or serving it as it
+// is), with and without asking for compression.
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	url := flags.String("url", "", "server to benchmark, e.g. http://127.0.0.1:8080; by default one is started in-process")
+	requests := flags.Int("n", 1000, "number of requests for each run")
+	concurrency := flags.Int("c", 8, "number of requests at a time")
+	sampleSize := flags.Int("sample", 50, "number of content files to request")
+	flags.Parse(args)
+	if *requests < 1 || *concurrency < 1 || *sampleSize < 1 {
+		return fmt.Errorf("-n, -c and -sample must be at least 1")
+	}
+
+	sample, err := benchSample(*flagContentDir, *sampleSize)
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		return fmt.Errorf("no content in %s", *flagContentDir)
+	}
+
+	base := strings.TrimSuffix(*url, "/")
+	if base == "" {
+		site, err = newSiteIndex(*flagContentDir)
+		if err != nil {
+			return err
+		}
+		server := httptest.NewServer(serverHandler())
+		defer server.Close()
+		base = server.URL
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: *concurrency,
+	}}
+
+	fmt.Printf("%d requests, %d at a time, for %d files from %s\n\n", *requests, *concurrency, len(sample), base)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "requests\terrors\tp50\tp90\tp99\tmax\treq/s\tKB/s\t\tserved as")
+	for _, gzip := range []bool{false, true} {
+		results, elapsed := benchRun(client, base, sample, *requests, *concurrency, gzip)
+		byKind := make(map[string][]benchResult)
+		for _, r := range results {
+			byKind[r.kind] = append(byKind[r.kind], r)
+		}
+		byKind["all"] = results
+		var kinds []string
+		for kind := range byKind {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			rs := byKind[kind]
+			var times []time.Duration
+			var errors int
+			var bytes int64
+			for _, r := range rs {
+				times = append(times, r.elapsed)
+				bytes += r.size
+				if r.err {
+					errors++
+				}
+			}
+			sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+			label := kind
+			if gzip {
+				label += " (gzip asked for)"
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t%.0f\t%.0f\t\t%s\n", len(rs), errors,
+				percentile(times, .5).Round(time.Microsecond), percentile(times, .9).Round(time.Microsecond),
+				percentile(times, .99).Round(time.Microsecond), times[len(times)-1].Round(time.Microsecond),
+				float64(len(rs))/elapsed.Seconds(), float64(bytes)/1024/elapsed.Seconds(), label)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// listeners are the connected clients' channels for messages that
+// originate with the server itself (e.g. build errors) rather than
+// with a change the client's own watcher noticed.
+var listeners = struct {
+	sync.Mutex
+	channels map[chan string]bool
+}{channels: make(map[chan string]bool)}
+
+func subscribe() chan string {
+	c := make(chan string, 16)
+	listeners.Lock()
+	listeners.channels[c] = true
+	listeners.Unlock()
+	return c
+}
+
+func unsubscribe(c chan string) {
+	listeners.Lock()
+	delete(listeners.channels, c)
+	listeners.Unlock()
+}
+
+// broadcast queues message for every subscriber, dropping it for any
+// that have fallen too far behind.
+func broadcast(message string) {
+	broadcastExcept(message, nil)
+}
+
+// broadcastExcept is broadcast for everyone but the subscriber except.
+func broadcastExcept(message string, except chan string) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	for c := range listeners.channels {
+		if c == except {
+			continue
+		}
+		select {
+		case c <- message:
+		default:
+			log.Warning("dropping message for slow client: %s", message)
+		}
+	}
+}
+
+// the most recent failure of each build step (sass, esbuild, ...)
+var buildErrors = struct {
+	sync.Mutex
+	text map[string]string
+}{text: make(map[string]string)}
+
+// setBuildError records the outcome of a build step, text being empty
+// if it succeeded, and updates the clients' error overlays.
+func setBuildError(step string, text string) {
+	buildErrors.Lock()
+	changed := buildErrors.text[step] != text
+	buildErrors.text[step] = text
+	buildErrors.Unlock()
+	if changed {
+		broadcast(newErrorMessage(currentErrorText()))
+	}
+}
+
+// currentErrorText describes every failing build step, or is empty
+// when nothing is broken.
+func currentErrorText() string {
+	buildErrors.Lock()
+	defer buildErrors.Unlock()
+
+	var steps []string
+	for step, text := range buildErrors.text {
+		if text != "" {
+			steps = append(steps, step)
+		}
+	}
+	sort.Strings(steps)
+	var texts []string
+	for _, step := range steps {
+		texts = append(texts, buildErrors.text[step])
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// A clientMessage is something the client script sent us.
+type clientMessage struct {
+	Sync  json.RawMessage `json:"sync"`  // ghost mode event
+	Pause *bool           `json:"pause"` // pause (or resume) reloads in this tab
+	Page  string          `json:"page"`  // the page the tab is showing
+	User  string          `json:"user"`  // who's using it, if they aren't signed in
+
+	// the Markdown files the tab has loaded, with -targeted-reload
+	Loaded []string `json:"loaded"`
+
+	// the number of the last change the tab knows of, to catch up from
+	Since *int `json:"since"`
+}
+
+// handleClientMessage decodes a message sent by the client subscribed
+// to messages.  Ghost mode (-sync) events are passed on to the other
+// clients; the rest is up to the caller.
+func handleClientMessage(m string, messages chan string) clientMessage {
+	var decoded clientMessage
+	if err := json.Unmarshal([]byte(m), &decoded); err != nil {
+		log.Warning("ignoring malformed client message: %s", m)
+		return decoded
+	}
+	if decoded.Sync != nil && *flagSync {
+		log.Debug("relaying sync event: %s", decoded.Sync)
+		broadcastExcept(m, messages)
+	}
+	return decoded
+}
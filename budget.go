@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usage is warned about when it reaches this fraction of its limit
+const budgetWarnAt = 0.8
+
+// watchedDirs are the directories with an inotify (or kqueue, ...)
+// watch on them.
+var watchedDirs = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// noteWatch records that a directory is being watched, or not.
+func noteWatch(name string, watched bool) {
+	watchedDirs.Lock()
+	if watched {
+		watchedDirs.names[name] = true
+	} else {
+		delete(watchedDirs.names, name)
+	}
+	watchedDirs.Unlock()
+}
+
+// resourceUsage is how much of what the OS rations the server is
+// using.  Limits are 0 where they aren't known.
+type resourceUsage struct {
+	Watches     int   `json:"watches"`
+	WatchLimit  int   `json:"watch_limit"` // for the user, not just us
+	OpenFiles   int   `json:"open_files"`
+	FileLimit   int   `json:"open_file_limit"`
+	Websockets  int   `json:"websockets"`
+	CachedBytes int64 `json:"cached_bytes"`
+	Goroutines  int   `json:"goroutines"`
+}
+
+// procInt reads a number from a file such as those in /proc/sys.
+func procInt(name string) int {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
+
+// openFileLimit returns the soft limit on open files from
+// /proc/self/limits.
+func openFileLimit() int {
+	f, err := os.Open("/proc/self/limits")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		if fields := strings.Fields(strings.TrimPrefix(line, "Max open files")); len(fields) > 0 {
+			n, _ := strconv.Atoi(fields[0])
+			return n
+		}
+	}
+	return 0
+}
+
+// cachedBytes adds up what the in-memory caches hold.
+func cachedBytes() int64 {
+	var n int64
+	diagramCache.Lock()
+	for _, svg := range diagramCache.svgs {
+		n += int64(len(svg))
+	}
+	diagramCache.Unlock()
+	for _, p := range processors {
+		if p, ok := p.(*pluginProcessor); ok {
+			p.Lock()
+			for _, out := range p.cache {
+				n += int64(len(out))
+			}
+			p.Unlock()
+		}
+	}
+	diffs.Lock()
+	for _, s := range diffs.content {
+		n += int64(len(s))
+	}
+	for _, s := range diffs.last {
+		n += int64(len(s))
+	}
+	diffs.Unlock()
+	return n
+}
+
+func currentUsage() resourceUsage {
+	watchedDirs.Lock()
+	watches := len(watchedDirs.names)
+	watchedDirs.Unlock()
+	openFiles := 0
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		openFiles = len(fds)
+	}
+	clients.Lock()
+	websockets := len(clients.byID)
+	clients.Unlock()
+
+	return resourceUsage{
+		Watches:     watches,
+		WatchLimit:  procInt("/proc/sys/fs/inotify/max_user_watches"),
+		OpenFiles:   openFiles,
+		FileLimit:   openFileLimit(),
+		Websockets:  websockets,
+		CachedBytes: cachedBytes(),
+		Goroutines:  runtime.NumGoroutine(),
+	}
+}
+
+// nearLimit reports whether used is close to a known limit.
+func nearLimit(used int, limit int) bool {
+	return limit > 0 && float64(used) >= budgetWarnAt*float64(limit)
+}
+
+// watchBudget logs the server's resource usage every so often, with a
+// warning when the watches or open files are running out, which
+// otherwise shows up as changes that are never noticed or requests
+// that mysteriously fail.
+func watchBudget(every time.Duration) {
+	warned := make(map[string]bool)
+	warn := func(what string, near bool, used int, limit int) {
+		if near && !warned[what] {
+			log.Warning("using %d of %d %s", used, limit, what)
+		}
+		warned[what] = near
+	}
+	for {
+		time.Sleep(every)
+		u := currentUsage()
+		log.Info("%d watches, %d open files, %d websockets, %d cached bytes, %d goroutines",
+			u.Watches, u.OpenFiles, u.Websockets, u.CachedBytes, u.Goroutines)
+		warn("inotify watches (raise fs.inotify.max_user_watches)", nearLimit(u.Watches, u.WatchLimit), u.Watches, u.WatchLimit)
+		warn("open files (raise ulimit -n)", nearLimit(u.OpenFiles, u.FileLimit), u.OpenFiles, u.FileLimit)
+	}
+}
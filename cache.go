@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// -cache-mode says how browsers may cache what's served.  MDwiki
+// fetches navigation.md and the page again on every navigation, so by
+// default Markdown is sent with an ETag, a hash of it as served
+// (includes and all), to be revalidated each time, and unchanged pages
+// are answered with a 304.  Pages the snippet is spliced into are never
+// stored, as the snippet differs from run to run.  Cache-Control set by
+// a directory's headers is left alone.
+const (
+	cacheETag    = "etag"     // revalidate Markdown by ETag, don't store pages with the snippet
+	cacheNoStore = "no-store" // store nothing
+	cacheOff     = "off"      // send no caching headers at all
+)
+
+// checkCacheMode checks the -cache-mode flag.
+func checkCacheMode(mode string) error {
+	switch mode {
+	case cacheETag, cacheNoStore, cacheOff:
+		return nil
+	}
+	return fmt.Errorf("-cache-mode must be etag, no-store or off, not %q", mode)
+}
+
+// setCacheControl sets Cache-Control to value unless it's set already.
+func setCacheControl(w http.ResponseWriter, value string) {
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// cacheMarkdown sets the caching headers for the Markdown body, about
+// to be sent, and reports whether the request's If-None-Match means it
+// needn't be, a 304 having been sent instead.
+func cacheMarkdown(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	switch *flagCacheMode {
+	case cacheOff:
+		return false
+	case cacheNoStore:
+		setCacheControl(w, "no-store")
+		return false
+	}
+	etag := contentETag(body)
+	w.Header().Set("ETag", etag)
+	setCacheControl(w, "no-cache")
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// cacheInjected sets the caching headers for a page with the snippet
+// spliced into it.
+func cacheInjected(w http.ResponseWriter) {
+	if *flagCacheMode != cacheOff {
+		setCacheControl(w, "no-store")
+	}
+}
+
+// etagMatches reports whether an If-None-Match header matches etag,
+// comparing weakly, as If-None-Match does.
+func etagMatches(header string, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// The -chaos flags make the reload channel as unreliable as a demo's
+// Wi-Fi, to harden the protocol against it (see resync.go): some
+// messages to the clients are dropped, some are held back for a while,
+// and now and then, instead of a message, the connection is dropped.
+
+// errChaosKill is what a message the connection was killed instead of
+// sending fails with.
+var errChaosKill = errors.New("connection killed by -chaos-kill")
+
+// checkChaos checks the -chaos flags.
+func checkChaos() error {
+	for _, f := range []struct {
+		name string
+		p    float64
+	}{{"-chaos-drop", *flagChaosDrop}, {"-chaos-kill", *flagChaosKill}} {
+		if f.p < 0 || f.p > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, not %g", f.name, f.p)
+		}
+	}
+	if *flagChaosDelay < 0 {
+		return fmt.Errorf("-chaos-delay can't be negative")
+	}
+	if *flagChaosDrop > 0 || *flagChaosDelay > 0 || *flagChaosKill > 0 {
+		log.Warning("the reload channel is unreliable on purpose: -chaos-drop %g, -chaos-delay %s, -chaos-kill %g",
+			*flagChaosDrop, *flagChaosDelay, *flagChaosKill)
+	}
+	return nil
+}
+
+// chaos decides the fate of the message m to a client: whether to send
+// it, after a delay if -chaos-delay says so, or, with errChaosKill, to
+// drop the connection instead.
+func chaos(m string) (bool, error) {
+	if *flagChaosKill > 0 && rand.Float64() < *flagChaosKill {
+		log.Notice("chaos: killing the connection instead of sending %s", m)
+		return false, errChaosKill
+	}
+	if *flagChaosDrop > 0 && rand.Float64() < *flagChaosDrop {
+		log.Notice("chaos: dropping %s", m)
+		return false, nil
+	}
+	if *flagChaosDelay > 0 {
+		d := time.Duration(rand.Int63n(int64(*flagChaosDelay)))
+		log.Notice("chaos: delaying %s by %s", m, d)
+		time.Sleep(d)
+	}
+	return true, nil
+}
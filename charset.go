@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// how far into a page we look for a <meta> charset, as browsers do
+const charsetSniffLength = 1024
+
+var (
+	metaCharsetRegexp = regexp.MustCompile(`(?i)<meta\s[^>]*charset\s*=\s*["']?\s*([-\w:.]+)`)
+	typeCharsetRegexp = regexp.MustCompile(`(?i);\s*charset=[^;]*`)
+)
+
+// htmlCharset works out how a page is encoded: from its byte order
+// mark, from a <meta charset> or http-equiv tag near the top, or from
+// the telltale NULs of UTF-16 without a BOM.  Pages that don't say are
+// assumed to be UTF-8.
+func htmlCharset(body []byte) string {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8"
+	case bytes.HasPrefix(body, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	case bytes.HasPrefix(body, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	case bytes.HasPrefix(body, []byte{'<', 0}):
+		return "utf-16le"
+	case bytes.HasPrefix(body, []byte{0, '<'}):
+		return "utf-16be"
+	}
+
+	head := body
+	if len(head) > charsetSniffLength {
+		head = head[:charsetSniffLength]
+	}
+	if m := metaCharsetRegexp.FindSubmatch(head); m != nil {
+		charset := strings.ToLower(string(m[1]))
+		switch charset {
+		case "utf8", "unicode-1-1-utf-8":
+			return "utf-8"
+		case "utf-16":
+			// a BOM-less page that claims to be UTF-16 can't be, since
+			// we just read its <meta> as ASCII
+			return "utf-8"
+		}
+		return charset
+	}
+	return "utf-8"
+}
+
+// decodeUTF16 turns UTF-16 (with or without a byte order mark) into
+// UTF-8.
+func decodeUTF16(body []byte, order binary.ByteOrder) []byte {
+	if len(body) >= 2 && order.Uint16(body) == 0xfeff {
+		body = body[2:]
+	}
+	units := make([]uint16, len(body)/2)
+	for i := range units {
+		units[i] = order.Uint16(body[2*i:])
+	}
+	var out bytes.Buffer
+	for _, r := range utf16.Decode(units) {
+		out.WriteRune(r)
+	}
+	return out.Bytes()
+}
+
+// prepareHTML gets a page ready for the snippet, which is plain ASCII
+// and so can be spliced into any ASCII compatible encoding as it is.
+// UTF-16 pages are transcoded to UTF-8 (and their <meta> charset
+// updated to match).  It returns the page and the charset to announce
+// in the Content-Type header.
+func prepareHTML(name string, body []byte) ([]byte, string) {
+	charset := htmlCharset(body)
+	switch charset {
+	case "utf-16le", "utf-16be":
+		var order binary.ByteOrder = binary.LittleEndian
+		if charset == "utf-16be" {
+			order = binary.BigEndian
+		}
+		body = decodeUTF16(body, order)
+		body = metaCharsetRegexp.ReplaceAllFunc(body, func(m []byte) []byte {
+			loc := metaCharsetRegexp.FindSubmatchIndex(m)
+			return append(append(append([]byte(nil), m[:loc[2]]...), "utf-8"...), m[loc[3]:]...)
+		})
+		log.Info("transcoded %s from %s to utf-8", name, charset)
+		return body, "utf-8"
+	case "utf-8":
+		if !utf8.Valid(body) {
+			log.Warning("%s isn't valid utf-8, does it need a <meta charset>?", name)
+		}
+	}
+	return body, charset
+}
+
+// withCharset sets (or replaces) the charset parameter of a content type.
+func withCharset(contentType string, charset string) string {
+	return typeCharsetRegexp.ReplaceAllString(contentType, "") + "; charset=" + charset
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// A bibEntry is a work that can be cited, from a BibTeX or CSL-JSON
+// bibliography.
+type bibEntry struct {
+	Key       string
+	Authors   []string // family names
+	Names     []string // as they're listed in the references
+	Title     string
+	Year      string
+	Container string // the journal, book or proceedings
+	Publisher string
+	URL       string
+	DOI       string
+}
+
+var (
+	// [@key], [@key, p. 3] or [@a; @b]
+	citationRegexp    = regexp.MustCompile(`\[[^\[\]]*@[^\[\]]*\]`)
+	citationKeyRegexp = regexp.MustCompile(`^\s*@([\pL\pN_:.#$%&+?<>~/-]+)\s*,?\s*(.*?)\s*$`)
+)
+
+// parseBibTeX reads the entries, ignoring @comment, @preamble and
+// @string; the fields are kept with their braces and escapes removed.
+func parseBibTeX(src string) []bibEntry {
+	var entries []bibEntry
+	for {
+		at := strings.Index(src, "@")
+		if at < 0 {
+			break
+		}
+		src = src[at+1:]
+		open := strings.IndexAny(src, "{(")
+		if open < 0 {
+			break
+		}
+		kind := strings.ToLower(strings.TrimSpace(src[:open]))
+		body, rest := bibBalanced(src[open:])
+		src = rest
+		if kind == "comment" || kind == "preamble" || kind == "string" {
+			continue
+		}
+		comma := strings.Index(body, ",")
+		if comma < 0 {
+			continue
+		}
+		fields := bibFields(body[comma+1:])
+		e := bibEntry{
+			Key:       strings.TrimSpace(body[:comma]),
+			Title:     fields["title"],
+			Year:      fields["year"],
+			Container: fields["journal"],
+			Publisher: fields["publisher"],
+			URL:       fields["url"],
+			DOI:       fields["doi"],
+		}
+		if e.Container == "" {
+			e.Container = fields["booktitle"]
+		}
+		if e.Year == "" && len(fields["date"]) >= 4 {
+			e.Year = fields["date"][:4]
+		}
+		names := fields["author"]
+		if names == "" {
+			names = fields["editor"]
+		}
+		for _, name := range strings.Split(names, " and ") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			family, given := name, ""
+			if i := strings.Index(name, ","); i >= 0 {
+				family, given = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+			} else if i := strings.LastIndex(name, " "); i >= 0 {
+				family, given = name[i+1:], name[:i]
+			}
+			e.Authors = append(e.Authors, family)
+			e.Names = append(e.Names, strings.TrimSpace(family+", "+initials(given)))
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// bibBalanced splits s, which starts with an opening brace or
+// parenthesis, into what's between it and its match, and what follows.
+func bibBalanced(s string) (string, string) {
+	closing := byte('}')
+	if s[0] == '(' {
+		closing = ')'
+	}
+	depth := 0
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '{':
+			depth++
+		case s[i] == '}' && depth > 0:
+			depth--
+		case s[i] == closing && depth == 0:
+			return s[1:i], s[i+1:]
+		}
+	}
+	return s[1:], ""
+}
+
+// bibFields reads name = value pairs, values being {braced}, "quoted"
+// or bare.
+func bibFields(s string) map[string]string {
+	fields := make(map[string]string)
+	for {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			return fields
+		}
+		name := strings.ToLower(strings.TrimSpace(strings.TrimLeft(s[:eq], ", \t\r\n")))
+		s = strings.TrimLeft(s[eq+1:], " \t\r\n")
+		var value string
+		switch {
+		case s == "":
+		case s[0] == '{':
+			value, s = bibBalanced(s)
+		case s[0] == '"':
+			end := 1
+			for depth := 0; end < len(s) && (s[end] != '"' || depth > 0); end++ {
+				if s[end] == '{' {
+					depth++
+				} else if s[end] == '}' {
+					depth--
+				}
+			}
+			value = s[1:end]
+			if end < len(s) {
+				s = s[end+1:]
+			} else {
+				s = ""
+			}
+		default:
+			end := strings.IndexAny(s, ",\n")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		value = strings.NewReplacer("{", "", "}", "", `\&`, "&", `\%`, "%", `\_`, "_", "~", " ").Replace(value)
+		fields[name] = strings.Join(strings.Fields(value), " ")
+	}
+}
+
+// initials shortens given names to "J. R."
+func initials(given string) string {
+	var parts []string
+	for _, name := range strings.Fields(given) {
+		for _, r := range name {
+			if unicode.IsLetter(r) {
+				parts = append(parts, string(r)+".")
+				break
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// a CSL-JSON item, as much of it as the references show
+type cslItem struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Author []struct {
+		Family  string `json:"family"`
+		Given   string `json:"given"`
+		Literal string `json:"literal"`
+	} `json:"author"`
+	Issued struct {
+		DateParts [][]interface{} `json:"date-parts"`
+	} `json:"issued"`
+	Container string `json:"container-title"`
+	Publisher string `json:"publisher"`
+	URL       string `json:"URL"`
+	DOI       string `json:"DOI"`
+}
+
+func parseCSLJSON(src []byte) ([]bibEntry, error) {
+	var items []cslItem
+	if err := json.Unmarshal(src, &items); err != nil {
+		return nil, err
+	}
+	var entries []bibEntry
+	for _, item := range items {
+		e := bibEntry{Key: item.ID, Title: item.Title, Container: item.Container,
+			Publisher: item.Publisher, URL: item.URL, DOI: item.DOI}
+		if len(item.Issued.DateParts) > 0 && len(item.Issued.DateParts[0]) > 0 {
+			e.Year = fmt.Sprint(item.Issued.DateParts[0][0])
+		}
+		for _, a := range item.Author {
+			if a.Literal != "" {
+				e.Authors = append(e.Authors, a.Literal)
+				e.Names = append(e.Names, a.Literal)
+			} else {
+				e.Authors = append(e.Authors, a.Family)
+				e.Names = append(e.Names, strings.TrimSpace(a.Family+", "+initials(a.Given)))
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readBibliography reads the bibliography files, relative to the
+// content directory, by key.  Files that can't be read are logged and
+// skipped.
+func readBibliography(files []string) map[string]bibEntry {
+	bib := make(map[string]bibEntry)
+	for _, rel := range files {
+		src, err := readContent(rel)
+		if err != nil {
+			log.Warning("unable to read bibliography %s: %s", rel, err)
+			continue
+		}
+		var entries []bibEntry
+		if path.Ext(rel) == ".json" {
+			if entries, err = parseCSLJSON(src); err != nil {
+				log.Warning("ignoring bad CSL-JSON in %s: %s", rel, err)
+			}
+		} else {
+			entries = parseBibTeX(string(src))
+		}
+		for _, e := range entries {
+			bib[e.Key] = e
+		}
+	}
+	return bib
+}
+
+// citeAuthors is how a work's authors appear in a citation: Smith,
+// Smith and Jones, or Smith et al.
+func citeAuthors(e bibEntry) string {
+	switch len(e.Authors) {
+	case 0:
+		if e.Title != "" {
+			return e.Title
+		}
+		return e.Key
+	case 1:
+		return e.Authors[0]
+	case 2:
+		return e.Authors[0] + " and " + e.Authors[1]
+	}
+	return e.Authors[0] + " et al."
+}
+
+// reference is a work's entry in the references section.
+func reference(e bibEntry) string {
+	var b strings.Builder
+	switch n := len(e.Names); {
+	case n == 1:
+		b.WriteString(e.Names[0] + " ")
+	case n > 1:
+		b.WriteString(strings.Join(e.Names[:n-1], ", ") + " and " + e.Names[n-1] + " ")
+	}
+	if e.Year != "" {
+		fmt.Fprintf(&b, "(%s). ", e.Year)
+	}
+	if e.Title != "" {
+		fmt.Fprintf(&b, "*%s*. ", strings.TrimSuffix(e.Title, "."))
+	}
+	for _, s := range []string{e.Container, e.Publisher} {
+		if s != "" {
+			fmt.Fprintf(&b, "%s. ", strings.TrimSuffix(s, "."))
+		}
+	}
+	switch {
+	case e.DOI != "":
+		fmt.Fprintf(&b, "<https://doi.org/%s>", e.DOI)
+	case e.URL != "":
+		fmt.Fprintf(&b, "<%s>", e.URL)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// processCitations turns [@key] citations into (Author Year) links to
+// a References section added to the end of the page, listing the works
+// cited in the order they were first cited.  The bibliography files
+// are the config file's, and any the page's front matter names
+// (relative to the page).
+func processCitations(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if !bytes.Contains(in, []byte("@")) {
+		return in, nil
+	}
+	files := append([]string{}, cfg.Bibliography...)
+	site.RLock()
+	if p := site.pages[ctx.Path]; p != nil {
+		for _, f := range metaStrings(p.Meta["bibliography"]) {
+			files = append(files, path.Join(path.Dir(ctx.Path), f))
+		}
+	}
+	site.RUnlock()
+	if len(files) == 0 {
+		return in, nil
+	}
+	for _, f := range files {
+		ctx.Depends(f)
+	}
+	bib := readBibliography(files)
+
+	var cited []bibEntry
+	seen := make(map[string]bool)
+	cite := func(m string) string {
+		var parts []string
+		for _, item := range strings.Split(m[1:len(m)-1], ";") {
+			k := citationKeyRegexp.FindStringSubmatch(item)
+			if k == nil {
+				return m
+			}
+			e, ok := bib[k[1]]
+			if !ok {
+				log.Warning("%s cites %s, which isn't in the bibliography", ctx.Path, k[1])
+				parts = append(parts, k[1]+"?")
+				continue
+			}
+			if !seen[e.Key] {
+				seen[e.Key] = true
+				cited = append(cited, e)
+			}
+			part := strings.TrimSpace(citeAuthors(e) + " " + e.Year)
+			if k[2] != "" {
+				part += ", " + k[2]
+			}
+			parts = append(parts, part)
+		}
+		return fmt.Sprintf("[(%s)](#!%s#references)", strings.Join(parts, "; "), ctx.Path)
+	}
+
+	lines := strings.SplitAfter(string(in), "\n")
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range typographySkipRegexp.FindAllStringIndex(line, -1) {
+			b.WriteString(citationRegexp.ReplaceAllStringFunc(line[last:m[0]], cite))
+			b.WriteString(line[m[0]:m[1]])
+			last = m[1]
+		}
+		b.WriteString(citationRegexp.ReplaceAllStringFunc(line[last:], cite))
+		lines[i] = b.String()
+	}
+	if len(cited) == 0 {
+		return []byte(strings.Join(lines, "")), nil
+	}
+
+	var b bytes.Buffer
+	b.WriteString(strings.TrimRight(strings.Join(lines, ""), "\r\n"))
+	b.WriteString("\n\n<a id=\"references\"></a>\n\n## References\n\n")
+	for _, e := range cited {
+		fmt.Fprintf(&b, "- %s\n", reference(e))
+	}
+	return b.Bytes(), nil
+}
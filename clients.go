@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A reloadClient is a browser connected to /_reloader.
+type reloadClient struct {
+	ID        int       `json:"id"`
+	Remote    string    `json:"remote"`
+	UserAgent string    `json:"user_agent"`
+	User      string    `json:"user,omitempty"`   // signed in, or as the client says
+	Page      string    `json:"page"`             // as the client last reported it
+	Loaded    []string  `json:"loaded,omitempty"` // the Markdown files it's showing, with -targeted-reload
+	Connected time.Time `json:"connected"`
+
+	messages   chan string   // the client's broadcast subscription
+	disconnect chan struct{} // closed to drop the connection
+	signedIn   bool          // User is the principal's, not the client's say
+}
+
+// clients is the registry of connected reload clients, by id.
+var clients = struct {
+	sync.Mutex
+	byID map[int]*reloadClient
+	next int
+}{byID: make(map[int]*reloadClient)}
+
+// registerClient adds a client for the websocket request r, whose
+// messages come through messages.
+func registerClient(r *http.Request, messages chan string) *reloadClient {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	clients.Lock()
+	defer clients.Unlock()
+	clients.next++
+	c := &reloadClient{
+		ID:         clients.next,
+		Remote:     remote,
+		UserAgent:  r.UserAgent(),
+		Connected:  time.Now(),
+		messages:   messages,
+		disconnect: make(chan struct{}),
+	}
+	if p := requestPrincipal(r); p != nil {
+		c.User, c.signedIn = p.Name, true
+	}
+	clients.byID[c.ID] = c
+	return c
+}
+
+func unregisterClient(c *reloadClient) {
+	clients.Lock()
+	delete(clients.byID, c.ID)
+	clients.Unlock()
+}
+
+// setPage records the page the client says it's showing.
+func (c *reloadClient) setPage(page string) {
+	clients.Lock()
+	c.Page = page
+	clients.Unlock()
+}
+
+// setLoaded records the Markdown files the client says it's loaded.
+func (c *reloadClient) setLoaded(files []string) {
+	clients.Lock()
+	c.Loaded = files
+	clients.Unlock()
+}
+
+// clientsSnapshot returns the connected clients, oldest first.
+func clientsSnapshot() []reloadClient {
+	clients.Lock()
+	defer clients.Unlock()
+	list := []reloadClient{}
+	for _, c := range clients.byID {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// clientsHandler serves /_api/clients, the list of connected clients
+// (showing pages the user may read), and POSTs to
+// /_api/clients/<id>/reload and /_api/clients/<id>/disconnect, which
+// reload the client's page or drop its connection, for users who may
+// edit the page.
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_api/clients"), "/")
+	if rest == "" {
+		list := []reloadClient{}
+		for _, c := range clientsSnapshot() {
+			if canRead(r, c.Page) {
+				c.Loaded = readablePages(r, c.Loaded)
+				list = append(list, c)
+			}
+		}
+		b, err := json.MarshalIndent(list, "", "  ")
+		maybeBail(err)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		maybeBail(err)
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	clients.Lock()
+	c := clients.byID[id]
+	var page string
+	if c != nil {
+		page = c.Page
+	}
+	clients.Unlock()
+	if c == nil || !canRead(r, page) {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+	if !canEdit(r, page) {
+		http.Error(w, "you may not change "+page, http.StatusForbidden)
+		return
+	}
+
+	switch parts[1] {
+	case "reload":
+		select {
+		case c.messages <- newReloadMessage("reloaded from /_api/clients"):
+		default:
+			http.Error(w, "client isn't keeping up", http.StatusServiceUnavailable)
+			return
+		}
+		log.Notice("reloading client %d", id)
+	case "disconnect":
+		clients.Lock()
+		if _, ok := clients.byID[id]; ok {
+			delete(clients.byID, id)
+			close(c.disconnect)
+		}
+		clients.Unlock()
+		log.Notice("disconnecting client %d", id)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -comments reviewers can select text on a preview page and
+// comment on it.  The comments are kept in .mdwiki-comments in the
+// content directory, which being a dot directory is neither served nor
+// watched, as a JSON file for each page; the snippet shows them in the
+// margin, and when one's made or deleted the other clients showing the
+// page fetch them again.  /_api/comments (or the review-report
+// command) gathers them all into a review report.
+
+// commentsDirName is where the comments are kept, below the content
+// directory.
+const commentsDirName = ".mdwiki-comments"
+
+// Limits on what a comment may be, in bytes.
+const (
+	maxCommentQuote = 1000
+	maxCommentBody  = 10000
+)
+
+// A comment is a reviewer's note on some text of a page.
+type comment struct {
+	ID     string    `json:"id"`
+	Path   string    `json:"path"`
+	Quote  string    `json:"quote"` // the text selected
+	Body   string    `json:"body"`
+	Author string    `json:"author"`
+	Time   time.Time `json:"time"`
+}
+
+// comments serializes changes to the comment files.
+var comments sync.Mutex
+
+func checkComments() error {
+	if *flagComments && !contentOnDisk() {
+		return fmt.Errorf("-comments can't keep comments on a -source snapshot")
+	}
+	return nil
+}
+
+// commentsFile is where the comments on rel are kept.
+func commentsFile(rel string) string {
+	return filepath.Join(*flagContentDir, commentsDirName, filepath.FromSlash(rel)+".json")
+}
+
+// loadComments returns the comments on rel, oldest first.
+func loadComments(rel string) ([]comment, error) {
+	list := []comment{}
+	b, err := ioutil.ReadFile(commentsFile(rel))
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, json.Unmarshal(b, &list)
+}
+
+// saveComments replaces the comments on rel, removing the file when
+// there are none left.
+func saveComments(rel string, list []comment) error {
+	name := commentsFile(rel)
+	if len(list) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(list, "", "  ")
+	maybeBail(err)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, b, 0644)
+}
+
+// allComments returns the comments on every page, by page.
+func allComments() (map[string][]comment, error) {
+	all := make(map[string][]comment)
+	dir := filepath.Join(*flagContentDir, commentsDirName)
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() || !strings.HasSuffix(name, ".json") {
+			return err
+		}
+		rel, err := filepath.Rel(dir, strings.TrimSuffix(name, ".json"))
+		maybeBail(err)
+		rel = filepath.ToSlash(rel)
+		list, err := loadComments(rel)
+		if err != nil {
+			log.Warning("unable to read the comments on %s: %s", rel, err)
+			return nil
+		}
+		if len(list) > 0 {
+			all[rel] = list
+		}
+		return nil
+	})
+	return all, err
+}
+
+// newCommentID returns an id for a comment.
+func newCommentID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	maybeBail(err)
+	return hex.EncodeToString(b)
+}
+
+// reviewReport writes the comments as a Markdown review report.
+func reviewReport(all map[string][]comment) []byte {
+	var pages []string
+	n := 0
+	for rel, list := range all {
+		pages = append(pages, rel)
+		n += len(list)
+	}
+	sort.Strings(pages)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Review comments\n\nPages commented on: %d; comments: %d.\n", len(pages), n)
+	for _, rel := range pages {
+		title := rel
+		if site != nil {
+			site.RLock()
+			if p := site.pages[rel]; p != nil && p.Title != "" {
+				title = p.Title
+			}
+			site.RUnlock()
+		}
+		fmt.Fprintf(&b, "\n## [%s](%s)\n", title, rel)
+		for _, c := range all[rel] {
+			b.WriteString("\n")
+			if c.Quote != "" {
+				b.WriteString("> " + strings.Join(strings.Split(c.Quote, "\n"), "\n> ") + "\n\n")
+			}
+			fmt.Fprintf(&b, "**%s**, %s: %s\n", c.Author, c.Time.Format("2006-01-02 15:04"), c.Body)
+		}
+	}
+	return b.Bytes()
+}
+
+// reviewReportCommand implements the review-report command, which
+// prints the comments as a Markdown review report.
+func reviewReportCommand(args []string) error {
+	flags := flag.NewFlagSet("review-report", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: review-report")
+	}
+	all, err := allComments()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(reviewReport(all))
+	return err
+}
+
+// commentAuthor is who's commenting: the signed in user, or whoever
+// the request says it is.
+func commentAuthor(r *http.Request, name string) string {
+	if p := requestPrincipal(r); p != nil {
+		return p.Name
+	}
+	if name = strings.TrimSpace(name); name != "" {
+		if len(name) > 100 {
+			name = name[:100]
+		}
+		return name
+	}
+	return "anonymous"
+}
+
+// commentsHandler serves /_api/comments, all the comments the user may
+// read (as a Markdown review report with ?format=markdown), and
+// /_api/comments/<page>: GET for the page's comments, POST {"quote":
+// "...", "body": "...", "author": "..."} to comment on it, and DELETE
+// ?id= to delete one, which its author or anyone who may edit the page
+// may do.
+func commentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !*flagComments {
+		http.NotFound(w, r)
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/_api/comments")), "/")
+	if rel == "" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		all, err := allComments()
+		if err != nil {
+			log.Error("unable to read the comments: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for rel := range all {
+			if !canRead(r, rel) {
+				delete(all, rel)
+			}
+		}
+		if r.URL.Query().Get("format") == "markdown" {
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+			_, err = w.Write(reviewReport(all))
+			maybeBail(err)
+			return
+		}
+		b, err := json.MarshalIndent(all, "", "  ")
+		maybeBail(err)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		maybeBail(err)
+		return
+	}
+
+	if protectedPath(rel) || !canRead(r, rel) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := readContent(rel); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var v interface{}
+	status := http.StatusOK
+	comments.Lock()
+	defer comments.Unlock()
+	list, err := loadComments(rel)
+	if err != nil {
+		log.Error("unable to read the comments on %s: %s", rel, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		v = list
+	case "POST":
+		if refuseReadOnly(w) {
+			return
+		}
+		var req struct {
+			Quote  string `json:"quote"`
+			Body   string `json:"body"`
+			Author string `json:"author"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = strings.TrimSpace(req.Body)
+		if req.Body == "" || len(req.Body) > maxCommentBody || len(req.Quote) > maxCommentQuote {
+			http.Error(w, "bad request: a comment needs a body, and not too long a one", http.StatusBadRequest)
+			return
+		}
+		c := comment{ID: newCommentID(), Path: rel, Quote: req.Quote, Body: req.Body,
+			Author: commentAuthor(r, req.Author), Time: time.Now()}
+		if err := saveComments(rel, append(list, c)); err != nil {
+			log.Error("unable to save the comments on %s: %s", rel, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info("%s commented on %s", c.Author, rel)
+		v = c
+		status = http.StatusCreated
+	case "DELETE":
+		if refuseReadOnly(w) {
+			return
+		}
+		id := r.URL.Query().Get("id")
+		i := 0
+		for i < len(list) && list[i].ID != id {
+			i++
+		}
+		if i == len(list) {
+			http.NotFound(w, r)
+			return
+		}
+		p := requestPrincipal(r)
+		if !canEdit(r, rel) && (p == nil || p.Name != list[i].Author) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		v = list[i]
+		if err := saveComments(rel, append(list[:i:i], list[i+1:]...)); err != nil {
+			log.Error("unable to save the comments on %s: %s", rel, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info("deleted comment %s on %s", id, rel)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != "GET" {
+		// just the news: the clients fetch the comments they may read
+		b, err := json.Marshal(map[string]interface{}{"comments": map[string]string{"path": rel}})
+		maybeBail(err)
+		broadcast(string(b))
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(b)
+	maybeBail(err)
+}
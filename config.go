@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config holds the settings that don't fit comfortably on the command
+// line.  It's read from a YAML file, .mdwiki-dev.yaml in the content
+// directory by default; the file is optional.
+type config struct {
+	// Assets are bundled with esbuild whenever their sources change.
+	Assets []assetConfig `yaml:"assets"`
+
+	// Lint configures the lint command and -lint.
+	Lint lintConfig `yaml:"lint"`
+
+	// Keys maps keyboard shortcut actions (reload, search, diff and
+	// pause) to the keys that trigger them; "" disables one.
+	Keys map[string]string `yaml:"keys"`
+
+	// Languages lists the language roots of a multi-language wiki, e.g.
+	// en and de; by default they're found by looking.
+	Languages []string `yaml:"languages"`
+
+	// Mime maps extensions (with the dot) to the Content-Type they're
+	// served with; -mime takes precedence.
+	Mime map[string]string `yaml:"mime"`
+
+	// Deploy configures the deploy command.
+	Deploy deployConfig `yaml:"deploy"`
+
+	// Perf sets the perf command's budgets.
+	Perf perfConfig `yaml:"perf"`
+
+	// EarlyHints lists what -early-hints names for the wiki's page,
+	// relative to it or the root, in place of navigation.md, config.json
+	// and its stylesheets.
+	EarlyHints []string `yaml:"early_hints"`
+
+	// Plugins are external programs that content is run through, after
+	// the built-in processors.
+	Plugins []pluginConfig `yaml:"plugins"`
+
+	// Rules rewrite, redirect, deny or add headers to requests before
+	// they're served.
+	Rules []ruleConfig `yaml:"rules"`
+
+	// Markdown picks the Markdown extensions used by -render.
+	Markdown markdownConfig `yaml:"markdown"`
+
+	// Typography rules find and replace text in -render pages and
+	// exports.
+	Typography []typographyRule `yaml:"typography"`
+
+	// Emoji adds shortcodes for -emoji, mapping each name (without the
+	// colons) to the URL of its image.
+	Emoji map[string]string `yaml:"emoji"`
+
+	// Webhooks are told what changed, a few seconds after it did, so
+	// that a team sharing a preview server can follow along.
+	Webhooks []webhookConfig `yaml:"webhooks"`
+
+	// Tasks are commands the server runs on a schedule, to keep a
+	// long-running preview host up to date.
+	Tasks []taskConfig `yaml:"tasks"`
+
+	// Bibliography lists the BibTeX (.bib) and CSL-JSON (.json) files,
+	// relative to the content directory, that [@key] citations refer
+	// to.  A page's bibliography front matter adds its own.
+	Bibliography []string `yaml:"bibliography"`
+
+	// Interwiki maps link prefixes, such as jira in jira:ABC-123, to
+	// the URLs they stand for.
+	Interwiki map[string]interwikiConfig `yaml:"interwiki"`
+
+	// Auth says who's asking, for ACL.
+	Auth authConfig `yaml:"auth"`
+
+	// ACL limits who may read and edit the pages below each path.
+	ACL []aclRule `yaml:"acl"`
+
+	// the settings a subdirectory's config file can override
+	dirConfig `yaml:",inline"`
+}
+
+type assetConfig struct {
+	Entry string `yaml:"entry"` // entry point, relative to the content directory
+	Out   string `yaml:"out"`   // bundle to write, relative to the content directory
+}
+
+var cfg config
+
+// the keyboard shortcuts used unless the config file says otherwise
+var defaultKeymap = map[string]string{
+	"reload": "r",
+	"search": "s",
+	"diff":   "d",
+	"pause":  "p",
+}
+
+// keymapJSON returns the keyboard shortcuts, defaults overridden by the
+// config file, as a JSON object for the client script.
+func keymapJSON() string {
+	keymap := make(map[string]string)
+	for action, key := range defaultKeymap {
+		keymap[action] = key
+	}
+	for action, key := range cfg.Keys {
+		if _, ok := defaultKeymap[action]; !ok {
+			log.Warning("ignoring unknown keyboard shortcut action %q", action)
+			continue
+		}
+		keymap[action] = key
+	}
+	b, err := json.Marshal(keymap)
+	maybeBail(err)
+	return string(b)
+}
+
+// loadConfig reads the configuration file name into cfg.  A missing
+// file is not an error.
+func loadConfig(name string) error {
+	if data := os.Getenv(configEnv); data != "" {
+		log.Info("reading configuration from $%s", configEnv)
+		return yaml.Unmarshal([]byte(data), &cfg)
+	}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		log.Debug("no configuration file at %s", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("reading configuration from %s", name)
+	return yaml.Unmarshal(data, &cfg)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// Kubernetes mounts a ConfigMap as a directory of symbolic links, one
+// per key, through ..data, itself a link to a directory named for when
+// it was written:
+//
+//	index.md -> ..data/index.md
+//	..data -> ..2026_10_14_17_52_03.123456789
+//
+// The kubelet updates it by writing a new timestamped directory and
+// renaming a new link over ..data, so the files change all at once
+// while nothing happens to the links the pages are served through.
+// The watchers see the swap for what it is: a change to every key.
+
+// configMapDataLink is the link the kubelet swaps.
+const configMapDataLink = "..data"
+
+// kubeletOwned reports whether name is one of the kubelet's own
+// entries in a ConfigMap volume (..data, ..data_tmp and the
+// timestamped directories), not a key.
+func kubeletOwned(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), "..")
+}
+
+// configMapKey reports whether name is a key's link in a ConfigMap
+// volume.
+func configMapKey(name string) bool {
+	target, err := os.Readlink(name)
+	return err == nil && strings.HasPrefix(filepath.ToSlash(target), configMapDataLink+"/")
+}
+
+// configMapSwap returns the events for a new ..data link, the one at
+// name: a write to each key in its directory.
+func configMapSwap(name string) []fsnotify.Event {
+	dir := filepath.Dir(name)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Error("unable to read the ConfigMap volume at %s: %s", dir, err)
+		return nil
+	}
+	var events []fsnotify.Event
+	for _, info := range infos {
+		key := filepath.Join(dir, info.Name())
+		if configMapKey(key) {
+			events = append(events, fsnotify.Event{Name: key, Op: fsnotify.Write})
+		}
+	}
+	noteConfigMapSwap(dir, len(events))
+	return events
+}
+
+// noteConfigMapSwap logs an update to the ConfigMap volume at dir,
+// which touched n keys.
+func noteConfigMapSwap(dir string, n int) {
+	log.Notice("ConfigMap update in %s: %d keys", dir, n)
+}
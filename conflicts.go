@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// the most versions kept for merging edits that conflict
+const contentVersionLimit = 256
+
+// contentVersions are recent versions of files, by ETag, that clients
+// may have read and be editing: the base of a three-way merge when
+// their edit conflicts with someone else's.
+var contentVersions = struct {
+	sync.Mutex
+	data map[string][]byte
+}{data: make(map[string][]byte)}
+
+// contentETag is the (strong) ETag of a file's content.
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// rememberVersion keeps data as a possible merge base, returning its
+// ETag.
+func rememberVersion(data []byte) string {
+	etag := contentETag(data)
+	contentVersions.Lock()
+	defer contentVersions.Unlock()
+	if _, ok := contentVersions.data[etag]; !ok && len(contentVersions.data) >= contentVersionLimit {
+		for k := range contentVersions.data {
+			delete(contentVersions.data, k)
+			break
+		}
+	}
+	contentVersions.data[etag] = data
+	return etag
+}
+
+func versionFor(etag string) ([]byte, bool) {
+	contentVersions.Lock()
+	defer contentVersions.Unlock()
+	data, ok := contentVersions.data[etag]
+	return data, ok
+}
+
+// A hunk replaces base[start:end] with lines.
+type hunk struct {
+	start, end int
+	lines      []string
+}
+
+// hunks turns an edit script into the hunks it makes of its base.
+func hunks(ops []diffOp) []hunk {
+	var found []hunk
+	i := 0
+	var h *hunk
+	for _, op := range ops {
+		if op.kind == ' ' {
+			if h != nil {
+				found = append(found, *h)
+				h = nil
+			}
+			i++
+			continue
+		}
+		if h == nil {
+			h = &hunk{start: i, end: i}
+		}
+		if op.kind == '-' {
+			i++
+			h.end = i
+		} else {
+			h.lines = append(h.lines, op.line)
+		}
+	}
+	if h != nil {
+		found = append(found, *h)
+	}
+	return found
+}
+
+// applyHunks is base[start:end] with hs, which lie within it, applied.
+func applyHunks(base []string, start int, end int, hs []hunk) []string {
+	var out []string
+	pos := start
+	for _, h := range hs {
+		out = append(out, base[pos:h.start]...)
+		out = append(out, h.lines...)
+		pos = h.end
+	}
+	return append(out, base[pos:end]...)
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// merge3 merges the changes made to base in theirs and in ours.  Where
+// they touch the same (or neighbouring) lines differently, both are
+// kept between conflict markers, and counted.
+func merge3(base string, theirs string, ours string) (string, int) {
+	b := splitLines(base)
+	th := hunks(diffLines(b, splitLines(theirs)))
+	oh := hunks(diffLines(b, splitLines(ours)))
+
+	var out []string
+	conflicts := 0
+	pos := 0
+	for len(th) > 0 || len(oh) > 0 {
+		start := len(b)
+		if len(th) > 0 {
+			start = th[0].start
+		}
+		if len(oh) > 0 && oh[0].start < start {
+			start = oh[0].start
+		}
+		// the region grows to take in every hunk that overlaps or touches it
+		end := start
+		var t, o []hunk
+		for grew := true; grew; {
+			grew = false
+			if len(th) > 0 && th[0].start <= end {
+				if th[0].end > end {
+					end = th[0].end
+				}
+				t, th, grew = append(t, th[0]), th[1:], true
+			}
+			if len(oh) > 0 && oh[0].start <= end {
+				if oh[0].end > end {
+					end = oh[0].end
+				}
+				o, oh, grew = append(o, oh[0]), oh[1:], true
+			}
+		}
+
+		out = append(out, b[pos:start]...)
+		theirLines, ourLines := applyHunks(b, start, end, t), applyHunks(b, start, end, o)
+		switch {
+		case len(o) == 0 || sameLines(theirLines, ourLines):
+			out = append(out, theirLines...)
+		case len(t) == 0:
+			out = append(out, ourLines...)
+		default:
+			conflicts++
+			out = append(out, "<<<<<<< yours")
+			out = append(out, ourLines...)
+			out = append(out, "=======")
+			out = append(out, theirLines...)
+			out = append(out, ">>>>>>> current")
+		}
+		pos = end
+	}
+	out = append(out, b[pos:]...)
+	if len(out) == 0 {
+		return "", conflicts
+	}
+	return strings.Join(out, "\n") + "\n", conflicts
+}
+
+// An editConflict is the 409 answer to an edit based on a version that
+// has since changed.
+type editConflict struct {
+	Path    string `json:"path"`
+	ETag    string `json:"etag"`    // the current version's, to send with If-Match once merged
+	Current string `json:"current"` // the current version
+	// the three-way merge of the two edits, if the version the edit was
+	// based on is known; conflicting lines are between markers
+	Merged    *string `json:"merged,omitempty"`
+	Conflicts int     `json:"conflicts"`
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// What's here makes the server a well-behaved container entrypoint:
+// it polls for changes when inotify can't be trusted, takes its
+// settings from the environment, stops promptly on SIGTERM, and
+// answers health checks on /_healthz.
+
+// envPrefix starts the names of the environment variables that set
+// flags: MDWIKI_DEV_WATCH_BACKEND=poll is -watch-backend poll.
+const envPrefix = "MDWIKI_DEV_"
+
+// configEnv holds the whole config file, for containers that haven't
+// got one.
+const configEnv = envPrefix + "CONFIG_YAML"
+
+// inContainer reports whether the server seems to be running in a
+// Docker, Podman or Kubernetes container.
+func inContainer() bool {
+	for _, name := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return true
+	}
+	b, err := ioutil.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	for _, runtime := range []string{"docker", "kubepods", "containerd", "libpod"} {
+		if strings.Contains(string(b), runtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveWatchBackend picks the backend -watch-backend auto stands
+// for: poll in a container, where the content is usually a volume
+// mounted from a host whose changes inotify never hears about, and
+// fsnotify anywhere else.
+func resolveWatchBackend(backend string) string {
+	if backend != backendAuto {
+		return backend
+	}
+	if inContainer() {
+		log.Info("running in a container, polling for changes")
+		return backendPoll
+	}
+	return backendFsnotify
+}
+
+// flagsFromEnvironment sets each flag not given on the command line
+// from its environment variable, if that's set: -audit-log, for
+// instance, from MDWIKI_DEV_AUDIT_LOG.
+func flagsFromEnvironment() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if e := flag.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %s", name, e)
+		}
+	})
+	return err
+}
+
+// the functions to run on the way out
+var shutdownHooks struct {
+	sync.Mutex
+	hooks []func()
+}
+
+// onShutdown arranges for f to be called when the server stops on a
+// signal, after it has stopped taking requests.
+func onShutdown(f func()) {
+	shutdownHooks.Lock()
+	defer shutdownHooks.Unlock()
+	shutdownHooks.hooks = append(shutdownHooks.hooks, f)
+}
+
+// shuttingDown is closed once the server starts stopping, so that
+// /_healthz can say so.
+var shuttingDown = make(chan struct{})
+
+// serve serves h on addr until SIGTERM or an interrupt, then finishes
+// the requests in flight, giving them -shutdown-timeout, and exits.
+// Reloader and editor websockets and event streams are just dropped:
+// browsers reconnect to whatever takes the server's place.
+func serve(addr string, h http.Handler) {
+	server := &http.Server{Addr: addr, Handler: h}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Notice("%s: shutting down", sig)
+		close(shuttingDown)
+		ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warning("dropping the requests still in flight: %s", err)
+			server.Close()
+		}
+		shutdownHooks.Lock()
+		for _, f := range shutdownHooks.hooks {
+			f()
+		}
+		shutdownHooks.Unlock()
+		close(stopped)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// healthzHandler serves /_healthz, for container health checks and
+// load balancers: 200 while the server's serving, 503 once it's
+// shutting down.  No one has to sign in to ask.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	select {
+	case <-shuttingDown:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "shutting down")
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// A sourceConverter turns a document written in some other markup
+// language into something MDwiki can display.  The command reads the
+// source document on stdin and writes the result on stdout.
+type sourceConverter struct {
+	ext     string
+	command []string
+}
+
+// sourceConverters are consulted, in order, when MDwiki asks for a .md
+// file that doesn't exist.  Asciidoctor produces an HTML fragment,
+// which MDwiki passes through untouched; pandoc produces GitHub
+// flavored Markdown.
+var sourceConverters = []sourceConverter{
+	{".adoc", []string{"asciidoctor", "-s", "-o", "-", "-"}},
+	{".rst", []string{"pandoc", "-f", "rst", "-t", "gfm"}},
+}
+
+// registerConverter adds a converter for files ending in ext,
+// replacing any converter already registered for that extension.
+func registerConverter(ext string, command []string) {
+	for i, c := range sourceConverters {
+		if c.ext == ext {
+			sourceConverters[i].command = command
+			return
+		}
+	}
+	sourceConverters = append(sourceConverters, sourceConverter{ext, command})
+}
+
+// converterFlag lets the user register (or override) converters from
+// the command line, e.g. -converter ".org=pandoc -f org -t gfm".
+type converterFlag struct{}
+
+func (c *converterFlag) String() string {
+	var exts []string
+	for _, c := range sourceConverters {
+		exts = append(exts, c.ext)
+	}
+	return strings.Join(exts, ",")
+}
+
+func (c *converterFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], ".") {
+		return fmt.Errorf("expected .ext=command, got %q", value)
+	}
+	command := strings.Fields(parts[1])
+	if len(command) == 0 {
+		return fmt.Errorf("no command given for %s", parts[0])
+	}
+	registerConverter(parts[0], command)
+	return nil
+}
+
+func init() {
+	flag.Var(&converterFlag{}, "converter",
+		"register a source converter, e.g. \".org=pandoc -f org -t gfm\" (repeatable)")
+}
+
+// convertSource looks for a document that can stand in for a missing
+// .md file.  It returns nil (and no error) if name isn't a .md file, if
+// the .md file exists, or if there's nothing to convert.
+func convertSource(root http.FileSystem, name string) ([]byte, error) {
+	if path.Ext(name) != ".md" {
+		return nil, nil
+	}
+	if f, err := root.Open(name); err == nil {
+		f.Close()
+		return nil, nil
+	}
+
+	base := strings.TrimSuffix(name, ".md")
+	for _, c := range sourceConverters {
+		f, err := root.Open(base + c.ext)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		log.Info("converting %s with %s", base+c.ext, c.command[0])
+		var stderr bytes.Buffer
+		cmd := exec.Command(c.command[0], c.command[1:]...)
+		cmd.Stdin = f
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", c.command[0], err,
+				strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// csvSeparator returns the field separator for a .csv or .tsv file
+// (or fenced block language), and false for anything else.
+func csvSeparator(kind string) (rune, bool) {
+	switch strings.ToLower(strings.TrimPrefix(kind, ".")) {
+	case "csv":
+		return ',', true
+	case "tsv":
+		return '\t', true
+	}
+	return 0, false
+}
+
+// wantsHTML is true when the client is a browser navigating to a
+// resource, as opposed to a script fetching it.
+func wantsHTML(r *http.Request) bool {
+	if _, raw := r.URL.Query()["raw"]; raw {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// renderTable renders delimited data as an HTML table, treating the
+// first row as the header.  If sortBy names a column the rows are
+// sorted by it (numerically when every value is a number).  If
+// sortLinks is true the column headers become links that (re)sort the
+// table.  At most maxRows rows are rendered.
+func renderTable(data []byte, comma rune, sortBy string, desc bool,
+	sortLinks bool, maxRows int) (string, error) {
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	header, rows := records[0], records[1:]
+
+	if col := indexOf(header, sortBy); col >= 0 {
+		sortRows(rows, col, desc)
+	}
+	truncated := 0
+	if maxRows > 0 && len(rows) > maxRows {
+		truncated = len(rows) - maxRows
+		rows = rows[:maxRows]
+	}
+
+	var b bytes.Buffer
+	b.WriteString("<table class=\"table table-striped table-condensed\">\n<thead><tr>")
+	for _, name := range header {
+		label := html.EscapeString(name)
+		if sortLinks {
+			q := url.Values{"sort": {name}}
+			if name == sortBy && !desc {
+				q.Set("desc", "1")
+			}
+			label = fmt.Sprintf("<a href=\"?%s\">%s</a>", html.EscapeString(q.Encode()), label)
+		}
+		fmt.Fprintf(&b, "<th>%s</th>", label)
+	}
+	b.WriteString("</tr></thead>\n<tbody>\n")
+	for _, row := range rows {
+		b.WriteString("<tr>")
+		for _, cell := range row {
+			fmt.Fprintf(&b, "<td>%s</td>", html.EscapeString(cell))
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	if truncated > 0 {
+		fmt.Fprintf(&b, "<p><em>%d more rows not shown.</em></p>\n", truncated)
+	}
+	return b.String(), nil
+}
+
+func indexOf(list []string, s string) int {
+	if s == "" {
+		return -1
+	}
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	if i, err := strconv.Atoi(s); err == nil && i > 0 && i <= len(list) {
+		return i - 1
+	}
+	return -1
+}
+
+func sortRows(rows [][]string, col int, desc bool) {
+	cell := func(row []string) string {
+		if col < len(row) {
+			return row[col]
+		}
+		return ""
+	}
+
+	numeric := true
+	for _, row := range rows {
+		if _, err := strconv.ParseFloat(cell(row), 64); err != nil {
+			numeric = false
+			break
+		}
+	}
+
+	less := func(a, b string) bool { return a < b }
+	if numeric {
+		less = func(a, b string) bool {
+			x, _ := strconv.ParseFloat(a, 64)
+			y, _ := strconv.ParseFloat(b, 64)
+			return x < y
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if desc {
+			return less(cell(rows[j]), cell(rows[i]))
+		}
+		return less(cell(rows[i]), cell(rows[j]))
+	})
+}
+
+// csvPage wraps a rendered table in a page of its own, for browsers
+// that follow a link to a .csv or .tsv file.
+func csvPage(r *http.Request, data []byte, maxRows int) ([]byte, error) {
+	comma, _ := csvSeparator(path.Ext(r.URL.Path))
+	q := r.URL.Query()
+	table, err := renderTable(data, comma, q.Get("sort"), q.Get("desc") != "",
+		true, maxRows)
+	if err != nil {
+		return nil, err
+	}
+
+	name := html.EscapeString(path.Base(r.URL.Path))
+	return []byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+</head>
+<body>
+<h1>%s</h1>
+<p><a href="?raw">raw</a></p>
+%s</body>
+</html>
+`, name, name, table)), nil
+}
+
+// matches a fenced block opening such as "```csv" or "```tsv sort=Name desc"
+var csvFenceRegexp = regexp.MustCompile("^```\\s*(csv|tsv)\\b(.*)$")
+
+// filterCSVFences replaces ```csv and ```tsv fenced blocks in Markdown
+// with HTML tables.  The fence's info string may carry "sort=<column>"
+// and "desc".  Tables are cut off after maxRows rows.
+func filterCSVFences(md []byte, maxRows int) []byte {
+	lines := strings.SplitAfter(string(md), "\n")
+	var out bytes.Buffer
+	for i := 0; i < len(lines); i++ {
+		m := csvFenceRegexp.FindStringSubmatch(strings.TrimRight(lines[i], "\r\n"))
+		if m == nil {
+			out.WriteString(lines[i])
+			continue
+		}
+
+		end := i + 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+			end++
+		}
+		if end == len(lines) {
+			// unterminated fence, leave it for MDwiki to deal with
+			out.WriteString(lines[i])
+			continue
+		}
+
+		var sortBy string
+		var desc bool
+		for _, opt := range strings.Fields(m[2]) {
+			if strings.HasPrefix(opt, "sort=") {
+				sortBy = strings.TrimPrefix(opt, "sort=")
+			} else if opt == "desc" {
+				desc = true
+			}
+		}
+
+		comma, _ := csvSeparator(m[1])
+		data := strings.Join(lines[i+1:end], "")
+		table, err := renderTable([]byte(data), comma, sortBy, desc, false,
+			maxRows)
+		if err != nil {
+			log.Warning("leaving malformed %s block alone: %s", m[1], err)
+			out.WriteString(lines[i])
+			continue
+		}
+		out.WriteString(table)
+		i = end
+	}
+	return out.Bytes()
+}
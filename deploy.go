@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// deployConfig is the deploy section of the config file.
+type deployConfig struct {
+	// Target is "gh-pages" for a branch of a git repository, an
+	// s3://bucket/prefix URL, or anything rsync understands
+	// (host:path, rsync://host/module, a local directory).
+	Target  string `yaml:"target"`
+	Branch  string `yaml:"branch"`   // for gh-pages, default gh-pages
+	Remote  string `yaml:"remote"`   // for gh-pages, default the content directory's origin
+	BaseURL string `yaml:"base_url"` // the published site's URL, for -og
+}
+
+// runCommand runs a command, letting it talk to the user.
+func runCommand(name string, args ...string) error {
+	log.Info("running %s %s", name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// deploy implements the deploy command, which exports the wiki and
+// publishes the export to the configured target.
+func deploy(args []string) error {
+	flags := flag.NewFlagSet("deploy", flag.ExitOnError)
+	target := flags.String("target", cfg.Deploy.Target, "where to deploy to, by default the config file's deploy target")
+	baseURL := flags.String("base-url", cfg.Deploy.BaseURL, "URL the site is published at, for -og")
+	dryRun := flags.Bool("dry-run", false, "show what would change without changing anything")
+	deleteOrphans := flags.Bool("delete", false, "delete published files that aren't in the export")
+	flags.Parse(args)
+
+	if *target == "" {
+		return fmt.Errorf("no deploy target, give one with -target or in the config file")
+	}
+
+	tmp, err := ioutil.TempDir("", "mdwiki-dev-server-deploy")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	out := filepath.Join(tmp, "site")
+
+	switch {
+	case *target == "gh-pages":
+		return deployGitBranch(out, *baseURL, *dryRun, *deleteOrphans)
+	case strings.HasPrefix(*target, "s3://"):
+		if err := exportTo(out, *baseURL); err != nil {
+			return err
+		}
+		args := []string{"s3", "sync", out, *target}
+		if *deleteOrphans {
+			args = append(args, "--delete")
+		}
+		if *dryRun {
+			args = append(args, "--dryrun")
+		}
+		return runCommand("aws", args...)
+	default:
+		if err := exportTo(out, *baseURL); err != nil {
+			return err
+		}
+		args := []string{"-a", "-v"}
+		if *deleteOrphans {
+			args = append(args, "--delete")
+		}
+		if *dryRun {
+			args = append(args, "--dry-run")
+		}
+		return runCommand("rsync", append(args, out+"/", *target)...)
+	}
+}
+
+func exportTo(out string, baseURL string) error {
+	e, err := newExporter(*flagContentDir, out, baseURL, false)
+	if err != nil {
+		return err
+	}
+	if err := e.exportAll(); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d files\n", e.written)
+	return nil
+}
+
+// deployGitBranch commits the export to a branch (gh-pages, normally)
+// of the remote repository, starting the branch if it doesn't exist.
+func deployGitBranch(out string, baseURL string, dryRun bool, deleteOrphans bool) error {
+	branch := cfg.Deploy.Branch
+	if branch == "" {
+		branch = "gh-pages"
+	}
+	remote := cfg.Deploy.Remote
+	if remote == "" {
+		origin, err := exec.Command("git", "-C", *flagContentDir, "remote", "get-url", "origin").Output()
+		if err != nil {
+			return fmt.Errorf("no deploy remote configured and no origin for %s", *flagContentDir)
+		}
+		remote = string(bytes.TrimSpace(origin))
+	}
+
+	git := func(args ...string) error {
+		return runCommand("git", append([]string{"-C", out}, args...)...)
+	}
+	err := runCommand("git", "clone", "--quiet", "--depth", "1", "--single-branch",
+		"--branch", branch, remote, out)
+	if err != nil {
+		log.Notice("starting a new %s branch", branch)
+		os.RemoveAll(out)
+		if err := runCommand("git", "init", "--quiet", out); err != nil {
+			return err
+		}
+		if err := git("checkout", "--quiet", "--orphan", branch); err != nil {
+			return err
+		}
+		if err := git("remote", "add", "origin", remote); err != nil {
+			return err
+		}
+	}
+	if deleteOrphans {
+		if err := git("rm", "-r", "--quiet", "--ignore-unmatch", "."); err != nil {
+			return err
+		}
+	}
+
+	if err := exportTo(out, baseURL); err != nil {
+		return err
+	}
+	// keep GitHub Pages from running the export through Jekyll
+	if err := ioutil.WriteFile(filepath.Join(out, ".nojekyll"), nil, 0644); err != nil {
+		return err
+	}
+	if err := git("add", "--all"); err != nil {
+		return err
+	}
+	if exec.Command("git", "-C", out, "diff", "--cached", "--quiet").Run() == nil {
+		fmt.Println("nothing to deploy, the published site is up to date")
+		return nil
+	}
+	if dryRun {
+		return git("status", "--short")
+	}
+	message := "Deploy " + time.Now().Format(time.RFC1123)
+	if err := git("commit", "--quiet", "-m", message); err != nil {
+		return err
+	}
+	return git("push", "--quiet", "origin", branch)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path/filepath"
+)
+
+func checkDiagnosticsFormat(format string) error {
+	switch format {
+	case "", "gcc", "vscode":
+		return nil
+	}
+	return fmt.Errorf("-diagnostics-format must be vscode or gcc, not %q", format)
+}
+
+func lintDiagnostics(vs []lintViolation) []diagnostic {
+	found := []diagnostic{}
+	for _, v := range vs {
+		found = append(found, diagnostic{v.File, v.Line, 1, "lint", v.Rule, v.Message})
+	}
+	return found
+}
+
+func spellingDiagnostics(ms []misspelling) []diagnostic {
+	found := []diagnostic{}
+	for _, m := range ms {
+		found = append(found, diagnostic{m.File, m.Line, m.Column, "spelling", "",
+			fmt.Sprintf("unknown word %q", m.Word)})
+	}
+	return found
+}
+
+// printDiagnostics writes problems found by lint, check-links or
+// check-spelling for -diagnostics-format: "gcc" is what the $gcc
+// problem matcher (and most CI annotators) read,
+//
+//	docs/a.md:3:1: warning: MD013 line is 92 characters long
+//
+// and "vscode" is what VS Code's $msCompile one does.
+//
+//	docs/a.md(3,1): warning MD013: line is 92 characters long
+//
+// Paths include -dir, so that they're relative to where the command
+// was run.
+func printDiagnostics(found []diagnostic, format string) {
+	for _, d := range found {
+		name := filepath.Join(*flagContentDir, filepath.FromSlash(d.Path))
+		code := d.Code
+		if code == "" {
+			code = d.Source
+		}
+		if format == "vscode" {
+			fmt.Printf("%s(%d,%d): warning %s: %s\n", name, d.Line, d.Column, code, d.Message)
+		} else {
+			fmt.Printf("%s:%d:%d: warning: %s %s\n", name, d.Line, d.Column, code, d.Message)
+		}
+	}
+}
+
+// checkLinks implements the check-links command, which reports the
+// links to pages that don't exist, and the interwiki references that
+// don't fit their prefixes, in every Markdown file in the content
+// directory.
+func checkLinks(args []string) error {
+	flags := flag.NewFlagSet("check-links", flag.ExitOnError)
+	format := flags.String("format", "text", "output format, text or json")
+	flags.Parse(args)
+
+	var err error
+	site, err = newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	found := []diagnostic{}
+	err = walkMarkdown(*flagContentDir, func(rel string, md []byte) error {
+		found = append(found, brokenLinks(rel, md)...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *format == "text" && *flagDiagnosticsFormat != "":
+		printDiagnostics(found, *flagDiagnosticsFormat)
+	case *format == "json":
+		b, err := json.MarshalIndent(found, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	case *format == "text":
+		for _, d := range found {
+			fmt.Printf("%s:%d:%d: %s\n", d.Path, d.Line, d.Column, d.Message)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if len(found) > 0 {
+		return fmt.Errorf("found %d broken links", len(found))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diagramRenderers turn the source of a fenced diagram into SVG,
+// reading it on stdin and writing the SVG on stdout.
+var diagramRenderers = map[string][]string{
+	"dot":      {"dot", "-Tsvg"},
+	"graphviz": {"dot", "-Tsvg"},
+	"mermaid":  {"mmdc", "--quiet", "-i", "-", "-o", "-", "-e", "svg"},
+}
+
+// a fenced diagram, ```dot or ```mermaid and the like
+var diagramFenceRegexp = regexp.MustCompile("^```(dot|graphviz|mermaid)[ \t]*$")
+
+// renderers get this long to draw a diagram
+const diagramTimeout = 30 * time.Second
+
+// rendered diagrams, by a hash of their language and source, so that a
+// page with diagrams doesn't have them all redrawn every time it's
+// saved
+var diagramCache = struct {
+	sync.Mutex
+	svgs map[[sha256.Size]byte][]byte
+}{svgs: make(map[[sha256.Size]byte][]byte)}
+
+// no more than this many diagrams are cached
+const diagramCacheSize = 256
+
+// renderDiagram returns the SVG for a diagram.
+func renderDiagram(lang string, source []byte) ([]byte, error) {
+	key := sha256.Sum256(append([]byte(lang+"\x00"), source...))
+	diagramCache.Lock()
+	svg, ok := diagramCache.svgs[key]
+	diagramCache.Unlock()
+	if ok {
+		return svg, nil
+	}
+
+	command := diagramRenderers[lang]
+	ctx, cancel := context.WithTimeout(context.Background(), diagramTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(source)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s timed out after %s", command[0], diagramTimeout)
+		}
+		return nil, fmt.Errorf("%s: %s: %s", command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	// MDwiki takes the SVG as an HTML block, which ends at the first
+	// blank line, so the prolog and any blank lines have to go
+	svg = stdout.Bytes()
+	if i := bytes.Index(svg, []byte("<svg")); i >= 0 {
+		svg = svg[i:]
+	}
+	var b bytes.Buffer
+	b.WriteString(`<div class="diagram">`)
+	for _, line := range bytes.Split(bytes.TrimSpace(svg), []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			b.Write(bytes.TrimRight(line, "\r"))
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString("</div>\n")
+	svg = b.Bytes()
+
+	diagramCache.Lock()
+	if len(diagramCache.svgs) >= diagramCacheSize {
+		diagramCache.svgs = make(map[[sha256.Size]byte][]byte)
+	}
+	diagramCache.svgs[key] = svg
+	diagramCache.Unlock()
+	return svg, nil
+}
+
+// filterDiagramFences replaces Graphviz and Mermaid fenced blocks with
+// the SVG drawn from them.  Blocks that can't be drawn (the renderer
+// isn't installed, say) are left alone, so MDwiki shows their source.
+func filterDiagramFences(md []byte) []byte {
+	lines := strings.SplitAfter(string(md), "\n")
+	var out bytes.Buffer
+	for i := 0; i < len(lines); i++ {
+		m := diagramFenceRegexp.FindStringSubmatch(strings.TrimRight(lines[i], "\r\n"))
+		if m == nil {
+			out.WriteString(lines[i])
+			continue
+		}
+
+		end := i + 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+			end++
+		}
+		if end == len(lines) {
+			// unterminated fence, leave it for MDwiki to deal with
+			out.WriteString(lines[i])
+			continue
+		}
+
+		svg, err := renderDiagram(m[1], []byte(strings.Join(lines[i+1:end], "")))
+		if err != nil {
+			log.Warning("leaving %s diagram alone: %s", m[1], err)
+			out.WriteString(lines[i])
+			continue
+		}
+		out.Write(svg)
+		i = end
+	}
+	return out.Bytes()
+}
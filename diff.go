@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// lines of context around each hunk
+const diffContext = 3
+
+// diffs don't look for a minimal edit script beyond this many edits,
+// reporting the whole file as replaced instead
+const diffMaxEdits = 2000
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns an edit script turning a into b, using the linear
+// space version of Myers' O((N+M)D) algorithm, which finds the middle
+// snake of the edit path and recurses on either side of it.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	// the middle snake of the whole edit path is found after about
+	// half its edits
+	if _, _, _, _, _, ok := middleSnake(trimCommon(a, b)); !ok {
+		for _, l := range a {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range b {
+			ops = append(ops, diffOp{'+', l})
+		}
+		return ops
+	}
+	diffInto(&ops, a, b)
+	return ops
+}
+
+// trimCommon returns a and b without the lines they start and end
+// with in common, with the search limit for middleSnake.
+func trimCommon(a, b []string) ([]string, []string, int) {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	return a, b, diffMaxEdits / 2
+}
+
+// diffInto appends the edits turning a into b to ops.
+func diffInto(ops *[]diffOp, a, b []string) {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		*ops = append(*ops, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	var suffix []string
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, a[len(a)-1])
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	d, x, y, u, v, _ := middleSnake(a, b, len(a)+len(b))
+	if d > 1 {
+		diffInto(ops, a[:x], b[:y])
+		for _, l := range a[x:u] {
+			*ops = append(*ops, diffOp{' ', l})
+		}
+		diffInto(ops, a[u:], b[v:])
+	} else {
+		// with the common ends gone, at most one of them is left
+		for _, l := range a {
+			*ops = append(*ops, diffOp{'-', l})
+		}
+		for _, l := range b {
+			*ops = append(*ops, diffOp{'+', l})
+		}
+	}
+
+	for i := len(suffix) - 1; i >= 0; i-- {
+		*ops = append(*ops, diffOp{' ', suffix[i]})
+	}
+}
+
+// middleSnake finds the middle snake of the shortest edit path from a
+// to b, searching forwards from the start and backwards from the end
+// at once until the two meet, or until they've each gone limit edits
+// without meeting.  It returns the length of the path and the snake's
+// start (x, y) and end (u, v).
+func middleSnake(a, b []string, limit int) (d, x, y, u, v int, ok bool) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	delta := n - m
+	odd := delta%2 != 0
+	offset := max + 1
+	// the furthest x reached on each diagonal, forwards from the
+	// start and backwards (measured from the end) from the end
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+
+	for D := 0; D <= max && D <= limit; D++ {
+		for k := -D; k <= D; k += 2 {
+			if k == -D || (k != D && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			vf[offset+k] = u
+			if kb := delta - k; odd && kb >= -(D-1) && kb <= D-1 && u+vb[offset+kb] >= n {
+				return 2*D - 1, x, y, u, v, true
+			}
+		}
+		for k := -D; k <= D; k += 2 {
+			var xb int
+			if k == -D || (k != D && vb[offset+k-1] < vb[offset+k+1]) {
+				xb = vb[offset+k+1]
+			} else {
+				xb = vb[offset+k-1] + 1
+			}
+			yb := xb - k
+			ub, ubY := xb, yb
+			for ub < n && ubY < m && a[n-1-ub] == b[m-1-ubY] {
+				ub++
+				ubY++
+			}
+			vb[offset+k] = ub
+			if kf := delta - k; !odd && kf >= -D && kf <= D && vf[offset+kf]+ub >= n {
+				return 2 * D, n - ub, m - ubY, n - xb, m - yb, true
+			}
+		}
+	}
+	return 0, 0, 0, 0, 0, false
+}
+
+// unifiedDiff returns the changes from old to new in unified diff
+// format, or "" if there aren't any.
+func unifiedDiff(name string, old string, new string) string {
+	ops := diffLines(splitLines(old), splitLines(new))
+
+	// line numbers in old and new reached before each op
+	posA := make([]int, len(ops)+1)
+	posB := make([]int, len(ops)+1)
+	for i, op := range ops {
+		posA[i+1], posB[i+1] = posA[i], posB[i]
+		if op.kind != '+' {
+			posA[i+1]++
+		}
+		if op.kind != '-' {
+			posB[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	i := 0
+	for i < len(ops) {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next < len(ops) && next-end <= 2*diffContext {
+				end = next
+				continue
+			}
+			end += diffContext
+			if end > len(ops) {
+				end = len(ops)
+			}
+			break
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+		}
+		aLen, bLen := posA[end]-posA[start], posB[end]-posB[start]
+		aStart, bStart := posA[start]+1, posB[start]+1
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// diffs remembers the content of every Markdown page (as of the last
+// change) and the most recent diff of each page that has changed.
+var diffs = struct {
+	sync.Mutex
+	content map[string]string
+	last    map[string]string
+}{content: make(map[string]string), last: make(map[string]string)}
+
+// loadDiffBaseline remembers the starting content of every page below dir.
+func loadDiffBaseline(dir string) {
+	err := walkMarkdown(dir, func(rel string, md []byte) error {
+		diffs.content[rel] = string(md)
+		return nil
+	})
+	maybeBail(err)
+}
+
+// updateDiff diffs a changed page against the content we remembered
+// and tells the clients what changed.
+func updateDiff(event fsnotify.Event, rel string) {
+	if path.Ext(rel) != ".md" {
+		return
+	}
+	md, err := readContent(rel)
+	if err != nil {
+		md = nil
+	}
+
+	diffs.Lock()
+	d := unifiedDiff(rel, diffs.content[rel], string(md))
+	if md == nil {
+		delete(diffs.content, rel)
+	} else {
+		diffs.content[rel] = string(md)
+	}
+	if d != "" {
+		diffs.last[rel] = d
+	}
+	diffs.Unlock()
+
+	if d != "" {
+		broadcast(newDiffMessage(rel, d))
+	}
+}
+
+// newDiffMessage tells the clients how a page just changed.
+func newDiffMessage(rel string, d string) (message string) {
+	type diff struct {
+		Path string `json:"path"`
+		Diff string `json:"diff"`
+	}
+	type diffMessage struct {
+		Diff diff `json:"diff"`
+	}
+
+	b, err := json.Marshal(diffMessage{diff{rel, d}})
+	maybeBail(err)
+	message = string(b)
+	return message
+}
+
+// diffHandler serves /_diff/<path>, the most recent change to a page:
+// as a colored page for browsers and as a plain diff otherwise.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/_diff/")), "/")
+	diffs.Lock()
+	d, ok := diffs.last[rel]
+	diffs.Unlock()
+	if !ok {
+		http.Error(w, "no changes to "+rel+" this session", http.StatusNotFound)
+		return
+	}
+
+	if !wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		_, err := w.Write([]byte(d))
+		maybeBail(err)
+		return
+	}
+
+	colors := map[byte]string{'+': "#cfc", '-': "#fcc", '@': "#ddf"}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"+
+		"<title>Changes to %s</title>\n</head>\n<body>\n<h1>Changes to <a href=\"/#!%s\">%s</a></h1>\n<pre>",
+		html.EscapeString(rel), html.EscapeString(rel), html.EscapeString(rel))
+	for _, line := range splitLines(d) {
+		style := ""
+		if len(line) > 0 && !strings.HasPrefix(line, "---") && !strings.HasPrefix(line, "+++") {
+			if c, ok := colors[line[0]]; ok {
+				style = fmt.Sprintf(" style=\"background:%s\"", c)
+			}
+		}
+		fmt.Fprintf(&b, "<div%s>%s</div>", style, html.EscapeString(line))
+	}
+	b.WriteString("</pre>\n</body>\n</html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := w.Write([]byte(b.String()))
+	maybeBail(err)
+}
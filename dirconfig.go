@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the name of the per-directory configuration file
+const dirConfigName = ".mdwiki-dev.yaml"
+
+// dirConfig is what a .mdwiki-dev.yaml can set for its own subtree.
+// In the root config file it sets the defaults.
+type dirConfig struct {
+	// Watch is a regular expression matching the files whose changes
+	// reload the browser, in place of -regexp.
+	Watch string `yaml:"watch"`
+
+	// Headers are added to every response.
+	Headers map[string]string `yaml:"headers"`
+
+	// Render overrides the matching command line flags.
+	Render renderConfig `yaml:"render"`
+
+	// Ignore lists glob patterns for files that aren't served, watched
+	// or indexed.  Patterns without a slash match file and directory
+	// names anywhere in the subtree, others match paths relative to
+	// the directory holding the config file.
+	Ignore []string `yaml:"ignore"`
+}
+
+type renderConfig struct {
+	Srcset         *bool `yaml:"srcset"`          // -srcset
+	CSVMaxRows     int   `yaml:"csv_max_rows"`    // -csv-max-rows
+	TOCDepth       int   `yaml:"toc_depth"`       // -toc-depth
+	HeadingAnchors *bool `yaml:"heading_anchors"` // -heading-anchors
+}
+
+// an ignore pattern and the directory (relative to the content
+// directory) it came from
+type ignoreRule struct {
+	dir     string
+	pattern string
+}
+
+// dirSettings are the settings in effect for one path, with the config
+// files between it and the content directory merged.
+type dirSettings struct {
+	watch          *regexp.Regexp
+	headers        map[string]string
+	srcset         bool
+	csvMaxRows     int
+	tocDepth       int
+	headingAnchors bool
+	ignore         []ignoreRule
+}
+
+// merge layers a config file from dir over s.  Later (deeper) files
+// win, except that ignore rules accumulate.
+func (s *dirSettings) merge(dir string, c dirConfig) {
+	if c.Watch != "" {
+		re, err := regexp.Compile(c.Watch)
+		if err != nil {
+			log.Error("ignoring bad watch pattern in %s: %s", path.Join(dir, dirConfigName), err)
+		} else {
+			s.watch = re
+		}
+	}
+	for k, v := range c.Headers {
+		s.headers[k] = v
+	}
+	if c.Render.Srcset != nil {
+		s.srcset = *c.Render.Srcset
+	}
+	if c.Render.CSVMaxRows > 0 {
+		s.csvMaxRows = c.Render.CSVMaxRows
+	}
+	if c.Render.TOCDepth > 0 {
+		s.tocDepth = c.Render.TOCDepth
+	}
+	if c.Render.HeadingAnchors != nil {
+		s.headingAnchors = *c.Render.HeadingAnchors
+	}
+	for _, p := range c.Ignore {
+		s.ignore = append(s.ignore, ignoreRule{dir, p})
+	}
+}
+
+// watches reports whether changes to rel should reload the browser.
+func (s *dirSettings) watches(rel string) bool {
+	return s.watch.MatchString(rel) && !s.ignored(rel)
+}
+
+// ignored reports whether rel, or a directory it's in, matches one of
+// the ignore rules.
+func (s *dirSettings) ignored(rel string) bool {
+	for _, rule := range s.ignore {
+		below := rel
+		if rule.dir != "" {
+			if !strings.HasPrefix(rel, rule.dir+"/") {
+				continue
+			}
+			below = strings.TrimPrefix(rel, rule.dir+"/")
+		}
+		if strings.Contains(rule.pattern, "/") {
+			if ok, _ := path.Match(rule.pattern, below); ok {
+				return true
+			}
+			continue
+		}
+		for _, name := range strings.Split(below, "/") {
+			if ok, _ := path.Match(rule.pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsed config files, reread when they change
+var dirConfigs = struct {
+	sync.Mutex
+	files map[string]cachedDirConfig
+}{files: make(map[string]cachedDirConfig)}
+
+type cachedDirConfig struct {
+	info os.FileInfo
+	c    dirConfig
+}
+
+// readDirConfig returns the config file in dir (a path below the
+// content directory), or false if there isn't one.
+func readDirConfig(dir string) (dirConfig, bool) {
+	name := path.Join(dir, dirConfigName)
+	info, err := statContent(name)
+	if err != nil {
+		return dirConfig{}, false
+	}
+
+	dirConfigs.Lock()
+	defer dirConfigs.Unlock()
+	if cached, ok := dirConfigs.files[name]; ok && (!contentOnDisk() || os.SameFile(cached.info, info)) &&
+		cached.info.ModTime().Equal(info.ModTime()) && cached.info.Size() == info.Size() {
+		return cached.c, true
+	}
+
+	var c dirConfig
+	data, err := readContent(name)
+	if err == nil {
+		err = yaml.Unmarshal(data, &c)
+	}
+	if err != nil {
+		log.Error("unable to read %s: %s", name, err)
+		return dirConfig{}, false
+	}
+	log.Info("read directory configuration from %s", name)
+	dirConfigs.files[name] = cachedDirConfig{info, c}
+	return c, true
+}
+
+// notifyRegexp is -regexp, compiled by compileNotifyRegexp.
+var notifyRegexp *regexp.Regexp
+
+// compileNotifyRegexp compiles -regexp once, at startup, so a bad one
+// is reported then rather than on the first request.
+func compileNotifyRegexp() error {
+	var err error
+	notifyRegexp, err = regexp.Compile(*flagNotifyRegexp)
+	if err != nil {
+		return fmt.Errorf("bad -regexp: %s", err)
+	}
+	return nil
+}
+
+// settingsFor returns the settings for rel, a path relative to the
+// content directory: the command line and root config first, then each
+// .mdwiki-dev.yaml in the directories leading down to it.
+func settingsFor(rel string) *dirSettings {
+	s := &dirSettings{
+		watch:          notifyRegexp,
+		headers:        make(map[string]string),
+		srcset:         *flagSrcset,
+		csvMaxRows:     *flagCSVMaxRows,
+		tocDepth:       *flagTOCDepth,
+		headingAnchors: *flagHeadingAnchors,
+	}
+	s.merge("", cfg.dirConfig)
+
+	dir := ""
+	for _, part := range strings.Split(path.Dir(rel), "/") {
+		if part == "." || part == "" {
+			continue
+		}
+		dir = path.Join(dir, part)
+		if c, ok := readDirConfig(dir); ok {
+			s.merge(dir, c)
+		}
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// pages in a directory with this name are drafts
+const draftsDirName = "_drafts"
+
+// metaTime reads a front matter date, which YAML may or may not have
+// made a time.Time already.
+func metaTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// draftReason says why the page at rel, with the given front matter,
+// is a draft, or is "" if it isn't one.  Drafts are pages in a _drafts
+// directory, marked draft: true, or dated in the future.
+func draftReason(rel string, meta map[string]interface{}) string {
+	if strings.HasPrefix(rel, draftsDirName+"/") || strings.Contains(rel, "/"+draftsDirName+"/") {
+		return "it's in " + draftsDirName
+	}
+	if draft, _ := meta["draft"].(bool); draft {
+		return "it's marked draft: true"
+	}
+	if date, ok := metaTime(meta["date"]); ok && date.After(time.Now()) {
+		return "it's dated " + date.Format("2006-01-02 15:04")
+	}
+	return ""
+}
+
+// isDraft reports whether the indexed page rel is a draft.
+func isDraft(rel string) bool {
+	if draftReason(rel, nil) != "" {
+		return true
+	}
+	site.RLock()
+	p := site.pages[rel]
+	site.RUnlock()
+	return p != nil && draftReason(rel, p.Meta) != ""
+}
+
+// pageBanner is a notice shown across the top of a page while it's
+// previewed.
+func pageBanner(text string, background string) string {
+	return fmt.Sprintf(`<div class="mdwds-ui mdwds-banner" style="background:%s;color:#000;`+
+		`padding:.5em 1em;margin-bottom:1em;font-weight:bold;text-align:center">%s</div>`+"\n\n",
+		background, html.EscapeString(text))
+}
+
+// processDrafts marks drafts with a banner while they're served.
+// Exports leave them out.
+func processDrafts(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if ctx.Export {
+		return in, nil
+	}
+	reason := draftReason(ctx.Path, ctx.Meta)
+	if reason == "" {
+		return in, nil
+	}
+	return append([]byte(pageBanner("DRAFT: this page won't be exported, "+reason, "#fc0")), in...), nil
+}
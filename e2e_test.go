@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// how long a test waits for a message the server should send; reloads
+// go out on the webHandler's one-second tick
+const messageTimeout = 5 * time.Second
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// HTML pages are sent with the snippet spliced in before </head>;
+// Markdown is sent as it is.
+func TestSnippetInjection(t *testing.T) {
+	s := startServer(t)
+	s.touch(t, "inject/index.html", "<html><head><title>Wiki</title></head><body></body></html>\n")
+	s.touch(t, "inject/page.md", "# Page\n")
+
+	resp, body := get(t, s.URL+"/inject/")
+	if got := resp.Header.Get("X-Via-FilteringFileServer"); got != "Filtered" {
+		t.Errorf("X-Via-FilteringFileServer is %q, want Filtered", got)
+	}
+	snippet := strings.Index(body, "Inserted by mdwiki-dev-server")
+	if snippet < 0 || snippet > strings.Index(body, "</head>") {
+		t.Errorf("no snippet before </head> in %q", body)
+	}
+	if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length is %s, but %d bytes were sent", got, len(body))
+	}
+
+	resp, body = get(t, s.URL+"/inject/page.md")
+	if got := resp.Header.Get("X-Via-FilteringFileServer"); got != "Skipped" {
+		t.Errorf("X-Via-FilteringFileServer for Markdown is %q, want Skipped", got)
+	}
+	if body != "# Page\n" {
+		t.Errorf("Markdown sent as %q", body)
+	}
+}
+
+// A change to a page reloads the connected clients, saying why.
+func TestReloadOnChange(t *testing.T) {
+	s := startServer(t)
+	s.touch(t, "reload/page.md", "# Before\n")
+	c := s.dial(t)
+	s.touch(t, "reload/page.md", "# After\n")
+
+	m := c.waitFor(t, "r", messageTimeout)
+	if m["reason"] != "reload/page.md changed" {
+		t.Errorf("reload reason %q, want %q", m["reason"], "reload/page.md changed")
+	}
+}
+
+// A change to a stylesheet swaps it in place, without a reload.
+func TestStylesheetRefresh(t *testing.T) {
+	s := startServer(t)
+	c := s.dial(t)
+	s.touch(t, "refresh/site.css", "body { color: red; }\n")
+
+	m := c.waitFor(t, "css", messageTimeout)
+	if got, _ := json.Marshal(m["css"]); string(got) != `["/refresh/site.css"]` {
+		t.Errorf("stylesheets refreshed: %s", got)
+	}
+	c.expectNone(t, "r", 1500*time.Millisecond)
+}
+
+// With -targeted-reload a client is only reloaded by changes to the
+// Markdown it's said it's loaded.
+func TestTargetedReload(t *testing.T) {
+	s := startServer(t)
+	*flagTargetedReload = true
+	defer func() { *flagTargetedReload = false }()
+	s.touch(t, "targeted/shown.md", "# Shown\n")
+	s.touch(t, "targeted/other.md", "# Other\n")
+
+	c := s.dial(t)
+	c.send(t, map[string]interface{}{"page": "targeted/shown.md", "loaded": []string{"targeted/shown.md"}})
+	// the server has the message once the client list says so
+	for deadline := time.Now().Add(messageTimeout); ; {
+		_, body := get(t, s.URL+"/_api/clients")
+		if strings.Contains(body, `"loaded"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the server never noted what the client loaded: %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.touch(t, "targeted/other.md", "# Other, changed\n")
+	c.expectNone(t, "r", 1500*time.Millisecond)
+	s.touch(t, "targeted/shown.md", "# Shown, changed\n")
+	m := c.waitFor(t, "r", messageTimeout)
+	if m["reason"] != "targeted/shown.md changed" {
+		t.Errorf("reload reason %q, want %q", m["reason"], "targeted/shown.md changed")
+	}
+}
+
+// A client that connects (or reconnects) after a change it hasn't
+// seen is reloaded when it says which it saw last.
+func TestResyncOnReconnect(t *testing.T) {
+	s := startServer(t)
+	seen := lastChange()
+	s.touch(t, "resync/page.md", "# Changed while away\n")
+
+	c := s.dial(t)
+	c.send(t, map[string]interface{}{"since": seen})
+	m := c.waitFor(t, "r", messageTimeout)
+	if m["reason"] != "resync/page.md changed" {
+		t.Errorf("reload reason %q, want %q", m["reason"], "resync/page.md changed")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// With -early-hints the wiki's page (MDwiki's index.html, or any page
+// the snippet goes into) is preceded by a 103 Early Hints response
+// naming what it needs first, so that a browser on a slow link starts
+// fetching those while the page is still being prepared: MDwiki's
+// navigation.md and config.json, and the stylesheets the page linked
+// to when last served.  The early_hints section of the config file
+// replaces that list, e.g.
+//
+//	early_hints:
+//	  - navigation.md
+//	  - /css/site.css
+//
+// The hints go out again as Link headers with the page itself, for a
+// proxy in front, which may push them over HTTP/2; the server itself
+// only speaks HTTP/1.1, so has nothing to push with.
+
+// the files MDwiki fetches, beside the page, before it shows anything
+var earlyHintDefaults = []string{"navigation.md", "config.json"}
+
+// shellStylesheets are the local stylesheets each page linked to when
+// last served, by the page's path.
+var shellStylesheets = struct {
+	sync.Mutex
+	byPage map[string][]string
+}{byPage: make(map[string][]string)}
+
+// isPageShell reports whether the request is for an HTML page, which
+// the snippet may go into, judging by its path alone.
+func isPageShell(r *http.Request) bool {
+	ext := path.Ext(r.URL.Path)
+	return strings.HasSuffix(r.URL.Path, "/") || ext == ".html" || ext == ".htm"
+}
+
+// recordStylesheets notes the local stylesheets the page at urlPath,
+// body, links to, to hint at next time.
+func recordStylesheets(urlPath string, body []byte) {
+	var sheets []string
+	for _, ref := range shellAssets(body) {
+		u, err := url.Parse(ref)
+		if err != nil || u.Scheme != "" || u.Host != "" || path.Ext(u.Path) != ".css" {
+			continue
+		}
+		sheets = append(sheets, ref)
+	}
+	shellStylesheets.Lock()
+	shellStylesheets.byPage[urlPath] = sheets
+	shellStylesheets.Unlock()
+}
+
+// earlyHints returns what the page at urlPath should hint at, as paths
+// from the root.
+func earlyHints(urlPath string) []string {
+	dir := urlPath
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	resolve := func(ref string) string {
+		if strings.HasPrefix(ref, "/") {
+			return path.Clean(ref)
+		}
+		return path.Join(dir, ref)
+	}
+
+	var hints []string
+	if len(cfg.EarlyHints) > 0 {
+		for _, ref := range cfg.EarlyHints {
+			hints = append(hints, resolve(ref))
+		}
+		return hints
+	}
+	for _, ref := range earlyHintDefaults {
+		if _, err := statContent(resolve(ref)); err == nil {
+			hints = append(hints, resolve(ref))
+		}
+	}
+	shellStylesheets.Lock()
+	for _, ref := range shellStylesheets.byPage[urlPath] {
+		hints = append(hints, resolve(ref))
+	}
+	shellStylesheets.Unlock()
+	if *flagInjectCSS != "" {
+		hints = append(hints, "/_inject.css")
+	}
+	return hints
+}
+
+// preloadLink is the Link header value that preloads target.
+func preloadLink(target string) string {
+	switch path.Ext(target) {
+	case ".css":
+		return fmt.Sprintf("<%s>; rel=preload; as=style", target)
+	case ".js":
+		return fmt.Sprintf("<%s>; rel=preload; as=script", target)
+	}
+	// MDwiki fetches the rest with XHRs, which preloads must match
+	return fmt.Sprintf("<%s>; rel=preload; as=fetch; crossorigin", target)
+}
+
+// sendEarlyHints sends the 103 Early Hints for the page r asks for,
+// leaving the Link headers for the page's own response.
+func sendEarlyHints(w http.ResponseWriter, r *http.Request) {
+	if !*flagEarlyHints || !isPageShell(r) {
+		return
+	}
+	hints := earlyHints(r.URL.Path)
+	if len(hints) == 0 {
+		return
+	}
+	for _, h := range hints {
+		w.Header().Add("Link", preloadLink((&url.URL{Path: h}).EscapedPath()))
+	}
+	log.Debug("sending early hints for %s: %s", r.URL.Path, strings.Join(hints, ", "))
+	w.WriteHeader(http.StatusEarlyHints)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// The /_editor websocket is for editor plugins.  Each message is a
+// JSON object.  Requests carry an id, which the response repeats:
+//
+//	-> {"id": 1, "method": "update", "params": {"path": "a.md", "text": "# A"}}
+//	<- {"id": 1, "result": null}
+//	-> {"id": 2, "method": "diagnostics", "params": {"path": "a.md"}}
+//	<- {"id": 2, "result": [{"path": "a.md", "line": 3, "column": 1,
+//	        "source": "lint", "code": "MD013", "message": "..."}]}
+//	<- {"method": "changed", "params": {"path": "b.md", "op": "WRITE"}}
+//
+// The methods, each taking the page's path (relative to the content
+// directory):
+//
+//	update       preview text, an unsaved buffer, in the browsers (as
+//	             PUT /_api/preview/<path> does) until it's saved, closed
+//	             or forgotten about
+//	close        stop previewing the buffer
+//	render       the page, or text if it's given, as it's served to
+//	             MDwiki ("markdown") and rendered as HTML ("html")
+//	diagnostics  lint violations, misspellings and broken links in the
+//	             page, or in text if it's given
+//
+// Errors are {"id": n, "error": "..."}.  Unprompted, the server sends
+// "changed" notices, as files that reload the browsers change.
+
+// an editor's request
+type editorRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params struct {
+		Path string  `json:"path"`
+		Text *string `json:"text"`
+	} `json:"params"`
+}
+
+// a response, or a notice if ID is nil
+type editorResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params interface{}     `json:"params,omitempty"`
+	Result interface{}     `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// A diagnostic is a problem found in a page, for an editor to show.
+type diagnostic struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Source  string `json:"source"` // lint, spelling or links
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// brokenLinks finds the links in a page, rel, to Markdown pages that
+// don't exist, and the interwiki references their prefixes don't
+// expect.
+func brokenLinks(rel string, md []byte) []diagnostic {
+	var found []diagnostic
+	inFence := false
+	for i, line := range strings.Split(string(md), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+		found = append(found, interwikiProblems(rel, i+1, line)...)
+		for _, m := range indexLinkRegexp.FindAllStringSubmatchIndex(line, -1) {
+			for g := 1; g < len(m)/2; g++ {
+				a, b := m[2*g], m[2*g+1]
+				if a < 0 {
+					continue
+				}
+				target := line[a:b]
+				if localLink(target) == "" || site.resolveLink(rel, target) != "" {
+					continue
+				}
+				exists := false
+				for _, c := range linkCandidates(rel, target) {
+					if _, err := statContent(c); err == nil {
+						exists = true
+						break
+					}
+				}
+				if !exists {
+					found = append(found, diagnostic{rel, i + 1, a + 1, "links", "",
+						fmt.Sprintf("no page %s", localLink(target))})
+				}
+			}
+		}
+	}
+	return found
+}
+
+// pageDiagnostics is everything wrong with a page.
+func pageDiagnostics(rel string, md []byte) []diagnostic {
+	found := lintDiagnostics(lintMarkdown(rel, md, cfg.Lint))
+	serverSpellCheckerOnce.Do(func() {
+		serverSpellChecker, serverSpellCheckerErr = newSpellChecker(spellingWordLists()...)
+	})
+	if serverSpellCheckerErr == nil {
+		found = append(found, spellingDiagnostics(serverSpellChecker.check(rel, md))...)
+	}
+	found = append(found, brokenLinks(rel, md)...)
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Line < found[j].Line })
+	return found
+}
+
+// handleEditorRequest answers one request.
+func handleEditorRequest(ws *websocket.Conn, req editorRequest) (interface{}, error) {
+	rel := strings.TrimPrefix(path.Clean("/"+req.Params.Path), "/")
+	if rel == "" || protectedPath(rel) || settingsFor(rel).ignored(rel) {
+		return nil, fmt.Errorf("bad path %q", req.Params.Path)
+	}
+	text := func() ([]byte, error) {
+		if req.Params.Text != nil {
+			return []byte(*req.Params.Text), nil
+		}
+		return readContent(rel)
+	}
+
+	allowed := canRead(ws.Request(), rel)
+	if req.Method == "update" || req.Method == "close" {
+		allowed = canEdit(ws.Request(), rel)
+	}
+	if !allowed {
+		return nil, fmt.Errorf("permission denied for %s", rel)
+	}
+	if *flagReadOnly && (req.Method == "update" || req.Method == "close") {
+		return nil, fmt.Errorf("the server is read-only")
+	}
+	switch req.Method {
+	case "update":
+		if req.Params.Text == nil {
+			return nil, fmt.Errorf("update needs text")
+		}
+		old, _ := readContent(rel)
+		setPreview(rel, []byte(*req.Params.Text))
+		added, removed := lineChanges(old, []byte(*req.Params.Text))
+		recordMutation(ws.Request(), mutation{Action: "preview", Path: rel, Added: added, Removed: removed})
+		return nil, nil
+	case "close":
+		if dropPreview(rel, nil) {
+			recordMutation(ws.Request(), mutation{Action: "discard", Path: rel})
+		}
+		return nil, nil
+	case "render":
+		md, err := text()
+		if err != nil {
+			return nil, err
+		}
+		processed, err := process(md, newProcessorContext(rel, "http://"+ws.Request().Host, false))
+		if err != nil {
+			return nil, err
+		}
+		html, err := markdownToHTML(processed)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"markdown": string(processed), "html": string(html)}, nil
+	case "diagnostics":
+		md, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return pageDiagnostics(rel, md), nil
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+func sendEditorMessage(ws *websocket.Conn, m editorResponse) error {
+	b, err := json.Marshal(m)
+	maybeBail(err)
+	return sendMessage(ws, string(b))
+}
+
+// editorHandler serves /_editor.
+func editorHandler(ws *websocket.Conn) {
+	log.Info("editor connected from %s", ws.Request().RemoteAddr)
+	changes := subscribeChanges()
+	defer unsubscribeChanges(changes)
+
+	incoming := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(incoming)
+		for {
+			var m string
+			if err := receiveMessage(ws, &m); err != nil {
+				log.Debug("editor connection closed: %s", err)
+				return
+			}
+			select {
+			case incoming <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var out editorResponse
+		select {
+		case change := <-changes:
+			if !settingsFor(change.rel).watches(change.rel) {
+				continue
+			}
+			out = editorResponse{Method: "changed", Params: map[string]string{
+				"path": change.rel, "op": change.event.Op.String()}}
+		case m, ok := <-incoming:
+			if !ok {
+				return
+			}
+			var req editorRequest
+			if err := json.Unmarshal([]byte(m), &req); err != nil {
+				out = editorResponse{Error: "malformed request: " + err.Error()}
+				break
+			}
+			result, err := handleEditorRequest(ws, req)
+			out = editorResponse{ID: req.ID, Result: result}
+			if err != nil {
+				out.Error = err.Error()
+			}
+		}
+		if err := sendEditorMessage(ws, out); err != nil {
+			log.Info("editor went away: %s", err)
+			return
+		}
+	}
+}
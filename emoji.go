@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark-emoji/definition"
+)
+
+// an emoji shortcode, :rocket: or :+1:
+var emojiRegexp = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+
+// the shortcodes GitHub understands, which are the ones Slack mostly
+// shares
+var githubEmojis = definition.Github()
+
+// emojiImage is an <img> standing in for an emoji that isn't Unicode.
+func emojiImage(name string, src string) string {
+	return fmt.Sprintf(`<img class="emoji" alt=":%s:" title=":%s:" src="%s" height="20" width="20">`,
+		name, name, html.EscapeString(src))
+}
+
+// expandEmoji replaces the emoji shortcodes in a line, leaving code
+// spans alone.
+func expandEmoji(line string) string {
+	parts := strings.Split(line, "`")
+	for i := 0; i < len(parts); i += 2 {
+		parts[i] = emojiRegexp.ReplaceAllStringFunc(parts[i], func(code string) string {
+			name := code[1 : len(code)-1]
+			if src, ok := cfg.Emoji[name]; ok {
+				return emojiImage(name, src)
+			}
+			e, ok := githubEmojis.Get(name)
+			if !ok {
+				return code
+			}
+			if !e.IsUnicode() {
+				return emojiImage(name, "https://github.githubassets.com/images/icons/emoji/"+name+".png")
+			}
+			return string(e.Unicode)
+		})
+	}
+	return strings.Join(parts, "`")
+}
+
+// processEmoji expands (with -emoji) the shortcodes in a page, outside
+// fenced code blocks.
+func processEmoji(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if !*flagEmoji || !strings.Contains(string(in), ":") {
+		return in, nil
+	}
+	lines := strings.SplitAfter(string(in), "\n")
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if !inFence {
+			lines[i] = expandEmoji(line)
+		}
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An exporter writes a static copy of the content directory, with the
+// processors that still make sense without a server (front matter,
+// includes, CSV tables, Open Graph tags) run over it.
+//
+// Incremental exporters keep a manifest in the output directory
+// recording which source files each exported file was made from, and
+// when those were last modified.  That's the dependency graph: files
+// whose sources haven't changed since are left alone, and when a
+// source changes everything made from it is exported again.
+type exporter struct {
+	dir      string
+	out      string
+	baseURL  string // for Open Graph tags, which need absolute URLs
+	jobs     int    // files exported at once
+	progress bool   // show a progress bar while exporting everything
+	gallery  bool   // write a gallery.md for directories of images
+
+	sync.Mutex // guards what follows, which the workers share
+	written    int
+	skipped    int
+	manifest   map[string]exportRecord // by exported file, nil if not incremental
+
+	fingerprint string // of the settings the export is made with
+}
+
+// an exportRecord lists the sources an exported file was made from,
+// with their modification times (in nanoseconds)
+type exportRecord struct {
+	Sources map[string]int64 `json:"sources"`
+}
+
+// the manifest's name within the output directory
+const exportManifestName = ".mdwiki-dev-build.json"
+
+// exportManifest is what's in the manifest file.
+type exportManifest struct {
+	Fingerprint string                  `json:"fingerprint"`
+	Files       map[string]exportRecord `json:"files"`
+}
+
+// exportFlags are the flags that change what's exported: what's read,
+// and how the processors turn it out.  The rest (-port, -verbose and
+// the like) only matter to the server.
+var exportFlags = []string{
+	"dir", "source", "follow-symlinks", "serve-dotfiles",
+	"csv-max-rows", "toc-depth", "heading-anchors",
+	"emoji", "glossary", "smartypants", "highlight", "highlight-classes",
+	"backlinks", "related", "og",
+}
+
+// exportFingerprint sums up everything besides the sources that goes
+// into an export: the exportFlags, the config file and the
+// directories' own config files, and the plugins.  When it changes,
+// every file has to be exported again.
+func exportFingerprint(dir string, baseURL string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "base-url=%s\x00", baseURL)
+	for _, name := range exportFlags {
+		fmt.Fprintf(h, "%s=%s\x00", name, flag.Lookup(name).Value)
+	}
+	if b, err := json.Marshal(cfg); err == nil {
+		h.Write(b)
+	}
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() == dirConfigName {
+			if data, err := ioutil.ReadFile(name); err == nil {
+				fmt.Fprintf(h, "%s\x00%s\x00", name, data)
+			}
+		}
+		return nil
+	})
+	for _, p := range processors {
+		if p, ok := p.(*pluginProcessor); ok {
+			key := p.cacheKey(nil, nil)
+			h.Write(key[:])
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func newExporter(dir string, out string, baseURL string, incremental bool) (*exporter, error) {
+	if *flagOG && baseURL == "" {
+		return nil, fmt.Errorf("-og needs a -base-url to export with")
+	}
+	var err error
+	if site == nil {
+		site, err = newSiteIndex(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e := &exporter{dir: dir, out: out, baseURL: baseURL, jobs: runtime.NumCPU(),
+		fingerprint: exportFingerprint(dir, baseURL)}
+	if incremental {
+		e.manifest = make(map[string]exportRecord)
+		var m exportManifest
+		data, err := ioutil.ReadFile(filepath.Join(out, exportManifestName))
+		if err == nil {
+			err = json.Unmarshal(data, &m)
+		}
+		switch {
+		case err != nil && !os.IsNotExist(err):
+			log.Warning("exporting everything, unable to read the export manifest: %s", err)
+		case err == nil && m.Fingerprint != e.fingerprint:
+			log.Notice("exporting everything, the settings have changed since the last export")
+		case m.Files != nil:
+			e.manifest = m.Files
+		}
+	}
+	return e, nil
+}
+
+// saveManifest writes the manifest for the next incremental export.
+func (e *exporter) saveManifest() error {
+	e.Lock()
+	defer e.Unlock()
+	if e.manifest == nil {
+		return nil
+	}
+	b, err := json.MarshalIndent(exportManifest{e.fingerprint, e.manifest}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(e.out, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(e.out, exportManifestName), b, 0644)
+}
+
+// modTime returns when a source file was last modified, or 0 if it
+// doesn't exist.
+func (e *exporter) modTime(rel string) int64 {
+	if path.Ext(rel) == ".md" && isDraft(rel) {
+		// drafts aren't exported, so they might as well not be there
+		return 0
+	}
+	info, err := os.Stat(filepath.Join(e.dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return 0
+	}
+	return info.ModTime().UnixNano()
+}
+
+// record notes what an exported file was made from.
+func (e *exporter) record(out string, sources ...string) {
+	r := exportRecord{Sources: make(map[string]int64)}
+	for _, src := range sources {
+		r.Sources[src] = e.modTime(src)
+	}
+	e.Lock()
+	defer e.Unlock()
+	if e.manifest != nil {
+		e.manifest[out] = r
+	}
+}
+
+// upToDate reports whether the exported file out was made from (at
+// least) sources, and nothing it was made from has changed since.
+func (e *exporter) upToDate(out string, sources ...string) bool {
+	e.Lock()
+	r, ok := e.manifest[out]
+	e.Unlock()
+	if !ok {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(e.out, filepath.FromSlash(out))); err != nil {
+		return false
+	}
+	for _, src := range sources {
+		if _, ok := r.Sources[src]; !ok {
+			return false
+		}
+	}
+	for src, t := range r.Sources {
+		if t != e.modTime(src) {
+			return false
+		}
+	}
+	return true
+}
+
+// dependents returns the exported files made (in part) from src.
+func (e *exporter) dependents(src string) []string {
+	e.Lock()
+	defer e.Unlock()
+	var found []string
+	for out, r := range e.manifest {
+		if _, ok := r.Sources[src]; ok {
+			found = append(found, out)
+		}
+	}
+	return found
+}
+
+// skip reports whether rel (a file or directory) is left out of the
+// export: the output directory and what's in it, if it's inside the
+// content directory, and anything the server wouldn't serve.
+func (e *exporter) skip(name string, rel string) bool {
+	if out, err := filepath.Abs(e.out); err == nil {
+		if abs, err := filepath.Abs(name); err == nil &&
+			(abs == out || strings.HasPrefix(abs, out+string(filepath.Separator))) {
+			return true
+		}
+	}
+	if rel == mocksDirName || path.Base(rel) == draftsDirName {
+		// mocked endpoints and drafts are for development only
+		return true
+	}
+	return protectedPath(rel) || settingsFor(rel).ignored(rel) || !symlinkAllowed(name)
+}
+
+// exportAll exports every file in the content directory, or, when
+// exporting incrementally, the ones that have changed, several at a
+// time.  Exported files whose sources have gone are removed.
+func (e *exporter) exportAll() error {
+	var files []string
+	err := filepath.Walk(e.dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == e.dir {
+			return nil
+		}
+		rel, err := filepath.Rel(e.dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if e.skip(name, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && e.modTime(rel) != 0 {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.exportFiles(files); err != nil {
+		return err
+	}
+	if err := e.exportRedirects(); err != nil {
+		return err
+	}
+	if err := e.exportGalleries(files); err != nil {
+		return err
+	}
+	if err := e.exportTags(); err != nil {
+		return err
+	}
+	if err := e.exportHighlightCSS(); err != nil {
+		return err
+	}
+
+	for out, r := range e.manifest {
+		// files are gone with the source of the same name, converted
+		// ones with what they were converted from
+		gone := true
+		if _, ok := r.Sources[out]; ok {
+			gone = e.modTime(out) == 0
+		} else {
+			for src := range r.Sources {
+				if e.modTime(src) != 0 {
+					gone = false
+				}
+			}
+		}
+		if gone {
+			log.Info("removing %s from the export", out)
+			if err := os.Remove(filepath.Join(e.out, filepath.FromSlash(out))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(e.manifest, out)
+		}
+	}
+	return e.saveManifest()
+}
+
+// exportFiles exports files with a pool of e.jobs workers, returning
+// the first error.
+func (e *exporter) exportFiles(files []string) error {
+	queue := make(chan string)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	jobs := e.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range queue {
+				err := e.exportFile(rel)
+				if err != nil {
+					err = fmt.Errorf("%s: %s", rel, err)
+				}
+				errs <- err
+			}
+		}()
+	}
+
+	go func() {
+		defer close(queue)
+		for _, rel := range files {
+			queue <- rel
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	done := 0
+	var first error
+	for err := range errs {
+		if err != nil && first == nil {
+			first = err
+		}
+		done++
+		if e.progress {
+			showProgress(done, len(files))
+		}
+	}
+	if e.progress && len(files) > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	return first
+}
+
+// the width of the progress bar, in characters
+const progressWidth = 40
+
+// showProgress redraws the progress bar on stderr.
+func showProgress(done int, total int) {
+	filled := progressWidth * done / total
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %d/%d", strings.Repeat("#", filled),
+		strings.Repeat(" ", progressWidth-filled), done, total)
+}
+
+// isTerminal reports whether f is (probably) a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// exportFile exports one file, given by its path relative to the
+// content directory.  Files (and directories) that have been removed
+// are removed from the export too.
+func (e *exporter) exportFile(rel string) error {
+	src := filepath.Join(e.dir, filepath.FromSlash(rel))
+	dst := filepath.Join(e.out, filepath.FromSlash(rel))
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		log.Info("removing %s from the export", rel)
+		e.Lock()
+		delete(e.manifest, rel)
+		e.Unlock()
+		return os.RemoveAll(dst)
+	}
+	if err != nil || info.IsDir() {
+		return err
+	}
+
+	ext := path.Ext(rel)
+	converted := ""
+	for _, c := range sourceConverters {
+		if c.ext == ext {
+			converted = strings.TrimSuffix(rel, ext) + ".md"
+		}
+	}
+	if e.manifest != nil && e.upToDate(rel, rel) &&
+		(converted == "" || e.modTime(converted) != 0 || e.upToDate(converted, rel)) {
+		e.Lock()
+		e.skipped++
+		e.Unlock()
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	ctx := newProcessorContext(rel, e.baseURL, true)
+	data, err = process(data, ctx)
+	if err != nil {
+		return err
+	}
+
+	// sources with converters also stand in for a missing .md
+	if converted != "" {
+		md, err := convertSource(contentFS{http.Dir(e.dir)}, "/"+converted)
+		if err != nil {
+			return err
+		}
+		if md != nil {
+			mdCtx := newProcessorContext(converted, e.baseURL, true)
+			md, err = process(md, mdCtx)
+			if err != nil {
+				return err
+			}
+			if err := e.write(filepath.Join(e.out, filepath.FromSlash(converted)), md, info); err != nil {
+				return err
+			}
+			e.record(converted, append([]string{rel}, mdCtx.deps...)...)
+		}
+	}
+
+	if err := e.write(dst, data, info); err != nil {
+		return err
+	}
+	e.record(rel, append([]string{rel}, ctx.deps...)...)
+	return nil
+}
+
+// write writes an exported file with its source's modification time,
+// so that tools like rsync can tell what changed.
+func (e *exporter) write(name string, data []byte, src os.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		return err
+	}
+	e.Lock()
+	e.written++
+	e.Unlock()
+	log.Debug("exported %s", name)
+	return os.Chtimes(name, src.ModTime(), src.ModTime())
+}
+
+// watch keeps the export up to date as files in the content directory
+// change, until something goes wrong.
+func (e *exporter) watch() error {
+	w := newTreeWatcher(e.dir, ".")
+	defer w.Close()
+	for note := range w.Events() {
+		rel, err := filepath.Rel(e.dir, note.Name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if e.skip(note.Name, rel) {
+			continue
+		}
+		site.contentChanged(note, rel)
+		if path.Ext(rel) == ".md" && isDraft(rel) {
+			e.Lock()
+			_, exported := e.manifest[rel]
+			delete(e.manifest, rel)
+			e.Unlock()
+			if exported {
+				log.Info("removing %s from the export, it's a draft now", rel)
+				if err := os.Remove(filepath.Join(e.out, filepath.FromSlash(rel))); err != nil && !os.IsNotExist(err) {
+					log.Error("unable to remove %s: %s", rel, err)
+				}
+			}
+			continue
+		}
+		if rel == redirectsFileName {
+			if err := e.exportRedirects(); err != nil {
+				log.Error("unable to export redirect pages: %s", err)
+			}
+		}
+
+		// the file itself, and anything else made from it
+		changed := []string{rel}
+		for _, out := range e.dependents(rel) {
+			if out != rel && e.modTime(out) != 0 && rel != redirectsFileName {
+				changed = append(changed, out)
+			}
+		}
+		for _, rel := range changed {
+			if err := e.exportFile(rel); err != nil {
+				log.Error("unable to export %s: %s", rel, err)
+				continue
+			}
+			fmt.Printf("%s %s\n", time.Now().Format("15:04:05"), rel)
+		}
+		if path.Ext(rel) == ".md" {
+			if err := e.exportTags(); err != nil {
+				log.Error("unable to export tag pages: %s", err)
+			}
+		}
+		if err := e.saveManifest(); err != nil {
+			log.Error("unable to save the export manifest: %s", err)
+		}
+	}
+	return nil
+}
+
+// build implements the build command, which exports a static copy of
+// the wiki ready to be published, and optionally keeps it up to date.
+func build(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	out := flags.String("out", "_site", "directory to write the export to")
+	baseURL := flags.String("base-url", "", "URL the export will be published at, for -og")
+	watch := flags.Bool("watch", false, "keep rebuilding the export as files change")
+	full := flags.Bool("full", false, "export every file, not just the ones that changed")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "number of files to export at once")
+	quiet := flags.Bool("quiet", false, "don't show a progress bar")
+	gallery := flags.Bool("gallery", false, "write a gallery.md for each directory that holds nothing but images")
+	flags.Parse(args)
+	if !contentOnDisk() {
+		return fmt.Errorf("build exports the -dir directory, not a -source snapshot")
+	}
+
+	e, err := newExporter(*flagContentDir, *out, *baseURL, !*full)
+	if err != nil {
+		return err
+	}
+	e.jobs = *jobs
+	e.progress = !*quiet && isTerminal(os.Stderr)
+	e.gallery = *gallery
+	if err := e.exportAll(); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d files to %s (%d unchanged)\n", e.written, *out, e.skipped)
+	if *watch {
+		fmt.Printf("watching %s for changes\n", *flagContentDir)
+		return e.watch()
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// The export fingerprint changes with the flags that change what's
+// exported, and with no others.
+func TestExportFingerprint(t *testing.T) {
+	for _, name := range exportFlags {
+		if flag.Lookup(name) == nil {
+			t.Fatalf("there's no -%s flag", name)
+		}
+	}
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name, value string
+		changes     bool
+	}{
+		{"toc-depth", "1", true},
+		{"highlight", "a-style-of-its-own", true},
+		{"og", "true", true},
+		{"verbose", "true", false},
+		{"port", "1", false},
+		{"shutdown-timeout", "1s", false},
+	} {
+		f := flag.Lookup(tc.name)
+		saved := f.Value.String()
+		if saved == tc.value {
+			t.Fatalf("-%s is already %s", tc.name, tc.value)
+		}
+		before := exportFingerprint(dir, "")
+		if err := f.Value.Set(tc.value); err != nil {
+			t.Fatal(err)
+		}
+		after := exportFingerprint(dir, "")
+		f.Value.Set(saved)
+		if (before != after) != tc.changes {
+			t.Errorf("setting -%s to %s changes the fingerprint is %t, want %t", tc.name, tc.value, before != after, tc.changes)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+	"gopkg.in/fsnotify.v1"
+)
+
+const haveFSEvents = true
+
+// newFSEventsTreeWatcher is newTreeWatcher for -watch-backend fsevents:
+// one FSEvents stream watches the whole tree, where kqueue needs a
+// descriptor for every file and directory and a big enough tree runs
+// out.  FSEvents reports real paths and doesn't follow symbolic links
+// into other trees.
+func newFSEventsTreeWatcher(dir string, matcher *regexp.Regexp) (chan fsnotify.Event, chan interface{}) {
+	notifier := make(chan fsnotify.Event)
+	notifierShutdown := make(chan interface{})
+
+	abs, err := filepath.Abs(dir)
+	maybeBail(err)
+	real, err := filepath.EvalSymlinks(abs)
+	maybeBail(err)
+	stream := &fsevents.EventStream{
+		Paths:   []string{real},
+		Latency: 50 * time.Millisecond,
+		Flags:   fsevents.FileEvents | fsevents.WatchRoot,
+	}
+	maybeBail(stream.Start())
+	noteWatch(dir, true)
+	log.Info("watching %s with FSEvents", dir)
+
+	go func() {
+		defer func() {
+			stream.Stop()
+			noteWatch(dir, false)
+		}()
+		for {
+			select {
+			case batch := <-stream.Events:
+				for _, e := range batch {
+					event, ok := fseventsEvent(e, real, dir)
+					if !ok || inDotDir(dir, event.Name) || !watchMatches(matcher, event.Name) ||
+						!symlinkAllowed(event.Name) {
+						continue
+					}
+					select {
+					case notifier <- event:
+					case <-notifierShutdown:
+						return
+					}
+				}
+			case <-notifierShutdown:
+				return
+			}
+		}
+	}()
+	return notifier, notifierShutdown
+}
+
+// fseventsEvent translates an FSEvents event below real, the resolved
+// content directory, into an fsnotify one below dir.  Directories and
+// changes to metadata alone are dropped, as the fsnotify watchers drop
+// them.  FSEvents coalesces flags, so whether the file is still there
+// decides between a create or a write and a remove or a rename.
+func fseventsEvent(e fsevents.Event, real string, dir string) (fsnotify.Event, bool) {
+	if e.Flags&fsevents.ItemIsDir != 0 {
+		return fsnotify.Event{}, false
+	}
+	name := e.Path
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	rel, err := filepath.Rel(real, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fsnotify.Event{}, false
+	}
+	name = filepath.Join(dir, rel)
+
+	var op fsnotify.Op
+	_, statErr := os.Lstat(name)
+	exists := statErr == nil
+	switch {
+	case e.Flags&fsevents.ItemRemoved != 0 && !exists:
+		op = fsnotify.Remove
+	case e.Flags&fsevents.ItemRenamed != 0 && !exists:
+		op = fsnotify.Rename
+	case e.Flags&(fsevents.ItemCreated|fsevents.ItemRenamed) != 0 && exists &&
+		e.Flags&fsevents.ItemModified == 0:
+		op = fsnotify.Create
+	case e.Flags&fsevents.ItemModified != 0 && exists:
+		op = fsnotify.Write
+	default:
+		return fsnotify.Event{}, false
+	}
+	return fsnotify.Event{Name: name, Op: op}, true
+}
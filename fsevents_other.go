@@ -0,0 +1,17 @@
+//go:build !darwin
+
+package main
+
+import (
+	"regexp"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+const haveFSEvents = false
+
+// newFSEventsTreeWatcher is only available on macOS; checkWatchBackend
+// keeps anyone from asking for it elsewhere.
+func newFSEventsTreeWatcher(dir string, matcher *regexp.Regexp) (chan fsnotify.Event, chan interface{}) {
+	panic("FSEvents is only available on macOS")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// size of the thumbnails shown on gallery pages
+const galleryThumbSize = "240x240"
+
+// imageDirectory returns the (sorted) names of the images in dir if
+// it contains nothing but images, and nil otherwise.  Dot files are
+// ignored.
+func imageDirectory(root http.FileSystem, dir string) []string {
+	d, err := root.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	entries, err := d.Readdir(-1)
+	if err != nil {
+		return nil
+	}
+
+	var images []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if e.IsDir() || !rasterExtRegex.MatchString(e.Name()) {
+			return nil
+		}
+		images = append(images, e.Name())
+	}
+	sort.Strings(images)
+	return images
+}
+
+// serveGallery answers requests for an image-only directory with a
+// generated gallery page, and requests for a missing gallery.md in
+// such a directory with the equivalent Markdown.  It returns false,
+// having written nothing, for any other request.
+func serveGallery(w http.ResponseWriter, r *http.Request, root http.FileSystem) bool {
+	name := r.URL.Path
+	isMarkdown := path.Base(name) == "gallery.md"
+	dir := name
+	if isMarkdown {
+		if f, err := root.Open(name); err == nil {
+			f.Close()
+			return false
+		}
+		dir = strings.TrimSuffix(path.Dir(name), "/") + "/"
+	} else if !strings.HasSuffix(name, "/") {
+		return false
+	}
+
+	images := imageDirectory(root, dir)
+	if len(images) == 0 {
+		return false
+	}
+
+	log.Info("generating gallery for %s", dir)
+	var body []byte
+	if isMarkdown {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		body = galleryMarkdown(dir, images, true)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		body = galleryPage(dir, images)
+	}
+	_, err := w.Write(body)
+	maybeBail(err)
+	return true
+}
+
+func galleryLinks(dir string, image string) (full string, thumb string) {
+	full = path.Join(dir, (&url.URL{Path: image}).String())
+	thumb = "/_thumbs/" + galleryThumbSize + full
+	return full, thumb
+}
+
+// galleryPage uses the markup that lightbox-style scripts look for
+// (an anchor with data-lightbox around each thumbnail).
+func galleryPage(dir string, images []string) []byte {
+	var b bytes.Buffer
+	title := html.EscapeString(dir)
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+.gallery { display: flex; flex-wrap: wrap; }
+.gallery figure { margin: 8px; text-align: center; }
+.gallery img { max-width: 240px; max-height: 240px; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<div class="gallery">
+`, title, title)
+	for _, image := range images {
+		full, thumb := galleryLinks(dir, image)
+		name := html.EscapeString(image)
+		fmt.Fprintf(&b, `<figure><a href="%s" data-lightbox="gallery" data-title="%s"><img src="%s" alt="%s"></a><figcaption>%s</figcaption></figure>
+`, full, name, thumb, name, name)
+	}
+	b.WriteString("</div>\n</body>\n</html>\n")
+	return b.Bytes()
+}
+
+// galleryMarkdown is the gallery as a page for MDwiki.  Without
+// thumbnails (there are none in an export) it shows the images
+// themselves.
+func galleryMarkdown(dir string, images []string, thumbs bool) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\n", path.Base(dir))
+	for _, image := range images {
+		full, thumb := galleryLinks(dir, image)
+		if !thumbs {
+			thumb = full
+		}
+		fmt.Fprintf(&b, "[![%s](%s)](%s)\n", image, thumb, full)
+	}
+	return b.Bytes()
+}
+
+// exportGalleries writes (with -gallery) a gallery.md into each
+// directory of files that holds nothing but images and has no
+// gallery.md of its own, and removes the ones written before for
+// directories that no longer qualify.
+func (e *exporter) exportGalleries(files []string) error {
+	root := contentFS{http.Dir(e.dir)}
+	dirs := make(map[string]bool)
+	if e.gallery {
+		for _, rel := range files {
+			dirs[path.Dir(rel)] = true
+		}
+	}
+
+	galleries := make(map[string]bool)
+	for dir := range dirs {
+		rel := path.Join(dir, "gallery.md")
+		if e.modTime(rel) != 0 {
+			continue
+		}
+		urlDir := strings.TrimSuffix("/"+strings.TrimPrefix(dir, "."), "/") + "/"
+		images := imageDirectory(root, urlDir)
+		if len(images) == 0 {
+			continue
+		}
+		galleries[rel] = true
+		md := galleryMarkdown(urlDir, images, false)
+		dst := filepath.Join(e.out, filepath.FromSlash(rel))
+		if old, err := ioutil.ReadFile(dst); err == nil && bytes.Equal(old, md) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(e.dir, filepath.FromSlash(dir)))
+		if err != nil {
+			return err
+		}
+		if err := e.write(dst, md, info); err != nil {
+			return err
+		}
+		var sources []string
+		for _, image := range images {
+			sources = append(sources, path.Join(dir, image))
+		}
+		e.record(rel, sources...)
+	}
+
+	e.Lock()
+	var gone []string
+	for out, r := range e.manifest {
+		if _, own := r.Sources[out]; path.Base(out) == "gallery.md" && !own && !galleries[out] {
+			gone = append(gone, out)
+		}
+	}
+	e.Unlock()
+	for _, out := range gone {
+		log.Info("removing %s from the export", out)
+		if err := os.Remove(filepath.Join(e.out, filepath.FromSlash(out))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		e.Lock()
+		delete(e.manifest, out)
+		e.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the glossary, at the top of the content directory
+const glossaryFileName = "glossary.md"
+
+var (
+	// "- Term: definition", optionally with the term in bold
+	glossaryItemRegexp = regexp.MustCompile(`^\s*[-*+]\s+\*{0,2}([^*:]+?)\*{0,2}:\*{0,2}\s+(.+?)\s*$`)
+	// ": definition", following the term on a line of its own
+	glossaryDefinitionRegexp = regexp.MustCompile(`^:\s+(.+?)\s*$`)
+
+	// two or more capitals (and digits), like HTML or MP3
+	acronymRegexp = regexp.MustCompile(`\b[A-Z][A-Z0-9]*[A-Z][A-Z0-9]*\b`)
+)
+
+// capitalized words that aren't acronyms, or don't need defining
+var notAcronyms = map[string]bool{
+	"TODO": true, "FIXME": true, "XXX": true, "NOTE": true, "OK": true,
+	"TOC": true,
+}
+
+// A glossaryTerm is a term defined in the glossary.
+type glossaryTerm struct {
+	Term       string `json:"term"`
+	Definition string `json:"definition"`
+}
+
+// parseGlossary reads the terms from the glossary, written either as a
+// list of "Term: definition" items or as a definition list.
+func parseGlossary(md []byte) []glossaryTerm {
+	if m := frontMatterRegexp.FindIndex(md); m != nil {
+		md = md[m[1]:]
+	}
+	var terms []glossaryTerm
+	last := ""
+	for _, line := range strings.Split(string(md), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := glossaryItemRegexp.FindStringSubmatch(line); m != nil {
+			terms = append(terms, glossaryTerm{strings.TrimSpace(m[1]), m[2]})
+		} else if m := glossaryDefinitionRegexp.FindStringSubmatch(line); m != nil && last != "" {
+			terms = append(terms, glossaryTerm{last, m[1]})
+		}
+		if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") {
+			last = strings.TrimSpace(line)
+		} else {
+			last = ""
+		}
+	}
+	return terms
+}
+
+// readGlossary returns the terms in glossary.md, if there is one.
+func readGlossary() []glossaryTerm {
+	md, err := readContent(glossaryFileName)
+	if err != nil {
+		return nil
+	}
+	return parseGlossary(md)
+}
+
+// glossaryRegexp matches any of the terms, the longest first.  Terms
+// in capitals only match in capitals; the rest match in any case.
+func glossaryRegexp(terms []glossaryTerm) *regexp.Regexp {
+	var alternatives []string
+	for _, t := range terms {
+		q := regexp.QuoteMeta(t.Term)
+		if strings.ToUpper(t.Term) != t.Term {
+			q = "(?i:" + q + ")"
+		}
+		alternatives = append(alternatives, q)
+	}
+	sort.SliceStable(alternatives, func(i, j int) bool { return len(alternatives[i]) > len(alternatives[j]) })
+	return regexp.MustCompile(`\b(?:` + strings.Join(alternatives, "|") + `)\b`)
+}
+
+// plainDefinition is a definition without its Markdown, for a tooltip.
+func plainDefinition(def string) string {
+	def = summaryLinkRegexp.ReplaceAllString(def, "$1")
+	return summaryMarkupRegexp.ReplaceAllString(def, "")
+}
+
+// processGlossary wraps (with -glossary) the first use of each term in
+// a page in an abbr element with its definition as the title, leaving
+// headings, code and links alone.
+func processGlossary(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if !*flagGlossary || ctx.Path == glossaryFileName || path.Base(ctx.Path) == "navigation.md" {
+		return in, nil
+	}
+	ctx.Depends(glossaryFileName)
+	terms := readGlossary()
+	if len(terms) == 0 {
+		return in, nil
+	}
+	definitions := make(map[string]string)
+	for _, t := range terms {
+		definitions[strings.ToLower(t.Term)] = plainDefinition(t.Definition)
+	}
+	re := glossaryRegexp(terms)
+
+	used := make(map[string]bool)
+	wrap := func(text string) string {
+		return re.ReplaceAllStringFunc(text, func(term string) string {
+			key := strings.ToLower(term)
+			if used[key] {
+				return term
+			}
+			used[key] = true
+			return `<abbr title="` + html.EscapeString(definitions[key]) + `">` + term + `</abbr>`
+		})
+	}
+
+	lines := strings.SplitAfter(string(in), "\n")
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range typographySkipRegexp.FindAllStringIndex(line, -1) {
+			b.WriteString(wrap(line[last:m[0]]))
+			b.WriteString(line[m[0]:m[1]])
+			last = m[1]
+		}
+		b.WriteString(wrap(line[last:]))
+		lines[i] = b.String()
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// A glossaryReport is /_api/glossary: the terms, the acronyms used
+// without being defined (with the pages that use them), and the terms
+// no page uses.
+type glossaryReport struct {
+	Terms     []glossaryTerm      `json:"terms"`
+	Undefined map[string][]string `json:"undefined"`
+	Unused    []string            `json:"unused"`
+}
+
+func (s *siteIndex) glossaryReport() glossaryReport {
+	terms := readGlossary()
+	report := glossaryReport{Terms: terms, Undefined: make(map[string][]string), Unused: []string{}}
+	if report.Terms == nil {
+		report.Terms = []glossaryTerm{}
+	}
+	defined := make(map[string]bool)
+	used := make(map[string]bool)
+	for _, t := range terms {
+		defined[strings.ToLower(t.Term)] = true
+	}
+	var re *regexp.Regexp
+	if len(terms) > 0 {
+		re = glossaryRegexp(terms)
+	}
+
+	for _, p := range s.sortedPages() {
+		if p.Path == glossaryFileName {
+			continue
+		}
+		md, err := readContent(p.Path)
+		if err != nil {
+			continue
+		}
+		if m := frontMatterRegexp.FindIndex(md); m != nil {
+			md = md[m[1]:]
+		}
+		seen := make(map[string]bool)
+		inFence := false
+		for _, line := range strings.Split(string(md), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "```") {
+				inFence = !inFence
+				continue
+			}
+			if inFence {
+				continue
+			}
+			line = typographySkipRegexp.ReplaceAllString(line, " ")
+			if re != nil {
+				for _, t := range re.FindAllString(line, -1) {
+					used[strings.ToLower(t)] = true
+				}
+			}
+			for _, a := range acronymRegexp.FindAllString(line, -1) {
+				if !defined[strings.ToLower(a)] && !notAcronyms[a] && !seen[a] {
+					seen[a] = true
+					report.Undefined[a] = append(report.Undefined[a], p.Path)
+				}
+			}
+		}
+	}
+	for _, t := range terms {
+		if !used[strings.ToLower(t.Term)] {
+			report.Unused = append(report.Unused, t.Term)
+		}
+	}
+	return report
+}
+
+// glossaryHandler serves /_api/glossary, the glossary consistency
+// report, naming only the pages the user may read.
+func glossaryHandler(w http.ResponseWriter, r *http.Request) {
+	report := site.glossaryReport()
+	for a, pages := range report.Undefined {
+		if readable := readablePages(r, pages); len(readable) > 0 {
+			report.Undefined[a] = readable
+		} else {
+			delete(report.Undefined, a)
+		}
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// /_graphql answers GraphQL queries over the index, so that dashboards
+// and gimmicks can ask for exactly what they need.  Only queries are
+// understood (there's nothing to mutate), without fragments,
+// directives or introspection.  The schema is:
+//
+//	type Query {
+//	  pages(prefix: String, tag: String): [Page!]!  # sorted by path
+//	  page(path: String!): Page
+//	}
+//
+//	type Page {
+//	  path: String!
+//	  title: String!
+//	  headings: [Heading!]!
+//	  links: [String!]!   # local link targets, as written
+//	  tags: [String!]!
+//	  frontmatter: JSON   # the front matter, as an object
+//	  content: String!    # the Markdown, without the front matter
+//	  summary: String!
+//	  image: String
+//	  words: Int!
+//	  readingTime: Int!   # minutes
+//	  mtime: String!      # RFC 3339
+//	}
+//
+//	type Heading {
+//	  level: Int!
+//	  text: String!
+//	}
+
+// A gqlField is a field in a selection set.
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*gqlField
+}
+
+// A gqlVariable is a $variable reference, resolved when the query is
+// run.
+type gqlVariable string
+
+// A gqlOperation is a query in a document.
+type gqlOperation struct {
+	name       string
+	defaults   map[string]interface{}
+	selections []*gqlField
+}
+
+// gqlParser is a recursive descent parser for the GraphQL we
+// understand.
+type gqlParser struct {
+	src  string
+	pos  int
+	tok  string // the current token; strings keep their quotes
+	kind byte   // 'n'ame, 's'tring, '0' number, 'p'unctuation, or 0 at the end
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// next moves on to the next token, skipping white space, commas and
+// comments.
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+	start := p.pos
+	if p.pos == len(p.src) {
+		p.tok, p.kind = "", 0
+		return nil
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.kind = 'n'
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		p.kind = '0'
+	case c == '"':
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			if p.pos < len(p.src) && p.src[p.pos] == '\n' {
+				return p.errorf("unterminated string")
+			}
+			p.pos++
+		}
+		if p.pos == len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		p.pos++
+		p.kind = 's'
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.kind = 'p'
+	case strings.IndexByte("{}():!$[]=@", c) >= 0:
+		p.pos++
+		p.kind = 'p'
+	default:
+		return p.errorf("unexpected %q", c)
+	}
+	p.tok = p.src[start:p.pos]
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// expect consumes the punctuation tok.
+func (p *gqlParser) expect(tok string) error {
+	if p.kind != 'p' || p.tok != tok {
+		return p.errorf("expected %s, found %q", tok, p.tok)
+	}
+	return p.next()
+}
+
+// name consumes a name.
+func (p *gqlParser) name() (string, error) {
+	if p.kind != 'n' {
+		return "", p.errorf("expected a name, found %q", p.tok)
+	}
+	name := p.tok
+	return name, p.next()
+}
+
+// parseGraphQL parses a document and returns its operations.
+func parseGraphQL(src string) ([]*gqlOperation, error) {
+	p := &gqlParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var ops []*gqlOperation
+	for p.kind != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, p.errorf("no operations")
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{defaults: make(map[string]interface{})}
+	if p.kind == 'n' {
+		switch p.tok {
+		case "query":
+		case "mutation", "subscription":
+			return nil, p.errorf("only queries are supported")
+		case "fragment":
+			return nil, p.errorf("fragments aren't supported")
+		default:
+			return nil, p.errorf("unexpected %q", p.tok)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.kind == 'n' {
+			op.name = p.tok
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if p.kind == 'p' && p.tok == "(" {
+			if err := p.variableDefinitions(op); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+// variableDefinitions parses ($name: Type = default, ...), keeping the
+// defaults.  Types aren't checked.
+func (p *gqlParser) variableDefinitions(op *gqlOperation) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !(p.kind == 'p' && p.tok == ")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		for p.kind == 'n' || p.kind == 'p' && strings.Contains("[]!", p.tok) {
+			if err := p.next(); err != nil {
+				return err
+			}
+		}
+		if p.kind == 'p' && p.tok == "=" {
+			if err := p.next(); err != nil {
+				return err
+			}
+			if op.defaults[name], err = p.value(); err != nil {
+				return err
+			}
+		}
+	}
+	return p.expect(")")
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []*gqlField
+	for !(p.kind == 'p' && p.tok == "}") {
+		if p.kind == 'p' && p.tok == "..." {
+			return nil, p.errorf("fragments aren't supported")
+		}
+		if p.kind == 'p' && p.tok == "@" {
+			return nil, p.errorf("directives aren't supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, p.expect("}")
+}
+
+func (p *gqlParser) field() (*gqlField, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	f := &gqlField{alias: name, name: name, args: make(map[string]interface{})}
+	if p.kind == 'p' && p.tok == ":" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if f.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.kind == 'p' && p.tok == "(" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !(p.kind == 'p' && p.tok == ")") {
+			arg, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if f.args[arg], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.kind == 'p' && p.tok == "{" {
+		if f.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// value parses a literal or a variable reference.  Lists are
+// understood, input objects aren't.
+func (p *gqlParser) value() (interface{}, error) {
+	var v interface{}
+	switch {
+	case p.kind == 'p' && p.tok == "$":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case p.kind == 'p' && p.tok == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !(p.kind == 'p' && p.tok == "]") {
+			e, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, e)
+		}
+		return list, p.next()
+	case p.kind == 's':
+		s, err := strconv.Unquote(p.tok)
+		if err != nil {
+			return nil, p.errorf("bad string %s", p.tok)
+		}
+		v = s
+	case p.kind == '0':
+		n, err := strconv.ParseFloat(p.tok, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %s", p.tok)
+		}
+		v = n
+	case p.kind == 'n' && p.tok == "true":
+		v = true
+	case p.kind == 'n' && p.tok == "false":
+		v = false
+	case p.kind == 'n' && p.tok == "null":
+		v = nil
+	case p.kind == 'n':
+		v = p.tok // an enum value
+	default:
+		return nil, p.errorf("expected a value, found %q", p.tok)
+	}
+	return v, p.next()
+}
+
+// A gqlObject is a result object, which keeps its fields in the order
+// they were asked for.
+type gqlObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *gqlObject) set(key string, v interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(o.values[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// a gqlQuery is an operation being run
+type gqlQuery struct {
+	index     *siteIndex
+	variables map[string]interface{}
+	readable  func(rel string) bool // the pages the query may see
+}
+
+// arg returns a field's argument as a string, with variables resolved.
+func (q *gqlQuery) arg(f *gqlField, name string) (string, bool, error) {
+	v, ok := f.args[name]
+	if ref, isRef := v.(gqlVariable); isRef {
+		v, ok = q.variables[string(ref)]
+	}
+	if !ok || v == nil {
+		return "", false, nil
+	}
+	s, isString := v.(string)
+	if !isString {
+		return "", false, fmt.Errorf("argument %s of %s must be a string", name, f.name)
+	}
+	return s, true, nil
+}
+
+// object resolves a selection set with resolve, which knows the
+// fields of one type.
+func (q *gqlQuery) object(typeName string, selections []*gqlField,
+	resolve func(f *gqlField) (interface{}, bool, error)) (*gqlObject, error) {
+	o := &gqlObject{values: make(map[string]interface{})}
+	for _, f := range selections {
+		if f.name == "__typename" {
+			o.set(f.alias, typeName)
+			continue
+		}
+		v, ok, err := resolve(f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("cannot query field %q on type %q", f.name, typeName)
+		}
+		o.set(f.alias, v)
+	}
+	return o, nil
+}
+
+// leaf checks that a scalar field hasn't been given a selection set.
+func leaf(f *gqlField, v interface{}) (interface{}, bool, error) {
+	if f.selections != nil {
+		return nil, false, fmt.Errorf("field %q is a scalar and can't have a selection", f.name)
+	}
+	return v, true, nil
+}
+
+// composite checks that an object field has been given a selection set.
+func composite(f *gqlField) error {
+	if f.selections == nil {
+		return fmt.Errorf("field %q needs a selection of subfields", f.name)
+	}
+	return nil
+}
+
+func (q *gqlQuery) root(f *gqlField) (interface{}, bool, error) {
+	switch f.name {
+	case "pages":
+		if err := composite(f); err != nil {
+			return nil, false, err
+		}
+		prefix, _, err := q.arg(f, "prefix")
+		if err != nil {
+			return nil, false, err
+		}
+		tag, _, err := q.arg(f, "tag")
+		if err != nil {
+			return nil, false, err
+		}
+		pages := []interface{}{}
+		for _, p := range q.index.sortedPages() {
+			if !strings.HasPrefix(p.Path, strings.TrimPrefix(prefix, "/")) ||
+				(tag != "" && !hasTags(p, []string{tag})) || !q.readable(p.Path) {
+				continue
+			}
+			o, err := q.page(p, f.selections)
+			if err != nil {
+				return nil, false, err
+			}
+			pages = append(pages, o)
+		}
+		return pages, true, nil
+	case "page":
+		if err := composite(f); err != nil {
+			return nil, false, err
+		}
+		rel, ok, err := q.arg(f, "path")
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return nil, false, fmt.Errorf("page needs a path")
+		}
+		q.index.RLock()
+		p := q.index.pages[strings.TrimPrefix(rel, "/")]
+		q.index.RUnlock()
+		if p == nil || !q.readable(p.Path) {
+			return nil, true, nil
+		}
+		o, err := q.page(p, f.selections)
+		return o, err == nil, err
+	}
+	return nil, false, nil
+}
+
+func (q *gqlQuery) page(p *page, selections []*gqlField) (*gqlObject, error) {
+	// the source is only read if content or front matter is asked for
+	var source []byte
+	var meta interface{}
+	read := func() error {
+		if source != nil {
+			return nil
+		}
+		md, err := readContent(p.Path)
+		if err != nil {
+			return err
+		}
+		source = md
+		if m := frontMatterRegexp.FindSubmatchIndex(md); m != nil {
+			source = md[m[1]:]
+			if m[2] >= 0 {
+				if err := yaml.Unmarshal(md[m[2]:m[3]], &meta); err != nil {
+					log.Warning("ignoring bad front matter in %s: %s", p.Path, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	return q.object("Page", selections, func(f *gqlField) (interface{}, bool, error) {
+		switch f.name {
+		case "path":
+			return leaf(f, p.Path)
+		case "title":
+			return leaf(f, p.Title)
+		case "links":
+			links := p.Links
+			if links == nil {
+				links = []string{}
+			}
+			return leaf(f, links)
+		case "tags":
+			return leaf(f, p.Tags)
+		case "summary":
+			return leaf(f, p.Summary)
+		case "image":
+			if p.Image == "" {
+				return leaf(f, nil)
+			}
+			return leaf(f, p.Image)
+		case "words":
+			return leaf(f, p.Words)
+		case "readingTime":
+			return leaf(f, p.ReadingTime())
+		case "mtime":
+			return leaf(f, p.ModTime.Format(time.RFC3339))
+		case "content":
+			if err := read(); err != nil {
+				return nil, false, err
+			}
+			return leaf(f, string(source))
+		case "frontmatter":
+			if err := read(); err != nil {
+				return nil, false, err
+			}
+			if meta == nil {
+				return leaf(f, nil)
+			}
+			return leaf(f, jsonCompatible(meta))
+		case "headings":
+			if err := composite(f); err != nil {
+				return nil, false, err
+			}
+			headings := []interface{}{}
+			for _, h := range p.Headings {
+				h := h
+				o, err := q.object("Heading", f.selections, func(f *gqlField) (interface{}, bool, error) {
+					switch f.name {
+					case "level":
+						return leaf(f, h.Level)
+					case "text":
+						return leaf(f, h.Text)
+					}
+					return nil, false, nil
+				})
+				if err != nil {
+					return nil, false, err
+				}
+				headings = append(headings, o)
+			}
+			return headings, true, nil
+		}
+		return nil, false, nil
+	})
+}
+
+// runGraphQL runs the named operation (or the only one) in a parsed
+// document.
+func runGraphQL(index *siteIndex, ops []*gqlOperation, operationName string,
+	variables map[string]interface{}, readable func(rel string) bool) (*gqlObject, error) {
+	var op *gqlOperation
+	for _, o := range ops {
+		if o.name == operationName || operationName == "" && len(ops) == 1 {
+			op = o
+		}
+	}
+	if op == nil {
+		if operationName == "" {
+			return nil, fmt.Errorf("the document has several operations, name one")
+		}
+		return nil, fmt.Errorf("no operation named %q", operationName)
+	}
+
+	q := &gqlQuery{index: index, variables: make(map[string]interface{}), readable: readable}
+	for k, v := range op.defaults {
+		q.variables[k] = v
+	}
+	for k, v := range variables {
+		q.variables[k] = v
+	}
+	return q.object("Query", op.selections, q.root)
+}
+
+// a GraphQL request, as POSTed
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// a GraphQL response
+type gqlResponse struct {
+	Data   *gqlObject        `json:"data,omitempty"`
+	Errors []gqlErrorMessage `json:"errors,omitempty"`
+}
+
+type gqlErrorMessage struct {
+	Message string `json:"message"`
+}
+
+// graphqlHandler serves /_graphql, taking the query as JSON in a POST
+// or in the query string of a GET.
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req gqlRequest
+	switch r.Method {
+	case "GET":
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "bad variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// a query that doesn't parse is a bad request; one that fails when
+	// it's run is answered with the error and no data
+	var resp gqlResponse
+	status := http.StatusOK
+	ops, err := parseGraphQL(req.Query)
+	if err == nil {
+		resp.Data, err = runGraphQL(site, ops, req.OperationName, req.Variables,
+			func(rel string) bool { return canRead(r, rel) })
+	} else {
+		status = http.StatusBadRequest
+	}
+	if err != nil {
+		resp.Errors = []gqlErrorMessage{{err.Error()}}
+	}
+
+	b, err := json.MarshalIndent(resp, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(b)
+	maybeBail(err)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// The types below are the parts of the HTTP Archive (HAR) 1.2 format
+// that we record, plus Chrome's _webSocketMessages for the reloader's
+// traffic.
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // milliseconds
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+
+	WebSocketMessages []harWebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harWebSocketMessage struct {
+	Type   string  `json:"type"` // send or receive, from the browser's point of view
+	Time   float64 `json:"time"` // seconds since the epoch
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+// the recording made with -record
+var harRecording = struct {
+	sync.Mutex
+	log   harLog
+	dirty bool
+}{log: harLog{Version: "1.2", Creator: harCreator{"mdwiki-dev-server", "dev"}}}
+
+// the request context key for a request's entry
+type harEntryKey struct{}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, harNameValue{name, v})
+		}
+	}
+	return headers
+}
+
+// harBody fills in recorded content, leaving out bodies over the
+// -record-max-body limit and base64 encoding binary ones.
+func harBody(body []byte, size int, contentType string) harContent {
+	c := harContent{Size: size, MimeType: contentType}
+	switch {
+	case size > *flagRecordMaxBody:
+		c.Comment = fmt.Sprintf("body of %d bytes not recorded", size)
+	case utf8.Valid(body):
+		c.Text = string(body)
+	default:
+		c.Text = base64.StdEncoding.EncodeToString(body)
+		c.Encoding = "base64"
+	}
+	return c
+}
+
+// milliseconds returns d in the HAR's unit.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// a harResponseWriter keeps a copy of what's written, up to the body
+// limit.
+type harResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	size      int
+	body      bytes.Buffer
+	firstByte time.Time
+}
+
+func (w *harResponseWriter) WriteHeader(code int) {
+	if code < 200 {
+		// informational, e.g. 103 Early Hints: the response is to come
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+		w.firstByte = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *harResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.size += len(b)
+	if w.body.Len()+len(b) <= *flagRecordMaxBody {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack lets the reloader's websocket through.
+func (w *harResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("can't hijack the connection")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+		w.firstByte = time.Now()
+	}
+	return h.Hijack()
+}
+
+// recordTraffic wraps a handler so that every request and response is
+// added to the -record HAR file.  Websocket connections are recorded
+// when they close, with the messages that went each way.
+func recordTraffic(h http.Handler) http.Handler {
+	if *flagRecord == "" {
+		return h
+	}
+	go saveRecording()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &harEntry{StartedDateTime: start}
+
+		var reqBody []byte
+		if r.Body != nil {
+			var err error
+			reqBody, err = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		}
+		url := "http://" + r.Host + r.URL.RequestURI()
+		entry.Request = harRequest{
+			Method:      r.Method,
+			URL:         url,
+			HTTPVersion: r.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(r.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		}
+		for name, values := range r.URL.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, v})
+			}
+		}
+		if len(reqBody) > 0 {
+			entry.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type")}
+			if len(reqBody) > *flagRecordMaxBody {
+				entry.Request.PostData.Comment = fmt.Sprintf("body of %d bytes not recorded", len(reqBody))
+			} else {
+				entry.Request.PostData.Text = string(reqBody)
+			}
+		}
+
+		recorder := &harResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), harEntryKey{}, entry)))
+		end := time.Now()
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+			recorder.firstByte = end
+		}
+
+		harRecording.Lock()
+		defer harRecording.Unlock()
+		entry.Time = milliseconds(end.Sub(start))
+		entry.Timings = harTimings{
+			Wait:    milliseconds(recorder.firstByte.Sub(start)),
+			Receive: milliseconds(end.Sub(recorder.firstByte)),
+		}
+		entry.Response = harResponse{
+			Status:      recorder.status,
+			StatusText:  http.StatusText(recorder.status),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(w.Header()),
+			Content:     harBody(recorder.body.Bytes(), recorder.size, w.Header().Get("Content-Type")),
+			RedirectURL: w.Header().Get("Location"),
+			HeadersSize: -1,
+			BodySize:    recorder.size,
+		}
+		harRecording.log.Entries = append(harRecording.log.Entries, entry)
+		harRecording.dirty = true
+	})
+}
+
+// recordWebSocketMessage adds a message to the recording of the
+// websocket it went over.
+func recordWebSocketMessage(ws *websocket.Conn, direction string, data string) {
+	entry, ok := ws.Request().Context().Value(harEntryKey{}).(*harEntry)
+	if !ok {
+		return
+	}
+	harRecording.Lock()
+	defer harRecording.Unlock()
+	entry.WebSocketMessages = append(entry.WebSocketMessages, harWebSocketMessage{
+		Type:   direction,
+		Time:   float64(time.Now().UnixNano()) / float64(time.Second),
+		Opcode: 1,
+		Data:   data,
+	})
+}
+
+// sendMessage sends a message to a client, recording it as received
+// by the browser.
+func sendMessage(ws *websocket.Conn, m string) error {
+	recordWebSocketMessage(ws, "receive", m)
+	return websocket.Message.Send(ws, m)
+}
+
+// receiveMessage receives a message from a client, recording it as
+// sent by the browser.
+func receiveMessage(ws *websocket.Conn, m *string) error {
+	if err := websocket.Message.Receive(ws, m); err != nil {
+		return err
+	}
+	recordWebSocketMessage(ws, "send", *m)
+	return nil
+}
+
+// writeRecording writes the HAR file, if anything's been recorded since
+// it was last written.
+func writeRecording() {
+	harRecording.Lock()
+	defer harRecording.Unlock()
+	if !harRecording.dirty {
+		return
+	}
+	b, err := json.MarshalIndent(harFile{harRecording.log}, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(*flagRecord, b, 0644)
+	}
+	if err != nil {
+		log.Error("unable to write %s: %s", *flagRecord, err)
+		return
+	}
+	harRecording.dirty = false
+}
+
+// saveRecording keeps the HAR file up to date, writing it once more
+// on the way out when the server is stopped.
+func saveRecording() {
+	log.Notice("recording traffic to %s", *flagRecord)
+	onShutdown(func() {
+		writeRecording()
+		harRecording.Lock()
+		log.Notice("recorded %d requests to %s", len(harRecording.log.Entries), *flagRecord)
+		harRecording.Unlock()
+	})
+	for range time.Tick(time.Second) {
+		writeRecording()
+	}
+}
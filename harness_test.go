@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"gopkg.in/fsnotify.v1"
+)
+
+// The end-to-end harness: the whole server, in-process, serving a
+// content directory of its own, changes to which reach it as soon as
+// they're made (rather than whenever the OS's watcher gets round to
+// them), and a client for /_reloader, for tests of what browsers see.
+// The server's handlers are registered once, on the default ServeMux,
+// so one server is shared by every test; each should use files of its
+// own.
+
+// A testServer is the server under test.
+type testServer struct {
+	URL     string
+	dir     string
+	watcher *fakeTreeWatcher
+	handled chan struct{} // each change, once the handlers are through with it
+}
+
+var harness struct {
+	once   sync.Once
+	server *testServer
+	err    error
+}
+
+// startServer returns the server for the tests, starting it the first
+// time.
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	harness.once.Do(func() {
+		dir, err := ioutil.TempDir("", "mdwds-test")
+		if err != nil {
+			harness.err = err
+			return
+		}
+		*flagContentDir = dir
+		if harness.err = compileNotifyRegexp(); harness.err != nil {
+			return
+		}
+		if site, harness.err = newSiteIndex(dir); harness.err != nil {
+			return
+		}
+		s := &testServer{dir: dir, watcher: newFakeTreeWatcher(), handled: make(chan struct{})}
+		onContentChange(site.contentChanged)
+		onContentChange(broadcastChange)
+		onContentChange(func(fsnotify.Event, string) { s.handled <- struct{}{} })
+		go dispatchChanges(dir, s.watcher)
+		s.URL = httptest.NewServer(serverHandler()).URL
+		harness.server = s
+	})
+	if harness.err != nil {
+		t.Fatalf("unable to start the server: %s", harness.err)
+	}
+	if *flagContentDir != harness.server.dir {
+		// another test pointed it elsewhere
+		*flagContentDir = harness.server.dir
+	}
+	return harness.server
+}
+
+// touch writes content to rel, below the content directory, and tells
+// the server it's changed, as the watcher would, returning once the
+// server's handled the change (so that a test can change the config,
+// say, without racing it).
+func (s *testServer) touch(t *testing.T, rel string, content string) {
+	t.Helper()
+	name := filepath.Join(s.dir, filepath.FromSlash(rel))
+	op := fsnotify.Write
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		op = fsnotify.Create
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.watcher.Send(fsnotify.Event{Name: name, Op: op})
+	select {
+	case <-s.handled:
+	case <-time.After(messageTimeout):
+		t.Fatalf("the server never handled the change to %s", rel)
+	}
+}
+
+// A testClient is a connection to /_reloader, as the snippet makes.
+type testClient struct {
+	ws       *websocket.Conn
+	messages chan map[string]interface{}
+}
+
+// dial connects a client to the server's /_reloader, which is closed
+// when the test ends, waiting for the server to let go of it (and so
+// of the config, which the next test may change).
+func (s *testServer) dial(t *testing.T) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/_reloader"
+	ws, err := websocket.Dial(url, "", s.URL)
+	if err != nil {
+		t.Fatalf("unable to connect to %s: %s", url, err)
+	}
+	c := &testClient{ws: ws, messages: make(chan map[string]interface{}, 16)}
+	go func() {
+		defer close(c.messages)
+		for {
+			var m string
+			if err := websocket.Message.Receive(ws, &m); err != nil {
+				return
+			}
+			var decoded map[string]interface{}
+			if json.Unmarshal([]byte(m), &decoded) == nil {
+				c.messages <- decoded
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		ws.Close()
+		for deadline := time.Now().Add(messageTimeout); len(clientsSnapshot()) > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Errorf("the server kept %d clients after they'd gone", len(clientsSnapshot()))
+				return
+			}
+		}
+	})
+	return c
+}
+
+// send sends the server v, as JSON.
+func (c *testClient) send(t *testing.T, v interface{}) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.Message.Send(c.ws, string(b)); err != nil {
+		t.Fatalf("unable to send %s: %s", b, err)
+	}
+}
+
+// waitFor returns the next message with key in it, failing the test
+// if none comes within timeout.
+func (c *testClient) waitFor(t *testing.T, key string, timeout time.Duration) map[string]interface{} {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m, ok := <-c.messages:
+			if !ok {
+				t.Fatalf("the server closed the connection before sending %q", key)
+			}
+			if _, found := m[key]; found {
+				return m
+			}
+		case <-deadline:
+			t.Fatalf("no %q message after %s", key, timeout)
+		}
+	}
+}
+
+// expectNone fails the test if a message with key in it comes within
+// d.
+func (c *testClient) expectNone(t *testing.T, key string, d time.Duration) {
+	t.Helper()
+	deadline := time.After(d)
+	for {
+		select {
+		case m, ok := <-c.messages:
+			if !ok {
+				return
+			}
+			if _, found := m[key]; found {
+				t.Fatalf("unexpected %q message: %v", key, m)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// the stylesheet for -highlight-classes, served and exported under
+// this name
+const highlightCSSName = "_highlight.css"
+
+// a fenced code block's opening line, with its language
+var codeFenceRegexp = regexp.MustCompile("^```[ \t]*([A-Za-z0-9_+#.-]+)")
+
+// checkHighlightStyle makes sure -highlight names a chroma style.
+func checkHighlightStyle() error {
+	if *flagHighlight == "" {
+		return nil
+	}
+	if _, ok := styles.Registry[strings.ToLower(*flagHighlight)]; !ok {
+		return fmt.Errorf("unknown -highlight style %q, try one of %s", *flagHighlight,
+			strings.Join(styles.Names(), ", "))
+	}
+	return nil
+}
+
+func highlightFormatter() *chromahtml.Formatter {
+	return chromahtml.New(chromahtml.WithClasses(*flagHighlightClasses), chromahtml.TabWidth(4))
+}
+
+// highlightCode returns a code block as highlighted HTML, or false if
+// there's no lexer for its language.
+func highlightCode(lang string, code string) (string, bool) {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return "", false
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		log.Warning("unable to highlight %s code: %s", lang, err)
+		return "", false
+	}
+	var b bytes.Buffer
+	if err := highlightFormatter().Format(&b, styles.Get(*flagHighlight), iterator); err != nil {
+		log.Warning("unable to highlight %s code: %s", lang, err)
+		return "", false
+	}
+
+	// a blank line would end the HTML block for MDwiki's Markdown
+	// parser, so blank lines are written as character references
+	s := strings.TrimRight(b.String(), "\n")
+	for strings.Contains(s, "\n\n") {
+		s = strings.Replace(s, "\n\n", "\n&#10;", -1)
+	}
+	return s + "\n", true
+}
+
+// processHighlight replaces fenced code blocks with highlighted HTML
+// in -render pages and exports; MDwiki does its own highlighting
+// otherwise.  Fences whose language isn't known are left alone.
+func processHighlight(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if *flagHighlight == "" || !(ctx.Export || *flagRender) {
+		return in, nil
+	}
+	lines := strings.SplitAfter(string(in), "\n")
+	var out bytes.Buffer
+	for i := 0; i < len(lines); i++ {
+		m := codeFenceRegexp.FindStringSubmatch(strings.TrimRight(lines[i], "\r\n"))
+		if m == nil {
+			out.WriteString(lines[i])
+			continue
+		}
+
+		end := i + 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+			end++
+		}
+		if end == len(lines) {
+			// unterminated fence, leave it for MDwiki to deal with
+			out.WriteString(lines[i])
+			continue
+		}
+		highlighted, ok := highlightCode(m[1], strings.Join(lines[i+1:end], ""))
+		if !ok {
+			out.WriteString(lines[i])
+			continue
+		}
+		out.WriteString(highlighted)
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// highlightCSS is the stylesheet for -highlight-classes.
+func highlightCSS() []byte {
+	var b bytes.Buffer
+	if err := highlightFormatter().WriteCSS(&b, styles.Get(*flagHighlight)); err != nil {
+		log.Error("unable to write the highlighting stylesheet: %s", err)
+	}
+	return b.Bytes()
+}
+
+// highlightCSSHandler serves /_highlight.css.
+func highlightCSSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	_, err := w.Write(highlightCSS())
+	maybeBail(err)
+}
+
+// exportHighlightCSS writes the stylesheet for -highlight-classes into
+// the export, for the site's pages to link to.
+func (e *exporter) exportHighlightCSS() error {
+	if *flagHighlight == "" || !*flagHighlightClasses {
+		return nil
+	}
+	css := highlightCSS()
+	name := filepath.Join(e.out, highlightCSSName)
+	if old, err := ioutil.ReadFile(name); err == nil && bytes.Equal(old, css) {
+		return nil
+	}
+	log.Info("writing %s", name)
+	return ioutil.WriteFile(name, css, 0644)
+}
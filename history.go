@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// history keeps at most this many entries, dropping the oldest
+const historyLimit = 10000
+
+// git diffs attached to history entries are cut off at this many bytes
+const historyDiffLimit = 64 * 1024
+
+// A historyEntry records one change seen by the watcher.
+type historyEntry struct {
+	Time time.Time `json:"time"`
+	File string    `json:"file"`
+	Op   string    `json:"op"`
+	Diff string    `json:"diff,omitempty"`
+}
+
+// history is everything that changed during this server session.
+var history struct {
+	sync.Mutex
+	entries []historyEntry
+}
+
+// recordHistory records a change below the content directory, with
+// its git diff if -history-diffs is set.
+func recordHistory(event fsnotify.Event, rel string) {
+	entry := historyEntry{time.Now(), rel, event.Op.String(), ""}
+	if *flagHistoryDiffs {
+		entry.Diff = gitDiff(*flagContentDir, filepath.FromSlash(rel))
+	}
+
+	history.Lock()
+	history.entries = append(history.entries, entry)
+	if len(history.entries) > historyLimit {
+		history.entries = history.entries[len(history.entries)-historyLimit:]
+	}
+	history.Unlock()
+}
+
+// gitDiff returns the uncommitted changes to a file, or "" if there
+// aren't any (or it isn't in a git repository).
+func gitDiff(dir string, rel string) string {
+	out, err := exec.Command("git", "-C", dir, "diff", "--no-color", "--", rel).Output()
+	if err != nil {
+		return ""
+	}
+	if len(out) > historyDiffLimit {
+		out = append(out[:historyDiffLimit], "\n[diff truncated]\n"...)
+	}
+	return string(out)
+}
+
+// historySnapshot returns the entries, newest first.
+func historySnapshot() []historyEntry {
+	history.Lock()
+	defer history.Unlock()
+	entries := make([]historyEntry, len(history.entries))
+	for i, e := range history.entries {
+		entries[len(entries)-1-i] = e
+	}
+	return entries
+}
+
+// readableHistory returns the entries, newest first, leaving out
+// changes to files the request's user may not read.
+func readableHistory(r *http.Request) []historyEntry {
+	entries := []historyEntry{}
+	for _, e := range historySnapshot() {
+		if canRead(r, e.File) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// historyAPIHandler serves /_api/history, the session's changes as JSON.
+func historyAPIHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(readableHistory(r), "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
+
+var historyTmpl = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Session history</title>
+<style>
+body { font-family: sans-serif; }
+td { padding: 2px 8px; vertical-align: top; }
+pre { margin: 0; }
+</style>
+</head>
+<body>
+<h1>Changes since {{.Started.Format "15:04:05 Jan 2"}}</h1>
+{{if not .Entries}}<p>Nothing has changed yet.</p>{{end}}
+<table>
+{{range .Entries}}<tr>
+<td>{{.Time.Format "15:04:05"}}</td>
+<td>{{.Op}}</td>
+<td><a href="/{{.File}}">{{.File}}</a>{{if .Diff}}
+<details><summary>diff</summary><pre>{{.Diff}}</pre></details>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// the time the server started, shown at the top of the timeline
+var sessionStarted = time.Now()
+
+// historyHandler serves /_history, the session's changes as a timeline.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := historyTmpl.Execute(w, struct {
+		Started time.Time
+		Entries []historyEntry
+	}{sessionStarted, readableHistory(r)})
+	if err != nil {
+		log.Error("unable to render history: %s", err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// words per minute assumed when estimating reading time
+const readingSpeed = 200
+
+// A heading is an ATX (#-style) heading within a page.
+type heading struct {
+	Level int    `json:"level"`
+	Text  string `json:"text"`
+}
+
+// A page is what the index knows about one Markdown file.
+type page struct {
+	Path     string    `json:"path"` // relative to the content directory, with slashes
+	Title    string    `json:"title"`
+	Words    int       `json:"words"`
+	Headings []heading `json:"headings"`
+	Links    []string  `json:"links"` // local link targets, as written
+	ModTime  time.Time `json:"mtime"`
+	Summary  string    `json:"summary"` // the first paragraph, as plain text
+	Image    string    `json:"image"`   // the first image, as written
+	Tags     []string  `json:"tags"`    // from the front matter and #tags in the text
+
+	// Meta is the page's front matter.
+	Meta map[string]interface{} `json:"meta,omitempty"`
+
+	// how many times each term (a word worth comparing) appears, for
+	// related pages
+	terms map[string]int
+
+	// the fenced code blocks, for searching
+	codeBlocks []*codeBlock
+}
+
+// ReadingTime is the estimated number of minutes it takes to read the page.
+func (p *page) ReadingTime() int {
+	return (p.Words + readingSpeed - 1) / readingSpeed
+}
+
+var (
+	indexHeadingRegexp = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	indexWordRegexp    = regexp.MustCompile(`[\pL\pN][\pL\pN'’-]*`)
+
+	// inline links, reference definitions and HTML anchors
+	indexLinkRegexp = regexp.MustCompile(`\]\(\s*<?([^)\s>]+)>?[^)]*\)|^\s*\[[^\]]+\]:\s*<?(\S+?)>?(?:\s|$)|<a\s[^>]*href="([^"]+)"`)
+
+	// Markdown images and HTML img tags
+	indexImageRegexp = regexp.MustCompile(`!\[[^\]]*\]\(\s*<?([^)\s>]+)|<img\s[^>]*src="([^"]+)"`)
+
+	// markup stripped from the summary, keeping the text of links
+	summaryImageRegexp  = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)|<[^>]+>`)
+	summaryLinkRegexp   = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	summaryMarkupRegexp = regexp.MustCompile("[*_`]+")
+)
+
+// the length summaries are cut down to
+const summaryLength = 200
+
+// summarize turns a paragraph of Markdown into a plain text summary.
+func summarize(paragraph []string) string {
+	text := strings.Join(paragraph, " ")
+	text = summaryImageRegexp.ReplaceAllString(text, "")
+	text = summaryLinkRegexp.ReplaceAllString(text, "$1")
+	text = summaryMarkupRegexp.ReplaceAllString(text, "")
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > summaryLength {
+		text = strings.TrimSpace(string(runes[:summaryLength-1])) + "…"
+	}
+	return text
+}
+
+// localLink reduces a link target to the Markdown page it refers to,
+// or "" if it points somewhere else.  MDwiki style "#!page.md" links are
+// understood, and anchors and query strings are dropped.
+func localLink(target string) string {
+	target = strings.TrimPrefix(target, "#!")
+	if i := strings.Index(target, "#!"); i >= 0 {
+		target = target[i+2:]
+	}
+	if i := strings.IndexAny(target, "#?"); i >= 0 {
+		target = target[:i]
+	}
+	if strings.Contains(target, ":") || !strings.HasSuffix(target, ".md") {
+		return ""
+	}
+	return target
+}
+
+// linkCandidates returns the index paths that a link found in from
+// might refer to, in the order they're tried.  Relative links are tried
+// against from's directory first and then the content root, since
+// MDwiki wikis use both.
+func linkCandidates(from string, target string) []string {
+	target = localLink(target)
+	if target == "" {
+		return nil
+	}
+	candidates := []string{strings.TrimPrefix(path.Clean("/"+target), "/")}
+	if !strings.HasPrefix(target, "/") {
+		rel := strings.TrimPrefix(path.Clean("/"+path.Join(path.Dir(from), target)), "/")
+		if rel != candidates[0] {
+			candidates = append([]string{rel}, candidates...)
+		}
+	}
+	return candidates
+}
+
+// resolveLink returns the index path of the page a link found in from
+// refers to, or "" if there's no such page.
+func (s *siteIndex) resolveLink(from string, target string) string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.resolveLinkLocked(from, target)
+}
+
+func (s *siteIndex) resolveLinkLocked(from string, target string) string {
+	for _, c := range linkCandidates(from, target) {
+		if _, ok := s.pages[c]; ok {
+			return c
+		}
+	}
+	return ""
+}
+
+// parsePage extracts a page's title, headings, links to other pages,
+// summary, first image, word count and code blocks.  Words
+// in fenced code blocks, link targets, URLs and HTML tags don't count.
+func parsePage(rel string, md []byte) *page {
+	p := &page{Path: rel, terms: make(map[string]int)}
+	skipped := 0 // the lines of front matter
+	if m := frontMatterRegexp.FindSubmatchIndex(md); m != nil {
+		skipped = strings.Count(string(md[:m[1]]), "\n")
+		if m[2] >= 0 {
+			if err := yaml.Unmarshal(md[m[2]:m[3]], &p.Meta); err != nil {
+				log.Warning("ignoring bad front matter in %s: %s", rel, err)
+			}
+			// nested maps as well, so that it can be served as JSON
+			for k, v := range p.Meta {
+				p.Meta[k] = jsonCompatible(v)
+			}
+		}
+		md = md[m[1]:]
+	}
+	tags := append(metaStrings(p.Meta["tags"]), metaStrings(p.Meta["categories"])...)
+	inFence := false
+	var paragraph []string
+	var code *codeBlock
+	for i, line := range strings.Split(string(md), "\n") {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "```") {
+			if inFence {
+				p.codeBlocks = append(p.codeBlocks, code.finish())
+			} else {
+				code = &codeBlock{Lang: fenceLanguage(strings.TrimPrefix(trimmed, "```")), Line: skipped + i + 1}
+			}
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			code.lines = append(code.lines, line)
+			continue
+		}
+
+		// the summary is the first paragraph that has any text in it
+		if p.Summary == "" {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				p.Summary = summarize(paragraph)
+				paragraph = nil
+			} else if !strings.HasPrefix(trimmed, "[gimmick") {
+				paragraph = append(paragraph, trimmed)
+			}
+		}
+		if p.Image == "" {
+			if m := indexImageRegexp.FindStringSubmatch(line); m != nil {
+				p.Image = m[1] + m[2]
+			}
+		}
+
+		if m := indexHeadingRegexp.FindStringSubmatch(line); m != nil {
+			p.Headings = append(p.Headings, heading{len(m[1]), m[2]})
+			if p.Title == "" {
+				p.Title = m[2]
+			}
+		}
+		for _, m := range indexLinkRegexp.FindAllStringSubmatch(line, -1) {
+			for _, target := range m[1:] {
+				if localLink(target) != "" {
+					p.Links = append(p.Links, target)
+				}
+			}
+		}
+		line = spellingSkipRegexp.ReplaceAllString(line, " ")
+		for _, m := range inlineTagRegexp.FindAllStringSubmatch(line, -1) {
+			tags = append(tags, m[1])
+		}
+		words := indexWordRegexp.FindAllString(line, -1)
+		p.Words += len(words)
+		for _, w := range words {
+			if w = strings.ToLower(w); isTerm(w) {
+				p.terms[w]++
+			}
+		}
+	}
+	if inFence {
+		p.codeBlocks = append(p.codeBlocks, code.finish())
+	}
+	if p.Summary == "" {
+		p.Summary = summarize(paragraph)
+	}
+	p.Tags = normalizeTags(tags)
+	if p.Title == "" {
+		p.Title = strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel))
+	}
+	return p
+}
+
+// A siteIndex keeps track of every Markdown page in the content
+// directory.
+type siteIndex struct {
+	sync.RWMutex
+	dir   string
+	pages map[string]*page
+
+	// the pages with links that might lead to each path, whether or
+	// not there's a page there yet, for backlinks
+	linkers map[string]map[string]bool
+
+	// the number of pages each term appears in, for related pages
+	terms map[string]int
+}
+
+// site is the server's index, kept up to date by its watcher.
+var site *siteIndex
+
+// newSiteIndex indexes every Markdown file below dir.
+func newSiteIndex(dir string) (*siteIndex, error) {
+	s := &siteIndex{dir: dir, pages: make(map[string]*page), linkers: make(map[string]map[string]bool),
+		terms: make(map[string]int)}
+	err := walkMarkdown(dir, func(rel string, md []byte) error {
+		s.add(rel, md)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("indexed %d pages", len(s.pages))
+	return s, nil
+}
+
+func (s *siteIndex) add(rel string, md []byte) {
+	p := parsePage(rel, md)
+	if info, err := statContent(rel); err == nil {
+		p.ModTime = info.ModTime()
+	}
+	s.Lock()
+	s.unlink(rel)
+	s.pages[rel] = p
+	for _, link := range p.Links {
+		for _, c := range linkCandidates(rel, link) {
+			if s.linkers[c] == nil {
+				s.linkers[c] = make(map[string]bool)
+			}
+			s.linkers[c][rel] = true
+		}
+	}
+	for t := range p.terms {
+		s.terms[t]++
+	}
+	s.Unlock()
+}
+
+// unlink drops rel's links from the backlink index, and its terms
+// from the counts for related pages.  The caller holds the lock.
+func (s *siteIndex) unlink(rel string) {
+	old := s.pages[rel]
+	if old == nil {
+		return
+	}
+	for t := range old.terms {
+		if s.terms[t]--; s.terms[t] <= 0 {
+			delete(s.terms, t)
+		}
+	}
+	for _, link := range old.Links {
+		for _, c := range linkCandidates(rel, link) {
+			delete(s.linkers[c], rel)
+			if len(s.linkers[c]) == 0 {
+				delete(s.linkers, c)
+			}
+		}
+	}
+}
+
+// backlinks returns the paths of the other pages that link to rel,
+// sorted.
+func (s *siteIndex) backlinks(rel string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	from := []string{}
+	for linker := range s.linkers[rel] {
+		if linker == rel {
+			continue
+		}
+		for _, link := range s.pages[linker].Links {
+			if s.resolveLinkLocked(linker, link) == rel {
+				from = append(from, linker)
+				break
+			}
+		}
+	}
+	sort.Strings(from)
+	return from
+}
+
+// update re-reads the file name (a path below the content directory
+// as reported by the watcher), dropping it from the index if it's gone.
+func (s *siteIndex) update(name string) {
+	rel, err := filepath.Rel(s.dir, name)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	md, err := readContent(rel)
+	if err != nil {
+		log.Debug("dropping %s from the index", rel)
+		s.Lock()
+		s.unlink(rel)
+		delete(s.pages, rel)
+		s.Unlock()
+		return
+	}
+	log.Debug("reindexing %s", rel)
+	s.add(rel, md)
+}
+
+// contentChanged keeps the index up to date as files change.
+func (s *siteIndex) contentChanged(event fsnotify.Event, rel string) {
+	if path.Ext(rel) == ".md" {
+		s.update(event.Name)
+	}
+}
+
+// sortedPages returns a snapshot of the pages sorted by path.
+func (s *siteIndex) sortedPages() []*page {
+	s.RLock()
+	defer s.RUnlock()
+	pages := make([]*page, 0, len(s.pages))
+	for _, p := range s.pages {
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+	return pages
+}
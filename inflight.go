@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// a request waits this long for its turn under -max-inflight before
+// it's turned away
+const inflightWait = 10 * time.Second
+
+// limitInflight wraps a handler so that no more than -max-inflight
+// requests are served at once, since each of them may hold a whole
+// file in memory.  As many again wait their turn; the rest, and any
+// that wait too long, get a 503 asking them to try again.  The
+// reloader's websockets live as long as their pages and don't count.
+func limitInflight(h http.Handler) http.Handler {
+	if *flagMaxInflight <= 0 {
+		return h
+	}
+	serving := make(chan struct{}, *flagMaxInflight)
+	waiting := make(chan struct{}, *flagMaxInflight)
+	busy := func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(inflightWait/time.Second)))
+		http.Error(w, "the server is busy, try again shortly", http.StatusServiceUnavailable)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_reloader" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case serving <- struct{}{}:
+		default:
+			select {
+			case waiting <- struct{}{}:
+			default:
+				log.Warning("turning away %s, %d requests in flight and as many waiting", r.URL.Path, *flagMaxInflight)
+				busy(w)
+				return
+			}
+			timer := time.NewTimer(inflightWait)
+			select {
+			case serving <- struct{}{}:
+				timer.Stop()
+				<-waiting
+			case <-timer.C:
+				<-waiting
+				log.Warning("turning away %s after waiting %s", r.URL.Path, inflightWait)
+				busy(w)
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				<-waiting
+				return
+			}
+		}
+		defer func() { <-serving }()
+		h.ServeHTTP(w, r)
+	})
+}
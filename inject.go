@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"regexp"
+)
+
+// injectedCSSHandler serves /_inject.css, the -inject-css stylesheet,
+// which every served page links to.
+func injectedCSSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, *flagInjectCSS)
+}
+
+// watchInjectedCSS refreshes the clients' stylesheets whenever the
+// -inject-css file changes.  It's likely to live outside the content
+// directory, so it needs a watcher of its own.
+func watchInjectedCSS() {
+	name, err := filepath.Abs(*flagInjectCSS)
+	maybeBail(err)
+	notifier, _ := newWatcher(filepath.Dir(name), "^"+regexp.QuoteMeta(filepath.ToSlash(name))+"$")
+	for note := range notifier {
+		log.Notice("injected stylesheet refresh needed because: %s", note)
+		broadcast(newCSSMessage([]string{"/_inject.css"}))
+	}
+}
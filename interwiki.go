@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An interwikiConfig expands references with a prefix.  URL is a
+// template for regexp.Expand, $0 being the reference after the prefix
+// and $1 and so on the submatches of Pattern, which the whole
+// reference must match (anything, unless it says otherwise):
+//
+//	interwiki:
+//	  jira:
+//	    url: https://jira.example.com/browse/$0
+//	    pattern: '[A-Z]+-\d+'
+//	  gh:
+//	    url: https://github.com/$1/issues/$2
+//	    pattern: '([\w.-]+/[\w.-]+)#(\d+)'
+type interwikiConfig struct {
+	URL     string `yaml:"url"`
+	Pattern string `yaml:"pattern"`
+}
+
+var (
+	// the config file's patterns, anchored, by prefix
+	interwikiPatterns map[string]*regexp.Regexp
+
+	// a bare prefix:reference in the text, from the start of a line or
+	// a space
+	interwikiBareRegexp *regexp.Regexp
+)
+
+// compileInterwiki checks and compiles the config file's interwiki
+// prefixes.
+func compileInterwiki() error {
+	interwikiPatterns = make(map[string]*regexp.Regexp)
+	var prefixes []string
+	for prefix, ic := range cfg.Interwiki {
+		if ic.URL == "" {
+			return fmt.Errorf("interwiki %s: no url", prefix)
+		}
+		pattern := ic.Pattern
+		if pattern == "" {
+			pattern = ".+"
+		}
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("interwiki %s: bad pattern: %s", prefix, err)
+		}
+		interwikiPatterns[prefix] = re
+		prefixes = append(prefixes, regexp.QuoteMeta(prefix))
+	}
+	if len(prefixes) > 0 {
+		sort.Strings(prefixes)
+		interwikiBareRegexp = regexp.MustCompile(`(^|\s)(` + strings.Join(prefixes, "|") + `):(\S+)`)
+	}
+	return nil
+}
+
+// expandInterwiki returns the URL that target, a link or bare
+// reference, stands for.  It's "" (with no error) if target doesn't
+// have one of the prefixes, and an error if it does but the reference
+// isn't what the prefix expects.
+func expandInterwiki(target string) (string, error) {
+	i := strings.Index(target, ":")
+	if i < 0 {
+		return "", nil
+	}
+	prefix, ref := target[:i], target[i+1:]
+	re := interwikiPatterns[prefix]
+	if re == nil {
+		return "", nil
+	}
+	m := re.FindStringSubmatchIndex(ref)
+	if m == nil {
+		return "", fmt.Errorf("%s isn't a %s reference", target, prefix)
+	}
+	return string(re.ExpandString(nil, cfg.Interwiki[prefix].URL, ref, m)), nil
+}
+
+// trimReference splits the punctuation a sentence puts after a bare
+// reference from it.
+func trimReference(ref string) (string, string) {
+	trimmed := strings.TrimRight(ref, ".,;:!?)'\"")
+	return trimmed, ref[len(trimmed):]
+}
+
+// processInterwiki expands interwiki links, [text](jira:ABC-123), into
+// URLs, and makes bare references, jira:ABC-123, into links.  Code is
+// left alone, as are references the prefix doesn't expect (check-links
+// reports those).
+func processInterwiki(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if len(interwikiPatterns) == 0 {
+		return in, nil
+	}
+	bare := func(text string) string {
+		return interwikiBareRegexp.ReplaceAllStringFunc(text, func(m string) string {
+			sm := interwikiBareRegexp.FindStringSubmatch(m)
+			ref, after := trimReference(sm[3])
+			url, err := expandInterwiki(sm[2] + ":" + ref)
+			if url == "" || err != nil {
+				return m
+			}
+			return fmt.Sprintf("%s[%s:%s](%s)%s", sm[1], sm[2], ref, url, after)
+		})
+	}
+
+	lines := strings.SplitAfter(string(in), "\n")
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+		// link targets, replaced from the end so that the indexes stay
+		// good
+		matches := indexLinkRegexp.FindAllStringSubmatchIndex(line, -1)
+		for j := len(matches) - 1; j >= 0; j-- {
+			for g := len(matches[j])/2 - 1; g >= 1; g-- {
+				a, b := matches[j][2*g], matches[j][2*g+1]
+				if a < 0 {
+					continue
+				}
+				if url, err := expandInterwiki(line[a:b]); url != "" && err == nil {
+					line = line[:a] + url + line[b:]
+				}
+			}
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, m := range typographySkipRegexp.FindAllStringIndex(line, -1) {
+			b.WriteString(bare(line[last:m[0]]))
+			b.WriteString(line[m[0]:m[1]])
+			last = m[1]
+		}
+		b.WriteString(bare(line[last:]))
+		lines[i] = b.String()
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// interwikiProblems finds the interwiki links and references in a line
+// that their prefixes don't expect, for check-links.
+func interwikiProblems(rel string, n int, line string) []diagnostic {
+	var found []diagnostic
+	if len(interwikiPatterns) == 0 {
+		return found
+	}
+	report := func(col int, target string) {
+		if _, err := expandInterwiki(target); err != nil {
+			found = append(found, diagnostic{rel, n, col + 1, "links", "", err.Error()})
+		}
+	}
+	for _, m := range indexLinkRegexp.FindAllStringSubmatchIndex(line, -1) {
+		for g := 1; g < len(m)/2; g++ {
+			if a, b := m[2*g], m[2*g+1]; a >= 0 {
+				report(a, line[a:b])
+			}
+		}
+	}
+	text := typographySkipRegexp.ReplaceAllStringFunc(line, func(s string) string {
+		return strings.Repeat(" ", len(s))
+	})
+	for _, m := range interwikiBareRegexp.FindAllStringSubmatchIndex(text, -1) {
+		ref, _ := trimReference(text[m[6]:m[7]])
+		report(m[4], text[m[4]:m[5]]+":"+ref)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Column < found[j].Column })
+	return found
+}
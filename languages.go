@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// directories named like this (en, de, pt-BR, ...) that hold an
+// index.md are taken to be the language roots of a multi-language wiki
+var languageDirRegexp = regexp.MustCompile(`^[a-z]{2,3}([-_][A-Za-z]{2,4})?$`)
+
+// languages returns the language roots in dir: the ones listed in the
+// config file, or else the ones that look like language roots.
+func languages(dir string) []string {
+	if len(cfg.Languages) > 0 {
+		return cfg.Languages
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Error("unable to list %s: %s", dir, err)
+		return nil
+	}
+	var langs []string
+	for _, info := range infos {
+		if !info.IsDir() || !languageDirRegexp.MatchString(info.Name()) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, info.Name(), "index.md")); err == nil {
+			langs = append(langs, info.Name())
+		}
+	}
+	return langs
+}
+
+// A languageReport is what we know about one language tree.
+type languageReport struct {
+	Language string   `json:"language"`
+	Pages    int      `json:"pages"`
+	Problems []string `json:"problems"`
+}
+
+// checkLanguage counts the pages in a language tree and checks that
+// every link in its navigation.md leads to a page in the same tree.
+func (s *siteIndex) checkLanguage(lang string) languageReport {
+	report := languageReport{Language: lang, Problems: []string{}}
+	prefix := lang + "/"
+	for _, p := range s.sortedPages() {
+		if strings.HasPrefix(p.Path, prefix) {
+			report.Pages++
+		}
+	}
+
+	nav := prefix + "navigation.md"
+	s.RLock()
+	p, ok := s.pages[nav]
+	s.RUnlock()
+	if !ok {
+		report.Problems = append(report.Problems, nav+" is missing")
+		return report
+	}
+	for _, target := range p.Links {
+		switch resolved := s.resolveLink(nav, target); {
+		case resolved == "":
+			report.Problems = append(report.Problems,
+				fmt.Sprintf("%s: broken link %s", nav, target))
+		case !strings.HasPrefix(resolved, prefix):
+			report.Problems = append(report.Problems,
+				fmt.Sprintf("%s: %s leads to %s, outside the %s tree", nav, target, resolved, lang))
+		}
+	}
+	return report
+}
+
+// checkLanguages checks every language tree.
+func (s *siteIndex) checkLanguages() []languageReport {
+	reports := []languageReport{}
+	for _, lang := range languages(s.dir) {
+		reports = append(reports, s.checkLanguage(lang))
+	}
+	return reports
+}
+
+// languagesJSON returns the language roots as a JSON array for the
+// client script's language switcher.
+func languagesJSON() string {
+	langs := languages(*flagContentDir)
+	if langs == nil {
+		langs = []string{}
+	}
+	b, err := json.Marshal(langs)
+	maybeBail(err)
+	return string(b)
+}
+
+// languagesHandler serves /_api/languages, a report on each language
+// tree.
+func languagesHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(site.checkLanguages(), "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
+
+// printLanguages implements the languages command, which lists the
+// language trees and the problems with their navigation.
+func printLanguages(args []string) error {
+	flags := flag.NewFlagSet("languages", flag.ExitOnError)
+	flags.Parse(args)
+
+	index, err := newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	reports := index.checkLanguages()
+	if len(reports) == 0 {
+		return fmt.Errorf("no language trees found in %s", *flagContentDir)
+	}
+
+	problems := 0
+	for _, report := range reports {
+		fmt.Printf("%s: %d pages\n", report.Language, report.Pages)
+		for _, p := range report.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+		problems += len(report.Problems)
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d navigation problems", problems)
+	}
+	return nil
+}
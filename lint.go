@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// lintConfig is the lint section of the config file.
+type lintConfig struct {
+	LineLength int      `yaml:"line_length"` // MD013 limit, default 80
+	Disable    []string `yaml:"disable"`     // rule IDs to skip, e.g. MD013
+}
+
+// A lintViolation is a place where a document breaks one of the rules.
+// Rules are named after their markdownlint equivalents.
+type lintViolation struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (v lintViolation) String() string {
+	return fmt.Sprintf("%s:%d: %s %s", v.File, v.Line, v.Rule, v.Message)
+}
+
+var (
+	lintHeadingRegexp = regexp.MustCompile(`^(#{1,6})\s`)
+	lintURLRegexp     = regexp.MustCompile(`https?://[^\s<>()\[\]]+`)
+)
+
+func (c lintConfig) enabled(rule string) bool {
+	for _, r := range c.Disable {
+		if strings.EqualFold(r, rule) {
+			return false
+		}
+	}
+	return true
+}
+
+// lintMarkdown checks a document against the rules:
+//
+//	MD001 heading levels only increase one at a time
+//	MD009 no trailing spaces (other than a two space line break)
+//	MD013 lines are no longer than the configured length
+//	MD034 URLs are wrapped in <> or used as link targets
+func lintMarkdown(name string, md []byte, c lintConfig) []lintViolation {
+	limit := c.LineLength
+	if limit <= 0 {
+		limit = 80
+	}
+
+	var found []lintViolation
+	report := func(line int, rule string, format string, args ...interface{}) {
+		if c.enabled(rule) {
+			found = append(found, lintViolation{name, line, rule, fmt.Sprintf(format, args...)})
+		}
+	}
+
+	inFence := false
+	lastLevel := 0
+	for i, line := range strings.Split(string(md), "\n") {
+		n := i + 1
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+
+		if m := lintHeadingRegexp.FindStringSubmatch(line); m != nil {
+			level := len(m[1])
+			if lastLevel > 0 && level > lastLevel+1 {
+				report(n, "MD001", "heading level jumps from h%d to h%d", lastLevel, level)
+			}
+			lastLevel = level
+		}
+
+		trimmed := strings.TrimRight(line, " \t")
+		if trailing := len(line) - len(trimmed); trailing > 0 && (trailing != 2 || trimmed == "") {
+			report(n, "MD009", "%d trailing spaces", trailing)
+		}
+
+		if length := len([]rune(line)); length > limit &&
+			strings.ContainsAny(string([]rune(line)[limit:]), " \t") {
+			report(n, "MD013", "line length %d exceeds %d", length, limit)
+		}
+
+		for _, loc := range lintURLRegexp.FindAllStringIndex(line, -1) {
+			if loc[0] > 0 && strings.ContainsRune("<(`\"'", rune(line[loc[0]-1])) {
+				continue
+			}
+			report(n, "MD034", "bare URL %s", line[loc[0]:loc[1]])
+		}
+	}
+	return found
+}
+
+// lint implements the lint command, which checks every Markdown file
+// in the content directory.
+func lint(args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	format := flags.String("format", "text", "output format, text or json")
+	flags.Parse(args)
+
+	var found []lintViolation
+	err := walkMarkdown(*flagContentDir, func(rel string, md []byte) error {
+		found = append(found, lintMarkdown(rel, md, cfg.Lint)...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *format == "text" && *flagDiagnosticsFormat != "":
+		printDiagnostics(lintDiagnostics(found), *flagDiagnosticsFormat)
+	case *format == "json":
+		b, err := json.MarshalIndent(found, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	case *format == "text":
+		for _, v := range found {
+			fmt.Println(v)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if len(found) > 0 {
+		return fmt.Errorf("found %d lint violations", len(found))
+	}
+	return nil
+}
+
+// lintChange lints each Markdown file below the content directory as
+// it's saved and shows the violations, if any, in the clients' error
+// overlay.
+func lintChange(event fsnotify.Event, rel string) {
+	if path.Ext(rel) != ".md" {
+		return
+	}
+	md, err := readContent(rel)
+	if err != nil {
+		// removed or renamed away
+		setBuildError("lint", "")
+		return
+	}
+
+	var lines []string
+	for _, v := range lintMarkdown(rel, md, cfg.Lint) {
+		lines = append(lines, v.String())
+	}
+	setBuildError("lint", strings.Join(lines, "\n"))
+}
@@ -13,15 +13,20 @@ import (
 	"flag"
 	"github.com/op/go-logging"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	flagContentDir = flag.String("dir", "./",
 		"Directory from which to read files")
-	flagNotifyRegexp = flag.String("regexp", ".*(json|md|html|css)$",
+	flagNotifyRegexp = flag.String("regexp", ".*(json|md|html|css|adoc|rst)$",
 		"Regular expression that matches files to watch for changes")
 	flagAddr = flag.String("addr", "127.0.0.1",
 		"specify address, default \"127.0.0.1\"")
@@ -29,17 +34,910 @@ var (
 	flagVerbose = flag.Bool("verbose", false, "foo")
 	flagDebug   = flag.Bool("debug", false, "foo")
 
+	flagCSVMaxRows = flag.Int("csv-max-rows", 1000,
+		"maximum number of rows rendered from CSV/TSV data")
+	flagThumbCache = flag.String("thumb-cache",
+		filepath.Join(os.TempDir(), "mdwiki-dev-server", "thumbs"),
+		"directory in which generated thumbnails are cached")
+	flagSrcset = flag.Bool("srcset", false,
+		"add srcset attributes pointing at /_thumbs/ to local images")
+	flagTOCDepth = flag.Int("toc-depth", 3,
+		"deepest heading level listed in the table of contents that replaces [TOC]")
+	flagHeadingAnchors = flag.Bool("heading-anchors", false,
+		"give every Markdown heading an id, not just those on pages with a [TOC]")
+	flagSass = flag.String("sass", "",
+		"command used to compile .scss files into .css, e.g. \"sass\"")
+	flagPostCSS = flag.String("postcss", "",
+		"command run on each compiled .css file, e.g. \"postcss --replace\"")
+	flagEsbuild = flag.String("esbuild", "esbuild",
+		"esbuild command used to bundle the assets listed in the config file")
+	flagConfig = flag.String("config", "",
+		"configuration file, default .mdwiki-dev.yaml in the content directory")
+	flagDict = flag.String("dict", "/usr/share/dict/words",
+		"dictionary used for spell checking (word list or hunspell .dic)")
+	flagWords = flag.String("words", "",
+		"additional word list used for spell checking")
+	flagPauseOnStart = flag.Bool("pause-on-start", false,
+		"start with live reload paused (see /_pause)")
+	flagReloadDelay = flag.Duration("reload-delay", 0,
+		"count down this long, cancelable with Esc, before reloading")
+	flagToolbar = flag.Bool("toolbar", false,
+		"show a development toolbar on served pages")
+	flagSync = flag.Bool("sync", false,
+		"mirror scrolling, navigation and clicks between connected browsers")
+	flagHistoryDiffs = flag.Bool("history-diffs", false,
+		"attach git diffs to the entries in /_history")
+	flagLint = flag.Bool("lint", false,
+		"lint Markdown files as they're saved, showing problems in the browser")
+	flagInjectCSS = flag.String("inject-css", "",
+		"stylesheet added to every served page, reloaded as it changes")
+	flagFollowSymlinks = flag.String("follow-symlinks", "safe",
+		"follow symbolic links: off, safe (only within -dir) or all")
+	flagServeDotfiles = flag.Bool("serve-dotfiles", false,
+		"serve dot files and the contents of dot directories such as .git")
+	flagOG = flag.Bool("og", false,
+		"add Open Graph tags describing each page to served HTML")
+	flagRecord = flag.String("record", "",
+		"record all traffic to this HTTP Archive (HAR) file")
+	flagRecordMaxBody = flag.Int("record-max-body", 1<<20,
+		"largest request or response body, in bytes, that -record keeps")
+	flagRender = flag.Bool("render", false,
+		"render Markdown pages on the server for browsers that ask for them directly")
+	flagHighlight = flag.String("highlight", "github",
+		"chroma style for highlighting code in -render pages and exports, \"\" for none")
+	flagHighlightClasses = flag.Bool("highlight-classes", false,
+		"highlight with classes and a stylesheet, /_highlight.css, rather than inline styles")
+	flagSmartypants = flag.Bool("smartypants", false,
+		"use curly quotes, dashes and ellipses in -render pages and exports")
+	flagEmoji = flag.Bool("emoji", false,
+		"expand emoji shortcodes such as :rocket: in Markdown pages")
+	flagBacklinks = flag.Bool("backlinks", false,
+		"add a \"Pages linking here\" section to the end of each page")
+	flagReadOnly = flag.Bool("read-only", false,
+		"refuse edits, moves and previews, and run no -sass, asset or task commands")
+	flagAuditLog = flag.String("audit-log", "",
+		"append a JSON line to this file for every change made through the server")
+	flagSFTP = flag.String("sftp", "",
+		"also serve the content directory over SFTP, to the auth config's users, on this address (e.g. :2022)")
+	flagSFTPHostKey = flag.String("sftp-host-key", "",
+		"the -sftp host key, made here if the file doesn't exist (default: a new one each run)")
+	flagBroker = flag.String("broker", "",
+		"share changes with the other instances through this redis:// or nats:// URL, so that all their clients reload")
+	flagAgentToken = flag.String("agent-token", "",
+		"the secret agents present to /_agent, and the agent command to the server; agents are refused without one")
+	flagSnapshots = flag.String("snapshots", "",
+		"where snapshots of the content are kept (default .mdwiki-snapshots in -dir)")
+	flagSnapshotLimit = flag.Int("snapshot-limit", 20,
+		"how many snapshots to keep, removing the oldest (0 for no limit)")
+	flagProtect = flag.Bool("protect", false,
+		"keep pages deleted while the server's running in .trash, to be restored from /_api/trash")
+	flagComments = flag.Bool("comments", false,
+		"let reviewers comment on selected text of a page, kept in .mdwiki-comments and shown in the margin")
+	flagPresence = flag.Bool("presence", false,
+		"show who else is viewing each page, and whether it's being edited, in the toolbar")
+	flagChrome = flag.String("chrome", "",
+		"the Chrome or Chromium screenshots are taken with (default: found on the PATH)")
+	flagScreenshotWait = flag.Duration("screenshot-wait", time.Second,
+		"how long to let a page render before taking its screenshot")
+	flagTargetedReload = flag.Bool("targeted-reload", false,
+		"reload only the browsers showing a Markdown file that changed (or one it includes), as they say what they've loaded")
+	flagCacheMode = flag.String("cache-mode", cacheETag,
+		"how browsers may cache what's served: etag (Markdown revalidated by ETag, pages with the snippet not stored), no-store or off")
+	flagEarlyHints = flag.Bool("early-hints", false,
+		"send 103 Early Hints for what the wiki's page needs first, navigation.md, config.json and its stylesheets")
+	flagPrefetch = flag.Bool("prefetch", false,
+		"have browsers prefetch the pages navigation.md links to, when idle")
+	flagChaosDrop = flag.Float64("chaos-drop", 0,
+		"fraction of the messages to browsers to drop, to test the reload channel's resilience")
+	flagChaosDelay = flag.Duration("chaos-delay", 0,
+		"hold each message to browsers back for up to this long, to test the reload channel's resilience")
+	flagChaosKill = flag.Float64("chaos-kill", 0,
+		"fraction of the messages to browsers to drop the connection instead of sending, to test the reload channel's resilience")
+	flagShutdownTimeout = flag.Duration("shutdown-timeout", 2*time.Second,
+		"how long to let requests in flight finish on SIGTERM")
+	flagGlossary = flag.Bool("glossary", false,
+		"show the glossary.md definition of the first use of each term in a page as a tooltip")
+	flagRelated = flag.Int("related", 0,
+		"add a \"Related pages\" section listing this many similar pages to the end of each page")
+	flagMaxInflight = flag.Int("max-inflight", 0,
+		"most requests served at once, with as many queued and the rest turned away; 0 for no limit")
+	flagWatchShards = flag.Int("watch-shards", 1,
+		"number of filesystem watchers to spread the content tree's watches over, for very large trees")
+	flagLazyWatch = flag.Bool("lazy-watch", false,
+		"only watch directories with watched files in them, and those that are read from")
+	flagWatchBackend = flag.String("watch-backend", backendAuto,
+		"how to watch the content for changes: fsnotify, poll, fsevents on macOS for very large trees, or auto (poll in a container)")
+	flagPollInterval = flag.Duration("poll-interval", time.Second,
+		"how often -watch-backend poll (or a -source snapshot) looks for changes")
+	flagSource = flag.String("source", "",
+		"serve a snapshot of the content, zip:FILE or git:REF, instead of the -dir directory")
+	flagDiagnosticsFormat = flag.String("diagnostics-format", "",
+		"report lint, check-links and check-spelling problems for editors and CI: vscode or gcc")
+
 	log = logging.MustGetLogger("mdwiki-dev-server")
 )
 
-var snippetTmpl = ` <!-- From:
-https://www.npmjs.org/package/node-live-reload --> <!-- Inserted by
-mdwiki-dev-server --> <script> var ws; function socket() { ws = new
-WebSocket("ws://{{.Addr}}:{{.Port}}/_reloader"); ws.onmessage =
-function ( e ) { var data = JSON.parse(e.data); if ( data.r ) {
-ws.close(); location.reload(); } }; } setInterval(function () { if (
-ws ) { if ( ws.readyState !== 1 ) { ws.close(); socket(); } } else {
-socket(); } }, 1000); </script>
+// subcommands are run instead of the server when named on the command
+// line, e.g. "mdwiki-dev-server -dir docs check-spelling -format json".
+var subcommands = map[string]func(args []string) error{
+	"agent":          agent,
+	"audit":          audit,
+	"bench":          bench,
+	"build":          build,
+	"check-links":    checkLinks,
+	"check-spelling": checkSpelling,
+	"deploy":         deploy,
+	"index":          writeIndex,
+	"languages":      printLanguages,
+	"lint":           lint,
+	"mv":             move,
+	"perf":           perf,
+	"replay":         replay,
+	"review-report":  reviewReportCommand,
+	"rollback":       rollbackCommand,
+	"screenshots":    screenshots,
+	"snapshot":       takeSnapshotCommand,
+	"stats":          printStats,
+	"validate":       validate,
+	"visual-diff":    visualDiff,
+}
+
+var snippetTmpl = `
+<!-- Inserted by mdwiki-dev-server, based on
+https://www.npmjs.org/package/node-live-reload -->
+{{if .InjectCSS}}<link rel="stylesheet" href="/_inject.css">
+{{end}}<style id="mdwds-dark" media="not all">
+html { filter: invert(1) hue-rotate(180deg); background: #fff; }
+img, video, picture, canvas, iframe, .mdwds-ui { filter: invert(1) hue-rotate(180deg); }
+</style>
+<script>
+(function () {
+  var ws, overlay;
+
+  function showError(text) {
+    if (!overlay) {
+      overlay = document.createElement("pre");
+      overlay.className = "mdwds-ui";
+      overlay.style.cssText = "position:fixed;top:0;left:0;right:0;" +
+        "margin:0;padding:1em;z-index:100000;max-height:50%;overflow:auto;" +
+        "background:#300;color:#fcc;font:12px monospace;white-space:pre-wrap";
+      document.body.appendChild(overlay);
+    }
+    overlay.textContent = text;
+    overlay.style.display = text ? "block" : "none";
+  }
+
+  function swapCSS() {
+    var links = document.querySelectorAll('link[rel="stylesheet"]');
+    for (var i = 0; i < links.length; i++) {
+      var href = links[i].href.replace(/[?&]_mdwds=\d+/, "");
+      links[i].href = href + (href.indexOf("?") < 0 ? "?" : "&") +
+        "_mdwds=" + Date.now();
+    }
+  }
+
+  // diffs arrive just before the reload, so they're kept until the
+  // reloaded page can show them
+  var diffPanel;
+
+  function hideDiff() {
+    if (diffPanel) {
+      diffPanel.parentNode.removeChild(diffPanel);
+      diffPanel = null;
+    }
+  }
+
+  function showDiff(diff) {
+    hideDiff();
+    var panel = diffPanel = document.createElement("div");
+    panel.className = "mdwds-ui";
+    panel.style.cssText = "position:fixed;bottom:0;right:0;z-index:100000;" +
+      "max-width:60%;max-height:40%;overflow:auto;background:#fff;" +
+      "border:1px solid #999;font:12px monospace;box-shadow:0 0 8px #999";
+    var title = document.createElement("div");
+    title.style.cssText = "padding:4px 8px;background:#eee;cursor:pointer";
+    title.textContent = (diff.diff ? "Changed: " : "No changes this session: ") +
+      diff.path + " (click to close)";
+    title.onclick = hideDiff;
+    panel.appendChild(title);
+    var colors = { "+": "#cfc", "-": "#fcc", "@": "#ddf" };
+    var lines = diff.diff.split("\n");
+    for (var i = 2; i < lines.length; i++) {
+      var line = document.createElement("div");
+      line.style.cssText = "white-space:pre;padding:0 8px;background:" +
+        (colors[lines[i].charAt(0)] || "#fff");
+      line.textContent = lines[i];
+      panel.appendChild(line);
+    }
+    document.body.appendChild(panel);
+  }
+
+  window.addEventListener("load", function () {
+    var pending = sessionStorage.getItem("mdwds-diff");
+    if (pending) {
+      sessionStorage.removeItem("mdwds-diff");
+      showDiff(JSON.parse(pending));
+    }
+  });
+
+  // live reload can be paused in this tab (which is remembered across
+  // reloads) or for everyone by the server
+  var paused = sessionStorage.getItem("mdwds-paused") === "1";
+  var serverPaused = false;
+  var pending = false;
+
+  function send(message) {
+    if (ws && ws.readyState === 1) {
+      ws.send(JSON.stringify(message));
+    }
+  }
+
+  function setPaused(p) {
+    paused = p;
+    sessionStorage.setItem("mdwds-paused", paused ? "1" : "0");
+    send({ pause: paused });
+    if (pending) {
+      reload({ reason: "changes made while paused" });
+    }
+    updateToolbar();
+  }
+
+  // the Markdown file MDwiki is showing, or the file itself for
+  // anything that isn't MDwiki
+  function currentPage() {
+    var dir = location.pathname.replace(/[^\/]*$/, "").replace(/^\//, "");
+    if (window.jQuery && window.jQuery.md) {
+      return dir + (location.hash.replace(/^#!/, "").split("#")[0] || "index.md");
+    }
+    var page = location.pathname.replace(/^\//, "");
+    return page === dir ? dir + "index.html" : page;
+  }
+
+  // keyboard shortcuts, configured in the keys section of the config file
+  var keymap = {{.Keymap}};
+  var actions = {
+    reload: function () { location.reload(); },
+    search: function () {
+      var box = document.querySelector('input[type="search"], input[name="q"], input[type="text"]');
+      if (box) {
+        box.focus();
+      }
+    },
+    diff: function () {
+      if (diffPanel) {
+        hideDiff();
+        return;
+      }
+      var page = currentPage();
+      fetch("/_diff/" + page).then(function (r) {
+        return r.ok ? r.text() : "";
+      }).then(function (text) {
+        showDiff({ path: page, diff: text });
+      });
+    },
+    pause: function () { setPaused(!paused); }
+  };
+
+  document.addEventListener("keydown", function (e) {
+    var t = e.target;
+    if (e.ctrlKey || e.metaKey || e.altKey || t.tagName === "INPUT" ||
+        t.tagName === "TEXTAREA" || t.tagName === "SELECT" || t.isContentEditable) {
+      return;
+    }
+    for (var action in keymap) {
+      if (keymap[action] === e.key && actions[action]) {
+        e.preventDefault();
+        actions[action]();
+        return;
+      }
+    }
+  });
+
+{{if .Toolbar}}
+  // the toolbar shows whether we're connected, why the page was last
+  // reloaded, and lets the user reload by hand, pause live reload,
+  // switch to dark mode or switch languages
+  var toolbar = {};
+
+  function button(label, onclick) {
+    var b = document.createElement("button");
+    b.textContent = label;
+    b.style.cssText = "margin-left:6px;font:inherit;cursor:pointer";
+    b.onclick = onclick;
+    toolbar.bar.appendChild(b);
+    return b;
+  }
+
+  function updateToolbar() {
+    if (!toolbar.bar) {
+      return;
+    }
+    var connected = ws && ws.readyState === 1;
+    toolbar.dot.style.color = connected ? "#3c3" : "#c33";
+    toolbar.dot.title = connected ? "connected" : "disconnected";
+    toolbar.pause.textContent = (paused ? "Resume" : "Pause") +
+      (pending ? " (changes waiting)" : "");
+    toolbar.server.textContent = serverPaused ? "paused by server" : "";
+    toolbar.dark.textContent = dark ? "Light" : "Dark";
+  }
+
+  function buildToolbar() {
+    toolbar.bar = document.createElement("div");
+    toolbar.bar.className = "mdwds-ui";
+    toolbar.bar.style.cssText = "position:fixed;bottom:0;left:0;z-index:100001;" +
+      "padding:3px 8px;background:#333;color:#eee;font:12px sans-serif;" +
+      "opacity:0.85;border-top-right-radius:4px";
+    toolbar.dot = document.createElement("span");
+    toolbar.dot.textContent = "\u25cf";
+    toolbar.bar.appendChild(toolbar.dot);
+    var last = document.createElement("span");
+    last.style.marginLeft = "6px";
+    last.textContent = sessionStorage.getItem("mdwds-last-reload") || "no reloads yet";
+    toolbar.bar.appendChild(last);
+    button("Reload", function () { location.reload(); });
+    toolbar.pause = button("Pause", function () { setPaused(!paused); });
+    toolbar.server = document.createElement("span");
+    toolbar.server.style.cssText = "margin-left:6px;color:#fc6";
+    toolbar.bar.appendChild(toolbar.server);
+    toolbar.dark = button("Dark", function () { setDark(!dark); });
+{{if .Presence}}
+    button("Me", setName);
+    toolbar.presence = document.createElement("span");
+    toolbar.bar.appendChild(toolbar.presence);
+    showPresence(presence);
+{{end}}
+{{if .Snapshots}}
+    button("Snapshot", takeSnapshot);
+    button("Roll back", rollBack);
+{{end}}
+    languageSwitcher();
+    var status = document.createElement("a");
+    status.href = "/_status";
+    status.textContent = "status";
+    status.style.cssText = "margin-left:6px;color:#9cf";
+    toolbar.bar.appendChild(status);
+    var search = document.createElement("a");
+    search.href = "/_search";
+    search.textContent = "search";
+    search.style.cssText = "margin-left:6px;color:#9cf";
+    toolbar.bar.appendChild(search);
+    document.body.appendChild(toolbar.bar);
+    updateToolbar();
+  }
+
+{{if .Presence}}
+  // presence: who else is on this page, as a dot with their initials
+  // each, and whether someone's editing it
+  var clientID = 0;
+  var presence = { clients: [], editing: [] };
+
+  function setName() {
+    var name = prompt("Your name, as the others see it:", localStorage.getItem("mdwds-author") || "");
+    if (name !== null) {
+      localStorage.setItem("mdwds-author", name);
+      send({ user: name });
+    }
+  }
+
+  function showPresence(p) {
+    presence = p;
+    if (!toolbar.presence) {
+      return;
+    }
+    var page = currentPage();
+    toolbar.presence.textContent = "";
+    p.clients.forEach(function (c) {
+      if (c.id === clientID || c.page !== page) {
+        return;
+      }
+      var name = c.user || "anonymous";
+      var hue = 0;
+      for (var i = 0; i < name.length; i++) {
+        hue = (hue * 31 + name.charCodeAt(i)) % 360;
+      }
+      var dot = document.createElement("span");
+      dot.title = name + " is viewing this page";
+      dot.textContent = name.split(/\s+/).map(function (w) { return w.charAt(0); }).join("").slice(0, 2).toUpperCase();
+      dot.style.cssText = "display:inline-block;margin-left:4px;width:18px;height:18px;line-height:18px;" +
+        "border-radius:9px;text-align:center;font-size:9px;color:#fff;background:hsl(" + hue + ",60%,45%)";
+      toolbar.presence.appendChild(dot);
+    });
+    if (p.editing.indexOf(page) >= 0) {
+      var editing = document.createElement("span");
+      editing.textContent = "\u270e being edited";
+      editing.style.cssText = "margin-left:6px;color:#fc6";
+      toolbar.presence.appendChild(editing);
+    }
+  }
+
+  window.addEventListener("hashchange", function () {
+    showPresence(presence);
+  });
+
+{{end}}
+{{if .Snapshots}}
+  // a snapshot before a mass edit lets it be rolled back, to the
+  // newest snapshot, from here
+  function takeSnapshot() {
+    var note = prompt("Take a snapshot of the content. Note:", "");
+    if (note === null) {
+      return;
+    }
+    fetch("/_api/snapshots", {method: "POST", body: JSON.stringify({note: note})})
+      .then(function (r) { return r.ok ? r.json() : r.text().then(function (t) { throw t; }); })
+      .then(function (s) { alert("Took snapshot " + s.id + " of " + s.files + " files"); })
+      .catch(function (e) { alert("No snapshot: " + e); });
+  }
+
+  function rollBack() {
+    fetch("/_api/snapshots").then(function (r) { return r.json(); }).then(function (list) {
+      if (!list || !list.length) {
+        alert("There are no snapshots to roll back to");
+        return;
+      }
+      var s = list[0];
+      return fetch("/_api/snapshots/" + s.id).then(function (r) { return r.json(); }).then(function (plan) {
+        if (!confirm("Roll back to " + s.id + (s.note ? " (" + s.note + ")" : "") + "? " +
+            plan.write.length + " files will be written, " + plan.remove.length + " removed.")) {
+          return;
+        }
+        return fetch("/_api/snapshots/" + s.id + "/rollback", {method: "POST"}).then(function (r) {
+          if (!r.ok) {
+            return r.text().then(function (t) { throw t; });
+          }
+        });
+      });
+    }).catch(function (e) { alert("No rollback: " + e); });
+  }
+{{end}}
+  // switching languages swaps the language root at the start of the
+  // path, keeping the rest (and MDwiki's #!page) as it is
+  function languageSwitcher() {
+    var langs = {{.Languages}};
+    if (!langs.length) {
+      return;
+    }
+    var parts = location.pathname.split("/");
+    var current = langs.indexOf(parts[1]) >= 0 ? parts[1] : "";
+    var select = document.createElement("select");
+    select.style.cssText = "margin-left:6px;font:inherit";
+    if (!current) {
+      select.appendChild(new Option("language", ""));
+    }
+    for (var i = 0; i < langs.length; i++) {
+      select.appendChild(new Option(langs[i], langs[i], false, langs[i] === current));
+    }
+    select.onchange = function () {
+      if (current) {
+        parts[1] = select.value;
+      } else {
+        parts.splice(1, 0, select.value);
+      }
+      location.href = parts.join("/") + location.search + location.hash;
+    };
+    toolbar.bar.appendChild(select);
+  }
+
+  window.addEventListener("load", buildToolbar);
+  setInterval(updateToolbar, 1000);
+{{else}}
+  function updateToolbar() {}
+{{end}}
+  // dark mode inverts the page (but not its images), and is remembered
+  // by the browser
+  var dark = false;
+
+  function setDark(d) {
+    dark = d;
+    localStorage.setItem("mdwds-dark", dark ? "1" : "0");
+    document.getElementById("mdwds-dark").media = dark ? "all" : "not all";
+    updateToolbar();
+  }
+
+  if (localStorage.getItem("mdwds-dark") === "1") {
+    setDark(true);
+  }
+
+  var countdown;
+
+  function reloadNow(data) {
+    sessionStorage.setItem("mdwds-last-reload", "reloaded " +
+      new Date().toLocaleTimeString() + (data.reason ? " (" + data.reason + ")" : ""));
+    ws.close();
+    location.reload();
+  }
+
+  // with a reload delay, count down in a toast that Esc (or a click)
+  // cancels and Enter cuts short
+  function startCountdown(data) {
+    if (countdown) {
+      return;
+    }
+    var toast = document.createElement("div");
+    toast.className = "mdwds-ui";
+    toast.style.cssText = "position:fixed;top:12px;right:12px;z-index:100002;" +
+      "padding:8px 12px;background:#333;color:#fff;font:13px sans-serif;" +
+      "border-radius:4px;box-shadow:0 0 8px #666;cursor:pointer";
+    document.body.appendChild(toast);
+    var remaining = {{.ReloadDelay}};
+
+    function stop() {
+      clearInterval(countdown.timer);
+      document.removeEventListener("keydown", countdown.keys, true);
+      toast.parentNode.removeChild(toast);
+      countdown = null;
+    }
+
+    function tick() {
+      if (remaining <= 0) {
+        stop();
+        reloadNow(data);
+        return;
+      }
+      toast.textContent = "Reloading in " + Math.ceil(remaining / 1000) +
+        "s \u2014 press Esc to cancel" + (data.reason ? " (" + data.reason + ")" : "");
+      remaining -= 250;
+    }
+
+    countdown = {
+      timer: setInterval(tick, 250),
+      keys: function (e) {
+        if (e.key === "Escape") {
+          e.preventDefault();
+          stop();
+        } else if (e.key === "Enter") {
+          e.preventDefault();
+          stop();
+          reloadNow(data);
+        }
+      }
+    };
+    document.addEventListener("keydown", countdown.keys, true);
+    toast.onclick = stop;
+    tick();
+  }
+
+  function reload(data) {
+    if (paused || serverPaused) {
+      pending = true;
+      updateToolbar();
+      return;
+    }
+    if ({{.ReloadDelay}} > 0) {
+      startCountdown(data);
+    } else {
+      reloadNow(data);
+    }
+  }
+
+  // the server numbers its messages, so that we can tell when we've
+  // missed one, and the changes, of which the page knows of those up to
+  // version
+  var version = {{.Version}};
+  var lastSeq = 0;
+
+  function socket() {
+    ws = new WebSocket("ws://{{.Addr}}:{{.Port}}/_reloader");
+    ws.onopen = function () {
+{{if .Presence}}
+      send({ page: currentPage(), user: localStorage.getItem("mdwds-author") || "" });
+{{else}}
+      send({ page: currentPage() });
+{{end}}
+      if (paused) {
+        send({ pause: true });
+      }
+{{if .TargetedReload}}
+      sendLoaded();
+{{end}}
+      // catch up on what changed while we weren't connected
+      lastSeq = 0;
+      send({ since: version });
+    };
+    ws.onmessage = function (e) {
+      var data = JSON.parse(e.data);
+      if (data.seq) {
+        if (data.seq !== lastSeq + 1) {
+          // we've missed something
+          send({ since: version });
+        }
+        lastSeq = data.seq;
+      }
+      if (data.r) {
+        reload(data);
+      }
+      if ("paused" in data) {
+        serverPaused = data.paused;
+        if (pending) {
+          reload({ reason: "changes made while paused" });
+        }
+        updateToolbar();
+      }
+      if (data.css) {
+        swapCSS();
+      }
+{{if .Sync}}
+      if (data.sync) {
+        applySync(data.sync);
+      }
+{{end}}
+{{if .Presence}}
+      if (data.client) {
+        clientID = data.client;
+      }
+      if (data.presence) {
+        showPresence(data.presence);
+      }
+{{end}}
+{{if .Comments}}
+      if (data.comments && data.comments.path === currentPage()) {
+        loadComments();
+      }
+{{end}}
+      if (data.diff) {
+        sessionStorage.setItem("mdwds-diff", JSON.stringify(data.diff));
+      }
+      if ("error" in data) {
+        showError(data.error);
+      }
+    };
+  }
+
+{{if .Sync}}
+  // ghost mode: mirror scrolling, navigation and clicks to the other
+  // browsers, ignoring the events caused by mirroring theirs
+  var applying = 0;
+
+  function sendSync(event) {
+    if (ws && ws.readyState === 1 && Date.now() - applying > 200) {
+      ws.send(JSON.stringify({ sync: event }));
+    }
+  }
+
+  function selectorFor(el) {
+    var parts = [];
+    for (; el && el.nodeType === 1 && el !== document.body; el = el.parentNode) {
+      var n = 1;
+      for (var s = el.previousElementSibling; s; s = s.previousElementSibling) {
+        n++;
+      }
+      parts.unshift(el.tagName.toLowerCase() + ":nth-child(" + n + ")");
+    }
+    return "body > " + parts.join(" > ");
+  }
+
+  function applySync(event) {
+    applying = Date.now();
+    var root = document.documentElement;
+    if (event.type === "scroll") {
+      window.scrollTo(0, event.y * (root.scrollHeight - window.innerHeight));
+    } else if (event.type === "hash" && location.hash !== event.hash) {
+      location.hash = event.hash;
+    } else if (event.type === "click") {
+      var el = document.querySelector(event.selector);
+      if (el) {
+        el.click();
+      }
+    }
+  }
+
+  var scrollTimer;
+  window.addEventListener("scroll", function () {
+    clearTimeout(scrollTimer);
+    scrollTimer = setTimeout(function () {
+      var root = document.documentElement;
+      var range = root.scrollHeight - window.innerHeight;
+      sendSync({ type: "scroll", y: range > 0 ? window.scrollY / range : 0 });
+    }, 100);
+  });
+  window.addEventListener("hashchange", function () {
+    sendSync({ type: "hash", hash: location.hash });
+  });
+  document.addEventListener("click", function (e) {
+    sendSync({ type: "click", selector: selectorFor(e.target) });
+  }, true);
+{{end}}
+{{if .Comments}}
+  // comments: selecting text offers to comment on it, and the page's
+  // comments are shown in the margin, fetched again whenever anyone
+  // changes them; clicking one finds the text it's about
+  var commentPanel, commentButton;
+
+  function inUI(el) {
+    for (; el && el.classList; el = el.parentNode) {
+      if (el.classList.contains("mdwds-ui")) {
+        return true;
+      }
+    }
+    return false;
+  }
+
+  function loadComments() {
+    var page = currentPage();
+    fetch("/_api/comments/" + page).then(function (r) {
+      return r.ok ? r.json() : [];
+    }).then(function (list) {
+      if (page === currentPage()) {
+        showComments(list);
+      }
+    });
+  }
+
+  function showComments(list) {
+    if (commentPanel) {
+      commentPanel.parentNode.removeChild(commentPanel);
+      commentPanel = null;
+    }
+    if (!list.length) {
+      return;
+    }
+    commentPanel = document.createElement("div");
+    commentPanel.className = "mdwds-ui";
+    commentPanel.style.cssText = "position:fixed;top:60px;right:0;width:240px;max-height:70%;" +
+      "overflow:auto;z-index:100000;padding:6px;background:#ffd;color:#333;" +
+      "font:12px sans-serif;border:1px solid #cc9;box-shadow:0 0 6px #999";
+    list.forEach(function (c) {
+      var note = document.createElement("div");
+      note.style.cssText = "margin-bottom:8px;cursor:pointer";
+      if (c.quote) {
+        var quote = document.createElement("div");
+        quote.style.cssText = "font-style:italic;color:#775;border-left:2px solid #cc9;padding-left:4px";
+        quote.textContent = c.quote.length > 80 ? c.quote.slice(0, 80) + "\u2026" : c.quote;
+        note.appendChild(quote);
+      }
+      var body = document.createElement("div");
+      body.textContent = c.body;
+      note.appendChild(body);
+      var by = document.createElement("div");
+      by.style.color = "#997";
+      by.textContent = c.author + ", " + new Date(c.time).toLocaleString() + " ";
+      var del = document.createElement("span");
+      del.textContent = "delete";
+      del.style.cssText = "text-decoration:underline;cursor:pointer";
+      del.onclick = function (e) {
+        e.stopPropagation();
+        deleteComment(c);
+      };
+      by.appendChild(del);
+      note.appendChild(by);
+      note.onclick = function () {
+        if (c.quote && window.find) {
+          window.getSelection().removeAllRanges();
+          window.find(c.quote);
+        }
+      };
+      commentPanel.appendChild(note);
+    });
+    document.body.appendChild(commentPanel);
+  }
+
+  function addComment(quote) {
+    var body = prompt("Comment on \u201c" + quote.slice(0, 60) + "\u201d:", "");
+    if (!body) {
+      return;
+    }
+    var author = localStorage.getItem("mdwds-author");
+    if (author === null) {
+      author = prompt("Your name, to sign your comments with:", "") || "";
+      localStorage.setItem("mdwds-author", author);
+    }
+    fetch("/_api/comments/" + currentPage(), {method: "POST",
+      body: JSON.stringify({quote: quote, body: body, author: author})}).then(function (r) {
+      if (!r.ok) {
+        return r.text().then(function (t) { alert("No comment: " + t); });
+      }
+    });
+  }
+
+  function deleteComment(c) {
+    if (!confirm("Delete this comment?")) {
+      return;
+    }
+    fetch("/_api/comments/" + c.path + "?id=" + c.id, {method: "DELETE"}).then(function (r) {
+      if (!r.ok) {
+        return r.text().then(function (t) { alert("Not deleted: " + t); });
+      }
+    });
+  }
+
+  document.addEventListener("mouseup", function (e) {
+    if (inUI(e.target)) {
+      return;
+    }
+    setTimeout(function () {
+      if (commentButton) {
+        commentButton.parentNode.removeChild(commentButton);
+        commentButton = null;
+      }
+      var selection = window.getSelection();
+      var quote = selection.toString().trim();
+      if (!quote) {
+        return;
+      }
+      var rect = selection.getRangeAt(0).getBoundingClientRect();
+      commentButton = document.createElement("button");
+      commentButton.className = "mdwds-ui";
+      commentButton.textContent = "Comment";
+      commentButton.style.cssText = "position:fixed;z-index:100003;font:12px sans-serif;cursor:pointer;" +
+        "top:" + Math.max(0, rect.top - 28) + "px;left:" + rect.left + "px";
+      commentButton.onmousedown = function (e) {
+        e.preventDefault(); // keep the selection
+      };
+      commentButton.onclick = function () {
+        commentButton.parentNode.removeChild(commentButton);
+        commentButton = null;
+        addComment(quote.slice(0, 300));
+      };
+      document.body.appendChild(commentButton);
+    }, 0);
+  });
+  window.addEventListener("load", loadComments);
+  window.addEventListener("hashchange", loadComments);
+{{end}}
+  window.addEventListener("hashchange", function () {
+    send({ page: currentPage() });
+  });
+{{if .TargetedReload}}
+
+  // targeted reloads: MDwiki fetches the page (and navigation.md, and
+  // whatever gimmicks load) after the document itself, so the server
+  // is told which .md files those were, to reload only for changes to
+  // them
+  var loaded = {};
+  var loadedPage = currentPage();
+  var loadedTimer = null;
+  function sendLoaded() {
+    send({ loaded: Object.keys(loaded) });
+  }
+  function noteLoad(url) {
+    var u;
+    try {
+      u = new URL(url, location.href);
+    } catch (e) {
+      return;
+    }
+    if (u.host !== location.host || !/\.md$/.test(u.pathname)) {
+      return;
+    }
+    if (currentPage() !== loadedPage) {
+      // a new page: the navigation is only loaded once, so it stays
+      loadedPage = currentPage();
+      for (var f in loaded) {
+        if (!/(^|\/)navigation\.md$/.test(f)) {
+          delete loaded[f];
+        }
+      }
+    }
+    loaded[decodeURIComponent(u.pathname.replace(/^\//, ""))] = true;
+    clearTimeout(loadedTimer);
+    loadedTimer = setTimeout(sendLoaded, 100);
+  }
+  var xhrOpen = XMLHttpRequest.prototype.open;
+  XMLHttpRequest.prototype.open = function (method, url) {
+    noteLoad(url);
+    return xhrOpen.apply(this, arguments);
+  };
+  if (window.fetch) {
+    var fetch = window.fetch;
+    window.fetch = function (input) {
+      noteLoad(typeof input === "string" ? input : input.url);
+      return fetch.apply(this, arguments);
+    };
+  }
+{{end}}
+
+  setInterval(function () {
+    if (ws) {
+      if (ws.readyState !== 1) {
+        ws.close();
+        socket();
+      }
+    } else {
+      socket();
+    }
+  }, 1000);
+})();
+</script>
 
 `
 
@@ -62,7 +960,7 @@ func maybeBail(err error) {
 }
 
 // keep track of tickers, useful for debugging
-var tickerID = 1
+var tickerID int32
 
 // newTicker starts a ticker goroutine that creates two channels
 // (ticker, tickerShutdown) then wakes up every once in a while and
@@ -74,8 +972,7 @@ func newTicker(d time.Duration) (chan bool, chan interface{}) {
 	tickerShutdown := make(chan interface{})
 
 	go func() {
-		myID := tickerID
-		tickerID++
+		myID := int(atomic.AddInt32(&tickerID, 1))
 	Loop:
 		for {
 			time.Sleep(d)
@@ -97,39 +994,41 @@ var watcherID = 1
 
 // newWatcher starts a goroutine that sends notifications about
 // changes within a directory.  It returns two channels: notifier, on
-// which it sends the fsnotify event as a string; and
+// which it sends the fsnotify event; and
 // notifierShutdown, on which it listens for a message telling it to
 // shutdown.
 //
 // It takes two arguments, a directory name to watch (string) and a
 // regular expression which names much match in order to cause a
 // notification.
-func newWatcher(dir string, matchPattern string) (chan string, chan interface{}) {
-	notifier := make(chan string)
+func newWatcher(dir string, matchPattern string) (chan fsnotify.Event, chan interface{}) {
+	notifier := make(chan fsnotify.Event)
 	notifierShutdown := make(chan interface{})
 
 	go func() {
 		myID := watcherID
 		watcherID++
 
+		matcher := regexp.MustCompile(matchPattern)
+		var coalescer eventCoalescer
 		watcher, err := fsnotify.NewWatcher()
 		maybeBail(err)
 		defer watcher.Close()
 
 		err = watcher.Add(dir)
 		maybeBail(err)
+		noteWatch(dir, true)
+		defer noteWatch(dir, false)
 
 	Loop:
 		for {
 			select {
 			case event := <-watcher.Events:
-				matched, err := regexp.MatchString(matchPattern, event.Name)
-				maybeBail(err)
-
-				if !matched || event.Op&fsnotify.Chmod == fsnotify.Chmod {
+				if !watchMatches(matcher, event.Name) || event.Op&fsnotify.Chmod == fsnotify.Chmod ||
+					coalescer.repeat(event) {
 					continue
 				}
-				notifier <- event.String()
+				notifier <- event
 				log.Debug("notifier(%d) saw %s", myID, event.String())
 			case <-notifierShutdown:
 				break Loop
@@ -143,14 +1042,242 @@ func newWatcher(dir string, matchPattern string) (chan string, chan interface{})
 	return notifier, notifierShutdown
 }
 
+// newFsnotifyTreeWatcher is like newWatcher but watches dir and every
+// directory below it (other than dot directories), including ones
+// created later.  Events for directories themselves aren't passed on.
+// Symbolic links are followed as -follow-symlinks allows, and the
+// watches are spread over -watch-shards watchers.  With -lazy-watch
+// only dir itself and the directories with watched files in them are
+// watched to begin with; others are added as their files are served,
+// or as they're created in a watched directory.
+func newFsnotifyTreeWatcher(dir string, matcher *regexp.Regexp) (chan fsnotify.Event, chan interface{}) {
+	notifier := make(chan fsnotify.Event)
+	notifierShutdown := make(chan interface{})
+
+	watcher, err := newShardedWatcher(*flagWatchShards)
+	maybeBail(err)
+	// the real paths of the trees we've followed links into, so that
+	// links back up the tree don't send us round in circles
+	followed := make(map[string]bool)
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		followed[real] = true
+	}
+	var coalescer eventCoalescer
+	watched := make(map[string]bool)
+	addWatch := func(name string) {
+		if watched[name] {
+			return
+		}
+		if err := watcher.Add(name); err != nil {
+			log.Error("unable to watch %s: %s", name, err)
+			return
+		}
+		watched[name] = true
+		noteWatch(name, true)
+	}
+	var addTree func(root string)
+	addTree = func(root string) {
+		filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode()&os.ModeSymlink != 0 && symlinkAllowed(name) && !kubeletOwned(name) {
+				real, err := filepath.EvalSymlinks(name)
+				if target, statErr := os.Stat(name); err == nil && statErr == nil &&
+					target.IsDir() && !followed[real] {
+					followed[real] = true
+					addTree(name + string(filepath.Separator))
+				}
+				return nil
+			}
+			if err != nil {
+				return nil
+			}
+			if !info.IsDir() {
+				if *flagLazyWatch && lazyWatchWanted(dir, name) {
+					addWatch(filepath.Dir(name))
+				}
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ".") && name != root {
+				return filepath.SkipDir
+			}
+			if !*flagLazyWatch || name == root {
+				addWatch(name)
+			}
+			return nil
+		})
+	}
+	start := time.Now()
+	addTree(dir)
+	log.Info("watching %d directories below %s after %s", len(watched), dir, time.Since(start))
+
+	go func() {
+		// a crash ends the events, so that watchContent starts over
+		defer close(notifier)
+		defer recovered("watcher")
+		defer watcher.Close()
+		for {
+			select {
+			case event := <-watcher.Events:
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && watched[event.Name] {
+					// the watch goes with the directory
+					delete(watched, event.Name)
+					noteWatch(event.Name, false)
+				}
+				events := []fsnotify.Event{event}
+				switch {
+				case filepath.Base(event.Name) == configMapDataLink && event.Op&fsnotify.Create == fsnotify.Create:
+					events = configMapSwap(event.Name)
+				case kubeletOwned(event.Name):
+					continue
+				case event.Op&fsnotify.Create == fsnotify.Create:
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						addTree(event.Name)
+						continue
+					}
+				}
+				for _, event := range events {
+					if !watchMatches(matcher, event.Name) || event.Op&fsnotify.Chmod == fsnotify.Chmod ||
+						!symlinkAllowed(event.Name) || coalescer.repeat(event) {
+						continue
+					}
+					select {
+					case notifier <- event:
+					case <-notifierShutdown:
+						return
+					}
+				}
+			case rel := <-lazyWatches:
+				name := filepath.Join(dir, filepath.FromSlash(rel))
+				if info, err := os.Stat(name); err == nil && info.IsDir() && !watched[name] {
+					log.Info("watching %s now that it's being read", name)
+					addWatch(name)
+				}
+			case <-notifierShutdown:
+				return
+			case err := <-watcher.Errors:
+				log.Error("error in filesystem watcher: %s", err)
+			}
+		}
+	}()
+	return notifier, notifierShutdown
+}
+
+// contentHandlers are called, in the order they were registered, for
+// every change below the content directory.
+var contentHandlers []func(event fsnotify.Event, rel string)
+
+// onContentChange registers a handler for changes below the content
+// directory.  It's passed the event and the changed file's path
+// relative to the content directory, with slashes.
+func onContentChange(handler func(event fsnotify.Event, rel string)) {
+	contentHandlers = append(contentHandlers, handler)
+}
+
+// watchContent runs the content handlers for each change below dir,
+// and each an agent reports.  One watcher is shared by all of them.
+func watchContent(dir string) {
+	w := newTreeWatcher(dir, ".")
+	if *flagAgentToken != "" {
+		w = withAgents(w)
+	}
+	defer w.Close()
+	dispatchChanges(dir, w)
+}
+
+// dispatchChanges runs the content handlers for each event from w, a
+// watcher of dir.
+func dispatchChanges(dir string, w treeWatcher) {
+	for note := range w.Events() {
+		rel, err := filepath.Rel(dir, note.Name)
+		maybeBail(err)
+		rel = filepath.ToSlash(rel)
+		if settingsFor(rel).ignored(rel) {
+			continue
+		}
+		for _, handler := range contentHandlers {
+			handler(note, rel)
+		}
+	}
+}
+
+// A contentChange is a change passed on to the connected clients.
+type contentChange struct {
+	event fsnotify.Event
+	rel   string
+}
+
+// changeListeners are the connected clients' channels for changes, so
+// that they all share watchContent's watcher rather than each walking
+// the tree and watching every directory again.
+var changeListeners = struct {
+	sync.Mutex
+	channels map[chan contentChange]bool
+}{channels: make(map[chan contentChange]bool)}
+
+func subscribeChanges() chan contentChange {
+	c := make(chan contentChange, 64)
+	changeListeners.Lock()
+	changeListeners.channels[c] = true
+	changeListeners.Unlock()
+	return c
+}
+
+func unsubscribeChanges(c chan contentChange) {
+	changeListeners.Lock()
+	delete(changeListeners.channels, c)
+	changeListeners.Unlock()
+}
+
+// broadcastChange is the content handler that passes changes on to
+// the clients, dropping them for any that have fallen too far behind.
+func broadcastChange(event fsnotify.Event, rel string) {
+	recordChange(contentChange{event, rel})
+	changeListeners.Lock()
+	defer changeListeners.Unlock()
+	for c := range changeListeners.channels {
+		select {
+		case c <- contentChange{event, rel}:
+		default:
+			log.Warning("dropping change for slow client: %s", rel)
+		}
+	}
+}
+
 // newReloadMessage returns an instance of the message packet that the
-// node-live-reload javascript expects, as a JSON string.
-func newReloadMessage() (message string) {
+// node-live-reload javascript expects, as a JSON string.  The reason
+// is shown in the toolbar after the reload.
+func newReloadMessage(reason string) (message string) {
 	type reloadMessage struct {
-		R time.Time `json:"r"`
+		R      time.Time `json:"r"`
+		Reason string    `json:"reason"`
 	}
 
-	b, err := json.Marshal(reloadMessage{R: time.Now()})
+	b, err := json.Marshal(reloadMessage{R: time.Now(), Reason: reason})
+	maybeBail(err)
+	message = string(b)
+	return message
+}
+
+// newCSSMessage tells the client which stylesheets changed so that it
+// can refresh them without reloading the page.
+func newCSSMessage(names []string) (message string) {
+	type cssMessage struct {
+		CSS []string `json:"css"`
+	}
+
+	b, err := json.Marshal(cssMessage{CSS: names})
+	maybeBail(err)
+	message = string(b)
+	return message
+}
+
+// newErrorMessage asks the client to show text in its error overlay,
+// or to hide the overlay if text is empty.
+func newErrorMessage(text string) (message string) {
+	type errorMessage struct {
+		Error string `json:"error"`
+	}
+
+	b, err := json.Marshal(errorMessage{Error: text})
 	maybeBail(err)
 	message = string(b)
 	return message
@@ -160,29 +1287,168 @@ func webHandler(ws *websocket.Conn) {
 	log.Debug("Entering webHandler")
 
 	ticker, tickerShutdown := newTicker(1 * time.Second)
-	notifier, notifierShutdown := newWatcher(*flagContentDir, *flagNotifyRegexp)
+	changes := subscribeChanges()
+	messages := subscribe()
+	client := registerClient(ws.Request(), messages)
+	defer func() {
+		close(tickerShutdown)
+		unsubscribeChanges(changes)
+		unsubscribe(messages)
+		unregisterClient(client)
+		broadcastPresence()
+	}()
+
+	// messages to the client are numbered (see resync.go), and put
+	// through -chaos
+	seq := 0
+	send := func(m string) error {
+		seq++
+		ok, err := chaos(m)
+		if err != nil {
+			ws.Close()
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		return sendMessage(ws, withSeq(m, seq))
+	}
+
+	if *flagPresence {
+		if err := send(newClientMessage(client.ID)); err != nil {
+			log.Info("client went away: %s", err)
+			return
+		}
+		broadcastPresence()
+	}
+
+	if text := currentErrorText(); text != "" {
+		if err := send(newErrorMessage(text)); err != nil {
+			log.Info("client went away: %s", err)
+			return
+		}
+	}
+
+	if reloadsPaused() {
+		if err := send(newPausedMessage(true)); err != nil {
+			log.Info("client went away: %s", err)
+			return
+		}
+	}
 
+	// read what the client sends us, noticing when it goes away
+	incoming := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(incoming)
+		for {
+			var m string
+			if err := receiveMessage(ws, &m); err != nil {
+				log.Debug("client connection closed: %s", err)
+				return
+			}
+			select {
+			case incoming <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// stylesheets can be swapped in place, anything else needs a reload
+	var changedCSS []string
 	var somethingChanged = false
+	var reason string
+	var clientPaused = false
+	noteChange := func(change contentChange) {
+		note, rel := change.event, change.rel
+		switch {
+		case !settingsFor(rel).watches(rel):
+		case !client.shows(rel):
+			log.Debug("client %d isn't showing %s", client.ID, rel)
+		case path.Ext(rel) == ".css":
+			log.Notice("stylesheet refresh needed because: %s", note)
+			changedCSS = append(changedCSS, "/"+rel)
+		default:
+			log.Notice("reload needed because: %s", note)
+			somethingChanged = true
+			reason = rel + " changed"
+		}
+	}
 Loop:
 	for {
 		select {
-		case note := <-notifier:
-			log.Notice("reload needed because: %s", note)
-			somethingChanged = true
+		case change := <-changes:
+			noteChange(change)
+		case m, ok := <-incoming:
+			if !ok {
+				break Loop
+			}
+			decoded := handleClientMessage(m, messages)
+			if decoded.Pause != nil {
+				log.Info("client paused reloads: %t", *decoded.Pause)
+				clientPaused = *decoded.Pause
+			}
+			moved := decoded.User != "" && client.setUser(decoded.User)
+			if decoded.Page != "" {
+				client.setPage(decoded.Page)
+				moved = true
+			}
+			if decoded.Loaded != nil {
+				client.setLoaded(decoded.Loaded)
+			}
+			if decoded.Since != nil {
+				// catch up on what the client's missed
+				missed, kept := changesSince(*decoded.Since)
+				for _, change := range missed {
+					noteChange(change)
+				}
+				if !kept {
+					log.Notice("reload needed because: client %d missed too many changes", client.ID)
+					somethingChanged, reason = true, "changes were missed"
+				}
+				err := send(newErrorMessage(currentErrorText()))
+				if err == nil {
+					err = send(newPausedMessage(reloadsPaused()))
+				}
+				if err != nil {
+					log.Info("client went away: %s", err)
+					break Loop
+				}
+			}
+			if moved {
+				broadcastPresence()
+			}
+		case <-client.disconnect:
+			break Loop
+		case m := <-messages:
+			log.Info("sending message: %s", m)
+			if err := send(m); err != nil {
+				log.Info("client went away: %s", err)
+				break Loop
+			}
 		case _ = <-ticker:
 			log.Debug("handling ticker")
-			if somethingChanged == true {
-				m := newReloadMessage()
+			if somethingChanged == true && !clientPaused && !reloadsPaused() {
+				m := newReloadMessage(reason)
 				log.Notice("sending reload message: %s", m)
-
-				err := websocket.Message.Send(ws, m)
-				maybeBail(err)
+				if err := send(m); err != nil {
+					log.Info("client went away: %s", err)
+				}
 
 				somethingChanged = false
-				close(tickerShutdown)
-				close(notifierShutdown)
 				break Loop
 			}
+			if len(changedCSS) > 0 {
+				m := newCSSMessage(changedCSS)
+				log.Notice("sending stylesheet message: %s", m)
+				if err := send(m); err != nil {
+					log.Info("client went away: %s", err)
+					break Loop
+				}
+				changedCSS = nil
+			}
 		}
 	}
 	log.Debug("Leaving webHandler")
@@ -204,20 +1470,51 @@ func FilteringFileServer(root http.FileSystem) http.Handler {
 	return &filteringFileServer{root}
 }
 
-func buildSnippet(addr string, port string) ([]byte, error) {
+// snippetInfo is what the snippet template needs to know.
+type snippetInfo struct {
+	Addr    string
+	Port    string
+	Sync    bool
+	Toolbar bool
+
+	// milliseconds to count down before reloading, 0 to reload at once
+	ReloadDelay int64
+
+	// JSON object mapping keyboard shortcut actions to keys
+	Keymap string
+
+	// whether there's an -inject-css stylesheet to link to
+	InjectCSS bool
+
+	// JSON array of the wiki's language roots
+	Languages string
+
+	// whether the toolbar may take and roll back snapshots
+	Snapshots bool
+
+	// whether reviewers may comment on the page
+	Comments bool
+
+	// whether the toolbar shows who else is viewing the page
+	Presence bool
+
+	// whether to tell the server which Markdown files the page loaded
+	TargetedReload bool
+
+	// the number of the last change before the page was served
+	Version int
+}
+
+func buildSnippet(info snippetInfo) ([]byte, error) {
 
 	var buffer bytes.Buffer
-	type Info struct {
-		Addr string
-		Port string
-	}
 
 	t, err := template.New("snippet").Parse(snippetTmpl)
 	if err != nil {
 		return nil, err
 	}
 
-	err = t.Execute(&buffer, Info{addr, port})
+	err = t.Execute(&buffer, info)
 	if err != nil {
 		return nil, err
 	}
@@ -228,13 +1525,93 @@ func buildSnippet(addr string, port string) ([]byte, error) {
 func (f *filteringFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	snippet, err := buildSnippet(*flagAddr, *flagPort)
+	snippet, err := buildSnippet(snippetInfo{
+		Addr:    *flagAddr,
+		Port:    *flagPort,
+		Sync:    *flagSync,
+		Toolbar: *flagToolbar,
+
+		ReloadDelay: int64(*flagReloadDelay / time.Millisecond),
+		Keymap:      keymapJSON(),
+		InjectCSS:   *flagInjectCSS != "",
+		Languages:   languagesJSON(),
+		Snapshots:   canSnapshot() == nil,
+		Comments:    *flagComments,
+		Presence:    *flagPresence && *flagToolbar,
+
+		TargetedReload: *flagTargetedReload,
+		Version:        lastChange(),
+	})
 	maybeBail(err)
 
+	// a theme picked at /_themes overrides the wiki's own
+	theme := requestTheme(w, r)
+	if theme != "" {
+		snippet = append(themeStylesheet(theme), snippet...)
+	}
+	if *flagPrefetch && isPageShell(r) {
+		snippet = append(prefetchLinks(r), snippet...)
+	}
+
 	log.Debug("serving: %s", r.URL.String())
+
+	// files below the content directory can have settings of their own
+	rel := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if *flagLazyWatch {
+		watchLazily(path.Dir(rel))
+	}
+	settings := settingsFor(rel)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		// a directory's own settings apply to its index page
+		settings = settingsFor(path.Join(rel, "index.html"))
+	}
+	if settings.ignored(rel) {
+		http.NotFound(w, r)
+		return
+	}
+	for k, v := range settings.headers {
+		w.Header().Set(k, v)
+	}
+	sendEarlyHints(w, r)
+	processRel := rel
+	if strings.HasSuffix(r.URL.Path, "/") {
+		processRel = path.Join(rel, "index.html")
+	}
+	ctx := newProcessorContext(processRel, "http://"+r.Host, false)
+
+	// stand in for missing .md files with converted .adoc, .rst, ...
+	converted, err := convertSource(f.root, r.URL.Path)
+	if err != nil {
+		log.Error("unable to convert %s: %s", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if converted != nil {
+		log.Notice("serving converted content for %s", r.URL.Path)
+		converted, err = process(converted, ctx)
+		if err != nil {
+			log.Error("unable to process %s: %s", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordDepends(rel, ctx.deps)
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("X-Via-FilteringFileServer", "Converted")
+		if cacheMarkdown(w, r, converted) {
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(converted)))
+		_, err = w.Write(converted)
+		maybeBail(err)
+		return
+	}
+
 	recorder := httptest.NewRecorder()
-	h := http.FileServer(f.root)
-	h.ServeHTTP(recorder, r)
+	if !serveGallery(recorder, r, f.root) {
+		h := http.FileServer(f.root)
+		h.ServeHTTP(recorder, r)
+	}
+	body := recorder.Body.Bytes()
 
 	// we copy the original headers first
 	for k, v := range recorder.Header() {
@@ -247,45 +1624,102 @@ func (f *filteringFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		w.Header()[k] = v
 	}
 
+	// server side transformations
+	if recorder.Code == http.StatusOK {
+		ext := path.Ext(r.URL.Path)
+		if ext == ".md" {
+			body, err = process(body, ctx)
+			if err != nil {
+				log.Error("unable to process %s: %s", r.URL.Path, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			recordDepends(rel, ctx.deps)
+			if theme != "" && path.Base(r.URL.Path) == "navigation.md" {
+				body = themeGimmickRegexp.ReplaceAll(body, nil)
+			}
+			if *flagRender && wantsHTML(r) {
+				body, err = renderMarkdown(r, body)
+				if err != nil {
+					log.Error("unable to render %s: %s", r.URL.Path, err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			}
+		} else if _, ok := csvSeparator(ext); ok && wantsHTML(r) {
+			body, err = csvPage(r, body, settings.csvMaxRows)
+			if err != nil {
+				log.Error("unable to render %s: %s", r.URL.Path, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+	}
+
 	// is content HTML?
 	contentType := w.Header().Get("Content-Type")
 	log.Debug("content type is %s", contentType)
 	isHTML, err := regexp.MatchString("^text/html.*", contentType)
 	maybeBail(err)
 
+	if isHTML {
+		var charset string
+		body, charset = prepareHTML(r.URL.Path, body)
+		w.Header().Set("Content-Type", withCharset(contentType, charset))
+		body, err = process(body, ctx)
+		if err != nil {
+			log.Error("unable to process %s: %s", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if *flagEarlyHints && recorder.Code == http.StatusOK && isPageShell(r) {
+			recordStylesheets(r.URL.Path, body)
+		}
+	}
+
 	// does content contain our marker (and where is it?)?
-	i := bytes.Index(recorder.Body.Bytes(), []byte("</head>"))
+	i := bytes.Index(body, []byte("</head>"))
 	log.Debug("splice location found at position %d", i)
 
 	if isHTML && i >= 0 {
 		// Kilroy was here
 		log.Notice("serving modified content for " + r.URL.Path)
 		w.Header().Set("X-Via-FilteringFileServer", "Filtered")
+		cacheInjected(w)
 
 		// update Content-Length header with correct value
 		w.Header().Set("Content-Length",
-			strconv.Itoa(len(recorder.Body.Bytes())+len(snippet)))
+			strconv.Itoa(len(body)+len(snippet)))
+		w.WriteHeader(recorder.Code)
 
 		// write body with snippet spliced in
-		_, err = w.Write(recorder.Body.Bytes()[:i])
+		_, err = w.Write(body[:i])
 		maybeBail(err)
 		_, err = w.Write(snippet)
 		maybeBail(err)
-		_, err = w.Write(recorder.Body.Bytes()[i:])
+		_, err = w.Write(body[i:])
 		maybeBail(err)
 	} else {
 		// Kilroy was here
 		log.Notice("serving unaltered content for " + r.URL.Path)
 		w.Header().Set("X-Via-FilteringFileServer", "Skipped")
+		if recorder.Code == http.StatusOK && !isHTML && path.Ext(r.URL.Path) == ".md" && cacheMarkdown(w, r, body) {
+			return
+		}
 
-		// send the original body
-		_, err = w.Write(recorder.Body.Bytes())
+		// send the (possibly transformed) body
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(recorder.Code)
+		_, err = w.Write(body)
 		maybeBail(err)
 	}
 }
 
 func main() {
 	flag.Parse()
+	maybeBail(flagsFromEnvironment())
 
 	if *flagVerbose {
 		setupLogging(logging.INFO)
@@ -295,8 +1729,135 @@ func main() {
 		setupLogging(logging.ERROR)
 	}
 
-	http.Handle("/_reloader", websocket.Handler(webHandler))
-	http.Handle("/", FilteringFileServer(http.Dir(*flagContentDir)))
+	if *flagConfig == "" {
+		*flagConfig = filepath.Join(*flagContentDir, ".mdwiki-dev.yaml")
+	}
+	maybeBail(loadConfig(*flagConfig))
+	maybeBail(checkSymlinkPolicy(*flagFollowSymlinks))
+	maybeBail(checkWatchBackend(*flagWatchBackend))
+	maybeBail(checkCacheMode(*flagCacheMode))
+	maybeBail(checkChaos())
+	*flagWatchBackend = resolveWatchBackend(*flagWatchBackend)
+	maybeBail(openContentSource(*flagSource))
+	maybeBail(compileNotifyRegexp())
+	maybeBail(registerMimeTypes())
+	maybeBail(registerPlugins())
+	maybeBail(compileRules())
+	maybeBail(compileInterwiki())
+	maybeBail(checkACL())
+	maybeBail(checkSFTP())
+	maybeBail(checkComments())
+	maybeBail(checkBroker())
+	maybeBail(checkHighlightStyle())
+	maybeBail(compileTypography())
+	maybeBail(checkTasks())
+	maybeBail(checkDiagnosticsFormat(*flagDiagnosticsFormat))
+	applyReadOnly()
+
+	if flag.NArg() > 0 {
+		run, ok := subcommands[flag.Arg(0)]
+		if !ok {
+			log.Fatalf("unknown command %q", flag.Arg(0))
+		}
+		maybeBail(run(flag.Args()[1:]))
+		return
+	}
+
+	if len(cfg.Assets) > 0 {
+		go watchAssets(*flagContentDir)
+	}
+
+	var err error
+	site, err = newSiteIndex(*flagContentDir)
+	maybeBail(err)
+	loadDiffBaseline(*flagContentDir)
 
-	log.Fatal(http.ListenAndServe(*flagAddr+":"+*flagPort, nil))
+	onContentChange(previewSaved)
+	onContentChange(site.contentChanged)
+	onContentChange(recordHistory)
+	if *flagProtect {
+		// before updateDiff forgets the page
+		onContentChange(protectDeletion)
+	}
+	onContentChange(updateDiff)
+	onContentChange(broadcastChange)
+	if activeBroker != nil {
+		onContentChange(publishChange)
+		supervise("broker relay", relayChanges)
+	}
+	if *flagLint {
+		onContentChange(lintChange)
+	}
+	if len(cfg.Webhooks) > 0 {
+		onContentChange(notifyWebhooks)
+	}
+	if *flagSass != "" {
+		go compileSass(*flagContentDir)
+		onContentChange(sassChange)
+	}
+	supervise("watcher", func() { watchContent(*flagContentDir) })
+	startTasks()
+	if *flagSFTP != "" {
+		go serveSFTP(*flagSFTP)
+	}
+	supervise("budget", func() { watchBudget(time.Minute) })
+
+	if *flagInjectCSS != "" {
+		supervise("inject-css", watchInjectedCSS)
+	}
+
+	if *flagPauseOnStart {
+		setReloadsPaused(true)
+	}
+
+	serve(*flagAddr+":"+*flagPort, recordTraffic(logAccess(authenticate(limitInflight(serverHandler())))))
+}
+
+// serverHandler registers the server's handlers and returns the
+// handler that answers every request.
+func serverHandler() http.Handler {
+	http.Handle("/_reloader", websocket.Handler(webHandler))
+	http.Handle("/_editor", websocket.Handler(editorHandler))
+	http.HandleFunc("/_status", statusHandler)
+	http.HandleFunc("/_healthz", healthzHandler)
+	http.HandleFunc("/_agent", agentEndpoint)
+	http.HandleFunc("/_themes", themesHandler)
+	http.HandleFunc("/_inject.css", injectedCSSHandler)
+	http.HandleFunc("/_pause", pauseHandler)
+	http.HandleFunc("/_history", historyHandler)
+	http.HandleFunc("/_analytics", analyticsHandler)
+	http.HandleFunc("/_api/history", historyAPIHandler)
+	http.HandleFunc("/_api/audit", auditHandler)
+	http.HandleFunc("/_diff/", diffHandler)
+	http.HandleFunc("/_api/spelling/", spellingHandler)
+	http.HandleFunc("/_api/stats", statsHandler)
+	http.HandleFunc("/_api/languages", languagesHandler)
+	http.HandleFunc("/_api/pages", pagesHandler)
+	http.HandleFunc("/_api/pages/", pagesHandler)
+	http.HandleFunc("/_api/backlinks/", backlinksHandler)
+	http.HandleFunc("/_api/related/", relatedHandler)
+	http.HandleFunc("/_api/search", searchHandler)
+	http.HandleFunc("/_search", searchHandler)
+	http.HandleFunc("/_api/mv", moveHandler)
+	http.HandleFunc("/_api/trash", trashHandler)
+	http.HandleFunc("/_api/trash/", trashHandler)
+	http.HandleFunc("/_api/snapshots", snapshotsHandler)
+	http.HandleFunc("/_api/snapshots/", snapshotsHandler)
+	http.HandleFunc("/_api/reviews", reviewsHandler)
+	http.HandleFunc("/_api/screenshot", screenshotHandler)
+	http.HandleFunc("/_api/comments", commentsHandler)
+	http.HandleFunc("/_api/comments/", commentsHandler)
+	http.HandleFunc("/_api/tags", tagsHandler)
+	http.HandleFunc("/_auth/", authHandler)
+	http.HandleFunc("/_api/glossary", glossaryHandler)
+	http.HandleFunc("/"+tagsDirName+"/", tagPagesHandler)
+	http.HandleFunc("/_api/clients", clientsHandler)
+	http.HandleFunc("/_api/clients/", clientsHandler)
+	http.HandleFunc("/_api/preview", previewHandler)
+	http.HandleFunc("/_api/preview/", previewHandler)
+	http.HandleFunc("/_graphql", graphqlHandler)
+	http.HandleFunc("/"+highlightCSSName, highlightCSSHandler)
+	http.Handle("/_thumbs/", ThumbnailServer(contentFS{contentFileSystem()}, *flagThumbCache))
+	http.Handle("/", FilteringFileServer(contentFS{contentFileSystem()}))
+	return applyRules(applyRedirects(serveMocks(http.DefaultServeMux)))
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// MIME types we know better than Go does
+var defaultMimeTypes = map[string]string{
+	".map": "application/json",
+}
+
+// mimeOverrides are the -mime flags, as ext=type pairs, in order.
+var mimeOverrides []string
+
+// mimeFlag lets the user set the Content-Type served for an extension,
+// e.g. -mime ".mdx=text/markdown".
+type mimeFlag struct{}
+
+func (m *mimeFlag) String() string {
+	return strings.Join(mimeOverrides, ",")
+}
+
+func (m *mimeFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], ".") || parts[1] == "" {
+		return fmt.Errorf("expected .ext=type, got %q", value)
+	}
+	mimeOverrides = append(mimeOverrides, value)
+	return nil
+}
+
+func init() {
+	flag.Var(&mimeFlag{}, "mime",
+		"set the Content-Type for an extension, e.g. \".mdx=text/markdown\" (repeatable)")
+}
+
+// registerMimeTypes teaches the mime package our types: the defaults,
+// then the mime section of the config file, then -mime, each winning
+// over the ones before.  Text types without a charset get utf-8.
+func registerMimeTypes() error {
+	register := func(ext string, typ string) error {
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			return fmt.Errorf("unable to register %s as %s: %s", ext, typ, err)
+		}
+		log.Debug("serving %s as %s", ext, mime.TypeByExtension(ext))
+		return nil
+	}
+
+	for ext, typ := range defaultMimeTypes {
+		if err := register(ext, typ); err != nil {
+			return err
+		}
+	}
+	for ext, typ := range cfg.Mime {
+		if err := register(ext, typ); err != nil {
+			return err
+		}
+	}
+	for _, override := range mimeOverrides {
+		parts := strings.SplitN(override, "=", 2)
+		if err := register(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
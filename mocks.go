@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the directory of mocked API endpoints, in the content directory
+const mocksDirName = "_mocks"
+
+// A mock is a canned API response, read from a JSON or YAML file in
+// _mocks named for the endpoint: GET__api_users.json answers GET
+// /api/users.  The file can say otherwise with method and path.  A
+// body that's a string is sent as it is, anything else as JSON.
+type mock struct {
+	Method  string            `yaml:"method" json:"method"`
+	Path    string            `yaml:"path" json:"path"`
+	Status  int               `yaml:"status" json:"status"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	Body    interface{}       `yaml:"body" json:"body"`
+	Latency string            `yaml:"latency" json:"latency"` // e.g. "250ms"
+}
+
+// readMock reads a mock file, filling in the method and path from its
+// name.
+func readMock(name string) (*mock, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m mock
+	if path.Ext(name) == ".json" {
+		err = json.Unmarshal(data, &m)
+	} else {
+		err = yaml.Unmarshal(data, &m)
+		m.Body = jsonCompatible(m.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	if i := strings.Index(base, "_"); i > 0 {
+		if m.Method == "" {
+			m.Method = base[:i]
+		}
+		if m.Path == "" {
+			m.Path = strings.Replace(base[i+1:], "_", "/", -1)
+		}
+	}
+	if m.Method == "" || m.Path == "" {
+		return nil, fmt.Errorf("no method or path, name it like GET__api_users.json")
+	}
+	m.Method = strings.ToUpper(m.Method)
+	if !strings.HasPrefix(m.Path, "/") {
+		m.Path = "/" + m.Path
+	}
+	if m.Status == 0 {
+		m.Status = http.StatusOK
+	}
+	return &m, nil
+}
+
+// jsonCompatible turns the map[interface{}]interface{}s that YAML
+// gives us into map[string]interface{}s that encoding/json can handle.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonCompatible(e)
+		}
+	}
+	return v
+}
+
+// findMock returns the mock for a request, or nil if there isn't one.
+// The mocks are read afresh every time, so they can be edited while
+// the pages that use them are being worked on.
+func findMock(r *http.Request) *mock {
+	dir := filepath.Join(*flagContentDir, mocksDirName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	for _, fi := range files {
+		switch filepath.Ext(fi.Name()) {
+		case ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+		m, err := readMock(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			log.Warning("ignoring mock %s: %s", fi.Name(), err)
+			continue
+		}
+		if m.Path == r.URL.Path && (m.Method == method || m.Method == "ANY") {
+			return m
+		}
+	}
+	return nil
+}
+
+// serveMocks wraps a handler so that mocked endpoints are answered
+// from _mocks.
+func serveMocks(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(filepath.Join(*flagContentDir, mocksDirName)); err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		m := findMock(r)
+		if m == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		contentType := "text/plain; charset=utf-8"
+		switch b := m.Body.(type) {
+		case nil:
+		case string:
+			body = []byte(b)
+		default:
+			var err error
+			body, err = json.MarshalIndent(b, "", "  ")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			contentType = "application/json"
+		}
+		if m.Latency != "" {
+			latency, err := time.ParseDuration(m.Latency)
+			if err != nil {
+				log.Warning("ignoring latency of mock %s %s: %s", m.Method, m.Path, err)
+			}
+			time.Sleep(latency)
+		}
+
+		log.Info("serving mock %s %s", m.Method, m.Path)
+		w.Header().Set("Content-Type", contentType)
+		for k, v := range m.Headers {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("X-Via-FilteringFileServer", "Mocked")
+		w.WriteHeader(m.Status)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcConfig is auth's oidc section, which signs users in with Google,
+// GitHub or any OpenID Connect issuer.  The redirect URL is the
+// server's /_auth/callback, as registered with the provider.
+type oidcConfig struct {
+	Provider     string `yaml:"provider"` // google, github or oidc
+	Issuer       string `yaml:"issuer"`   // for oidc, e.g. https://login.example.com
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+
+	// Allowed lists who may sign in: user names (GitHub logins, or
+	// email addresses) or @domain for everyone with a verified address
+	// there.  Domains are matched against the address the provider
+	// reports, not the user name, so a GitHub user only matches one if
+	// their address on GitHub is public.  Anyone the provider knows
+	// may, if it's empty.
+	Allowed []string `yaml:"allowed"`
+
+	// SessionSecret signs the session cookies; a random one is made
+	// at startup otherwise, so restarting signs everyone out.
+	SessionSecret string `yaml:"session_secret"`
+}
+
+const (
+	sessionCookieName = "mdwds_session"
+	stateCookieName   = "mdwds_oauth_state"
+	sessionLifetime   = 24 * time.Hour
+)
+
+// an OAuth2 provider's endpoints
+type oidcEndpoints struct {
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	UserInfo      string `json:"userinfo_endpoint"`
+}
+
+var (
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+	sessionKey []byte
+
+	// discovered the first time someone signs in
+	oidcDiscovery struct {
+		sync.Mutex
+		endpoints *oidcEndpoints
+	}
+)
+
+func oidcEnabled() bool {
+	return cfg.Auth.OIDC.Provider != ""
+}
+
+// checkOIDC checks auth's oidc section.
+func checkOIDC() error {
+	c := cfg.Auth.OIDC
+	if c.Provider == "" {
+		return nil
+	}
+	switch c.Provider {
+	case "google", "github":
+	case "oidc":
+		if c.Issuer == "" {
+			return fmt.Errorf("auth: oidc: the oidc provider needs an issuer")
+		}
+	default:
+		return fmt.Errorf("auth: oidc: the provider must be google, github or oidc, not %q", c.Provider)
+	}
+	if c.ClientID == "" || c.ClientSecret == "" || c.RedirectURL == "" {
+		return fmt.Errorf("auth: oidc: client_id, client_secret and redirect_url are needed")
+	}
+	if u, err := url.Parse(c.RedirectURL); err != nil || u.Path != "/_auth/callback" {
+		return fmt.Errorf("auth: oidc: redirect_url must be the server's /_auth/callback")
+	}
+	if c.SessionSecret != "" {
+		sessionKey = []byte(c.SessionSecret)
+	} else {
+		sessionKey = make([]byte, 32)
+		if _, err := rand.Read(sessionKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpoints returns the provider's endpoints, asking an OIDC issuer
+// for them the first time.
+func (c oidcConfig) endpoints() (*oidcEndpoints, error) {
+	switch c.Provider {
+	case "github":
+		return &oidcEndpoints{"https://github.com/login/oauth/authorize",
+			"https://github.com/login/oauth/access_token", "https://api.github.com/user"}, nil
+	case "google":
+		c.Issuer = "https://accounts.google.com"
+	}
+	oidcDiscovery.Lock()
+	defer oidcDiscovery.Unlock()
+	if oidcDiscovery.endpoints != nil {
+		return oidcDiscovery.endpoints, nil
+	}
+	resp, err := oidcClient.Get(strings.TrimSuffix(c.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: OIDC discovery: %s", c.Issuer, resp.Status)
+	}
+	var e oidcEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, err
+	}
+	if e.Authorization == "" || e.Token == "" || e.UserInfo == "" {
+		return nil, fmt.Errorf("%s: OIDC discovery: missing endpoints", c.Issuer)
+	}
+	oidcDiscovery.endpoints = &e
+	return &e, nil
+}
+
+// allowed reports whether the config lets someone sign in, as name,
+// with the verified address email ("" if there isn't one).
+func (c oidcConfig) allowed(name string, email string) bool {
+	if len(c.Allowed) == 0 {
+		return true
+	}
+	for _, a := range c.Allowed {
+		if strings.EqualFold(a, name) || email != "" && strings.EqualFold(a, email) ||
+			strings.HasPrefix(a, "@") && email != "" && strings.HasSuffix(strings.ToLower(email), strings.ToLower(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+func sign(value string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A sessionValue is what a session cookie says, as JSON, so that names
+// and groups can have anything in them (Auth0 subjects look like
+// auth0|123).
+type sessionValue struct {
+	Name    string   `json:"name"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"expires"`
+}
+
+// sessionCookie is a signed sessionValue cookie.
+func sessionCookie(p *principal) *http.Cookie {
+	expires := time.Now().Add(sessionLifetime)
+	b, err := json.Marshal(sessionValue{p.Name, p.Groups, expires.Unix()})
+	maybeBail(err)
+	value := base64.RawURLEncoding.EncodeToString(b)
+	return &http.Cookie{Name: sessionCookieName, Value: value + "." + sign(value), Path: "/",
+		Expires: expires, HttpOnly: true, Secure: strings.HasPrefix(cfg.Auth.OIDC.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode}
+}
+
+// sessionPrincipal returns who the request's session cookie is for,
+// nil if it hasn't a good one.
+func sessionPrincipal(r *http.Request) *principal {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(sign(c.Value[:i])), []byte(c.Value[i+1:])) {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c.Value[:i])
+	if err != nil {
+		return nil
+	}
+	var v sessionValue
+	if err := json.Unmarshal(b, &v); err != nil || v.Name == "" || time.Now().Unix() > v.Expires {
+		return nil
+	}
+	return &principal{Name: v.Name, Groups: v.Groups}
+}
+
+// signIn sends the browser to the provider, to come back to next.
+func signIn(w http.ResponseWriter, r *http.Request, next string) {
+	c := cfg.Auth.OIDC
+	e, err := c.endpoints()
+	if err != nil {
+		log.Error("unable to sign in with %s: %s", c.Provider, err)
+		http.Error(w, "unable to sign in: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	maybeBail(err)
+	state := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: stateCookieName, Value: state + "|" + next, Path: "/_auth/",
+		MaxAge: 600, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+	scope := "openid email profile"
+	if c.Provider == "github" {
+		scope = "read:user user:email"
+	}
+	q := url.Values{"response_type": {"code"}, "client_id": {c.ClientID},
+		"redirect_uri": {c.RedirectURL}, "scope": {scope}, "state": {state}}
+	http.Redirect(w, r, e.Authorization+"?"+q.Encode(), http.StatusFound)
+}
+
+// exchange trades the code the provider sent back for the user, and
+// their verified address, if the provider gave one.
+func (c oidcConfig) exchange(code string) (*principal, string, error) {
+	e, err := c.endpoints()
+	if err != nil {
+		return nil, "", err
+	}
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code},
+		"redirect_uri": {c.RedirectURL}, "client_id": {c.ClientID}, "client_secret": {c.ClientSecret}}
+	req, err := http.NewRequest("POST", e.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := oidcRequest(req, &token); err != nil {
+		return nil, "", err
+	}
+	if token.AccessToken == "" {
+		return nil, "", fmt.Errorf("no access token: %s", token.Error)
+	}
+
+	// the user info is asked for over TLS with the token, so there's no
+	// ID token signature to check
+	req, err = http.NewRequest("GET", e.UserInfo, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	var info struct {
+		Login         string   `json:"login"` // GitHub
+		Email         string   `json:"email"`
+		EmailVerified *bool    `json:"email_verified"`
+		Subject       string   `json:"sub"`
+		Groups        []string `json:"groups"`
+	}
+	if err := oidcRequest(req, &info); err != nil {
+		return nil, "", err
+	}
+	p := &principal{Name: info.Login, Groups: info.Groups}
+	email := ""
+	if info.Email != "" && (info.EmailVerified == nil || *info.EmailVerified) {
+		email = info.Email
+	}
+	if p.Name == "" {
+		p.Name = email
+	}
+	if p.Name == "" {
+		p.Name = info.Subject
+	}
+	if p.Name == "" {
+		return nil, "", fmt.Errorf("the provider didn't say who signed in")
+	}
+	return p, email, nil
+}
+
+func oidcRequest(req *http.Request, v interface{}) error {
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL.Host, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// authHandler serves /_auth/login, /_auth/callback (where the provider
+// sends the browser back) and /_auth/logout.
+func authHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/_auth/login":
+		next := r.URL.Query().Get("next")
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+			next = "/"
+		}
+		signIn(w, r, next)
+	case "/_auth/callback":
+		c, err := r.Cookie(stateCookieName)
+		parts := []string{"", "/"}
+		if err == nil {
+			parts = strings.SplitN(c.Value, "|", 2)
+		}
+		if len(parts) != 2 || parts[0] == "" || r.URL.Query().Get("state") != parts[0] {
+			http.Error(w, "bad state, try signing in again", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: stateCookieName, Path: "/_auth/", MaxAge: -1})
+		p, email, err := cfg.Auth.OIDC.exchange(r.URL.Query().Get("code"))
+		if err != nil {
+			log.Warning("unable to sign in with %s: %s", cfg.Auth.OIDC.Provider, err)
+			http.Error(w, "unable to sign in: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		if !cfg.Auth.OIDC.allowed(p.Name, email) {
+			log.Warning("turning away %s, who isn't allowed", p.Name)
+			http.Error(w, p.Name+" may not sign in here", http.StatusForbidden)
+			return
+		}
+		log.Notice("%s signed in", p.Name)
+		http.SetCookie(w, sessionCookie(p))
+		http.Redirect(w, r, parts[1], http.StatusFound)
+	case "/_auth/logout":
+		http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err := w.Write([]byte("signed out\n"))
+		maybeBail(err)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// A session cookie gives back who it was made for, whatever's in their
+// name and groups.
+func TestSessionCookie(t *testing.T) {
+	for _, p := range []*principal{
+		{Name: "octocat"},
+		{Name: "auth0|123", Groups: []string{"a|b", "c,d"}},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(sessionCookie(p))
+		if got := sessionPrincipal(r); !reflect.DeepEqual(got, p) {
+			t.Errorf("the session cookie for %+v gives back %+v", p, got)
+		}
+	}
+}
+
+// @domain rules match the verified address, not the user name.
+func TestOIDCAllowed(t *testing.T) {
+	c := oidcConfig{Allowed: []string{"@example.com", "octocat"}}
+	for _, tc := range []struct {
+		name, email string
+		want        bool
+	}{
+		{"someone@example.com", "someone@example.com", true},
+		{"hubber", "hubber@example.com", true},
+		{"hubber", "", false},
+		{"mallory-example.com", "", false},
+		{"eve@example.com.evil", "eve@example.com.evil", false},
+		{"octocat", "", true},
+	} {
+		if got := c.allowed(tc.name, tc.email); got != tc.want {
+			t.Errorf("allowed(%q, %q) = %t, want %t", tc.name, tc.email, got, tc.want)
+		}
+	}
+}
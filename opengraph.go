@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"path"
+	"strings"
+)
+
+// ogPage returns the indexed page an HTML request stands for: the
+// index.md that MDwiki shows first for a directory (or its
+// index.html), or the .md file named like any other HTML file.  Link
+// unfurlers never send MDwiki's #! part, so that's the best we can do.
+func ogPage(urlPath string) *page {
+	rel := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	switch {
+	case strings.HasSuffix(urlPath, "/"):
+		rel = path.Join(rel, "index.md")
+	case path.Ext(rel) == ".html" || path.Ext(rel) == ".htm":
+		rel = strings.TrimSuffix(rel, path.Ext(rel)) + ".md"
+	default:
+		return nil
+	}
+	rel = strings.TrimPrefix(rel, "./")
+
+	site.RLock()
+	defer site.RUnlock()
+	return site.pages[rel]
+}
+
+// openGraphTags returns og: meta tags describing the page behind the
+// HTML at urlPath, with URLs made absolute using base (e.g.
+// "http://localhost:8080"), or nil if there's no such page or the HTML
+// has tags of its own.
+func openGraphTags(base string, urlPath string, body []byte) []byte {
+	if bytes.Contains(body, []byte(`property="og:`)) {
+		return nil
+	}
+	p := ogPage(urlPath)
+	if p == nil {
+		return nil
+	}
+
+	var b bytes.Buffer
+	tag := func(property string, content string) {
+		if content != "" {
+			fmt.Fprintf(&b, "<meta property=\"og:%s\" content=\"%s\">\n",
+				property, html.EscapeString(content))
+		}
+	}
+	base = strings.TrimSuffix(base, "/")
+	tag("type", "website")
+	tag("title", p.Title)
+	tag("description", p.Summary)
+	tag("url", base+urlPath)
+	if image := p.Image; image != "" {
+		if !strings.Contains(image, "://") {
+			if !strings.HasPrefix(image, "/") {
+				image = path.Join("/", path.Dir(p.Path), image)
+			}
+			image = base + image
+		}
+		tag("image", image)
+	}
+	return b.Bytes()
+}
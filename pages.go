@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A pageSummary is a page in the /_api/pages list.
+type pageSummary struct {
+	Path    string    `json:"path"`
+	Title   string    `json:"title"`
+	ModTime time.Time `json:"mtime"`
+	Words   int       `json:"words"`
+	Tags    []string  `json:"tags"`
+}
+
+// A pageDetail is what /_api/pages/<path> says about a page.
+type pageDetail struct {
+	*page
+	ReadingTime int `json:"reading_time_minutes"`
+	// Raw is the file as it is, Rendered the Markdown as it's served
+	// to MDwiki, after the processors have been over it.
+	Raw       string   `json:"raw"`
+	Rendered  string   `json:"rendered"`
+	Outgoing  []string `json:"outgoing"`  // the pages it links to
+	Backlinks []string `json:"backlinks"` // the pages that link to it
+}
+
+// outgoing returns the paths of the indexed pages that p links to.
+func (s *siteIndex) outgoing(p *page) []string {
+	seen := make(map[string]bool)
+	targets := []string{}
+	for _, link := range p.Links {
+		if target := s.resolveLink(p.Path, link); target != "" && !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// pagesHandler serves /_api/pages, the list of pages (with ?tag=
+// those with all the tags given), and /_api/pages/<path>, everything
+// about one of them.
+func pagesHandler(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_api/pages"), "/")
+	var v interface{}
+	if rel == "" {
+		pages := []pageSummary{}
+		for _, p := range site.sortedPages() {
+			if !hasTags(p, r.URL.Query()["tag"]) || !canRead(r, p.Path) {
+				continue
+			}
+			pages = append(pages, pageSummary{p.Path, p.Title, p.ModTime, p.Words, p.Tags})
+		}
+		v = pages
+	} else {
+		site.RLock()
+		p := site.pages[rel]
+		site.RUnlock()
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		raw, err := readContent(rel)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		rendered, err := process(raw, newProcessorContext(rel, "http://"+r.Host, false))
+		if err != nil {
+			log.Error("unable to process %s: %s", rel, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v = pageDetail{p, p.ReadingTime(), string(raw), string(rendered),
+			site.outgoing(p), site.backlinks(rel)}
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// globalPause holds reloads for every client while paused is set.
+var globalPause struct {
+	sync.Mutex
+	paused bool
+}
+
+func reloadsPaused() bool {
+	globalPause.Lock()
+	defer globalPause.Unlock()
+	return globalPause.paused
+}
+
+// setReloadsPaused pauses (or resumes) reloads for every client and
+// tells them so.  Held reloads go out on the next tick after resuming.
+func setReloadsPaused(paused bool) {
+	globalPause.Lock()
+	changed := globalPause.paused != paused
+	globalPause.paused = paused
+	globalPause.Unlock()
+	if changed {
+		log.Notice("live reload paused: %t", paused)
+		broadcast(newPausedMessage(paused))
+	}
+}
+
+// newPausedMessage tells the client whether the server is holding reloads.
+func newPausedMessage(paused bool) (message string) {
+	type pausedMessage struct {
+		Paused bool `json:"paused"`
+	}
+
+	b, err := json.Marshal(pausedMessage{Paused: paused})
+	maybeBail(err)
+	message = string(b)
+	return message
+}
+
+// pauseHandler serves /_pause.  POST pauses reloads for everyone,
+// DELETE (or POST with ?resume) resumes them; every method gets the
+// current state back as JSON.
+func pauseHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		_, resume := r.URL.Query()["resume"]
+		setReloadsPaused(!resume)
+	case "DELETE":
+		setReloadsPaused(false)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write([]byte(newPausedMessage(reloadsPaused())))
+	maybeBail(err)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"code.google.com/p/go.net/html"
+)
+
+// The perf command weighs each page as a browser's first visit to it
+// would: MDwiki's index.html and what it loads, navigation.md and
+// config.json, the page and its images.  Sizes are what's sent over
+// the wire, compressed where the server compresses.  A page goes over
+// budget when it weighs too much, takes too many requests, or loads an
+// asset that's too big on its own; the budgets are in the perf section
+// of the config file, e.g.
+//
+//	perf:
+//	  page_weight: 1MB
+//	  requests: 40
+//	  asset_size: 300KB
+
+// perfConfig is the perf command's budgets.
+type perfConfig struct {
+	PageWeight string `yaml:"page_weight"` // default 1MB
+	Requests   int    `yaml:"requests"`    // default 50
+	AssetSize  string `yaml:"asset_size"`  // default 500KB
+}
+
+// the budgets used unless the config file or flags say otherwise
+const (
+	defaultPageWeight = "1MB"
+	defaultRequests   = 50
+	defaultAssetSize  = "500KB"
+)
+
+// perfLargest is how many of a page's largest assets are reported.
+const perfLargest = 3
+
+// A perfAsset is something a page loads.
+type perfAsset struct {
+	URL      string `json:"url"`
+	Bytes    int64  `json:"bytes"`
+	External bool   `json:"external,omitempty"` // not weighed
+}
+
+// A perfPage is what a first visit to a page costs.
+type perfPage struct {
+	Path       string      `json:"path"`
+	Requests   int         `json:"requests"`
+	Bytes      int64       `json:"bytes"`
+	Largest    []perfAsset `json:"largest"`
+	OverBudget []string    `json:"over_budget,omitempty"`
+}
+
+// parseByteSize parses a size such as 500KB, 1.5MB or 2000.
+func parseByteSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	mult := 1.0
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(t, u.suffix) {
+			t, mult = strings.TrimSpace(strings.TrimSuffix(t, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(n * mult), nil
+}
+
+// formatByteSize is the other way round.
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// perfFetch gets u as a browser would, returning the size of what was
+// sent and, decompressed, the body, and whether it was found.
+func perfFetch(client *http.Client, u string) (int64, []byte, bool) {
+	req, err := http.NewRequest("GET", u, nil)
+	maybeBail(err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, false
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, false
+	}
+	size := int64(len(body))
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if plain, err := ioutil.ReadAll(zr); err == nil {
+				body = plain
+			}
+		}
+	}
+	return size, body, resp.StatusCode == http.StatusOK
+}
+
+// shellAssets returns what the HTML page shell loads.
+func shellAssets(shell []byte) []string {
+	var refs []string
+	z := html.NewTokenizer(bytes.NewReader(shell))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return refs
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		tok := z.Token()
+		attrs := make(map[string]string)
+		for _, a := range tok.Attr {
+			attrs[a.Key] = a.Val
+		}
+		switch tok.Data {
+		case "script", "img", "iframe", "source":
+			if attrs["src"] != "" {
+				refs = append(refs, attrs["src"])
+			}
+		case "link":
+			switch strings.ToLower(attrs["rel"]) {
+			case "stylesheet", "icon", "shortcut icon", "preload", "modulepreload":
+				refs = append(refs, attrs["href"])
+			}
+		}
+	}
+}
+
+// measurePage weighs a first visit to the page rel from the server at
+// base, whose index.html weighs shellSize and loads loads.
+func measurePage(client *http.Client, base string, rel string, shellSize int64, loads []perfAsset) perfPage {
+	p := perfPage{Path: rel, Requests: 1, Bytes: shellSize}
+	assets := append([]perfAsset{{URL: "/", Bytes: shellSize}}, loads...)
+	seen := make(map[string]bool)
+	add := func(a perfAsset) {
+		if seen[a.URL] {
+			return
+		}
+		seen[a.URL] = true
+		p.Requests++
+		p.Bytes += a.Bytes
+		assets = append(assets, a)
+	}
+	for _, a := range loads {
+		seen[a.URL] = true
+		p.Requests++
+		p.Bytes += a.Bytes
+	}
+	// MDwiki asks for these whether or not they're there
+	for _, u := range []string{"/navigation.md", "/config.json"} {
+		if size, _, ok := perfFetch(client, base+u); ok {
+			add(perfAsset{URL: u, Bytes: size})
+		}
+	}
+	size, md, _ := perfFetch(client, base+"/"+rel)
+	add(perfAsset{URL: "/" + rel, Bytes: size})
+	for _, m := range indexImageRegexp.FindAllStringSubmatch(string(md), -1) {
+		if a, ok := perfResolve(client, base, path.Dir("/"+rel), m[1]+m[2]); ok {
+			add(a)
+		}
+	}
+
+	sort.SliceStable(assets, func(i, j int) bool { return assets[i].Bytes > assets[j].Bytes })
+	if len(assets) > perfLargest {
+		assets = assets[:perfLargest]
+	}
+	p.Largest = assets
+	return p
+}
+
+// perfResolve weighs the asset ref, relative to dir, if it's not
+// inline.
+func perfResolve(client *http.Client, base string, dir string, ref string) (perfAsset, bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme == "data" {
+		return perfAsset{}, false
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return perfAsset{URL: ref, External: true}, true
+	}
+	p := u.Path
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(dir, p)
+	}
+	size, _, _ := perfFetch(client, base+p)
+	return perfAsset{URL: p, Bytes: size}, true
+}
+
+// perfBudgets are the budgets, from the config file unless flags
+// override them.
+func perfBudgets(weight string, requests int, asset string) (int64, int, int64, error) {
+	if weight == "" {
+		weight = cfg.Perf.PageWeight
+	}
+	if weight == "" {
+		weight = defaultPageWeight
+	}
+	if asset == "" {
+		asset = cfg.Perf.AssetSize
+	}
+	if asset == "" {
+		asset = defaultAssetSize
+	}
+	if requests == 0 {
+		requests = cfg.Perf.Requests
+	}
+	if requests == 0 {
+		requests = defaultRequests
+	}
+	w, err := parseByteSize(weight)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("page weight budget: %s", err)
+	}
+	a, err := parseByteSize(asset)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("asset size budget: %s", err)
+	}
+	return w, requests, a, nil
+}
+
+// perf implements the perf command, which weighs every page against
+// the performance budgets, failing if any goes over.
+func perf(args []string) error {
+	flags := flag.NewFlagSet("perf", flag.ExitOnError)
+	serverURL := flags.String("url", "", "server to weigh the pages from, e.g. http://127.0.0.1:8080; by default one is started in-process")
+	format := flags.String("format", "text", "output format, text or json")
+	weightFlag := flags.String("page-weight", "", "the most a page may weigh, e.g. 1MB (default: the config file's, or "+defaultPageWeight+")")
+	requestsFlag := flags.Int("requests", 0, "the most requests a page may take (default: the config file's, or "+strconv.Itoa(defaultRequests)+")")
+	assetFlag := flags.String("asset-size", "", "the most an asset may weigh, e.g. 300KB (default: the config file's, or "+defaultAssetSize+")")
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	weightBudget, requestBudget, assetBudget, err := perfBudgets(*weightFlag, *requestsFlag, *assetFlag)
+	if err != nil {
+		return err
+	}
+
+	site, err = newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(*serverURL, "/")
+	if base == "" {
+		server := httptest.NewServer(serverHandler())
+		defer server.Close()
+		base = server.URL
+	}
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	shellSize, shell, ok := perfFetch(client, base+"/")
+	if !ok {
+		return fmt.Errorf("no index.html at %s/", base)
+	}
+	var assets []perfAsset
+	seen := make(map[string]bool)
+	for _, ref := range shellAssets(shell) {
+		if a, ok := perfResolve(client, base, "/", ref); ok && !seen[a.URL] {
+			seen[a.URL] = true
+			assets = append(assets, a)
+		}
+	}
+
+	pages := []perfPage{}
+	over := 0
+	for _, pg := range site.sortedPages() {
+		if path.Base(pg.Path) == "navigation.md" {
+			continue
+		}
+		p := measurePage(client, base, pg.Path, shellSize, assets)
+		if p.Bytes > weightBudget {
+			p.OverBudget = append(p.OverBudget, fmt.Sprintf("weighs %s, over %s", formatByteSize(p.Bytes), formatByteSize(weightBudget)))
+		}
+		if p.Requests > requestBudget {
+			p.OverBudget = append(p.OverBudget, fmt.Sprintf("takes %d requests, over %d", p.Requests, requestBudget))
+		}
+		for _, a := range p.Largest {
+			if a.Bytes > assetBudget {
+				p.OverBudget = append(p.OverBudget, fmt.Sprintf("%s weighs %s, over %s", a.URL, formatByteSize(a.Bytes), formatByteSize(assetBudget)))
+			}
+		}
+		if len(p.OverBudget) > 0 {
+			over++
+		}
+		pages = append(pages, p)
+	}
+
+	if *format == "json" {
+		b, err := json.MarshalIndent(pages, "", "  ")
+		maybeBail(err)
+		fmt.Println(string(b))
+	} else {
+		fmt.Printf("budgets: %s a page, %d requests, %s an asset\n\n",
+			formatByteSize(weightBudget), requestBudget, formatByteSize(assetBudget))
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "page\trequests\tweight\tlargest\t")
+		for _, p := range pages {
+			mark := ""
+			if len(p.OverBudget) > 0 {
+				mark = "over budget"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s (%s)\t%s\n", p.Path, p.Requests, formatByteSize(p.Bytes),
+				p.Largest[0].URL, formatByteSize(p.Largest[0].Bytes), mark)
+		}
+		tw.Flush()
+		for _, p := range pages {
+			for _, o := range p.OverBudget {
+				fmt.Printf("%s: %s\n", p.Path, o)
+			}
+		}
+	}
+	if over > 0 {
+		return fmt.Errorf("%d of %d pages over budget", over, len(pages))
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pluginConfig declares an external plugin: a program that reads a
+// file's content on stdin and writes the transformed content on
+// stdout.  Its context (the file's path, whether it's being exported,
+// the base URL and the page's front matter) is JSON in the
+// MDWIKI_DEV_CONTEXT environment variable.  The program is either a
+// command or a WASI module, which follows the same protocol in a
+// sandbox.
+type pluginConfig struct {
+	Name     string        `yaml:"name"`
+	Command  []string      `yaml:"command"`   // run in the content directory
+	Wasm     string        `yaml:"wasm"`      // module, relative to the content directory
+	MemoryMB uint32        `yaml:"memory_mb"` // for wasm, default 64
+	Match    string        `yaml:"match"`     // regexp for the paths it handles, default \.md$
+	Timeout  time.Duration `yaml:"timeout"`   // default 10s
+}
+
+// pluginContext is what a plugin is told about the file it's given.
+type pluginContext struct {
+	Path    string                 `json:"path"`
+	Export  bool                   `json:"export"`
+	BaseURL string                 `json:"base_url"`
+	Meta    map[string]interface{} `json:"meta"`
+}
+
+// A pluginProcessor runs an external plugin as part of the pipeline.
+// Results are cached, since the same content is asked for over and over
+// while it's being edited.
+type pluginProcessor struct {
+	pluginConfig
+	match *regexp.Regexp
+	run   func(in []byte, context []byte) ([]byte, error)
+
+	sync.Mutex
+	cache map[[sha256.Size]byte][]byte
+}
+
+// no more than this many results are cached for each plugin
+const pluginCacheSize = 256
+
+func (p *pluginProcessor) Match(name string) bool {
+	return p.match.MatchString(name)
+}
+
+func (p *pluginProcessor) Process(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	context, err := json.Marshal(pluginContext{ctx.Path, ctx.Export, ctx.BaseURL, ctx.Meta})
+	if err != nil {
+		return nil, err
+	}
+
+	key := p.cacheKey(in, context)
+	p.Lock()
+	out, ok := p.cache[key]
+	p.Unlock()
+	if ok {
+		return out, nil
+	}
+
+	log.Debug("running plugin %s on %s", p.Name, ctx.Path)
+	out, err = p.run(in, context)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %s", p.Name, err)
+	}
+
+	p.Lock()
+	if len(p.cache) >= pluginCacheSize {
+		p.cache = make(map[[sha256.Size]byte][]byte)
+	}
+	p.cache[key] = out
+	p.Unlock()
+	return out, nil
+}
+
+// runCommand runs a command plugin.  WaitDelay stops a timed out
+// plugin's children, which may still hold its output open, from
+// keeping us waiting.
+func (p *pluginProcessor) runCommand(in []byte, contextJSON []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Dir = *flagContentDir
+	cmd.Env = append(os.Environ(), "MDWIKI_DEV_CONTEXT="+string(contextJSON))
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %s", p.Timeout)
+		}
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// cacheKey identifies a run of the plugin: its input, its context, and
+// the modification times of its module or any files named on its
+// command line, so that editing a plugin takes effect straight away.
+func (p *pluginProcessor) cacheKey(in []byte, context []byte) [sha256.Size]byte {
+	h := sha256.New()
+	for _, arg := range append([]string{p.Wasm}, p.Command...) {
+		if arg == "" {
+			continue
+		}
+		name := arg
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(*flagContentDir, name)
+		}
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(h, "%s@%d\x00", arg, fi.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(h, "%s\x00", arg)
+		}
+	}
+	h.Write(context)
+	h.Write([]byte{0})
+	h.Write(in)
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// registerPlugins adds the config file's plugins to the end of the
+// processor pipeline, after the built-in processors.
+func registerPlugins() error {
+	for i, pc := range cfg.Plugins {
+		if pc.Name == "" {
+			pc.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if (len(pc.Command) == 0) == (pc.Wasm == "") {
+			return fmt.Errorf("plugin %s needs a command or a wasm module (not both)", pc.Name)
+		}
+		if pc.Match == "" {
+			pc.Match = `\.md$`
+		}
+		match, err := regexp.Compile(pc.Match)
+		if err != nil {
+			return fmt.Errorf("plugin %s: bad match: %s", pc.Name, err)
+		}
+		if pc.Timeout <= 0 {
+			pc.Timeout = 10 * time.Second
+		}
+		p := &pluginProcessor{
+			pluginConfig: pc,
+			match:        match,
+			cache:        make(map[[sha256.Size]byte][]byte),
+		}
+		if pc.Wasm != "" {
+			if pc.MemoryMB == 0 {
+				pc.MemoryMB = 64
+			}
+			p.run = newWasmPlugin(pc).run
+			log.Info("registered plugin %s (%s)", pc.Name, pc.Wasm)
+		} else {
+			p.run = p.runCommand
+			log.Info("registered plugin %s (%s)", pc.Name, strings.Join(pc.Command, " "))
+		}
+		registerProcessor(p)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// With -prefetch the wiki's page links to the pages its navigation.md
+// does, the wiki's top-level pages, with rel="prefetch", so that the
+// browser fetches them when it's idle and moving around the wiki (in a
+// demo, say) doesn't wait on the network.  It's behind a flag because
+// it's more requests, for pages that may never be looked at.
+
+// maxPrefetch is the most pages prefetched.
+const maxPrefetch = 20
+
+// prefetchLinks returns the <link rel="prefetch"> tags for the pages
+// the navigation beside the page r asks for links to, that the user
+// may read.
+func prefetchLinks(r *http.Request) []byte {
+	dir := r.URL.Path
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	nav := strings.TrimPrefix(path.Join(dir, "navigation.md"), "/")
+
+	site.RLock()
+	p, ok := site.pages[nav]
+	site.RUnlock()
+	if !ok {
+		return nil
+	}
+	var b bytes.Buffer
+	seen := make(map[string]bool)
+	for _, target := range p.Links {
+		rel := site.resolveLink(nav, target)
+		if rel == "" || seen[rel] || !canRead(r, rel) {
+			continue
+		}
+		seen[rel] = true
+		href := (&url.URL{Path: "/" + rel}).EscapedPath()
+		fmt.Fprintf(&b, "<link rel=\"prefetch\" href=\"%s\">\n", html.EscapeString(href))
+		if len(seen) == maxPrefetch {
+			break
+		}
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// With -presence the toolbar shows who else is looking at the page:
+// whenever a client comes, goes or moves to another page, every client
+// is sent who's where, and which pages have an editor's unsaved
+// changes previewing, so that collaborators can keep out of each
+// other's way.  Users are who they signed in as, or without auth who
+// the client says (the name comments are signed with).
+
+// A presenceEntry is one client, as the others see it.
+type presenceEntry struct {
+	ID   int    `json:"id"`
+	User string `json:"user"`
+	Page string `json:"page"`
+}
+
+// setUser records who the client says is using it, unless they
+// signed in; it reports whether that changed anything.
+func (c *reloadClient) setUser(user string) bool {
+	user = strings.TrimSpace(user)
+	if len(user) > 100 {
+		user = user[:100]
+	}
+	clients.Lock()
+	defer clients.Unlock()
+	if c.signedIn || c.User == user {
+		return false
+	}
+	c.User = user
+	return true
+}
+
+// newClientMessage tells a client its id, so that it can tell itself
+// from the others.
+func newClientMessage(id int) string {
+	b, err := json.Marshal(struct {
+		Client int `json:"client"`
+	}{id})
+	maybeBail(err)
+	return string(b)
+}
+
+// newPresenceMessage says who's where.
+func newPresenceMessage() string {
+	type presence struct {
+		Clients []presenceEntry `json:"clients"`
+		Editing []string        `json:"editing"` // the pages with previews
+	}
+	p := presence{Clients: []presenceEntry{}, Editing: []string{}}
+	for _, c := range clientsSnapshot() {
+		p.Clients = append(p.Clients, presenceEntry{c.ID, c.User, c.Page})
+	}
+	previews.Lock()
+	for rel := range previews.files {
+		p.Editing = append(p.Editing, rel)
+	}
+	previews.Unlock()
+	sort.Strings(p.Editing)
+
+	b, err := json.Marshal(struct {
+		Presence presence `json:"presence"`
+	}{p})
+	maybeBail(err)
+	return string(b)
+}
+
+// broadcastPresence tells the clients who's where, with -presence.
+func broadcastPresence() {
+	if *flagPresence {
+		broadcast(newPresenceMessage())
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// an editor's preview lasts this long after its last update
+const previewExpiry = 2 * time.Minute
+
+// the largest preview accepted
+const previewMaxBytes = 10 << 20
+
+// A preview is an editor's unsaved buffer, served in place of the file
+// it's for.
+type preview struct {
+	data    []byte
+	modTime time.Time
+	expires time.Time
+	timer   *time.Timer
+}
+
+// previews are the unsaved buffers, by path relative to the content
+// directory.
+var previews = struct {
+	sync.Mutex
+	files map[string]*preview
+}{files: make(map[string]*preview)}
+
+// previewContent returns the preview of rel, if there is one.
+func previewContent(rel string) ([]byte, time.Time, bool) {
+	previews.Lock()
+	defer previews.Unlock()
+	p, ok := previews.files[strings.TrimPrefix(path.Clean("/"+rel), "/")]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return p.data, p.modTime, true
+}
+
+// previewChanged tells the index, the diff viewer and the clients that
+// rel's preview has come or gone.  Saved changes are left to the
+// watcher; history, lint, webhooks and the like only hear about those.
+func previewChanged(rel string) {
+	event := fsnotify.Event{Name: filepath.Join(*flagContentDir, filepath.FromSlash(rel)), Op: fsnotify.Write}
+	site.contentChanged(event, rel)
+	updateDiff(event, rel)
+	broadcastChange(event, rel)
+}
+
+// setPreview overlays data on rel until it expires.
+func setPreview(rel string, data []byte) {
+	swapPreview(rel, data, "")
+}
+
+// swapPreview overlays data on rel, as setPreview does, if the ETag
+// match (unless it's "" or *) is the current content's, checking and
+// setting it under the one lock so that of two edits based on the same
+// version only the first gets in.  It returns the content it found,
+// and false if it didn't match.
+func swapPreview(rel string, data []byte, match string) ([]byte, bool) {
+	previews.Lock()
+	p, ok := previews.files[rel]
+	var old []byte
+	if ok {
+		old = p.data
+	} else {
+		old, _ = fs.ReadFile(contentFiles(), rel)
+	}
+	if match != "" && match != "*" && match != contentETag(old) {
+		previews.Unlock()
+		return old, false
+	}
+	if ok {
+		p.timer.Stop()
+	} else {
+		p = &preview{}
+		previews.files[rel] = p
+	}
+	p.data, p.modTime, p.expires = data, time.Now(), time.Now().Add(previewExpiry)
+	p.timer = time.AfterFunc(previewExpiry, func() {
+		log.Info("preview of %s expired", rel)
+		dropPreview(rel, p)
+	})
+	previews.Unlock()
+	previewChanged(rel)
+	if !ok {
+		broadcastPresence()
+	}
+	return old, true
+}
+
+// dropPreview removes rel's preview, if it's still p (or p is nil).
+func dropPreview(rel string, p *preview) bool {
+	previews.Lock()
+	current, ok := previews.files[rel]
+	if !ok || (p != nil && current != p) {
+		previews.Unlock()
+		return false
+	}
+	current.timer.Stop()
+	delete(previews.files, rel)
+	previews.Unlock()
+	previewChanged(rel)
+	broadcastPresence()
+	return true
+}
+
+// A previewFile is an open preview, for the file server.
+type previewFile struct {
+	*bytes.Reader
+	info previewInfo
+}
+
+func (f *previewFile) Close() error {
+	return nil
+}
+
+func (f *previewFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *previewFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// previewInfo describes a preview as if it were the file.
+type previewInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi previewInfo) Name() string       { return fi.name }
+func (fi previewInfo) Size() int64        { return fi.size }
+func (fi previewInfo) Mode() fs.FileMode  { return 0644 }
+func (fi previewInfo) ModTime() time.Time { return fi.modTime }
+func (fi previewInfo) IsDir() bool        { return false }
+func (fi previewInfo) Sys() interface{}   { return nil }
+
+// openPreview opens the preview of name, a URL path, or returns nil.
+func openPreview(name string) *previewFile {
+	data, modTime, ok := previewContent(name)
+	if !ok {
+		return nil
+	}
+	return &previewFile{bytes.NewReader(data), previewInfo{path.Base(name), int64(len(data)), modTime}}
+}
+
+// a preview in the /_api/preview list
+type previewSummary struct {
+	Path    string    `json:"path"`
+	Size    int       `json:"size"`
+	Expires time.Time `json:"expires"`
+}
+
+// previewHandler serves /_api/preview/<path>, which editor plugins PUT
+// a buffer to so that it's served, and the browsers reload, before
+// it's saved.  The preview lasts until the file is saved, it's DELETEd
+// or it hasn't been updated for a while.  GET /_api/preview lists the
+// previews.
+//
+// GET /_api/preview/<path> is the file as it's served, preview or not,
+// with an ETag.  A PUT with that ETag in If-Match is refused with a 409
+// if the file (or its preview) has changed since: the answer has the
+// current version, and a three-way merge of the two edits to try
+// again with.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/_api/preview")), "/")
+	if rel == "" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		list := []previewSummary{}
+		previews.Lock()
+		for rel, p := range previews.files {
+			if !canRead(r, rel) {
+				continue
+			}
+			list = append(list, previewSummary{rel, len(p.data), p.expires})
+		}
+		previews.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+		b, err := json.MarshalIndent(list, "", "  ")
+		maybeBail(err)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		maybeBail(err)
+		return
+	}
+
+	if protectedPath(rel) || settingsFor(rel).ignored(rel) || r.Method != "GET" && !canEdit(r, rel) {
+		http.Error(w, rel+" may not be previewed", http.StatusForbidden)
+		return
+	}
+	if (r.Method == "PUT" || r.Method == "DELETE") && refuseReadOnly(w) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		data, err := readContent(rel)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", rememberVersion(data))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = w.Write(data)
+		maybeBail(err)
+		return
+	case "PUT":
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, previewMaxBytes))
+		if err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		match := r.Header.Get("If-Match")
+		old, ok := swapPreview(rel, data, match)
+		if !ok {
+			conflict := editConflict{Path: rel, ETag: rememberVersion(old), Current: string(old)}
+			if base, ok := versionFor(match); ok {
+				merged, n := merge3(string(base), string(old), string(data))
+				conflict.Merged, conflict.Conflicts = &merged, n
+			}
+			log.Warning("refusing an edit of %s based on a version that has changed", rel)
+			b, err := json.MarshalIndent(conflict, "", "  ")
+			maybeBail(err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			_, err = w.Write(b)
+			maybeBail(err)
+			return
+		}
+		w.Header().Set("ETag", rememberVersion(data))
+		log.Info("previewing %d unsaved bytes of %s", len(data), rel)
+		added, removed := lineChanges(old, data)
+		recordMutation(r, mutation{Action: "preview", Path: rel, Added: added, Removed: removed})
+	case "DELETE":
+		if !dropPreview(rel, nil) {
+			http.NotFound(w, r)
+			return
+		}
+		recordMutation(r, mutation{Action: "discard", Path: rel})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// previewSaved is the content handler that drops a preview once the
+// file it's for is saved.
+func previewSaved(event fsnotify.Event, rel string) {
+	previews.Lock()
+	p, ok := previews.files[rel]
+	previews.Unlock()
+	if ok {
+		log.Info("%s saved, dropping its preview", rel)
+		dropPreview(rel, p)
+	}
+}
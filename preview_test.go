@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Of two edits based on the same version, one gets in and the other is
+// told it conflicts, rather than silently overwriting the first.
+func TestPreviewConcurrentEdits(t *testing.T) {
+	s := startServer(t)
+	s.touch(t, "preview/page.md", "# Page\n")
+	url := s.URL + "/_api/preview/preview/page.md"
+	defer func() {
+		r, _ := http.NewRequest("DELETE", url, nil)
+		if resp, err := http.DefaultClient.Do(r); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	for round := 0; round < 10; round++ {
+		resp, _ := get(t, url)
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			t.Fatal("no ETag for the page")
+		}
+
+		codes := make(chan int, 2)
+		var wg sync.WaitGroup
+		for _, by := range []string{"one", "the other"} {
+			edit := fmt.Sprintf("# Edited by %s in round %d\n", by, round)
+			wg.Add(1)
+			go func(edit string) {
+				defer wg.Done()
+				r, err := http.NewRequest("PUT", url, strings.NewReader(edit))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r.Header.Set("If-Match", etag)
+				resp, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				codes <- resp.StatusCode
+			}(edit)
+		}
+		wg.Wait()
+		close(codes)
+
+		conflicts := 0
+		for code := range codes {
+			switch code {
+			case http.StatusConflict:
+				conflicts++
+			case http.StatusNoContent:
+			default:
+				t.Errorf("PUT answered %d", code)
+			}
+		}
+		if conflicts != 1 {
+			t.Fatalf("round %d: %d of the two edits conflicted, want 1", round, conflicts)
+		}
+	}
+}
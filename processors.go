@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A Processor transforms content on its way to the browser (or into an
+// export).  Each registered processor whose Match accepts a file's path
+// runs over it in turn, in the order they were registered.
+type Processor interface {
+	// Match reports whether the processor handles the file at path,
+	// relative to the content directory, with slashes.
+	Match(path string) bool
+
+	// Process returns the transformed content.
+	Process(in []byte, ctx *ProcessorContext) ([]byte, error)
+}
+
+// A ProcessorContext tells processors about the file being processed,
+// and lets them pass things on to the ones that follow.
+type ProcessorContext struct {
+	Path     string       // relative to the content directory, with slashes
+	Export   bool         // true when exporting rather than serving
+	BaseURL  string       // where the content is (or will be) served from, e.g. "http://localhost:8080"
+	Settings *dirSettings // the settings in effect for Path
+
+	// Meta holds the page's front matter, if it has any.
+	Meta map[string]interface{}
+
+	// the other files the content was made from (includes and the like)
+	deps []string
+}
+
+// Depends notes that the output depends on another file (relative to
+// the content directory) as well as its own, so that exports are kept
+// up to date when it changes.
+func (ctx *ProcessorContext) Depends(rel string) {
+	ctx.deps = append(ctx.deps, rel)
+}
+
+// processors, in the order they run
+var processors []Processor
+
+// registerProcessor adds a processor to the end of the pipeline.
+// Custom processors register themselves from an init function.
+func registerProcessor(p Processor) {
+	processors = append(processors, p)
+}
+
+// newProcessorContext returns the context for processing rel.
+func newProcessorContext(rel string, baseURL string, export bool) *ProcessorContext {
+	return &ProcessorContext{
+		Path:     rel,
+		Export:   export,
+		BaseURL:  strings.TrimSuffix(baseURL, "/"),
+		Settings: settingsFor(rel),
+		Meta:     make(map[string]interface{}),
+	}
+}
+
+// process runs content through every processor that matches it.
+func process(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	for _, p := range processors {
+		if !p.Match(ctx.Path) {
+			continue
+		}
+		out, err := p.Process(in, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ctx.Path, err)
+		}
+		in = out
+	}
+	return in, nil
+}
+
+// An extProcessor is a built-in processor for files with the given
+// extensions.
+type extProcessor struct {
+	exts []string
+	fn   func(in []byte, ctx *ProcessorContext) ([]byte, error)
+}
+
+func (p extProcessor) Match(name string) bool {
+	ext := path.Ext(name)
+	for _, e := range p.exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (p extProcessor) Process(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	return p.fn(in, ctx)
+}
+
+var (
+	markdownExts = []string{".md"}
+	htmlExts     = []string{".html", ".htm"}
+)
+
+// front matter: a YAML block between --- lines at the top of a page
+var frontMatterRegexp = regexp.MustCompile(`\A---\r?\n((?s:.*?)\r?\n)?---\r?\n`)
+
+// processFrontMatter strips a page's front matter, which MDwiki would
+// show as a rule and some text, keeping it in ctx.Meta.
+func processFrontMatter(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	m := frontMatterRegexp.FindSubmatchIndex(in)
+	if m == nil {
+		return in, nil
+	}
+	if m[2] >= 0 {
+		if err := yaml.Unmarshal(in[m[2]:m[3]], &ctx.Meta); err != nil {
+			log.Warning("ignoring bad front matter in %s: %s", ctx.Path, err)
+		}
+	}
+	return in[m[1]:], nil
+}
+
+// an include directive, on a line of its own
+var includeRegexp = regexp.MustCompile(`(?m)^[ \t]*<!--\s*include:?\s*(\S+?)\s*-->[ \t]*\r?$`)
+
+// includes nest no deeper than this, which also stops loops
+const maxIncludeDepth = 8
+
+// processIncludes replaces <!-- include: other.md --> lines with the
+// content of the named file, relative to the including page.
+func processIncludes(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	return expandIncludes(in, ctx.Path, ctx, 0)
+}
+
+func expandIncludes(in []byte, from string, ctx *ProcessorContext, depth int) ([]byte, error) {
+	if !includeRegexp.Match(in) {
+		return in, nil
+	}
+	if depth >= maxIncludeDepth {
+		return nil, fmt.Errorf("includes nested more than %d deep in %s", maxIncludeDepth, from)
+	}
+
+	var failed error
+	out := includeRegexp.ReplaceAllFunc(in, func(m []byte) []byte {
+		target := string(includeRegexp.FindSubmatch(m)[1])
+		rel := strings.TrimPrefix(path.Clean("/"+path.Join(path.Dir(from), target)), "/")
+		if strings.HasPrefix(target, "/") {
+			rel = strings.TrimPrefix(path.Clean(target), "/")
+		}
+		ctx.Depends(rel)
+		name := filepath.Join(*flagContentDir, filepath.FromSlash(rel))
+		if protectedPath(rel) || !symlinkAllowed(name) {
+			failed = fmt.Errorf("%s may not include %s", from, target)
+			return m
+		}
+		included, err := readContent(rel)
+		if err == nil {
+			included, err = expandIncludes(frontMatterRegexp.ReplaceAll(included, nil), rel, ctx, depth+1)
+		}
+		if err != nil {
+			failed = err
+			return m
+		}
+		return bytes.TrimRight(included, "\r\n")
+	})
+	return out, failed
+}
+
+func init() {
+	registerProcessor(extProcessor{markdownExts, processFrontMatter})
+	registerProcessor(extProcessor{markdownExts, processIncludes})
+	registerProcessor(extProcessor{markdownExts, func(in []byte, ctx *ProcessorContext) ([]byte, error) {
+		return filterCSVFences(in, ctx.Settings.csvMaxRows), nil
+	}})
+	registerProcessor(extProcessor{markdownExts, func(in []byte, ctx *ProcessorContext) ([]byte, error) {
+		return filterDiagramFences(in), nil
+	}})
+	registerProcessor(extProcessor{markdownExts, processCitations})
+	registerProcessor(extProcessor{markdownExts, processInterwiki})
+	registerProcessor(extProcessor{markdownExts, processTOC})
+	registerProcessor(extProcessor{markdownExts, processEmoji})
+	registerProcessor(extProcessor{markdownExts, processGlossary})
+	registerProcessor(extProcessor{markdownExts, processTypography})
+	registerProcessor(extProcessor{markdownExts, processHighlight})
+	registerProcessor(extProcessor{markdownExts, processBacklinks})
+	registerProcessor(extProcessor{markdownExts, processRelated})
+	registerProcessor(extProcessor{markdownExts, processDrafts})
+	registerProcessor(extProcessor{markdownExts, processReviews})
+
+	// srcsets point at /_thumbs/, which only the server has
+	registerProcessor(extProcessor{[]string{".md", ".html", ".htm"},
+		func(in []byte, ctx *ProcessorContext) ([]byte, error) {
+			if ctx.Export || !ctx.Settings.srcset {
+				return in, nil
+			}
+			return addSrcset("/"+ctx.Path, in, path.Ext(ctx.Path) == ".md"), nil
+		}})
+
+	registerProcessor(extProcessor{htmlExts, func(in []byte, ctx *ProcessorContext) ([]byte, error) {
+		if !*flagOG {
+			return in, nil
+		}
+		i := bytes.Index(in, []byte("</head>"))
+		if i < 0 {
+			return in, nil
+		}
+		if p := ogPage("/" + ctx.Path); p != nil {
+			ctx.Depends(p.Path)
+		}
+		tags := openGraphTags(ctx.BaseURL, "/"+ctx.Path, in)
+		return append(append(append([]byte(nil), in[:i]...), tags...), in[i:]...), nil
+	}})
+}
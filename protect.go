@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// files that are likely to hold secrets, which aren't served even with
+// -serve-dotfiles
+var sensitiveFilePatterns = []string{
+	"*.key", "*.pem", "*.p12", "*.pfx", "*.env", "*.kdbx",
+	"id_rsa*", "id_dsa*", "id_ecdsa*", "id_ed25519*",
+}
+
+// dot directories that are safe, and expected, to serve
+var publicDotNames = map[string]bool{
+	".well-known": true,
+}
+
+// protectedPath reports whether name, a path below the content
+// directory, is one we refuse to serve: anything inside a dot
+// directory or named like a dot file (.git/config, .ssh/id_rsa, .env),
+// unless -serve-dotfiles says otherwise, and anything named like a
+// secret.  The path is cleaned first, so however it was spelled in the
+// URL it refers to the file that would be opened.
+func protectedPath(name string) bool {
+	if strings.ContainsAny(name, "\\\x00") {
+		return true
+	}
+	// file systems that ignore case would serve ID_RSA as id_rsa
+	for _, elem := range strings.Split(strings.ToLower(path.Clean("/"+name)), "/") {
+		if strings.HasPrefix(elem, ".") && !publicDotNames[elem] && !*flagServeDotfiles {
+			return true
+		}
+		for _, pattern := range sensitiveFilePatterns {
+			if ok, _ := path.Match(pattern, elem); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProtectedPath(t *testing.T) {
+	for name, want := range map[string]bool{
+		"index.md":          false,
+		"docs/page.md":      false,
+		".well-known/x.txt": false,
+		".git/config":       true,
+		".GIT/config":       true,
+		"docs/../.git/HEAD": true,
+		"..\\.git\\config":  true,
+		".env":              true,
+		"keys/ID_RSA":       true,
+		"Secret.KEY":        true,
+		"cert.pem":          true,
+	} {
+		if got := protectedPath(name); got != want {
+			t.Errorf("protectedPath(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+// Requests that try to reach protected files, or leave the content
+// directory, by encoding the path's separators and dots.
+func TestProtectedPathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdwiki-dev-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := filepath.Join(dir, "content")
+	for name, data := range map[string]string{
+		"content/index.md":    "# Index\n",
+		"content/.git/config": "[core]\n",
+		"content/ID_RSA":      "secret\n",
+		"secret.txt":          "outside\n",
+	} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*flagContentDir = content
+	server := http.FileServer(contentFS{http.Dir(content)})
+
+	for _, raw := range []string{
+		"/.git/config",
+		"/.GIT/config",
+		"/%2egit/config",
+		"/.git%2fconfig",
+		"/%2e%2e/secret.txt",
+		"/%2e%2e%2fsecret.txt",
+		"/..%5csecret.txt",
+		"/docs/..%5c..%5csecret.txt",
+		"/ID_RSA",
+		"/id_rsa",
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.RawPath = raw
+		r.URL.Path, err = url.PathUnescape(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.ServeHTTP(w, r)
+		if w.Code == http.StatusOK {
+			t.Errorf("GET %s served %q", raw, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/index.md", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /index.md: status %d", w.Code)
+	}
+}
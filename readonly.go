@@ -0,0 +1,39 @@
+package main
+
+import "net/http"
+
+// applyReadOnly turns off, with -read-only, whatever the flags and the
+// config file ask for that would run commands as files change or on a
+// schedule, or write below the content directory: -sass, assets,
+// tasks and -protect's trash.
+func applyReadOnly() {
+	if !*flagReadOnly {
+		return
+	}
+	if *flagSass != "" {
+		log.Warning("-read-only: not compiling stylesheets with %s", *flagSass)
+		*flagSass = ""
+	}
+	if len(cfg.Assets) > 0 {
+		log.Warning("-read-only: not bundling %d assets", len(cfg.Assets))
+		cfg.Assets = nil
+	}
+	if len(cfg.Tasks) > 0 {
+		log.Warning("-read-only: not running %d tasks", len(cfg.Tasks))
+		cfg.Tasks = nil
+	}
+	if *flagProtect {
+		log.Warning("-read-only: not saving deleted pages to the trash")
+		*flagProtect = false
+	}
+}
+
+// refuseReadOnly answers a request that would change something with a
+// 403, with -read-only, reporting whether it did.
+func refuseReadOnly(w http.ResponseWriter) bool {
+	if !*flagReadOnly {
+		return false
+	}
+	http.Error(w, "the server is read-only", http.StatusForbidden)
+	return true
+}
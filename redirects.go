@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the redirects file, in the content directory's root
+const redirectsFileName = "_redirects"
+
+// A redirectRule is a line of a _redirects file, in Netlify's syntax:
+//
+//	/from [param=:value ...] /to [status][!]
+//
+// From can end in * (matched by :splat in to) and have :placeholder
+// segments.  The status is 301 by default; 200 rewrites (or proxies,
+// if to is a URL) instead of redirecting, and 404 and the like serve to
+// with that status.  Rules are ignored for paths that exist, unless
+// forced with a !.
+type redirectRule struct {
+	line   int
+	source string
+	from   *regexp.Regexp
+	params map[string]string // query parameter to placeholder
+	to     string
+	status int
+	force  bool
+}
+
+var (
+	redirectStatusRegexp      = regexp.MustCompile(`^([0-9]{3})(!?)$`)
+	redirectPlaceholderRegexp = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// parseRedirects parses a _redirects file, warning about (and leaving
+// out) the rules it can't honor.
+func parseRedirects(data []byte) []redirectRule {
+	var rules []redirectRule
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		r := redirectRule{line: i + 1, params: make(map[string]string), status: http.StatusMovedPermanently}
+		from := fields[0]
+		fields = fields[1:]
+		for len(fields) > 0 && strings.Contains(fields[0], "=") && !strings.HasPrefix(fields[0], "/") &&
+			!strings.Contains(fields[0], "://") {
+			kv := strings.SplitN(fields[0], "=", 2)
+			r.params[kv[0]] = strings.TrimPrefix(kv[1], ":")
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			log.Warning("%s:%d: no destination", redirectsFileName, r.line)
+			continue
+		}
+		r.source, r.to = from, fields[0]
+		fields = fields[1:]
+		if len(fields) > 0 {
+			if m := redirectStatusRegexp.FindStringSubmatch(fields[0]); m != nil {
+				r.status, _ = strconv.Atoi(m[1])
+				r.force = m[2] == "!"
+				fields = fields[1:]
+			}
+		}
+		if len(fields) > 0 {
+			log.Warning("%s:%d: ignoring a rule with conditions (%s)", redirectsFileName, r.line,
+				strings.Join(fields, " "))
+			continue
+		}
+		if !strings.HasPrefix(from, "/") {
+			log.Warning("%s:%d: ignoring a rule for another host", redirectsFileName, r.line)
+			continue
+		}
+
+		// /a/:b/* becomes ^/a/(?P<b>[^/]+)/(?P<splat>.*)$, and the
+		// trailing slash is optional
+		var pattern bytes.Buffer
+		pattern.WriteString("^")
+		for j, segment := range strings.Split(strings.TrimSuffix(from, "/"), "/") {
+			if j > 0 {
+				pattern.WriteString("/")
+			}
+			switch {
+			case segment == "*":
+				pattern.WriteString("(?P<splat>.*)")
+			case strings.HasPrefix(segment, ":"):
+				fmt.Fprintf(&pattern, "(?P<%s>[^/]+)", segment[1:])
+			default:
+				pattern.WriteString(regexp.QuoteMeta(segment))
+			}
+		}
+		pattern.WriteString("/?$")
+		var err error
+		if r.from, err = regexp.Compile(pattern.String()); err != nil {
+			log.Warning("%s:%d: bad source %s: %s", redirectsFileName, r.line, from, err)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// match returns the destination of the rule for a request, or false if
+// it doesn't apply.
+func (r *redirectRule) match(req *http.Request) (string, bool) {
+	m := r.from.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return "", false
+	}
+	values := make(map[string]string)
+	for i, name := range r.from.SubexpNames() {
+		if name != "" {
+			values[name] = m[i]
+		}
+	}
+	query := req.URL.Query()
+	for param, placeholder := range r.params {
+		if _, ok := query[param]; !ok {
+			return "", false
+		}
+		values[placeholder] = query.Get(param)
+	}
+	to := redirectPlaceholderRegexp.ReplaceAllStringFunc(r.to, func(p string) string {
+		if v, ok := values[p[1:]]; ok {
+			return v
+		}
+		return p
+	})
+	if len(r.params) == 0 && req.URL.RawQuery != "" && !strings.Contains(to, "?") {
+		to += "?" + req.URL.RawQuery
+	}
+	return to, true
+}
+
+// the parsed _redirects file, reread when it changes
+var redirectsFile = struct {
+	sync.Mutex
+	info  os.FileInfo
+	rules []redirectRule
+}{}
+
+// readRedirects returns the rules in the content directory's
+// _redirects file, if it has one.
+func readRedirects(dir string) []redirectRule {
+	name := filepath.Join(dir, redirectsFileName)
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil
+	}
+
+	redirectsFile.Lock()
+	defer redirectsFile.Unlock()
+	if cached := redirectsFile.info; cached != nil && os.SameFile(cached, info) &&
+		cached.ModTime().Equal(info.ModTime()) && cached.Size() == info.Size() {
+		return redirectsFile.rules
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.Error("unable to read %s: %s", name, err)
+		return nil
+	}
+	redirectsFile.info = info
+	redirectsFile.rules = parseRedirects(data)
+	log.Info("read %d redirect rules from %s", len(redirectsFile.rules), name)
+	return redirectsFile.rules
+}
+
+// contentExists reports whether there's something to serve at urlPath,
+// which shadows unforced redirect rules.
+func contentExists(urlPath string) bool {
+	name := filepath.Join(*flagContentDir, filepath.FromSlash(path.Clean("/"+urlPath)))
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		info, err = os.Stat(filepath.Join(name, "index.html"))
+	}
+	return err == nil
+}
+
+// applyRedirects wraps a handler so that the _redirects file is
+// honored before anything is served.
+func applyRedirects(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, r := range readRedirects(*flagContentDir) {
+			to, ok := r.match(req)
+			if !ok || (!r.force && contentExists(req.URL.Path)) {
+				continue
+			}
+			switch {
+			case r.status == http.StatusOK && strings.Contains(to, "://"):
+				target, err := url.Parse(to)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+				log.Info("%s:%d: proxying %s to %s", redirectsFileName, r.line, req.URL.Path, to)
+				proxy := &httputil.ReverseProxy{Director: func(out *http.Request) {
+					out.URL = target
+					out.Host = target.Host
+				}}
+				proxy.ServeHTTP(w, req)
+				return
+			case r.status >= 300 && r.status < 400:
+				log.Info("%s:%d: redirecting %s to %s", redirectsFileName, r.line, req.URL.Path, to)
+				http.Redirect(w, req, to, r.status)
+				return
+			default:
+				log.Info("%s:%d: serving %s for %s", redirectsFileName, r.line, to, req.URL.Path)
+				target, err := url.Parse(to)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				req.URL.Path, req.URL.RawPath = target.Path, ""
+				if target.RawQuery != "" {
+					req.URL.RawQuery = target.RawQuery
+				}
+				if r.status != http.StatusOK {
+					w = &statusWriter{ResponseWriter: w, status: r.status}
+				}
+			}
+			break
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// a statusWriter answers with its status, whatever the handler says.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if code < 200 {
+		// informational, e.g. 103 Early Hints: the response is to come
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// redirectStub is a page that sends browsers on to to, for hosts that
+// don't read _redirects.
+func redirectStub(to string) []byte {
+	to = html.EscapeString(to)
+	return []byte(fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Redirecting</title>
+<link rel="canonical" href="%s">
+<meta http-equiv="refresh" content="0; url=%s">
+</head><body><a href="%s">Redirecting to %s</a></body></html>
+`, to, to, to, to))
+}
+
+// exportRedirects writes a redirect stub page for each plain redirect
+// rule whose source is a page (a directory or an .html file) the
+// export doesn't otherwise have.  The _redirects file itself is
+// exported as it is, for the hosts that do read it.
+func (e *exporter) exportRedirects() error {
+	info, err := os.Stat(filepath.Join(e.dir, redirectsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	stubs := make(map[string]bool)
+	var rules []redirectRule
+	if info != nil {
+		rules = readRedirects(e.dir)
+	}
+	for _, r := range rules {
+		if r.status < 300 || r.status >= 400 || len(r.params) > 0 || strings.ContainsAny(r.source, ":*") {
+			continue
+		}
+		rel := strings.TrimPrefix(path.Clean(r.source), "/")
+		switch path.Ext(rel) {
+		case ".html", ".htm":
+		case "":
+			rel = path.Join(rel, "index.html")
+		default:
+			continue
+		}
+		if e.modTime(rel) != 0 || stubs[rel] {
+			continue
+		}
+		stubs[rel] = true
+		if e.manifest != nil && e.upToDate(rel, redirectsFileName) {
+			continue
+		}
+		if err := e.write(filepath.Join(e.out, filepath.FromSlash(rel)), redirectStub(r.to), info); err != nil {
+			return err
+		}
+		e.record(rel, redirectsFileName)
+	}
+
+	// stubs for rules that have gone
+	for _, out := range e.dependents(redirectsFileName) {
+		if out != redirectsFileName && !stubs[out] && e.modTime(out) == 0 {
+			log.Info("removing %s from the export", out)
+			if err := os.Remove(filepath.Join(e.out, filepath.FromSlash(out))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			e.Lock()
+			delete(e.manifest, out)
+			e.Unlock()
+		}
+	}
+	return nil
+}
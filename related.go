@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// words too common to say anything about what a page is about
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`about after again all also and any are because been before
+		being both but can could did does doing down during each few for from further had has have
+		having her here hers him his how into its itself just more most much nor not now off once
+		only other our ours out over own same she should some such than that the their theirs them
+		then there these they this those through too under until very was were what when where which
+		while who whom why will with would you your yours`) {
+		stopWords[w] = true
+	}
+}
+
+// isTerm reports whether a (lower case) word is worth comparing pages
+// by.
+func isTerm(w string) bool {
+	return len(w) >= 3 && !stopWords[w]
+}
+
+// A relatedPage is a page similar to another, scored from 0 to 1.
+type relatedPage struct {
+	Path  string  `json:"path"`
+	Title string  `json:"title"`
+	Score float64 `json:"score"`
+}
+
+// weights returns p's term vector: each term's count, scaled up for the
+// terms few pages have.  The caller holds the lock.
+func (s *siteIndex) weights(p *page) (map[string]float64, float64) {
+	v := make(map[string]float64, len(p.terms))
+	norm := 0.0
+	for t, n := range p.terms {
+		w := float64(n) * math.Log(float64(len(s.pages)+1)/float64(s.terms[t]))
+		v[t] = w
+		norm += w * w
+	}
+	return v, math.Sqrt(norm)
+}
+
+// related returns the (at most) n pages most like rel, by the cosine
+// similarity of their term vectors, best first, of those readable
+// allows if it's given.  The navigation isn't like anything.
+func (s *siteIndex) related(rel string, n int, readable func(rel string) bool) []relatedPage {
+	s.RLock()
+	defer s.RUnlock()
+	found := []relatedPage{}
+	p := s.pages[rel]
+	if p == nil {
+		return found
+	}
+	v, norm := s.weights(p)
+	if norm == 0 {
+		return found
+	}
+	for _, q := range s.pages {
+		if q == p || path.Base(q.Path) == "navigation.md" || (readable != nil && !readable(q.Path)) {
+			continue
+		}
+		w, qnorm := s.weights(q)
+		if qnorm == 0 {
+			continue
+		}
+		dot := 0.0
+		for t, x := range v {
+			dot += x * w[t]
+		}
+		if dot > 0 {
+			found = append(found, relatedPage{q.Path, q.Title, dot / (norm * qnorm)})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Score != found[j].Score {
+			return found[i].Score > found[j].Score
+		}
+		return found[i].Path < found[j].Path
+	})
+	if len(found) > n {
+		found = found[:n]
+	}
+	return found
+}
+
+// relatedHandler serves /_api/related/<path>, the pages most like a
+// page, ?n= of them (5 unless it says otherwise).
+func relatedHandler(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(r.URL.Path, "/_api/related/")
+	site.RLock()
+	p := site.pages[rel]
+	site.RUnlock()
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	n := 5
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "bad n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	related := site.related(rel, n, func(rel string) bool { return canRead(r, rel) })
+	b, err := json.MarshalIndent(related, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
+
+// processRelated adds (with -related) a "Related pages" section to the
+// end of a page, after any "Pages linking here".
+func processRelated(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if *flagRelated <= 0 || path.Base(ctx.Path) == "navigation.md" {
+		return in, nil
+	}
+	related := site.related(ctx.Path, *flagRelated, nil)
+	if len(related) == 0 {
+		return in, nil
+	}
+
+	var b bytes.Buffer
+	b.Write(bytes.TrimRight(in, "\r\n"))
+	b.WriteString("\n\n## Related pages\n\n")
+	for _, p := range related {
+		ctx.Depends(p.Path)
+		fmt.Fprintf(&b, "- [%s](#!%s)\n", p.Title, p.Path)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A linkEdit is a link rewritten because the page it leads to (or the
+// page it's in) moved.
+type linkEdit struct {
+	Path string `json:"path"` // where the link is, after the move
+	Line int    `json:"line"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+func (e linkEdit) String() string {
+	return fmt.Sprintf("%s:%d: %s -> %s", e.Path, e.Line, e.Old, e.New)
+}
+
+// splitLink splits a link target into the MDwiki "#!" prefix, if it
+// has one, the page path, and the anchor or query string that follows.
+func splitLink(target string) (prefix string, page string, suffix string) {
+	if i := strings.Index(target, "#!"); i >= 0 {
+		prefix, target = target[:i+2], target[i+2:]
+	}
+	if i := strings.IndexAny(target, "#?"); i >= 0 {
+		target, suffix = target[:i], target[i:]
+	}
+	return prefix, target, suffix
+}
+
+// relativeLink returns the link from a page in dir to the page rel.
+func relativeLink(dir string, rel string) string {
+	link, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(rel))
+	if err != nil {
+		return rel
+	}
+	return filepath.ToSlash(link)
+}
+
+// rewriteLink returns the link that should replace target, found in
+// the page at from (which is moving to fromAfter) once the page at old
+// has moved to new, or "" if it can stay as it is.  Links keep their
+// style: absolute, relative to the content root, or relative to the
+// page's directory.
+func (s *siteIndex) rewriteLink(from string, fromAfter string, target string, old string, new string) string {
+	resolved := s.resolveLink(from, target)
+	if resolved == "" {
+		return ""
+	}
+	// the first candidate is the one relative to the page's directory
+	relative := resolved == linkCandidates(from, target)[0]
+	if resolved == old {
+		resolved = new
+	} else if fromAfter == from {
+		return ""
+	}
+
+	prefix, link, suffix := splitLink(target)
+	switch {
+	case strings.HasPrefix(link, "/"):
+		link = "/" + resolved
+	case relative:
+		link = relativeLink(path.Dir(fromAfter), resolved)
+	default:
+		link = resolved
+	}
+	if prefix+link+suffix == target {
+		return ""
+	}
+	return prefix + link + suffix
+}
+
+// planMove works out the edits that moving the page old to new calls
+// for, returning them with the edited content of each page that has
+// any, under its path after the move.
+func (s *siteIndex) planMove(old string, new string) ([]linkEdit, map[string][]byte, error) {
+	edits := []linkEdit{}
+	contents := make(map[string][]byte)
+	for _, p := range s.sortedPages() {
+		after := p.Path
+		if after == old {
+			after = new
+		}
+		md, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(p.Path)))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// links in front matter and fenced code blocks aren't links
+		start := 0
+		if m := frontMatterRegexp.FindIndex(md); m != nil {
+			start = m[1]
+		}
+		lines := strings.SplitAfter(string(md[start:]), "\n")
+		inFence, changed := false, false
+		for i, line := range lines {
+			if strings.HasPrefix(strings.TrimSpace(line), "```") {
+				inFence = !inFence
+				continue
+			}
+			if inFence {
+				continue
+			}
+			// replaced from the end, so that the indexes stay good
+			var lineEdits []linkEdit
+			matches := indexLinkRegexp.FindAllStringSubmatchIndex(line, -1)
+			for j := len(matches) - 1; j >= 0; j-- {
+				for g := len(matches[j])/2 - 1; g >= 1; g-- {
+					a, b := matches[j][2*g], matches[j][2*g+1]
+					if a < 0 {
+						continue
+					}
+					target := line[a:b]
+					if localLink(target) == "" {
+						continue
+					}
+					replacement := s.rewriteLink(p.Path, after, target, old, new)
+					if replacement == "" {
+						continue
+					}
+					line = line[:a] + replacement + line[b:]
+					lineEdits = append([]linkEdit{{after, 1 + strings.Count(string(md[:start]), "\n") + i,
+						target, replacement}}, lineEdits...)
+					changed = true
+				}
+			}
+			edits = append(edits, lineEdits...)
+			lines[i] = line
+		}
+		if changed || p.Path == old {
+			contents[after] = append(append([]byte{}, md[:start]...), strings.Join(lines, "")...)
+		}
+	}
+	return edits, contents, nil
+}
+
+// errMoveForbidden is what a move that would change a page the user
+// may not edit fails with.
+var errMoveForbidden = errors.New("the move would change a page you may not edit")
+
+// movePage moves the page old to new, both relative to the content
+// directory, rewriting the links to it and its own relative links.
+// With dryRun nothing is changed, but the edits are still returned.
+// Unless editable (if it isn't nil) allows every page the move would
+// change, nothing is, and it fails with errMoveForbidden.
+func (s *siteIndex) movePage(old string, new string, dryRun bool, editable func(rel string) bool) ([]linkEdit, error) {
+	if !contentOnDisk() {
+		return nil, fmt.Errorf("pages can't be moved in a -source snapshot")
+	}
+	if *flagReadOnly && !dryRun {
+		return nil, fmt.Errorf("pages can't be moved with -read-only")
+	}
+	old = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(old)), "/")
+	new = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(new)), "/")
+	s.RLock()
+	_, ok := s.pages[old]
+	s.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a page", old)
+	}
+	if path.Ext(new) != ".md" {
+		return nil, fmt.Errorf("%s isn't a Markdown file", new)
+	}
+	newName := filepath.Join(s.dir, filepath.FromSlash(new))
+	if protectedPath(new) || settingsFor(new).ignored(new) || !symlinkAllowed(newName) {
+		return nil, fmt.Errorf("%s may not be written", new)
+	}
+	if _, err := os.Lstat(newName); err == nil {
+		return nil, fmt.Errorf("%s already exists", new)
+	}
+
+	edits, contents, err := s.planMove(old, new)
+	if err != nil {
+		return nil, err
+	}
+	if editable != nil {
+		for rel := range contents {
+			if !editable(rel) {
+				return nil, fmt.Errorf("%w: %s", errMoveForbidden, rel)
+			}
+		}
+	}
+	if dryRun {
+		return edits, nil
+	}
+
+	oldName := filepath.Join(s.dir, filepath.FromSlash(old))
+	info, err := os.Stat(oldName)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(newName), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(oldName, newName); err != nil {
+		return nil, err
+	}
+	for rel, md := range contents {
+		name := filepath.Join(s.dir, filepath.FromSlash(rel))
+		mode := info.Mode()
+		if fi, err := os.Stat(name); err == nil {
+			mode = fi.Mode()
+		}
+		if err := ioutil.WriteFile(name, md, mode.Perm()); err != nil {
+			return edits, err
+		}
+	}
+	log.Notice("moved %s to %s, rewriting %d links", old, new, len(edits))
+	return edits, nil
+}
+
+// move implements the mv command, which moves a page and fixes the
+// links to it, reporting each one.
+func move(args []string) error {
+	flags := flag.NewFlagSet("mv", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only show the links that would be rewritten")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: mv [-n] old.md new.md")
+	}
+
+	index, err := newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	edits, err := index.movePage(flags.Arg(0), flags.Arg(1), *dryRun, nil)
+	for _, e := range edits {
+		fmt.Println(e)
+	}
+	return err
+}
+
+// a request to /_api/mv
+type moveRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// moveHandler serves /_api/mv, which is the mv command for editor
+// plugins: POST {"from": "old.md", "to": "new.md"} and get the edits
+// back.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req moveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.DryRun && refuseReadOnly(w) {
+		return
+	}
+	if !canEdit(r, req.From) || !canEdit(r, req.To) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	edits, err := site.movePage(req.From, req.To, req.DryRun, func(rel string) bool { return canEdit(r, rel) })
+	if errors.Is(err, errMoveForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.DryRun {
+		recordMutation(r, mutation{Action: "move", Path: strings.TrimPrefix(path.Clean("/"+req.From), "/"),
+			To: strings.TrimPrefix(path.Clean("/"+req.To), "/"), Links: len(edits)})
+	}
+
+	b, err := json.MarshalIndent(edits, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
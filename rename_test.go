@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A page can't be moved through a symbolic link the -follow-symlinks
+// policy wouldn't follow, out of the content directory.
+func TestMovePageSymlink(t *testing.T) {
+	dir := t.TempDir()
+	content, outside := filepath.Join(dir, "content"), filepath.Join(dir, "outside")
+	for _, d := range []string{content, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(content, "page.md"), []byte("# Page\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(content, "link")); err != nil {
+		t.Skipf("unable to make a symbolic link: %s", err)
+	}
+	savedDir, savedPolicy := *flagContentDir, *flagFollowSymlinks
+	defer func() { *flagContentDir, *flagFollowSymlinks = savedDir, savedPolicy }()
+	*flagContentDir = content
+	index, err := newSiteIndex(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []string{symlinksOff, symlinksSafe} {
+		*flagFollowSymlinks = policy
+		if _, err := index.movePage("page.md", "link/page.md", false, nil); err == nil {
+			t.Errorf("with -follow-symlinks %s, the page was moved through the link", policy)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "page.md")); err == nil {
+			t.Fatalf("with -follow-symlinks %s, the page was written outside -dir", policy)
+		}
+	}
+}
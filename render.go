@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// markdownConfig turns the Markdown extensions used by -render on and
+// off.  They're all on unless the config file says otherwise, which is
+// what authors used to GitHub expect.
+type markdownConfig struct {
+	Tables         *bool `yaml:"tables"`
+	Strikethrough  *bool `yaml:"strikethrough"`
+	Autolinks      *bool `yaml:"autolinks"`
+	TaskLists      *bool `yaml:"task_lists"`
+	Footnotes      *bool `yaml:"footnotes"`
+	DefinitionList *bool `yaml:"definition_lists"`
+}
+
+func enabled(b *bool) bool {
+	return b == nil || *b
+}
+
+// the Markdown renderer, made from the config file the first time it's
+// needed
+var (
+	markdownOnce     sync.Once
+	markdownRenderer goldmark.Markdown
+)
+
+func newMarkdownRenderer(c markdownConfig) goldmark.Markdown {
+	var extensions []goldmark.Extender
+	for _, e := range []struct {
+		on  *bool
+		ext goldmark.Extender
+	}{
+		{c.Tables, extension.Table},
+		{c.Strikethrough, extension.Strikethrough},
+		{c.Autolinks, extension.Linkify},
+		{c.TaskLists, extension.TaskList},
+		{c.Footnotes, extension.Footnote},
+		{c.DefinitionList, extension.DefinitionList},
+	} {
+		if enabled(e.on) {
+			extensions = append(extensions, e.ext)
+		}
+	}
+	return goldmark.New(
+		goldmark.WithExtensions(extensions...),
+		goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		// the processors write HTML into the Markdown
+		goldmark.WithRendererOptions(gmhtml.WithUnsafe()),
+	)
+}
+
+// markdownToHTML renders (processed) Markdown as an HTML fragment.
+func markdownToHTML(md []byte) ([]byte, error) {
+	markdownOnce.Do(func() { markdownRenderer = newMarkdownRenderer(cfg.Markdown) })
+	var body bytes.Buffer
+	if err := markdownRenderer.Convert(md, &body); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// renderMarkdown renders a (processed) Markdown page as an HTML
+// document, for -render.
+func renderMarkdown(r *http.Request, md []byte) ([]byte, error) {
+	body, err := markdownToHTML(md)
+	if err != nil {
+		return nil, err
+	}
+
+	title := path.Base(r.URL.Path)
+	site.RLock()
+	if p := site.pages[strings.TrimPrefix(path.Clean(r.URL.Path), "/")]; p != nil {
+		title = p.Title
+	}
+	site.RUnlock()
+	var stylesheet string
+	if *flagHighlight != "" && *flagHighlightClasses {
+		stylesheet = `<link rel="stylesheet" href="/` + highlightCSSName + `">` + "\n"
+	}
+	return []byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+%s</head>
+<body>
+<p><a href="?raw">raw</a></p>
+%s</body>
+</html>
+`, html.EscapeString(title), stylesheet, body)), nil
+}
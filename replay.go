@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// replay implements the replay command, which issues the requests in a
+// HAR file (made with -record, say) to the server again, as the
+// content stands now, and reports the responses that differ from the
+// recorded ones.  Only GET and HEAD requests are replayed, so nothing
+// is edited a second time, and websockets are left out.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	showDiffs := flags.Bool("diff", false, "show how changed text bodies differ")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: replay [-diff] session.har")
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return fmt.Errorf("%s: %s", flags.Arg(0), err)
+	}
+
+	site, err = newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	handler := serverHandler()
+
+	replayed, skipped, changed := 0, 0, 0
+	for _, entry := range har.Log.Entries {
+		method := entry.Request.Method
+		if (method != "GET" && method != "HEAD") || entry.Response.Status == http.StatusSwitchingProtocols {
+			skipped++
+			continue
+		}
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return err
+		}
+		req := httptest.NewRequest(method, u.RequestURI(), nil)
+		req.Host = u.Host
+		for _, h := range entry.Request.Headers {
+			req.Header.Add(h.Name, h.Value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		replayed++
+
+		was := entry.Response
+		body := w.Body.Bytes()
+		var problems []string
+		if w.Code != was.Status {
+			problems = append(problems, fmt.Sprintf("status %d, was %d", w.Code, was.Status))
+		}
+		var old []byte
+		recorded := was.Content.Comment == ""
+		if recorded {
+			old = []byte(was.Content.Text)
+			if was.Content.Encoding == "base64" {
+				if old, err = base64.StdEncoding.DecodeString(was.Content.Text); err != nil {
+					return err
+				}
+			}
+		}
+		switch {
+		case recorded && sha256.Sum256(body) != sha256.Sum256(old):
+			problems = append(problems, fmt.Sprintf("body %x, was %x",
+				sha256.Sum256(body), sha256.Sum256(old)))
+		case !recorded && len(body) != was.Content.Size:
+			problems = append(problems, fmt.Sprintf("body of %d bytes, was %d", len(body), was.Content.Size))
+		}
+		if len(problems) == 0 {
+			continue
+		}
+
+		changed++
+		fmt.Printf("%s %s: %s\n", method, u.RequestURI(), strings.Join(problems, ", "))
+		if *showDiffs && recorded && utf8.Valid(body) && utf8.Valid(old) {
+			fmt.Print(unifiedDiff(strings.TrimPrefix(u.Path, "/"), string(old), string(body)))
+		}
+	}
+
+	fmt.Printf("replayed %d requests (%d skipped), %d changed\n", replayed, skipped, changed)
+	if changed > 0 {
+		return fmt.Errorf("%d responses changed", changed)
+	}
+	return nil
+}
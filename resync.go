@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The reload channel survives flaky networks.  Each message to a
+// /_reloader client is numbered, from 1 on each connection, so that a
+// client can tell when it's missed one; and every change is numbered.
+// A page is served with the number of the last change before it, which
+// the client sends on connecting, and again when it notices a gap, as
+// {"since": n}: the server then goes over the changes since n as if
+// they'd just happened (reloading the page if any of them would have),
+// and sends the error overlay and the paused state as they are now.  A
+// reload lost in transit, or missed while reconnecting, still happens.
+
+// recentChangeLimit is how many changes are kept for clients to catch
+// up on; one further behind is reloaded regardless.
+const recentChangeLimit = 256
+
+// recentChanges are the latest changes, numbered.
+var recentChanges = struct {
+	sync.Mutex
+	last    int // the number of the last change
+	changes []contentChange
+}{}
+
+// recordChange numbers a change.
+func recordChange(c contentChange) {
+	recentChanges.Lock()
+	defer recentChanges.Unlock()
+	recentChanges.last++
+	recentChanges.changes = append(recentChanges.changes, c)
+	if n := len(recentChanges.changes); n > recentChangeLimit {
+		recentChanges.changes = recentChanges.changes[n-recentChangeLimit:]
+	}
+}
+
+// lastChange is the number of the last change.
+func lastChange() int {
+	recentChanges.Lock()
+	defer recentChanges.Unlock()
+	return recentChanges.last
+}
+
+// changesSince returns the changes after the one numbered n, and false
+// if some of them are no longer kept.
+func changesSince(n int) ([]contentChange, bool) {
+	recentChanges.Lock()
+	defer recentChanges.Unlock()
+	missed := recentChanges.last - n
+	if missed <= 0 {
+		return nil, true
+	}
+	if missed > len(recentChanges.changes) {
+		return nil, false
+	}
+	kept := recentChanges.changes
+	return append([]contentChange(nil), kept[len(kept)-missed:]...), true
+}
+
+// withSeq numbers the (JSON object) message m.
+func withSeq(m string, seq int) string {
+	if !strings.HasPrefix(m, "{") {
+		return m
+	}
+	if strings.TrimSpace(m[1:]) == "}" {
+		return `{"seq":` + strconv.Itoa(seq) + `}`
+	}
+	return `{"seq":` + strconv.Itoa(seq) + `,` + m[1:]
+}
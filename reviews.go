@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// reviewBy returns the date a page's front matter says it should be
+// reviewed by, as review_by (or review-by).
+func reviewBy(meta map[string]interface{}) (time.Time, bool) {
+	v, ok := meta["review_by"]
+	if !ok {
+		v = meta["review-by"]
+	}
+	return metaTime(v)
+}
+
+// An overdueReview is a page that should have been reviewed by now.
+type overdueReview struct {
+	Path     string    `json:"path"`
+	Title    string    `json:"title"`
+	ReviewBy time.Time `json:"review_by"`
+	Days     int       `json:"days_overdue"`
+}
+
+// overdueReviews returns the pages whose review date has passed, most
+// overdue first, leaving out those readable says no to (if it isn't
+// nil).
+func (s *siteIndex) overdueReviews(now time.Time, readable func(rel string) bool) []overdueReview {
+	overdue := []overdueReview{}
+	for _, p := range s.sortedPages() {
+		if readable != nil && !readable(p.Path) {
+			continue
+		}
+		if by, ok := reviewBy(p.Meta); ok && by.Before(now) {
+			overdue = append(overdue, overdueReview{p.Path, p.Title, by, int(now.Sub(by).Hours() / 24)})
+		}
+	}
+	sort.SliceStable(overdue, func(i, j int) bool { return overdue[i].ReviewBy.Before(overdue[j].ReviewBy) })
+	return overdue
+}
+
+// reviewsHandler serves /_api/reviews, the pages that are overdue for
+// review (of those the user may read).
+func reviewsHandler(w http.ResponseWriter, r *http.Request) {
+	readable := func(rel string) bool { return canRead(r, rel) }
+	b, err := json.MarshalIndent(site.overdueReviews(time.Now(), readable), "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
+
+// processReviews marks pages that are overdue for review with a banner
+// while they're served.
+func processReviews(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	by, ok := reviewBy(ctx.Meta)
+	if ctx.Export || !ok || !by.Before(time.Now()) {
+		return in, nil
+	}
+	banner := pageBanner("OUTDATED: this page was due for review by "+by.Format("2006-01-02"), "#f96")
+	return append([]byte(banner), in...), nil
+}
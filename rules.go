@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ruleConfig is one of the config file's request rules.  Rules are
+// tried in order against every request before it's served; a rule
+// matches when its path regexp matches the URL path and each of its
+// header regexps matches the request header of that name.  A matching
+// rule sets response headers, rewrites the path (and carries on with
+// the rules that follow), or ends things with a redirect or a denial.
+// Rewrite and redirect targets can use the path's submatches, $1 and
+// so on.
+type ruleConfig struct {
+	Path    string            `yaml:"path"`
+	Header  map[string]string `yaml:"header"`
+	Method  string            `yaml:"method"`
+	Rewrite string            `yaml:"rewrite"`
+	// Redirect answers with Status, by default 302 Found
+	Redirect   string            `yaml:"redirect"`
+	SetHeaders map[string]string `yaml:"set_headers"`
+	// Deny answers with Status, by default 403 Forbidden
+	Deny   bool `yaml:"deny"`
+	Status int  `yaml:"status"`
+}
+
+type rule struct {
+	ruleConfig
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+}
+
+// the config file's rules, compiled
+var rules []rule
+
+// compileRules checks and compiles the config file's rules.
+func compileRules() error {
+	for i, rc := range cfg.Rules {
+		r := rule{ruleConfig: rc, headers: make(map[string]*regexp.Regexp)}
+		var err error
+		if rc.Path == "" {
+			rc.Path = "^"
+		}
+		if r.path, err = regexp.Compile(rc.Path); err != nil {
+			return fmt.Errorf("rule %d: bad path: %s", i+1, err)
+		}
+		for name, pattern := range rc.Header {
+			if r.headers[name], err = regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("rule %d: bad %s header: %s", i+1, name, err)
+			}
+		}
+		if rc.Redirect != "" && rc.Deny {
+			return fmt.Errorf("rule %d: can't both redirect and deny", i+1)
+		}
+		rules = append(rules, r)
+	}
+	return nil
+}
+
+// match returns the path's submatches if the rule applies to req.
+func (r *rule) match(req *http.Request) []int {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return nil
+	}
+	for name, re := range r.headers {
+		if !re.MatchString(req.Header.Get(name)) {
+			return nil
+		}
+	}
+	return r.path.FindStringSubmatchIndex(req.URL.Path)
+}
+
+// applyRules wraps a handler so that requests go through the rules
+// first.
+func applyRules(h http.Handler) http.Handler {
+	if len(rules) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers := make(map[string]string)
+		for i := range rules {
+			r := &rules[i]
+			m := r.match(req)
+			if m == nil {
+				continue
+			}
+			for k, v := range r.SetHeaders {
+				headers[k] = v
+			}
+			expand := func(template string) string {
+				return string(r.path.ExpandString(nil, template, req.URL.Path, m))
+			}
+
+			switch {
+			case r.Deny:
+				log.Info("rule %d: denying %s", i+1, req.URL.Path)
+				status := r.Status
+				if status == 0 {
+					status = http.StatusForbidden
+				}
+				setRuleHeaders(w, headers)
+				http.Error(w, http.StatusText(status), status)
+				return
+			case r.Redirect != "":
+				target := expand(r.Redirect)
+				if req.URL.RawQuery != "" && !strings.Contains(target, "?") {
+					target += "?" + req.URL.RawQuery
+				}
+				log.Info("rule %d: redirecting %s to %s", i+1, req.URL.Path, target)
+				status := r.Status
+				if status == 0 {
+					status = http.StatusFound
+				}
+				setRuleHeaders(w, headers)
+				http.Redirect(w, req, target, status)
+				return
+			case r.Rewrite != "":
+				target := expand(r.Rewrite)
+				log.Debug("rule %d: rewriting %s to %s", i+1, req.URL.Path, target)
+				req.URL.Path = target
+				req.URL.RawPath = ""
+			}
+		}
+		if len(headers) > 0 {
+			w = &ruleHeaderWriter{ResponseWriter: w, headers: headers}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func setRuleHeaders(w http.ResponseWriter, headers map[string]string) {
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+}
+
+// a ruleHeaderWriter sets the rules' headers just before the response
+// goes out, so that they win over the handler's own.
+type ruleHeaderWriter struct {
+	http.ResponseWriter
+	headers map[string]string
+	wrote   bool
+}
+
+func (w *ruleHeaderWriter) WriteHeader(code int) {
+	if code < 200 {
+		// informational, e.g. 103 Early Hints: the response is to come
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !w.wrote {
+		w.wrote = true
+		setRuleHeaders(w.ResponseWriter, w.headers)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ruleHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack lets the reloader's websocket through.
+func (w *ruleHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("can't hijack the connection")
+	}
+	return h.Hijack()
+}
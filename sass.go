@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// sassChange recompiles the stylesheets whenever a .scss file below
+// the content directory changes; any of them might be a partial that
+// the others import.  Writing the .css output is what triggers the
+// clients' stylesheet refresh.
+func sassChange(event fsnotify.Event, rel string) {
+	if path.Ext(rel) != ".scss" {
+		return
+	}
+	log.Notice("recompiling stylesheets because: %s", event)
+	compileSass(*flagContentDir)
+}
+
+// sassSources returns the .scss files below dir that aren't partials
+// (_name.scss) or ignored.
+func sassSources(dir string) []string {
+	var sources []string
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || name == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(info.Name(), ".") || settingsFor(rel).ignored(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && path.Ext(rel) == ".scss" && !strings.HasPrefix(info.Name(), "_") {
+			sources = append(sources, name)
+		}
+		return nil
+	})
+	return sources
+}
+
+// held while compiling, so that the compile at startup and one for a
+// change don't write the same files at once
+var sassCompiling sync.Mutex
+
+// compileSass compiles each .scss file below dir that isn't a partial
+// into the .css file next to it, then runs the PostCSS command over the
+// output if there is one.
+func compileSass(dir string) {
+	sassCompiling.Lock()
+	defer sassCompiling.Unlock()
+
+	var failures []string
+	for _, src := range sassSources(dir) {
+		css := strings.TrimSuffix(src, ".scss") + ".css"
+		log.Info("compiling %s", src)
+		err := runTool(*flagSass, src, css)
+		if err == nil && *flagPostCSS != "" {
+			err = runTool(*flagPostCSS, css)
+		}
+		if err != nil {
+			log.Error("unable to compile %s: %s", src, err)
+			failures = append(failures, err.Error())
+		}
+	}
+	setBuildError("sass", strings.Join(failures, "\n\n"))
+}
+
+// runTool runs a user supplied command line with args appended.
+func runTool(command string, args ...string) error {
+	fields := strings.Fields(command)
+	var output bytes.Buffer
+	cmd := exec.Command(fields[0], append(fields[1:], args...)...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %s\n%s", fields[0], strings.Join(args, " "),
+			err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// Screenshots of the pages, as a browser renders them, are taken with
+// a headless Chrome (or Chromium), found on the PATH unless -chrome
+// says where: /_api/screenshot takes one of a page, and the
+// screenshots command takes one of every page, for visual review and
+// changelogs.  The snippet's toolbar and the like are hidden first.
+// With each of the command's screenshots goes the page's layout, where
+// its headings, paragraphs and so on are, for visual-diff.
+
+const (
+	screenshotWidth   = 1280 // the default viewport width
+	screenshotHeight  = 800  // the viewport height; the screenshot is of the whole page
+	screenshotTimeout = 30 * time.Second
+)
+
+// hideSnippetUI hides what the snippet adds to a page.
+const hideSnippetUI = `(function () {
+  var s = document.createElement("style");
+  s.textContent = ".mdwds-ui { display: none !important; }";
+  document.head.appendChild(s);
+})()`
+
+// pageLayout finds where the page's blocks are.
+const pageLayout = `Array.prototype.filter.call(
+  document.querySelectorAll("h1, h2, h3, h4, h5, h6, p, pre, table, img, ul, ol, blockquote"),
+  function (e) { return !e.closest(".mdwds-ui"); }
+).map(function (e) {
+  var r = e.getBoundingClientRect();
+  return {tag: e.tagName.toLowerCase(), text: (e.textContent || e.getAttribute("alt") || "").trim().slice(0, 40),
+    x: Math.round(r.left + scrollX), y: Math.round(r.top + scrollY), w: Math.round(r.width), h: Math.round(r.height)};
+})`
+
+// A layoutBox is where a block of a page is.
+type layoutBox struct {
+	Tag  string `json:"tag"`
+	Text string `json:"text"` // the start of it, to say which it is
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+	W    int    `json:"w"`
+	H    int    `json:"h"`
+}
+
+// A shot is a screenshot of a page, and its layout.
+type shot struct {
+	PNG    []byte
+	Layout []layoutBox
+}
+
+// newBrowser starts a headless Chrome, whose tabs take the screenshots.
+func newBrowser() (context.Context, context.CancelFunc, error) {
+	opts := chromedp.DefaultExecAllocatorOptions[:]
+	if *flagChrome != "" {
+		opts = append(opts[:len(opts):len(opts)], chromedp.ExecPath(*flagChrome))
+	}
+	alloc, cancelAlloc := chromedp.NewExecAllocator(context.Background(), opts...)
+	browser, cancelBrowser := chromedp.NewContext(alloc)
+	cancel := func() {
+		cancelBrowser()
+		cancelAlloc()
+	}
+	if err := chromedp.Run(browser); err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("unable to start Chrome: %s", err)
+	}
+	return browser, cancel, nil
+}
+
+// screenshotURL is where below base the page rel is shown: MDwiki's
+// #! URL for a Markdown page, the file itself for anything else.
+func screenshotURL(base string, rel string) string {
+	if path.Ext(rel) == ".md" {
+		return base + "/#!" + rel
+	}
+	return base + "/" + rel
+}
+
+// screenshot renders url in a new tab of browser, width pixels wide,
+// sending headers with each request, and returns it as a PNG, with its
+// layout.
+func screenshot(browser context.Context, url string, width int, headers network.Headers) (shot, error) {
+	ctx, cancel := chromedp.NewContext(browser)
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(ctx, screenshotTimeout)
+	defer cancelTimeout()
+
+	var s shot
+	actions := []chromedp.Action{chromedp.EmulateViewport(int64(width), screenshotHeight)}
+	if len(headers) > 0 {
+		actions = append(actions, network.Enable(), network.SetExtraHTTPHeaders(headers))
+	}
+	actions = append(actions,
+		chromedp.Navigate(url),
+		chromedp.WaitReady("body"),
+		// give MDwiki time to render the page
+		chromedp.Sleep(*flagScreenshotWait),
+		chromedp.Evaluate(hideSnippetUI, nil),
+		chromedp.Evaluate(pageLayout, &s.Layout),
+		chromedp.FullScreenshot(&s.PNG, 100))
+	err := chromedp.Run(ctx, actions...)
+	return s, err
+}
+
+// localBase is the server's URL, for a browser on the same machine.
+func localBase() string {
+	host := *flagAddr
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, *flagPort)
+}
+
+// screenshotHandler serves /_api/screenshot?path=<page>&width=<pixels>,
+// a PNG of the page.  The browser is sent the request's credentials,
+// so that it sees the page as the user does.
+func screenshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	if rel == "" {
+		rel = "index.md"
+	}
+	width := screenshotWidth
+	if v := r.URL.Query().Get("width"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 320 || n > 4096 {
+			http.Error(w, "bad request: width must be between 320 and 4096", http.StatusBadRequest)
+			return
+		}
+		width = n
+	}
+	if protectedPath(rel) || !canRead(r, rel) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := readContent(rel); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	headers := network.Headers{}
+	for _, h := range []string{"Cookie", "Authorization"} {
+		if v := r.Header.Get(h); v != "" {
+			headers[h] = v
+		}
+	}
+	browser, cancel, err := newBrowser()
+	if err != nil {
+		log.Error("screenshot: %s", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer cancel()
+	s, err := screenshot(browser, screenshotURL(localBase(), rel), width, headers)
+	if err != nil {
+		log.Error("unable to take a screenshot of %s: %s", rel, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info("took a screenshot of %s, %d wide", rel, width)
+	w.Header().Set("Content-Type", "image/png")
+	_, err = w.Write(s.PNG)
+	maybeBail(err)
+}
+
+// shootPages takes a screenshot of every page from the server at url,
+// or one started in-process if url is empty, passing each to fn.
+func shootPages(url string, width int, fn func(rel string, s shot) error) error {
+	var err error
+	site, err = newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(url, "/")
+	if base == "" {
+		server := httptest.NewServer(serverHandler())
+		defer server.Close()
+		base = server.URL
+	}
+	browser, cancel, err := newBrowser()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	for _, p := range site.sortedPages() {
+		if path.Base(p.Path) == "navigation.md" {
+			continue
+		}
+		s, err := screenshot(browser, screenshotURL(base, p.Path), width, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %s", p.Path, err)
+		}
+		if err := fn(p.Path, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shotName is where below dir the screenshot of rel goes, as rel with
+// .png for .md; its layout goes beside it, with .json.
+func shotName(dir string, rel string) string {
+	return filepath.Join(dir, filepath.FromSlash(strings.TrimSuffix(rel, ".md")+".png"))
+}
+
+// screenshots implements the screenshots command, which takes a
+// screenshot of every page, writing them below -out.
+func screenshots(args []string) error {
+	flags := flag.NewFlagSet("screenshots", flag.ExitOnError)
+	url := flags.String("url", "", "server to take them from, e.g. http://127.0.0.1:8080; by default one is started in-process")
+	out := flags.String("out", "screenshots", "directory to write the screenshots to")
+	width := flags.Int("width", screenshotWidth, "viewport width, in pixels")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: screenshots [-url URL] [-out DIR] [-width N]")
+	}
+
+	n := 0
+	err := shootPages(*url, *width, func(rel string, s shot) error {
+		name := shotName(*out, rel)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, s.PNG, 0644); err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(s.Layout, "", "  ")
+		maybeBail(err)
+		if err := ioutil.WriteFile(strings.TrimSuffix(name, ".png")+".json", b, 0644); err != nil {
+			return err
+		}
+		fmt.Println(name)
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("took %d screenshots\n", n)
+	return nil
+}
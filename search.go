@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// /_api/search searches the pages, by the words in them, or with
+// type=code their fenced code blocks, which are indexed on their own:
+// identifiers are split as code is written (getUserName and
+// get_user_name both have user in them, and in CSS, shell and the
+// like dashes join words), and a block can be looked for by its
+// language.  /_search is the same for browsers, as a page.
+
+// the most results returned, unless the request says otherwise
+const defaultSearchLimit = 20
+
+// A codeBlock is a fenced code block in a page.
+type codeBlock struct {
+	Lang string // the language the fence says, normalized
+	Line int    // of the opening fence
+	Code string
+
+	lines  []string       // while the page is being parsed
+	tokens map[string]int // identifiers, and their parts
+}
+
+// codeLanguageAliases normalizes the names languages are given.
+var codeLanguageAliases = map[string]string{
+	"js": "javascript", "jsx": "javascript", "ts": "typescript", "tsx": "typescript",
+	"py": "python", "py3": "python", "rb": "ruby", "golang": "go", "rs": "rust",
+	"sh": "bash", "shell": "bash", "zsh": "bash", "console": "bash", "yml": "yaml",
+	"c++": "cpp", "cc": "cpp", "cs": "csharp", "kt": "kotlin", "md": "markdown",
+}
+
+// the languages whose identifiers may have dashes in them
+var dashedLanguages = map[string]bool{
+	"css": true, "scss": true, "less": true, "bash": true, "lisp": true, "clojure": true,
+	"scheme": true, "yaml": true, "html": true, "xml": true, "makefile": true,
+}
+
+var (
+	codeIdentRegexp       = regexp.MustCompile(`[\pL_$][\pL\pN_$]*`)
+	codeDashedIdentRegexp = regexp.MustCompile(`[\pL_$][\pL\pN_$-]*[\pL\pN_$]|[\pL_$]`)
+	codePartRegexp        = regexp.MustCompile(`\p{Lu}?[\p{Ll}\pN]+|\p{Lu}+\pN*`)
+)
+
+// fenceLanguage is the language a fence's info string, such as "go",
+// "{.python}" or "js title=app.js", says its code is in.
+func fenceLanguage(info string) string {
+	fields := strings.Fields(strings.Trim(strings.TrimSpace(info), "{}"))
+	if len(fields) == 0 {
+		return ""
+	}
+	return normalizeLanguage(strings.TrimPrefix(fields[0], "."))
+}
+
+func normalizeLanguage(lang string) string {
+	lang = strings.ToLower(lang)
+	if alias, ok := codeLanguageAliases[lang]; ok {
+		return alias
+	}
+	return lang
+}
+
+// codeTokens returns the identifiers in code, in lang, lower case.
+// With parts, identifiers' parts are included as well.
+func codeTokens(lang string, code string, parts bool) []string {
+	re := codeIdentRegexp
+	if dashedLanguages[lang] {
+		re = codeDashedIdentRegexp
+	}
+	var tokens []string
+	for _, ident := range re.FindAllString(code, -1) {
+		tokens = append(tokens, strings.ToLower(ident))
+		if !parts {
+			continue
+		}
+		for _, word := range strings.FieldsFunc(ident, func(r rune) bool { return r == '_' || r == '-' || r == '$' }) {
+			found := codePartRegexp.FindAllString(word, -1)
+			if len(found) == 1 && found[0] == ident {
+				continue
+			}
+			for _, part := range found {
+				if len(part) >= 2 {
+					tokens = append(tokens, strings.ToLower(part))
+				}
+			}
+		}
+	}
+	return tokens
+}
+
+// finish indexes the block, once its lines are all read.
+func (c *codeBlock) finish() *codeBlock {
+	c.Code = strings.Join(c.lines, "\n")
+	c.lines = nil
+	c.tokens = make(map[string]int)
+	for _, t := range codeTokens(c.Lang, c.Code, true) {
+		c.tokens[t]++
+	}
+	return c
+}
+
+// A codeHit is a code block that matches a search.
+type codeHit struct {
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	Lang    string `json:"lang"`
+	Line    int    `json:"line"` // of the first line that matches
+	Snippet string `json:"snippet"`
+	Score   int    `json:"score"`
+}
+
+// A pageHit is a page that matches a search.
+type pageHit struct {
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+	Score   int    `json:"score"`
+}
+
+// searchCode returns the code blocks, in lang if it isn't empty, with
+// every identifier in q, best first.  The query found as it is counts
+// for more.
+func (s *siteIndex) searchCode(q string, lang string, readable func(rel string) bool) []codeHit {
+	lang = normalizeLanguage(lang)
+	words := codeTokens(lang, q, false)
+	phrase := strings.ToLower(strings.TrimSpace(q))
+	hits := []codeHit{}
+	if len(words) == 0 {
+		return hits
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for _, p := range s.pages {
+		if readable != nil && !readable(p.Path) {
+			continue
+		}
+		for _, c := range p.codeBlocks {
+			if lang != "" && c.Lang != lang {
+				continue
+			}
+			score := 0
+			for _, w := range words {
+				n := c.tokens[w]
+				if n == 0 {
+					score = 0
+					break
+				}
+				score += n
+			}
+			if score == 0 {
+				continue
+			}
+			lower := strings.ToLower(c.Code)
+			score += 10 * strings.Count(lower, phrase)
+			line, snippet := codeSnippet(c, phrase, words[0])
+			hits = append(hits, codeHit{p.Path, p.Title, c.Lang, line, snippet, score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].Path != hits[j].Path {
+			return hits[i].Path < hits[j].Path
+		}
+		return hits[i].Line < hits[j].Line
+	})
+	return hits
+}
+
+// codeSnippet returns the line of the page where the block first has
+// phrase in it, or failing that word, and a few lines from there.
+func codeSnippet(c *codeBlock, phrase string, word string) (int, string) {
+	lines := strings.Split(c.Code, "\n")
+	at := 0
+	for _, find := range []string{phrase, word} {
+		found := false
+		for i, line := range lines {
+			if strings.Contains(strings.ToLower(line), find) {
+				at, found = i, true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+	start, end := at-1, at+4
+	if start < 0 {
+		start = 0
+	}
+	if end > len(lines) {
+		end = len(lines)
+	}
+	return c.Line + 1 + at, strings.Join(lines[start:end], "\n")
+}
+
+// searchPages returns the pages with every word of q in them, best
+// first, those with the words in their titles before others.
+func (s *siteIndex) searchPages(q string, readable func(rel string) bool) []pageHit {
+	var words []string
+	for _, w := range indexWordRegexp.FindAllString(q, -1) {
+		words = append(words, strings.ToLower(w))
+	}
+	hits := []pageHit{}
+	if len(words) == 0 {
+		return hits
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for _, p := range s.pages {
+		if readable != nil && !readable(p.Path) {
+			continue
+		}
+		title := strings.ToLower(p.Title)
+		score := 0
+		for _, w := range words {
+			n := p.terms[w]
+			if strings.Contains(title, w) {
+				n += 20
+			} else if n == 0 && !isTerm(w) && strings.Contains(strings.ToLower(p.Summary), w) {
+				// too short or common to be a term, but there
+				n = 1
+			}
+			if n == 0 {
+				score = 0
+				break
+			}
+			score += n
+		}
+		if score > 0 {
+			hits = append(hits, pageHit{p.Path, p.Title, p.Summary, score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Path < hits[j].Path
+	})
+	return hits
+}
+
+var searchTmpl = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Search{{if .Q}}: {{.Q}}{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; }
+li { margin: 0.8em 0; list-style: none; }
+pre { background: #f6f6f6; padding: 0.5em; overflow: auto; margin: 0.3em 0; }
+.where { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Search</h1>
+<form action="/_search">
+<input type="search" name="q" value="{{.Q}}" size="40" autofocus>
+<select name="type">
+<option value="pages"{{if eq .Type "pages"}} selected{{end}}>pages</option>
+<option value="code"{{if eq .Type "code"}} selected{{end}}>code</option>
+</select>
+<input type="text" name="lang" value="{{.Lang}}" placeholder="language (for code)" size="16">
+<button>Search</button>
+</form>
+{{if .Q}}<ul>
+{{range .Pages}}<li><a href="/#!{{.Path}}">{{.Title}}</a> <span class="where">{{.Path}}</span><br>{{.Summary}}</li>
+{{end}}{{range .Code}}<li><a href="/#!{{.Path}}">{{.Title}}</a> <span class="where">{{.Path}}:{{.Line}}{{if .Lang}}, {{.Lang}}{{end}}</span>
+<pre>{{.Snippet}}</pre></li>
+{{end}}</ul>
+{{if and (not .Pages) (not .Code)}}<p>Nothing found.</p>{{end}}
+{{end}}</body>
+</html>
+`))
+
+// searchHandler serves /_api/search?q=...[&type=code[&lang=...]][&limit=n],
+// the pages (or code blocks) the user may read that match, best first,
+// and /_search, a search page, for browsers.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	q, typ, lang := query.Get("q"), query.Get("type"), query.Get("lang")
+	if typ == "" {
+		typ = "pages"
+	}
+	if typ != "pages" && typ != "code" {
+		http.Error(w, "bad request: type must be pages or code", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "bad request: bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	readable := func(rel string) bool { return canRead(r, rel) }
+
+	data := struct {
+		Q, Type, Lang string
+		Pages         []pageHit
+		Code          []codeHit
+	}{Q: q, Type: typ, Lang: lang}
+	var v interface{}
+	if typ == "code" {
+		data.Code = site.searchCode(q, lang, readable)
+		if len(data.Code) > limit {
+			data.Code = data.Code[:limit]
+		}
+		v = data.Code
+	} else {
+		data.Pages = site.searchPages(q, readable)
+		if len(data.Pages) > limit {
+			data.Pages = data.Pages[:limit]
+		}
+		v = data.Pages
+	}
+
+	if r.URL.Path == "/_search" && wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := searchTmpl.Execute(w, data); err != nil {
+			log.Error("unable to render the search page: %s", err)
+		}
+		return
+	}
+	if q == "" {
+		http.Error(w, "bad request: no q", http.StatusBadRequest)
+		return
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
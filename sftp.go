@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// -sftp runs an SSH server that speaks nothing but SFTP, for uploading
+// pages and images from tools that can't write to the content
+// directory any other way.  (scp is SFTP too, since OpenSSH 9.0, and
+// older clients can use scp -s.)  Users sign in as the users in the
+// auth config, with their password or one of their keys, and see the
+// content directory as the root, less the files the server won't
+// serve; the ACL rules decide what they may read and change.  Uploads
+// are written straight to the content directory, so the watcher picks
+// them up and browsers reload as they would for any edit.
+
+// checkSFTP makes sure -sftp has something to serve and someone to
+// serve it to.
+func checkSFTP() error {
+	if *flagSFTP == "" {
+		return nil
+	}
+	if !contentOnDisk() {
+		return fmt.Errorf("-sftp can't serve a -source snapshot")
+	}
+	if len(cfg.Auth.Users) == 0 {
+		return fmt.Errorf("-sftp needs users in the auth config")
+	}
+	return nil
+}
+
+// sftpHostKey loads the server's host key from -sftp-host-key, making
+// one (and saving it there) if there's no such file.  Without
+// -sftp-host-key the key lasts as long as the server does.
+func sftpHostKey() (gossh.Signer, error) {
+	if *flagSFTPHostKey != "" {
+		b, err := ioutil.ReadFile(*flagSFTPHostKey)
+		if err == nil {
+			return gossh.ParsePrivateKey(b)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if *flagSFTPHostKey != "" {
+		block, err := gossh.MarshalPrivateKey(key, "mdwiki-dev-server")
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(*flagSFTPHostKey, pem.EncodeToMemory(block), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return gossh.NewSignerFromKey(key)
+}
+
+// sftpPrincipal returns who signed in to an SSH session.
+func sftpPrincipal(ctx ssh.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// sftpSignIn records that the user ctx is for has signed in.
+func sftpSignIn(ctx ssh.Context, u authUser) {
+	ctx.SetValue(principalKey{}, &principal{Name: ctx.User(), Groups: u.Groups})
+}
+
+// serveSFTP runs the -sftp server, on addr.
+func serveSFTP(addr string) {
+	signer, err := sftpHostKey()
+	maybeBail(err)
+	server := &ssh.Server{
+		Addr: addr,
+		Handler: func(s ssh.Session) {
+			io.WriteString(s.Stderr(), "only sftp is served here\n")
+			s.Exit(1)
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			u, ok := cfg.Auth.Users[ctx.User()]
+			if !ok || u.Password == "" || !passwordMatches(password, u.Password) {
+				log.Warning("sftp: bad password for %s from %s", ctx.User(), ctx.RemoteAddr())
+				return false
+			}
+			sftpSignIn(ctx, u)
+			return true
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			u, ok := cfg.Auth.Users[ctx.User()]
+			if !ok {
+				return false
+			}
+			for _, k := range u.Keys {
+				known, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+				if err != nil {
+					log.Warning("sftp: user %s has a bad key: %s", ctx.User(), err)
+					continue
+				}
+				if ssh.KeysEqual(key, known) {
+					sftpSignIn(ctx, u)
+					return true
+				}
+			}
+			return false
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": func(s ssh.Session) {
+				root := &sftpRoot{sftpPrincipal(s.Context()), s.RemoteAddr().String()}
+				log.Info("sftp: %s signed in from %s", root.user.Name, root.remote)
+				server := sftp.NewRequestServer(s, sftp.Handlers{
+					FileGet: root, FilePut: root, FileCmd: root, FileList: root})
+				if err := server.Serve(); err != nil && err != io.EOF {
+					log.Warning("sftp: %s: %s", root.user.Name, err)
+				}
+				server.Close()
+			},
+		},
+	}
+	server.AddHostKey(signer)
+	log.Notice("serving sftp on %s, host key %s", addr, gossh.FingerprintSHA256(signer.PublicKey()))
+	maybeBail(server.ListenAndServe())
+}
+
+// An sftpRoot is the content directory as one SFTP user sees it.
+type sftpRoot struct {
+	user   *principal
+	remote string
+}
+
+// resolve turns an SFTP path into one relative to the content
+// directory, and the file's name, refusing the files the server won't
+// serve.
+func (root *sftpRoot) resolve(p string) (rel string, name string, err error) {
+	rel = strings.TrimPrefix(path.Clean("/"+p), "/")
+	name = filepath.Join(*flagContentDir, filepath.FromSlash(rel))
+	if rel != "" && (protectedPath(rel) || settingsFor(rel).ignored(rel) || !symlinkAllowed(name)) {
+		return "", "", sftp.ErrSSHFxPermissionDenied
+	}
+	return rel, name, nil
+}
+
+// editable resolves p as a path the user may change.
+func (root *sftpRoot) editable(p string) (rel string, name string, err error) {
+	if *flagReadOnly {
+		return "", "", sftp.ErrSSHFxPermissionDenied
+	}
+	rel, name, err = root.resolve(p)
+	if err == nil && (rel == "" || !mayEdit(root.user, rel)) {
+		err = sftp.ErrSSHFxPermissionDenied
+	}
+	return rel, name, err
+}
+
+// movable checks that the user may move rel, the file or directory
+// name, to to: that they may edit everything below a directory, where
+// it is and where it would be.
+func (root *sftpRoot) movable(rel string, name string, to string) error {
+	return filepath.Walk(name, func(child string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		suffix, err := filepath.Rel(name, child)
+		if err != nil {
+			return err
+		}
+		suffix = filepath.ToSlash(suffix)
+		if !mayEdit(root.user, path.Join(rel, suffix)) || !mayEdit(root.user, path.Join(to, suffix)) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return nil
+	})
+}
+
+// record writes a change to the audit log.
+func (root *sftpRoot) record(m mutation) {
+	m.Time = time.Now()
+	m.User = root.user.Name
+	m.Remote = root.remote
+	logMutation(m)
+}
+
+func (root *sftpRoot) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	rel, name, err := root.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if !mayRead(root.user, rel) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return os.Open(name)
+}
+
+func (root *sftpRoot) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	rel, name, err := root.editable(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	flags := r.Pflags()
+	mode := os.O_WRONLY
+	if flags.Creat {
+		mode |= os.O_CREATE
+	}
+	if flags.Trunc {
+		mode |= os.O_TRUNC
+	}
+	if flags.Excl {
+		mode |= os.O_EXCL
+	}
+	f, err := os.OpenFile(name, mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.Notice("sftp: %s uploading %s", root.user.Name, rel)
+	root.record(mutation{Action: "upload", Path: rel})
+	return f, nil
+}
+
+func (root *sftpRoot) Filecmd(r *sftp.Request) error {
+	rel, name, err := root.editable(r.Filepath)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "Setstat":
+		// times and modes aren't the user's business
+		return nil
+	case "Rename":
+		to, toName, err := root.editable(r.Target)
+		if err != nil {
+			return err
+		}
+		if err := root.movable(rel, name, to); err != nil {
+			return err
+		}
+		// os.Rename would replace it, behind the trash's back
+		if _, err := os.Lstat(toName); err == nil {
+			return fmt.Errorf("%s already exists", to)
+		}
+		if err := os.Rename(name, toName); err != nil {
+			return err
+		}
+		root.record(mutation{Action: "move", Path: rel, To: to})
+	case "Remove":
+		if err := moveToTrash(rel, root.user.Name); err != nil {
+			return err
+		}
+		root.record(mutation{Action: "remove", Path: rel})
+	case "Rmdir":
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		root.record(mutation{Action: "remove", Path: rel})
+	case "Mkdir":
+		if err := os.Mkdir(name, 0755); err != nil {
+			return err
+		}
+		root.record(mutation{Action: "mkdir", Path: rel})
+	default:
+		// links could lead out of the content directory
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	log.Notice("sftp: %s: %s %s", root.user.Name, strings.ToLower(r.Method), rel)
+	return nil
+}
+
+func (root *sftpRoot) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	rel, name, err := root.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		infos, err := ioutil.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		var listed sftpListing
+		for _, info := range infos {
+			child := path.Join(rel, info.Name())
+			if _, _, err := root.resolve(child); err != nil || !mayRead(root.user, child) {
+				continue
+			}
+			listed = append(listed, info)
+		}
+		return listed, nil
+	case "Stat":
+		if rel != "" && !mayRead(root.user, rel) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing{info}, nil
+	}
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+// An sftpListing is a directory listing, or a file's attributes.
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
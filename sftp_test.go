@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// Renames don't carry pages the user may not edit along with a
+// directory, or replace what's already there.
+func TestSFTPRename(t *testing.T) {
+	dir := t.TempDir()
+	for _, rel := range []string{"docs/open.md", "docs/secret/page.md", "other/open.md"} {
+		name := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte("# "+rel+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	savedDir, savedCfg := *flagContentDir, cfg
+	defer func() { *flagContentDir, cfg = savedDir, savedCfg }()
+	*flagContentDir = dir
+	cfg = config{}
+	cfg.ACL = []aclRule{{Path: "/docs/secret", Read: []string{"*"}, Edit: []string{"alice"}}}
+	root := &sftpRoot{&principal{Name: "bob"}, "test"}
+
+	for _, tc := range []struct {
+		from, to string
+		ok       bool
+	}{
+		{"docs", "moved", false},
+		{"docs/open.md", "other/open.md", false},
+		{"docs/open.md", "other/new.md", true},
+	} {
+		r := sftp.NewRequest("Rename", "/"+tc.from)
+		r.Target = "/" + tc.to
+		err := root.Filecmd(r)
+		if (err == nil) != tc.ok {
+			t.Errorf("renaming %s to %s: %v", tc.from, tc.to, err)
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, filepath.FromSlash(tc.from))); (statErr == nil) == tc.ok {
+			t.Errorf("renaming %s to %s left it in place: %t", tc.from, tc.to, statErr == nil)
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "other", "open.md")); err != nil || string(b) != "# other/open.md\n" {
+		t.Errorf("other/open.md is now %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"hash/fnv"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// A shardedWatcher spreads its watches over several fsnotify watchers,
+// by a hash of the directory name, and merges their events.  Each
+// inotify instance has its own event queue (and its own reader), so a
+// very large tree's event storms overflow less and drain faster.
+type shardedWatcher struct {
+	shards []*fsnotify.Watcher
+	Events chan fsnotify.Event
+	Errors chan error
+	done   chan struct{}
+}
+
+func newShardedWatcher(n int) (*shardedWatcher, error) {
+	if n < 1 {
+		n = 1
+	}
+	w := &shardedWatcher{
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		shard, err := fsnotify.NewWatcher()
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.shards = append(w.shards, shard)
+		go w.merge(shard)
+	}
+	return w, nil
+}
+
+// merge passes a shard's events and errors on.
+func (w *shardedWatcher) merge(shard *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-shard.Events:
+			if !ok {
+				return
+			}
+			select {
+			case w.Events <- event:
+			case <-w.done:
+				return
+			}
+		case err, ok := <-shard.Errors:
+			if !ok {
+				return
+			}
+			select {
+			case w.Errors <- err:
+			case <-w.done:
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// shard returns the watcher that looks after a directory.
+func (w *shardedWatcher) shard(name string) *fsnotify.Watcher {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return w.shards[h.Sum32()%uint32(len(w.shards))]
+}
+
+func (w *shardedWatcher) Add(name string) error {
+	return w.shard(name).Add(name)
+}
+
+func (w *shardedWatcher) Remove(name string) error {
+	return w.shard(name).Remove(name)
+}
+
+func (w *shardedWatcher) Close() error {
+	close(w.done)
+	var err error
+	for _, shard := range w.shards {
+		if e := shard.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// lazyWatches are directories, relative to the content directory, to
+// start watching under -lazy-watch because something in them was
+// served.
+var lazyWatches = make(chan string, 64)
+
+// watchLazily asks the content watcher to watch a directory, if it
+// isn't already.  It doesn't wait; a busy watcher catches up the
+// next time the directory is read from.
+func watchLazily(rel string) {
+	select {
+	case lazyWatches <- rel:
+	default:
+	}
+}
+
+// lazyWatchWanted reports whether name, a file below dir, makes its
+// directory worth watching under -lazy-watch: it's a file changes to
+// which are watched for, or a directory's config file.
+func lazyWatchWanted(dir string, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	return path.Base(rel) == ".mdwiki-dev.yaml" || settingsFor(rel).watches(rel)
+}
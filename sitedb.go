@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A siteModel is everything the index knows about the site, for tools
+// that would rather not parse the Markdown themselves.
+type siteModel struct {
+	Generated time.Time       `json:"generated"`
+	Pages     []siteModelPage `json:"pages"`
+}
+
+type siteModelPage struct {
+	Path     string          `json:"path"`
+	Title    string          `json:"title"`
+	Words    int             `json:"words"`
+	ModTime  time.Time       `json:"mtime"`
+	Summary  string          `json:"summary"`
+	Headings []heading       `json:"headings"`
+	Links    []siteModelLink `json:"links"`
+	Tags     []string        `json:"tags"`
+}
+
+type siteModelLink struct {
+	Target   string `json:"target"`   // as written
+	Resolved string `json:"resolved"` // the page it leads to, "" if none
+}
+
+func (s *siteIndex) model() siteModel {
+	m := siteModel{Generated: time.Now(), Pages: []siteModelPage{}}
+	for _, p := range s.sortedPages() {
+		mp := siteModelPage{p.Path, p.Title, p.Words, p.ModTime, p.Summary,
+			p.Headings, []siteModelLink{}, p.Tags}
+		if mp.Headings == nil {
+			mp.Headings = []heading{}
+		}
+		for _, l := range p.Links {
+			mp.Links = append(mp.Links, siteModelLink{l, s.resolveLink(p.Path, l)})
+		}
+		m.Pages = append(m.Pages, mp)
+	}
+	return m
+}
+
+const siteModelSchema = `
+CREATE TABLE pages (path TEXT PRIMARY KEY, title TEXT, words INTEGER, mtime TEXT, summary TEXT);
+CREATE TABLE headings (page TEXT, position INTEGER, level INTEGER, text TEXT);
+CREATE TABLE links (page TEXT, target TEXT, resolved TEXT);
+CREATE TABLE tags (page TEXT, tag TEXT);
+CREATE INDEX links_resolved ON links (resolved);
+CREATE INDEX tags_tag ON tags (tag);
+`
+
+// sqlString quotes s as an SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// sql writes the model out as SQLite statements.
+func (m siteModel) sql() []byte {
+	var b bytes.Buffer
+	b.WriteString("BEGIN;\n")
+	b.WriteString(siteModelSchema)
+	for _, p := range m.Pages {
+		fmt.Fprintf(&b, "INSERT INTO pages VALUES (%s, %s, %d, %s, %s);\n", sqlString(p.Path),
+			sqlString(p.Title), p.Words, sqlString(p.ModTime.Format(time.RFC3339)), sqlString(p.Summary))
+		for i, h := range p.Headings {
+			fmt.Fprintf(&b, "INSERT INTO headings VALUES (%s, %d, %d, %s);\n",
+				sqlString(p.Path), i, h.Level, sqlString(h.Text))
+		}
+		for _, l := range p.Links {
+			resolved := "NULL"
+			if l.Resolved != "" {
+				resolved = sqlString(l.Resolved)
+			}
+			fmt.Fprintf(&b, "INSERT INTO links VALUES (%s, %s, %s);\n",
+				sqlString(p.Path), sqlString(l.Target), resolved)
+		}
+		for _, t := range p.Tags {
+			fmt.Fprintf(&b, "INSERT INTO tags VALUES (%s, %s);\n", sqlString(p.Path), sqlString(t))
+		}
+	}
+	b.WriteString("COMMIT;\n")
+	return b.Bytes()
+}
+
+// writeSQLite makes a SQLite database of the model at name, using the
+// sqlite3 command, replacing whatever was there only once it's done.
+func (m siteModel) writeSQLite(name string) error {
+	tmp := name + ".tmp"
+	os.Remove(tmp)
+	cmd := exec.Command("sqlite3", "-bail", tmp)
+	cmd.Stdin = bytes.NewReader(m.sql())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("sqlite3: %s %s", err, bytes.TrimSpace(out))
+	}
+	return os.Rename(tmp, name)
+}
+
+// writeIndex implements the index command, which writes the site model to
+// a file, as JSON or (if sqlite3 is installed) a SQLite database with
+// pages, headings, links and tags tables.  The format goes by the
+// file's extension unless -format says otherwise.
+func writeIndex(args []string) error {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	out := flags.String("out", "", "file to write, e.g. site.db or site.json; - for JSON on stdout")
+	format := flags.String("format", "", "json or sqlite, rather than going by -out's extension")
+	flags.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("usage: index -out site.db")
+	}
+	if *format == "" {
+		*format = "sqlite"
+		if *out == "-" || strings.EqualFold(filepath.Ext(*out), ".json") {
+			*format = "json"
+		}
+	}
+
+	s, err := newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	m := s.model()
+
+	switch *format {
+	case "json":
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		if *out == "-" {
+			fmt.Println(string(b))
+			return nil
+		}
+		err = ioutil.WriteFile(*out, append(b, '\n'), 0644)
+		if err != nil {
+			return err
+		}
+	case "sqlite":
+		if *out == "-" {
+			return fmt.Errorf("a SQLite database can't be written to stdout")
+		}
+		if err := m.writeSQLite(*out); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	log.Notice("wrote %d pages to %s", len(m.Pages), *out)
+	return nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot is a copy of the content directory, taken before an
+// experimental mass edit so that it can be rolled back.  Snapshots are
+// plain copies, in -snapshots (.mdwiki-snapshots in the content
+// directory, by default, which being a dot directory is neither served
+// nor watched), so that what's edited in place afterwards can't reach
+// them.  Each is a directory named for its id, with the files below
+// files/ and what it is in snapshot.json.
+type snapshot struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Note  string    `json:"note,omitempty"`
+	Files int       `json:"files"`
+}
+
+// A rollbackPlan is what rolling back to a snapshot changes.
+type rollbackPlan struct {
+	Snapshot snapshot `json:"snapshot"`
+	Write    []string `json:"write"`  // changed since, or removed
+	Remove   []string `json:"remove"` // added since
+}
+
+// snapshotsDir is where the snapshots are kept.
+func snapshotsDir() string {
+	if *flagSnapshots != "" {
+		return *flagSnapshots
+	}
+	return filepath.Join(*flagContentDir, ".mdwiki-snapshots")
+}
+
+// snapshotFiles returns the files below dir a snapshot keeps, by path
+// relative to dir: what's served or watched, but not what's ignored.
+func snapshotFiles(dir string) map[string]string {
+	files := make(map[string]string)
+	// with -snapshots below -dir, the snapshots aren't part of them
+	inside := snapshotsDir() + string(filepath.Separator)
+	for name := range pollTree(dir) {
+		rel, err := filepath.Rel(dir, name)
+		maybeBail(err)
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(name, inside) && !strings.HasPrefix(dir, inside) {
+			continue
+		}
+		if !protectedPath(rel) && !settingsFor(rel).ignored(rel) {
+			files[rel] = name
+		}
+	}
+	return files
+}
+
+// canSnapshot reports why snapshots can't be taken or rolled back, if
+// they can't.
+func canSnapshot() error {
+	if !contentOnDisk() {
+		return fmt.Errorf("a -source snapshot can't be snapshotted")
+	}
+	if *flagReadOnly {
+		return fmt.Errorf("snapshots can't be taken or rolled back with -read-only")
+	}
+	return nil
+}
+
+// takeSnapshot copies the content in dir to a new snapshot.
+func takeSnapshot(dir string, note string) (snapshot, error) {
+	if err := canSnapshot(); err != nil {
+		return snapshot{}, err
+	}
+	s := snapshot{ID: time.Now().Format("20060102-150405"), Time: time.Now(), Note: note}
+	root := filepath.Join(snapshotsDir(), s.ID)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			break
+		}
+		s.ID = fmt.Sprintf("%s-%d", s.Time.Format("20060102-150405"), n)
+		root = filepath.Join(snapshotsDir(), s.ID)
+	}
+
+	for rel, name := range snapshotFiles(dir) {
+		if err := copyFile(name, filepath.Join(root, "files", filepath.FromSlash(rel))); err != nil {
+			os.RemoveAll(root)
+			return snapshot{}, err
+		}
+		s.Files++
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	maybeBail(err)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return snapshot{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "snapshot.json"), b, 0644); err != nil {
+		os.RemoveAll(root)
+		return snapshot{}, err
+	}
+	log.Notice("took snapshot %s of %d files", s.ID, s.Files)
+	return s, nil
+}
+
+// pruneSnapshots removes the oldest snapshots beyond -snapshot-limit,
+// once a new one's been taken (and, for a rollback, rolled back to).
+func pruneSnapshots() {
+	if *flagSnapshotLimit <= 0 {
+		return
+	}
+	snapshots, err := listSnapshots()
+	if err != nil {
+		log.Warning("unable to list the snapshots to prune them: %s", err)
+		return
+	}
+	if len(snapshots) <= *flagSnapshotLimit {
+		return
+	}
+	for _, s := range snapshots[*flagSnapshotLimit:] {
+		if err := os.RemoveAll(filepath.Join(snapshotsDir(), s.ID)); err != nil {
+			log.Warning("unable to remove snapshot %s: %s", s.ID, err)
+			continue
+		}
+		log.Info("removed snapshot %s, beyond -snapshot-limit", s.ID)
+	}
+}
+
+// copyFile copies the file from to to, with its mode.
+func copyFile(from string, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, b, info.Mode().Perm())
+}
+
+// listSnapshots returns the snapshots, newest first.
+func listSnapshots() ([]snapshot, error) {
+	infos, err := ioutil.ReadDir(snapshotsDir())
+	if os.IsNotExist(err) {
+		return []snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []snapshot{}
+	for _, info := range infos {
+		if s, err := loadSnapshot(info.Name()); err == nil {
+			snapshots = append(snapshots, s)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.After(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// loadSnapshot reads what the snapshot id is.
+func loadSnapshot(id string) (snapshot, error) {
+	var s snapshot
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return s, fmt.Errorf("no snapshot %q", id)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(snapshotsDir(), id, "snapshot.json"))
+	if os.IsNotExist(err) {
+		return s, fmt.Errorf("no snapshot %q", id)
+	}
+	if err != nil {
+		return s, err
+	}
+	return s, json.Unmarshal(b, &s)
+}
+
+// planRollback works out what rolling dir back to the snapshot id
+// would change.
+func planRollback(dir string, id string) (rollbackPlan, error) {
+	s, err := loadSnapshot(id)
+	if err != nil {
+		return rollbackPlan{}, err
+	}
+	plan := rollbackPlan{Snapshot: s, Write: []string{}, Remove: []string{}}
+	kept := snapshotFiles(filepath.Join(snapshotsDir(), id, "files"))
+	current := snapshotFiles(dir)
+	for rel, name := range kept {
+		old, err := ioutil.ReadFile(name)
+		if err != nil {
+			return rollbackPlan{}, err
+		}
+		if now, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel))); err != nil || !bytes.Equal(now, old) {
+			plan.Write = append(plan.Write, rel)
+		}
+	}
+	for rel := range current {
+		if _, ok := kept[rel]; !ok {
+			plan.Remove = append(plan.Remove, rel)
+		}
+	}
+	sort.Strings(plan.Write)
+	sort.Strings(plan.Remove)
+	return plan, nil
+}
+
+// rollBack carries out a plan, after taking a snapshot of how things
+// were, so that the rollback can be rolled back too.  Only the files
+// that differ are touched, so the watcher sees just what changed.
+func rollBack(dir string, plan rollbackPlan) error {
+	if err := canSnapshot(); err != nil {
+		return err
+	}
+	if len(plan.Write)+len(plan.Remove) == 0 {
+		return nil
+	}
+	if _, err := takeSnapshot(dir, "before rolling back to "+plan.Snapshot.ID); err != nil {
+		return err
+	}
+	files := filepath.Join(snapshotsDir(), plan.Snapshot.ID, "files")
+	for _, rel := range plan.Write {
+		if err := copyFile(filepath.Join(files, filepath.FromSlash(rel)), filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	for _, rel := range plan.Remove {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(rel))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	log.Notice("rolled back to snapshot %s: %d files written, %d removed",
+		plan.Snapshot.ID, len(plan.Write), len(plan.Remove))
+	pruneSnapshots()
+	return nil
+}
+
+// takeSnapshotCommand implements the snapshot command, which takes a
+// snapshot and prints its id, or with -l lists them.
+func takeSnapshotCommand(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	note := flags.String("m", "", "a note saying what the snapshot is for")
+	list := flags.Bool("l", false, "list the snapshots instead, newest first")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: snapshot [-m note] | snapshot -l")
+	}
+	if *list {
+		snapshots, err := listSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			fmt.Printf("%s\t%d files\t%s\n", s.ID, s.Files, s.Note)
+		}
+		return nil
+	}
+	s, err := takeSnapshot(*flagContentDir, *note)
+	if err == nil {
+		fmt.Println(s.ID)
+		pruneSnapshots()
+	}
+	return err
+}
+
+// rollbackCommand implements the rollback command, which rolls the
+// content back to a snapshot, reporting each file it changes.
+func rollbackCommand(args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only show the files that would change")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: rollback [-n] <id>")
+	}
+	plan, err := planRollback(*flagContentDir, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, rel := range plan.Write {
+		fmt.Println("write", rel)
+	}
+	for _, rel := range plan.Remove {
+		fmt.Println("remove", rel)
+	}
+	if *dryRun {
+		return nil
+	}
+	return rollBack(*flagContentDir, plan)
+}
+
+// snapshotsHandler serves /_api/snapshots: GET for the list, POST
+// {"note": "..."} to take one (for users who may edit every page it
+// would copy); /_api/snapshots/<id>, what rolling back
+// to it would change (to the pages the user may read); and POST
+// /_api/snapshots/<id>/rollback to do it.
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_api/snapshots"), "/")
+	id := strings.TrimSuffix(rest, "/rollback")
+	var v interface{}
+	var err error
+	status := http.StatusOK
+	switch {
+	case rest == "" && r.Method == "GET":
+		v, err = listSnapshots()
+	case rest == "" && r.Method == "POST":
+		if refuseReadOnly(w) {
+			return
+		}
+		for rel := range snapshotFiles(*flagContentDir) {
+			if !canEdit(r, rel) {
+				http.Error(w, "you may not change "+rel, http.StatusForbidden)
+				return
+			}
+		}
+		var req struct {
+			Note string `json:"note"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v, err = takeSnapshot(*flagContentDir, req.Note); err == nil {
+			pruneSnapshots()
+		}
+		status = http.StatusCreated
+	case rest == "":
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	case id == rest && r.Method == "GET", id != rest && r.Method == "POST":
+		plan, planErr := planRollback(*flagContentDir, id)
+		if planErr != nil {
+			http.Error(w, planErr.Error(), http.StatusNotFound)
+			return
+		}
+		if id != rest {
+			if refuseReadOnly(w) {
+				return
+			}
+			for _, rel := range append(append([]string{}, plan.Write...), plan.Remove...) {
+				if !canEdit(r, rel) {
+					http.Error(w, "you may not change "+rel, http.StatusForbidden)
+					return
+				}
+			}
+			if err = rollBack(*flagContentDir, plan); err == nil {
+				for _, rel := range plan.Write {
+					recordMutation(r, mutation{Action: "rollback", Path: rel})
+				}
+				for _, rel := range plan.Remove {
+					recordMutation(r, mutation{Action: "rollback", Path: rel})
+				}
+			}
+		} else {
+			plan.Write, plan.Remove = readablePages(r, plan.Write), readablePages(r, plan.Remove)
+		}
+		v = plan
+	case id == rest:
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	default:
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Error("snapshots: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(b)
+	maybeBail(err)
+}
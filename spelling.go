@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A misspelling is a word that isn't in the dictionary or word list.
+type misspelling struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Word   string `json:"word"`
+}
+
+type spellChecker struct {
+	words map[string]bool
+}
+
+// newSpellChecker loads the words in each of the named files.  Plain
+// word lists (one word per line, e.g. /usr/share/dict/words) and
+// hunspell .dic files (a count, then word/FLAGS lines) both work,
+// although hunspell affix rules aren't applied.
+func newSpellChecker(files ...string) (*spellChecker, error) {
+	s := &spellChecker{words: make(map[string]bool)}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		first := true
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if first {
+				first = false
+				if _, err := strconv.Atoi(line); err == nil {
+					continue
+				}
+			}
+			if i := strings.IndexByte(line, '/'); i >= 0 {
+				line = line[:i]
+			}
+			if line != "" && !strings.HasPrefix(line, "#") {
+				s.words[line] = true
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		log.Debug("loaded word list %s", name)
+	}
+	return s, nil
+}
+
+// suffixes stripped from words that aren't found as-is
+var spellingSuffixes = []string{"'s", "s", "es", "ed", "d", "ing", "ly", "er", "ers"}
+
+func (s *spellChecker) known(word string) bool {
+	for _, w := range []string{word, strings.ToLower(word)} {
+		if s.words[w] {
+			return true
+		}
+		for _, suffix := range spellingSuffixes {
+			base := strings.TrimSuffix(w, suffix)
+			if base == w || len(base) < 2 {
+				continue
+			}
+			if s.words[base] || s.words[base+"e"] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	// things that aren't prose: inline code, link targets, URLs,
+	// e-mail addresses and HTML tags
+	spellingSkipRegexp = regexp.MustCompile("`[^`]*`|\\]\\([^)]*\\)|\\bhttps?://\\S+|\\S+@\\S+|<[^>]+>")
+	spellingWordRegexp = regexp.MustCompile(`[\pL][\pL']*`)
+)
+
+// check returns the misspellings in a Markdown document.  Fenced code
+// blocks are skipped, as are words containing capitals after the first
+// letter (acronyms, CamelCase identifiers).
+func (s *spellChecker) check(name string, md []byte) []misspelling {
+	var found []misspelling
+	inFence := false
+	for i, line := range strings.Split(string(md), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+
+		// blank out what we skip so columns still line up
+		line = spellingSkipRegexp.ReplaceAllStringFunc(line, func(m string) string {
+			return strings.Repeat(" ", len(m))
+		})
+		for _, loc := range spellingWordRegexp.FindAllStringIndex(line, -1) {
+			word := strings.TrimRight(line[loc[0]:loc[1]], "'")
+			if len([]rune(word)) < 2 || strings.IndexFunc(word[1:], unicode.IsUpper) >= 0 {
+				continue
+			}
+			if !s.known(word) {
+				found = append(found, misspelling{name, i + 1, loc[0] + 1, word})
+			}
+		}
+	}
+	return found
+}
+
+// spelling word lists: the dictionary, the project's .spelling file
+// (if there is one) and anything given with -words
+func spellingWordLists() []string {
+	lists := []string{*flagDict}
+	project := filepath.Join(*flagContentDir, ".spelling")
+	if _, err := os.Stat(project); err == nil {
+		lists = append(lists, project)
+	}
+	if *flagWords != "" {
+		lists = append(lists, *flagWords)
+	}
+	return lists
+}
+
+// walkMarkdown calls fn for each Markdown file below dir, skipping dot
+// files and directories and anything ignored by the config files, with
+// the file's path relative to dir.
+func walkMarkdown(dir string, fn func(rel string, md []byte) error) error {
+	files := os.DirFS(dir)
+	if dir == *flagContentDir {
+		files = contentFiles()
+	}
+	return fs.WalkDir(files, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || settingsFor(rel).ignored(rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		name := filepath.Join(dir, filepath.FromSlash(rel))
+		if d.IsDir() || path.Ext(rel) != ".md" || !symlinkAllowed(name) {
+			return nil
+		}
+		md, err := fs.ReadFile(files, rel)
+		if err != nil {
+			return err
+		}
+		return fn(rel, md)
+	})
+}
+
+// checkSpelling implements the check-spelling command, which reports
+// the misspellings in every Markdown file in the content directory.
+func checkSpelling(args []string) error {
+	flags := flag.NewFlagSet("check-spelling", flag.ExitOnError)
+	format := flags.String("format", "text", "output format, text or json")
+	flags.Parse(args)
+
+	checker, err := newSpellChecker(spellingWordLists()...)
+	if err != nil {
+		return err
+	}
+
+	var found []misspelling
+	err = walkMarkdown(*flagContentDir, func(rel string, md []byte) error {
+		found = append(found, checker.check(rel, md)...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *format == "text" && *flagDiagnosticsFormat != "":
+		printDiagnostics(spellingDiagnostics(found), *flagDiagnosticsFormat)
+	case *format == "json":
+		b, err := json.MarshalIndent(found, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	case *format == "text":
+		for _, m := range found {
+			fmt.Printf("%s:%d:%d: %s\n", m.File, m.Line, m.Column, m.Word)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if len(found) > 0 {
+		return fmt.Errorf("found %d misspellings", len(found))
+	}
+	return nil
+}
+
+// the server's checker is loaded on first use
+var (
+	serverSpellChecker     *spellChecker
+	serverSpellCheckerErr  error
+	serverSpellCheckerOnce sync.Once
+)
+
+// spellingHandler serves /_api/spelling/<path>, the misspellings in a
+// single page as JSON, for editor integrations.
+func spellingHandler(w http.ResponseWriter, r *http.Request) {
+	serverSpellCheckerOnce.Do(func() {
+		serverSpellChecker, serverSpellCheckerErr = newSpellChecker(spellingWordLists()...)
+	})
+	if serverSpellCheckerErr != nil {
+		http.Error(w, serverSpellCheckerErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/_api/spelling/"))
+	rel := strings.TrimPrefix(name, "/")
+	if path.Ext(name) != ".md" || settingsFor(rel).ignored(rel) {
+		http.NotFound(w, r)
+		return
+	}
+	// contentFS applies the protected file and symbolic link policies
+	f, err := contentFS{contentFileSystem()}.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	md, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	found := serverSpellChecker.check(strings.TrimPrefix(name, "/"), md)
+	if found == nil {
+		found = []misspelling{}
+	}
+	b, err := json.MarshalIndent(found, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+type pageStats struct {
+	Path        string `json:"path"`
+	Words       int    `json:"words"`
+	ReadingTime int    `json:"reading_time_minutes"`
+	Headings    int    `json:"headings"`
+}
+
+type siteStats struct {
+	Pages       int         `json:"pages"`
+	Words       int         `json:"words"`
+	ReadingTime int         `json:"reading_time_minutes"`
+	Headings    int         `json:"headings"`
+	PerPage     []pageStats `json:"per_page"`
+}
+
+// stats summarizes the index, page by page and in total, leaving out
+// the pages readable says no to (if it isn't nil).
+func (s *siteIndex) stats(readable func(rel string) bool) siteStats {
+	var stats siteStats
+	stats.PerPage = []pageStats{}
+	for _, p := range s.sortedPages() {
+		if readable != nil && !readable(p.Path) {
+			continue
+		}
+		ps := pageStats{p.Path, p.Words, p.ReadingTime(), len(p.Headings)}
+		stats.PerPage = append(stats.PerPage, ps)
+		stats.Pages++
+		stats.Words += ps.Words
+		stats.ReadingTime += ps.ReadingTime
+		stats.Headings += ps.Headings
+	}
+	return stats
+}
+
+// statsHandler serves /_api/stats, for the pages the user may read.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(site.stats(func(rel string) bool { return canRead(r, rel) }), "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
+
+// printStats implements the stats command, which prints a table of
+// per-page statistics followed by the totals.
+func printStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+
+	index, err := newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	stats := index.stats(nil)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "words\tminutes\theadings\t\tpage")
+	for _, p := range stats.PerPage {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t\t%s\n", p.Words, p.ReadingTime, p.Headings, p.Path)
+	}
+	fmt.Fprintf(tw, "%d\t%d\t%d\t\t%d pages\n", stats.Words, stats.ReadingTime,
+		stats.Headings, stats.Pages)
+	return tw.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// serverStatus is what /_status reports.
+type serverStatus struct {
+	Started     time.Time `json:"started"`
+	Uptime      string    `json:"uptime"`
+	ContentDir  string    `json:"content_dir"`
+	Address     string    `json:"address"`
+	Clients     int       `json:"clients"`
+	Pages       int       `json:"pages"`
+	Changes     int       `json:"changes"`
+	BuildErrors string    `json:"build_errors"`
+
+	Resources  resourceUsage     `json:"resources"`
+	Components []componentStatus `json:"components"` // the supervised parts of the server
+}
+
+func currentStatus() serverStatus {
+	listeners.Lock()
+	clients := len(listeners.channels)
+	listeners.Unlock()
+	site.RLock()
+	pages := len(site.pages)
+	site.RUnlock()
+	history.Lock()
+	changes := len(history.entries)
+	history.Unlock()
+
+	return serverStatus{
+		Started:     sessionStarted,
+		Uptime:      time.Since(sessionStarted).Truncate(time.Second).String(),
+		ContentDir:  *flagContentDir,
+		Address:     *flagAddr + ":" + *flagPort,
+		Clients:     clients,
+		Pages:       pages,
+		Changes:     changes,
+		BuildErrors: currentErrorText(),
+		Resources:   currentUsage(),
+		Components:  componentsSnapshot(),
+	}
+}
+
+var statusTmpl = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mdwiki-dev-server status</title>
+<style>
+body { font-family: sans-serif; }
+th { text-align: left; padding-right: 1em; }
+</style>
+</head>
+<body>
+<h1>mdwiki-dev-server status</h1>
+<table>
+<tr><th>Serving</th><td>{{.ContentDir}} on {{.Address}}</td></tr>
+<tr><th>Up since</th><td>{{.Started.Format "15:04:05 Jan 2"}} ({{.Uptime}})</td></tr>
+<tr><th>Connected clients</th><td>{{.Clients}}</td></tr>
+<tr><th>Pages indexed</th><td>{{.Pages}}</td></tr>
+<tr><th>Changes this session</th><td><a href="/_history">{{.Changes}}</a></td></tr>
+</table>
+<h2>Resources</h2>
+<table>
+{{with .Resources}}<tr><th>Watched directories</th><td>{{.Watches}}{{if .WatchLimit}} of {{.WatchLimit}}{{end}}</td></tr>
+<tr><th>Open files</th><td>{{.OpenFiles}}{{if .FileLimit}} of {{.FileLimit}}{{end}}</td></tr>
+<tr><th>Websockets</th><td>{{.Websockets}}</td></tr>
+<tr><th>Cached bytes</th><td>{{.CachedBytes}}</td></tr>
+<tr><th>Goroutines</th><td>{{.Goroutines}}</td></tr>
+{{end}}</table>
+{{if .Components}}<h2>Components</h2>
+<table>
+{{range .Components}}<tr><th>{{.Name}}</th><td>{{if .Running}}running{{else}}restarting{{end}}{{if .Restarts}}; restarts: {{.Restarts}}, the last at {{.LastRestart.Format "15:04:05 Jan 2"}} ({{.LastFailure}}){{end}}</td></tr>
+{{end}}</table>
+{{end}}{{if .BuildErrors}}<h2>Build errors</h2>
+<pre>{{.BuildErrors}}</pre>{{end}}
+</body>
+</html>
+`))
+
+// statusHandler serves /_status: a page for browsers, JSON otherwise.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	status := currentStatus()
+	if !wantsHTML(r) {
+		b, err := json.MarshalIndent(status, "", "  ")
+		maybeBail(err)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		maybeBail(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTmpl.Execute(w, status); err != nil {
+		log.Error("unable to render status: %s", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The server's long-running parts, the content watcher and the
+// handlers it feeds changes to, the broker relay and so on, run
+// supervised: one that panics is logged, with its stack, and started
+// again after a pause, rather than taking live reload (or everything)
+// down with it.  The pause doubles with each crash in a row, up to a
+// minute; a part that's run for a minute since starting over has
+// recovered.  /_status has how often each has been restarted.
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+)
+
+// componentStatus is how a supervised part of the server is doing.
+type componentStatus struct {
+	Name        string     `json:"name"`
+	Running     bool       `json:"running"`
+	Restarts    int        `json:"restarts"`
+	LastFailure string     `json:"last_failure,omitempty"`
+	LastRestart *time.Time `json:"last_restart,omitempty"`
+}
+
+// components are the supervised parts of the server, by name.
+var components = struct {
+	sync.Mutex
+	byName map[string]*componentStatus
+}{byName: make(map[string]*componentStatus)}
+
+// supervise runs f, the part of the server called name, in a goroutine
+// of its own, starting it again whenever it panics or, as it's
+// expected to run for good, returns.
+func supervise(name string, f func()) {
+	components.Lock()
+	status := &componentStatus{Name: name, Running: true}
+	components.byName[name] = status
+	components.Unlock()
+
+	go func() {
+		backoff := minRestartBackoff
+		for {
+			started := time.Now()
+			failure := runRecovering(name, f)
+			if time.Since(started) >= maxRestartBackoff {
+				backoff = minRestartBackoff
+			}
+			log.Error("%s %s; restarting it in %s", name, failure, backoff)
+			components.Lock()
+			status.Running, status.LastFailure = false, failure
+			components.Unlock()
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRestartBackoff {
+				backoff = maxRestartBackoff
+			}
+			components.Lock()
+			status.Running = true
+			status.Restarts++
+			now := time.Now()
+			status.LastRestart = &now
+			components.Unlock()
+		}
+	}()
+}
+
+// runRecovering runs f, describing how it stopped.
+func runRecovering(name string, f func()) (failure string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("%s panicked: %v\n%s", name, err, debug.Stack())
+			failure = fmt.Sprintf("panicked: %v", err)
+		}
+	}()
+	f()
+	return "stopped"
+}
+
+// recovered, deferred in a goroutine of the part of the server called
+// name, logs a panic, letting the goroutine end instead of the server.
+func recovered(name string) {
+	if err := recover(); err != nil {
+		log.Error("%s panicked: %v\n%s", name, err, debug.Stack())
+	}
+}
+
+// componentsSnapshot returns how the supervised parts of the server
+// are doing, by name.
+func componentsSnapshot() []componentStatus {
+	components.Lock()
+	defer components.Unlock()
+	list := []componentStatus{}
+	for _, c := range components.byName {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the -follow-symlinks policies
+const (
+	symlinksOff  = "off"  // symbolic links aren't followed at all
+	symlinksSafe = "safe" // only links to something inside the content directory
+	symlinksAll  = "all"  // links are followed wherever they lead
+)
+
+func checkSymlinkPolicy(policy string) error {
+	switch policy {
+	case symlinksOff, symlinksSafe, symlinksAll:
+		return nil
+	}
+	return fmt.Errorf("-follow-symlinks must be off, safe or all, not %q", policy)
+}
+
+// symlinkAllowed reports whether the -follow-symlinks policy lets us
+// serve or watch name, a path below the content directory.  Paths that
+// don't exist (yet, or any more) are judged by where their nearest
+// existing parent leads.
+func symlinkAllowed(name string) bool {
+	root := *flagContentDir
+	switch *flagFollowSymlinks {
+	case symlinksAll:
+		return true
+	case symlinksOff:
+		rel, err := filepath.Rel(root, name)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return false
+		}
+		p := root
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			p = filepath.Join(p, part)
+			info, err := os.Lstat(p)
+			if err != nil {
+				return true
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return false
+			}
+		}
+		return true
+	default:
+		realRoot, err := realPath(root)
+		if err != nil {
+			return false
+		}
+		real, err := realPath(name)
+		if err != nil {
+			return false
+		}
+		rel, err := filepath.Rel(realRoot, real)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+}
+
+// realPath returns the absolute path name really refers to, with every
+// symbolic link followed.  A path that doesn't exist (a file about to
+// be created, say) is resolved through its nearest existing parent, so
+// that it ends up wherever that parent's links lead.
+func realPath(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	var missing []string
+	for {
+		real, err := filepath.EvalSymlinks(abs)
+		if err == nil {
+			real, err = filepath.Abs(real)
+			if err != nil {
+				return "", err
+			}
+			for i := len(missing) - 1; i >= 0; i-- {
+				real = filepath.Join(real, missing[i])
+			}
+			return real, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(abs))
+		abs = parent
+	}
+}
+
+// contentFS is an http.Dir that refuses to open protected files (which
+// it pretends aren't there) and files the -follow-symlinks policy
+// doesn't allow.
+type contentFS struct {
+	http.FileSystem
+}
+
+func (fs contentFS) Open(name string) (http.File, error) {
+	if protectedPath(name) {
+		log.Warning("refusing to serve protected file %s", name)
+		return nil, os.ErrNotExist
+	}
+	if f := openPreview(name); f != nil {
+		return f, nil
+	}
+	if dir, ok := fs.FileSystem.(http.Dir); ok {
+		full := filepath.Join(string(dir), filepath.FromSlash(path.Clean("/"+name)))
+		if !symlinkAllowed(full) {
+			log.Warning("not following symbolic link to %s", name)
+			return nil, os.ErrPermission
+		}
+	}
+	return fs.FileSystem.Open(name)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// With agent -sync the agent sends the server the files themselves,
+// not just the news that they changed, for a server that doesn't
+// share a filesystem with the machine where they're edited.  On
+// connecting it sends a manifest, the sha256 of every file, and the
+// server asks for those it hasn't got or has different; after that
+// each change is sent as it happens.  A file is sent the way rsync
+// sends one: the server describes the blocks of its copy, the agent
+// finds them in the new file and sends only what's between them.
+// What the server writes its own watcher sees, so its clients reload
+// as they would for a local edit.
+
+// syncBlockSize is the size of the blocks a file is cut into.
+const syncBlockSize = 1024
+
+// A blockSig identifies a block of the server's copy of a file: a
+// weak sum that can be rolled along the new file cheaply, and a strong
+// one to be sure.
+type blockSig struct {
+	Weak   uint32 `json:"w"`
+	Strong []byte `json:"s"`
+}
+
+// A deltaOp is a step in rebuilding a file: copy the Block'th block
+// of the server's copy, or, if there's Data, add that.
+type deltaOp struct {
+	Block int    `json:"b,omitempty"`
+	Data  []byte `json:"d,omitempty"`
+}
+
+// An agentReply is the server's answer to a -sync message.
+type agentReply struct {
+	Type   string     `json:"type"` // wanted, signature or done
+	Rel    string     `json:"rel,omitempty"`
+	Paths  []string   `json:"paths,omitempty"`  // wanted: the files to send
+	Blocks []blockSig `json:"blocks,omitempty"` // signature: the server's copy
+	Error  string     `json:"error,omitempty"`
+}
+
+// weakSum is rsync's rolling checksum of b.
+func weakSum(b []byte) (a uint32, s uint32) {
+	for i, x := range b {
+		a += uint32(x)
+		s += uint32(len(b)-i) * uint32(x)
+	}
+	return a & 0xffff, s & 0xffff
+}
+
+// strongSum is the strong checksum of b.
+func strongSum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:8]
+}
+
+// fileSum is the sha256 of a whole file, as the manifest has it.
+func fileSum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// signatures describes the blocks of old.
+func signatures(old []byte) []blockSig {
+	var sigs []blockSig
+	for start := 0; start < len(old); start += syncBlockSize {
+		end := start + syncBlockSize
+		if end > len(old) {
+			end = len(old)
+		}
+		a, s := weakSum(old[start:end])
+		sigs = append(sigs, blockSig{a | s<<16, strongSum(old[start:end])})
+	}
+	return sigs
+}
+
+// delta works out how to make data from the blocks sigs describes.
+// Only whole blocks are found; a short last block is sent as it is.
+func delta(sigs []blockSig, data []byte) []deltaOp {
+	blocks := make(map[uint32][]int)
+	for i, sig := range sigs {
+		blocks[sig.Weak] = append(blocks[sig.Weak], i)
+	}
+	var ops []deltaOp
+	literal := 0 // where the data not yet sent starts
+	i := 0
+	var a, s uint32
+	if len(data) >= syncBlockSize {
+		a, s = weakSum(data[:syncBlockSize])
+	}
+	for i+syncBlockSize <= len(data) {
+		found := -1
+		for _, j := range blocks[a|s<<16] {
+			if bytes.Equal(sigs[j].Strong, strongSum(data[i:i+syncBlockSize])) {
+				found = j
+				break
+			}
+		}
+		if found >= 0 {
+			if literal < i {
+				ops = append(ops, deltaOp{Data: data[literal:i]})
+			}
+			ops = append(ops, deltaOp{Block: found})
+			i += syncBlockSize
+			literal = i
+			if i+syncBlockSize <= len(data) {
+				a, s = weakSum(data[i : i+syncBlockSize])
+			}
+			continue
+		}
+		if i+syncBlockSize < len(data) {
+			out, in := uint32(data[i]), uint32(data[i+syncBlockSize])
+			a = (a - out + in) & 0xffff
+			s = (s - syncBlockSize*out + a) & 0xffff
+		}
+		i++
+	}
+	if literal < len(data) {
+		ops = append(ops, deltaOp{Data: data[literal:]})
+	}
+	return ops
+}
+
+// applyDelta rebuilds a file from the server's copy, old, and ops.
+func applyDelta(old []byte, ops []deltaOp) ([]byte, error) {
+	var out []byte
+	for _, op := range ops {
+		if op.Data != nil {
+			out = append(out, op.Data...)
+			continue
+		}
+		start := op.Block * syncBlockSize
+		if op.Block < 0 || start >= len(old) {
+			return nil, fmt.Errorf("no block %d", op.Block)
+		}
+		end := start + syncBlockSize
+		if end > len(old) {
+			end = len(old)
+		}
+		out = append(out, old[start:end]...)
+	}
+	return out, nil
+}
+
+// syncTarget resolves a path an agent sends, relative to the content
+// directory, refusing the files the server won't serve.
+func syncTarget(rel string) (string, string, error) {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	name := filepath.Join(*flagContentDir, filepath.FromSlash(rel))
+	if rel == "" || protectedPath(rel) || settingsFor(rel).ignored(rel) || !symlinkAllowed(name) {
+		return "", "", fmt.Errorf("%s may not be written", rel)
+	}
+	return rel, name, nil
+}
+
+// handleSync answers one of an agent's -sync messages.
+func handleSync(remote string, m agentMessage) agentReply {
+	if m.Type == "manifest" {
+		wanted := []string{}
+		for rel, sum := range m.Files {
+			if _, name, err := syncTarget(rel); err == nil {
+				if b, err := ioutil.ReadFile(name); err != nil || fileSum(b) != sum {
+					wanted = append(wanted, rel)
+				}
+			}
+		}
+		log.Info("agent at %s: %d of %d files differ", remote, len(wanted), len(m.Files))
+		return agentReply{Type: "wanted", Paths: wanted}
+	}
+
+	reply := agentReply{Type: "done", Rel: m.Rel}
+	if m.Type == "offer" {
+		reply.Type = "signature"
+	}
+	rel, name, err := syncTarget(m.Rel)
+	switch {
+	case err != nil:
+	case *flagReadOnly:
+		err = fmt.Errorf("the server is read-only")
+	case !contentOnDisk():
+		err = fmt.Errorf("the server is serving a -source snapshot")
+	case m.Type == "offer":
+		old, _ := ioutil.ReadFile(name)
+		reply.Blocks = signatures(old)
+	case m.Type == "delta":
+		old, _ := ioutil.ReadFile(name)
+		var data []byte
+		if data, err = applyDelta(old, m.Delta); err == nil {
+			err = writeSynced(name, data, m.Sum)
+		}
+		if err == nil {
+			log.Notice("agent at %s sent %s", remote, rel)
+			logMutation(mutation{Time: time.Now(), Remote: remote, Action: "sync", Path: rel})
+		}
+	case m.Type == "remove":
+		if err = moveToTrash(rel, ""); err == nil || os.IsNotExist(err) {
+			err = nil
+			log.Notice("agent at %s removed %s", remote, rel)
+			logMutation(mutation{Time: time.Now(), Remote: remote, Action: "remove", Path: rel})
+		}
+	default:
+		err = fmt.Errorf("unknown message %q", m.Type)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	return reply
+}
+
+// writeSynced writes a file an agent sent, if it's what the agent
+// meant to send, in one go, so that nothing sees it half written.
+func writeSynced(name string, data []byte, sum string) error {
+	if fileSum(data) != sum {
+		return fmt.Errorf("checksum mismatch")
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".sync-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// agentRequest sends the server m and returns its reply.
+func agentRequest(ws *websocket.Conn, m agentMessage) (agentReply, error) {
+	var reply agentReply
+	if err := websocket.JSON.Send(ws, m); err != nil {
+		return reply, err
+	}
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		return reply, err
+	}
+	if reply.Error != "" {
+		return reply, syncRefusal{m.Rel, reply.Error}
+	}
+	return reply, nil
+}
+
+// A syncRefusal is the server turning down a file.
+type syncRefusal struct {
+	rel    string
+	reason string
+}
+
+func (e syncRefusal) Error() string {
+	return e.rel + ": " + e.reason
+}
+
+// manifest returns the sha256 of each file below dir the agent would
+// send.
+func manifest(dir string) map[string]string {
+	files := make(map[string]string)
+	for name := range pollTree(dir) {
+		rel, err := filepath.Rel(dir, name)
+		maybeBail(err)
+		rel = filepath.ToSlash(rel)
+		if protectedPath(rel) || settingsFor(rel).ignored(rel) {
+			continue
+		}
+		if b, err := ioutil.ReadFile(name); err == nil {
+			files[rel] = fileSum(b)
+		}
+	}
+	return files
+}
+
+// syncAll sends the server the files below dir that it hasn't got.
+func syncAll(ws *websocket.Conn, dir string) error {
+	files := manifest(dir)
+	reply, err := agentRequest(ws, agentMessage{Type: "manifest", Files: files})
+	if err != nil {
+		return err
+	}
+	log.Notice("sending %d of %d files", len(reply.Paths), len(files))
+	for _, rel := range reply.Paths {
+		if err := syncFile(ws, dir, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFile sends the server a file, rel, below dir, or tells it the
+// file's gone.  Refusals are logged, not returned: they're about the
+// file, not the connection.
+func syncFile(ws *websocket.Conn, dir string, rel string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		_, err = agentRequest(ws, agentMessage{Type: "remove", Rel: rel})
+		return refusal(err)
+	}
+	if err != nil {
+		// a directory, or a file going away as we look
+		return nil
+	}
+	reply, err := agentRequest(ws, agentMessage{Type: "offer", Rel: rel})
+	if err != nil {
+		return refusal(err)
+	}
+	ops := delta(reply.Blocks, data)
+	_, err = agentRequest(ws, agentMessage{Type: "delta", Rel: rel, Delta: ops, Sum: fileSum(data)})
+	if err == nil {
+		sent := 0
+		for _, op := range ops {
+			sent += len(op.Data)
+		}
+		log.Info("sent %s: %d of %d bytes", rel, sent, len(data))
+	}
+	return refusal(err)
+}
+
+// refusal logs a file the server turned down, and passes on other
+// errors, which mean the connection's failed.
+func refusal(err error) error {
+	if e, ok := err.(syncRefusal); ok {
+		log.Error("the server refused %s", e)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tag index pages are served (and exported) in this directory, as
+// <slug>.md, with index.md listing the tags
+const tagsDirName = "_tags"
+
+// an inline tag, #like-this, at the start of a line or after a space
+var inlineTagRegexp = regexp.MustCompile(`(?:^|\s)#([\pL][\pL\pN_/-]*)`)
+
+// metaStrings reads a front matter list, which may also be written as
+// a single comma-separated string.
+func metaStrings(v interface{}) []string {
+	var found []string
+	switch v := v.(type) {
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				found = append(found, s)
+			}
+		}
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok && strings.TrimSpace(s) != "" {
+				found = append(found, strings.TrimSpace(s))
+			}
+		}
+	}
+	return found
+}
+
+// normalizeTags lower-cases tags (so that #Go and go are the same tag),
+// dropping duplicates, and sorts them.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	normal := []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), "#"))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			normal = append(normal, t)
+		}
+	}
+	sort.Strings(normal)
+	return normal
+}
+
+// tagSlug is the name of a tag's index page, without the .md.
+func tagSlug(tag string) string {
+	slug := headingSlug(strings.Replace(tag, "/", "-", -1))
+	if slug == "index" {
+		// that's the list of tags
+		return "index-tag"
+	}
+	return slug
+}
+
+// tagLink is the MDwiki link to a tag's index page.
+func tagLink(tag string) string {
+	return "#!" + tagsDirName + "/" + tagSlug(tag) + ".md"
+}
+
+// tags returns the pages with each tag, sorted by path, leaving out
+// drafts unless drafts is set (they're served, but not exported), and
+// those readable doesn't allow when it's given.
+func (s *siteIndex) tags(drafts bool, readable func(rel string) bool) map[string][]*page {
+	tagged := make(map[string][]*page)
+	for _, p := range s.sortedPages() {
+		if (!drafts && isDraft(p.Path)) || (readable != nil && !readable(p.Path)) {
+			continue
+		}
+		for _, t := range p.Tags {
+			tagged[t] = append(tagged[t], p)
+		}
+	}
+	return tagged
+}
+
+func sortedTags(tagged map[string][]*page) []string {
+	tags := make([]string, 0, len(tagged))
+	for t := range tagged {
+		if tagSlug(t) != "" {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// tagsIndexMarkdown is the page listing every tag.
+func tagsIndexMarkdown(tagged map[string][]*page) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Tags\n\n")
+	for _, t := range sortedTags(tagged) {
+		fmt.Fprintf(&b, "- [%s](%s) (%d)\n", t, tagLink(t), len(tagged[t]))
+	}
+	return b.Bytes()
+}
+
+// tagMarkdown is the page listing the pages with a tag.
+func tagMarkdown(tag string, pages []*page) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\n", tag)
+	for _, p := range pages {
+		fmt.Fprintf(&b, "- [%s](#!%s)", p.Title, p.Path)
+		if p.Summary != "" {
+			fmt.Fprintf(&b, " — %s", p.Summary)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\n[All tags](#!%s/index.md)\n", tagsDirName)
+	return b.Bytes()
+}
+
+// tagPages returns the tag index pages, by path relative to the
+// content directory.
+func tagPages(tagged map[string][]*page) map[string][]byte {
+	pages := make(map[string][]byte)
+	if len(tagged) == 0 {
+		return pages
+	}
+	pages[tagsDirName+"/index.md"] = tagsIndexMarkdown(tagged)
+	for _, t := range sortedTags(tagged) {
+		pages[tagsDirName+"/"+tagSlug(t)+".md"] = tagMarkdown(t, tagged[t])
+	}
+	return pages
+}
+
+// tagPagesHandler serves the tag index pages, /_tags/index.md and
+// /_tags/<tag>.md.
+func tagPagesHandler(w http.ResponseWriter, r *http.Request) {
+	readable := func(rel string) bool { return canRead(r, rel) }
+	md, ok := tagPages(site.tags(true, readable))[strings.TrimPrefix(path.Clean(r.URL.Path), "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	_, err := w.Write(md)
+	maybeBail(err)
+}
+
+// tagsHandler serves /_api/tags, each tag with the paths of its pages.
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	tags := make(map[string][]string)
+	for t, pages := range site.tags(true, func(rel string) bool { return canRead(r, rel) }) {
+		for _, p := range pages {
+			tags[t] = append(tags[t], p.Path)
+		}
+	}
+
+	b, err := json.MarshalIndent(tags, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
+
+// hasTags reports whether p has all of tags.
+func hasTags(p *page, tags []string) bool {
+	for _, want := range normalizeTags(tags) {
+		found := false
+		for _, t := range p.Tags {
+			if t == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// exportTags writes the tag index pages, removing the ones written
+// before for tags that have gone.
+func (e *exporter) exportTags() error {
+	tagged := site.tags(false, nil)
+	pages := tagPages(tagged)
+	sources := make(map[string][]string)
+	for _, t := range sortedTags(tagged) {
+		rel := tagsDirName + "/" + tagSlug(t) + ".md"
+		for _, p := range tagged[t] {
+			sources[rel] = append(sources[rel], p.Path)
+			sources[tagsDirName+"/index.md"] = append(sources[tagsDirName+"/index.md"], p.Path)
+		}
+	}
+	for rel, md := range pages {
+		var newest os.FileInfo
+		for _, src := range sources[rel] {
+			if info, err := os.Stat(filepath.Join(e.dir, filepath.FromSlash(src))); err == nil &&
+				(newest == nil || info.ModTime().After(newest.ModTime())) {
+				newest = info
+			}
+		}
+		if newest == nil {
+			continue
+		}
+
+		dst := filepath.Join(e.out, filepath.FromSlash(rel))
+		if old, err := ioutil.ReadFile(dst); err == nil && bytes.Equal(old, md) {
+			continue
+		}
+		if err := e.write(dst, md, newest); err != nil {
+			return err
+		}
+		e.record(rel, sources[rel]...)
+	}
+
+	e.Lock()
+	var gone []string
+	for out := range e.manifest {
+		if _, ok := pages[out]; !ok && path.Dir(out) == tagsDirName {
+			gone = append(gone, out)
+		}
+	}
+	e.Unlock()
+	for _, out := range gone {
+		log.Info("removing %s from the export", out)
+		if err := os.Remove(filepath.Join(e.out, filepath.FromSlash(out))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		e.Lock()
+		delete(e.manifest, out)
+		e.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// With -targeted-reload a change to a Markdown file only reloads the
+// browsers showing it.  MDwiki loads its pages with XHRs after the
+// document, which the Referer can't tell apart from tab to tab, so the
+// snippet tells the server which .md files each tab has loaded; the
+// server knows which other files those were made from (includes and
+// the like), as it processes them.  Changes to anything else, and tabs
+// that haven't said, reload as ever.
+
+// depends is what each Markdown file was last served made from.
+var depends = struct {
+	sync.Mutex
+	byFile map[string][]string
+}{byFile: make(map[string][]string)}
+
+// recordDepends notes the other files rel, just served, was made from.
+func recordDepends(rel string, deps []string) {
+	depends.Lock()
+	defer depends.Unlock()
+	if len(deps) == 0 {
+		delete(depends.byFile, rel)
+		return
+	}
+	depends.byFile[rel] = append([]string(nil), deps...)
+}
+
+// markdownFor is the Markdown file a change to rel changes: rel for
+// Markdown, the .md it's served as for a converted source, otherwise
+// "".
+func markdownFor(rel string) string {
+	ext := path.Ext(rel)
+	if ext == ".md" {
+		return rel
+	}
+	for _, c := range sourceConverters {
+		if ext == c.ext {
+			return strings.TrimSuffix(rel, ext) + ".md"
+		}
+	}
+	return ""
+}
+
+// shows reports whether a change to rel should reload the client:
+// when it's showing rel, or something made from it, or might be.
+func (c *reloadClient) shows(rel string) bool {
+	md := markdownFor(rel)
+	if !*flagTargetedReload || md == "" {
+		return true
+	}
+	clients.Lock()
+	files := append([]string{c.Page}, c.Loaded...)
+	reported := c.Loaded != nil
+	clients.Unlock()
+	if !reported {
+		return true
+	}
+
+	depends.Lock()
+	defer depends.Unlock()
+	for _, f := range files {
+		if f == md {
+			return true
+		}
+		for _, d := range depends.byFile[f] {
+			if d == md || d == rel {
+				return true
+			}
+		}
+	}
+	return false
+}
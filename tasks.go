@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// taskConfig is a command the server runs on a schedule, every so
+// often or once a day at a time (in local time, as "15:04"), e.g.
+// git pull every 10m, or a nightly lint.  Commands run in the content
+// directory, with this program's path in MDWIKI_DEV_SERVER so that
+// they can use its subcommands; with Mail the output is sent to that
+// address with sendmail.
+type taskConfig struct {
+	Name    string        `yaml:"name"`
+	Command []string      `yaml:"command"`
+	Every   time.Duration `yaml:"every"`
+	At      string        `yaml:"at"`
+	Mail    string        `yaml:"mail"`
+	Timeout time.Duration `yaml:"timeout"` // default 10m
+}
+
+// checkTasks makes sure the config file's tasks can be run, filling
+// in their defaults.
+func checkTasks() error {
+	for i := range cfg.Tasks {
+		t := &cfg.Tasks[i]
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if len(t.Command) == 0 {
+			return fmt.Errorf("task %s has no command", t.Name)
+		}
+		if (t.Every > 0) == (t.At != "") {
+			return fmt.Errorf("task %s needs every or at (not both)", t.Name)
+		}
+		if t.At != "" {
+			if _, err := time.Parse("15:04", t.At); err != nil {
+				return fmt.Errorf("task %s: bad at %q, want e.g. 02:30", t.Name, t.At)
+			}
+		}
+		if t.Timeout <= 0 {
+			t.Timeout = 10 * time.Minute
+		}
+	}
+	return nil
+}
+
+// next returns when the task is next due after now.
+func (t *taskConfig) next(now time.Time) time.Time {
+	if t.Every > 0 {
+		return now.Add(t.Every)
+	}
+	at, _ := time.Parse("15:04", t.At)
+	due := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !due.After(now) {
+		due = due.AddDate(0, 0, 1)
+	}
+	return due
+}
+
+// startTasks runs each task, in a goroutine of its own, whenever it's
+// due.  A task that's still running when it's due again waits for
+// itself.
+func startTasks() {
+	for i := range cfg.Tasks {
+		t := &cfg.Tasks[i]
+		go func() {
+			for {
+				due := t.next(time.Now())
+				log.Debug("task %s due at %s", t.Name, due.Format(time.RFC3339))
+				time.Sleep(time.Until(due))
+				t.run()
+			}
+		}()
+	}
+}
+
+// run runs the task, logging (and mailing) what happened.
+func (t *taskConfig) run() {
+	log.Info("running task %s: %s", t.Name, strings.Join(t.Command, " "))
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...)
+	cmd.Dir = *flagContentDir
+	self, _ := os.Executable()
+	cmd.Env = append(os.Environ(), "MDWIKI_DEV_SERVER="+self)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.WaitDelay = time.Second
+	start := time.Now()
+	err := cmd.Run()
+	status := "succeeded"
+	if ctx.Err() != nil {
+		status = fmt.Sprintf("timed out after %s", t.Timeout)
+	} else if err != nil {
+		status = "failed: " + err.Error()
+	}
+	if err != nil {
+		log.Warning("task %s %s: %s", t.Name, status, strings.TrimSpace(out.String()))
+	} else {
+		log.Info("task %s succeeded in %s", t.Name, time.Since(start).Round(time.Millisecond))
+	}
+
+	if t.Mail != "" {
+		if err := sendMail(t.Mail, fmt.Sprintf("mdwiki-dev-server task %s %s", t.Name, status), out.Bytes()); err != nil {
+			log.Warning("unable to mail task %s's output to %s: %s", t.Name, t.Mail, err)
+		}
+	}
+}
+
+// sendMail sends a plain text message with sendmail.
+func sendMail(to string, subject string, body []byte) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "To: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", to, subject)
+	msg.Write(body)
+	cmd := exec.Command("sendmail", "-t")
+	cmd.Stdin = &msg
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
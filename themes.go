@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+)
+
+// the Bootswatch themes MDwiki's theme gimmick knows about, plus plain
+// Bootstrap
+var mdwikiThemes = []string{
+	"bootstrap", "amelia", "cerulean", "cosmo", "cyborg", "flatly",
+	"journal", "readable", "simplex", "slate", "spacelab", "united",
+}
+
+// the cookie remembering a browser's theme
+const themeCookie = "mdwds-theme"
+
+// a theme gimmick in navigation.md, which would fight with ours
+var themeGimmickRegexp = regexp.MustCompile(`\[gimmick:\s*theme[^\]]*\]\([^)]*\)`)
+
+func knownTheme(name string) bool {
+	for _, t := range mdwikiThemes {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requestTheme returns the theme the browser asked for, or "" to leave
+// the wiki's own theme alone.  A theme query parameter picks one (and
+// remembers it in a cookie), "default" forgets it.
+func requestTheme(w http.ResponseWriter, r *http.Request) string {
+	if name := r.URL.Query().Get("theme"); name != "" {
+		if name == "default" || !knownTheme(name) {
+			http.SetCookie(w, &http.Cookie{Name: themeCookie, Path: "/", MaxAge: -1})
+			return ""
+		}
+		http.SetCookie(w, &http.Cookie{Name: themeCookie, Value: name, Path: "/"})
+		return name
+	}
+	if c, err := r.Cookie(themeCookie); err == nil && knownTheme(c.Value) {
+		return c.Value
+	}
+	return ""
+}
+
+// themeStylesheet returns the link element that loads a theme, which
+// is what MDwiki's theme gimmick adds too.
+func themeStylesheet(name string) []byte {
+	href := "//netdna.bootstrapcdn.com/bootswatch/3.0.0/" + name + "/bootstrap.min.css"
+	if name == "bootstrap" {
+		href = "//netdna.bootstrapcdn.com/bootstrap/3.0.0/css/bootstrap.min.css"
+	}
+	return []byte(fmt.Sprintf("<link rel=\"stylesheet\" href=\"%s\">\n", href))
+}
+
+var themesTmpl = template.Must(template.New("themes").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Themes</title>
+<style>
+body { font-family: sans-serif; }
+li { margin: 0.3em 0; }
+</style>
+</head>
+<body>
+<h1>Themes</h1>
+<p>Pick a theme for this browser; the wiki's files are left alone.</p>
+<ul>
+<li><a href="/?theme=default">the wiki's own theme</a>{{if eq .Current ""}} (current){{end}}</li>
+{{range .Themes}}<li><a href="/?theme={{.}}">{{.}}</a>{{if eq . $.Current}} (current){{end}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// themesHandler serves /_themes, the themes to choose from: as links
+// that switch to them for browsers and as JSON otherwise.
+func themesHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Themes  []string `json:"themes"`
+		Current string   `json:"current"`
+	}{mdwikiThemes, requestTheme(w, r)}
+
+	if !wantsHTML(r) {
+		b, err := json.MarshalIndent(data, "", "  ")
+		maybeBail(err)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		maybeBail(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := themesTmpl.Execute(w, data); err != nil {
+		log.Error("unable to render themes page: %s", err)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// widths offered in the srcset attributes added by addSrcset
+var srcsetWidths = []int{480, 960, 1920}
+
+type thumbnailServer struct {
+	root     http.FileSystem
+	cacheDir string
+}
+
+// ThumbnailServer serves resized copies of images in root at
+// /_thumbs/<w>x<h>/<path>.  The image is scaled to fit within w by h
+// keeping its aspect ratio; either dimension may be 0 to leave it
+// unconstrained.  Images are never scaled up.  Results in the sizes the
+// server links to are cached in cacheDir, and regenerated when the
+// original is newer; other sizes are made afresh each time, so that
+// requests for any number of them can't fill the disk.
+func ThumbnailServer(root http.FileSystem, cacheDir string) http.Handler {
+	return &thumbnailServer{root, cacheDir}
+}
+
+var thumbPathRegexp = regexp.MustCompile(`^/_thumbs/(\d+)x(\d+)(/.+)$`)
+
+// cachedThumbSize reports whether thumbnails of size (<w>x<h>) are
+// cached: those of the srcset widths, and the gallery's.
+func cachedThumbSize(size string) bool {
+	if size == galleryThumbSize {
+		return true
+	}
+	for _, w := range srcsetWidths {
+		if size == strconv.Itoa(w)+"x0" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *thumbnailServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := thumbPathRegexp.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	width, _ := strconv.Atoi(m[1])
+	height, _ := strconv.Atoi(m[2])
+	name := path.Clean(m[3])
+
+	src, err := t.root.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil || srcInfo.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	cached := filepath.Join(t.cacheDir, m[1]+"x"+m[2], filepath.FromSlash(name))
+	if info, err := os.Stat(cached); err == nil && !info.ModTime().Before(srcInfo.ModTime()) {
+		log.Debug("serving cached thumbnail %s", cached)
+		http.ServeFile(w, r, cached)
+		return
+	}
+
+	img, format, err := image.Decode(src)
+	if err != nil {
+		log.Warning("unable to decode %s: %s", name, err)
+		http.Error(w, "not an image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b := img.Bounds()
+	tw, th := fitWithin(b.Dx(), b.Dy(), width, height)
+	if tw >= b.Dx() || th >= b.Dy() {
+		// it's already small enough, hand back the original
+		http.ServeContent(w, r, name, srcInfo.ModTime(), src)
+		return
+	}
+
+	log.Info("generating %dx%d thumbnail of %s", tw, th, name)
+	thumb := scaleDown(img, tw, th)
+	if !cachedThumbSize(m[1] + "x" + m[2]) {
+		w.Header().Set("Content-Type", "image/"+format)
+		if err := encodeImage(w, format, thumb); err != nil {
+			log.Error("unable to send a thumbnail of %s: %s", name, err)
+		}
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(cached), 0755)
+	if err == nil {
+		err = writeImage(cached, format, thumb)
+	}
+	if err != nil {
+		log.Error("unable to cache thumbnail %s: %s", cached, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, cached)
+}
+
+// fitWithin returns the largest size with the aspect ratio of w x h
+// that fits in maxW x maxH (a zero max leaves that side unconstrained).
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	tw, th := int(float64(w)*scale+0.5), int(float64(h)*scale+0.5)
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	return tw, th
+}
+
+// scaleDown shrinks img to w x h by averaging the block of source
+// pixels that lands on each destination pixel.
+func scaleDown(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*b.Dy()/h, (y+1)*b.Dy()/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*b.Dx()/w, (x+1)*b.Dx()/w
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				d[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// encodeImage writes img to w in format, PNG if it's not one of the
+// others.
+func encodeImage(w io.Writer, format string, img image.Image) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return png.Encode(w, img)
+}
+
+func writeImage(name string, format string, img image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = encodeImage(f, format, img)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+var (
+	imgTagRegexp   = regexp.MustCompile(`<img\s[^>]*>`)
+	imgSrcRegexp   = regexp.MustCompile(`\ssrc="([^"]+)"`)
+	mdImageRegexp  = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)(?:\s+"([^"]*)")?\)`)
+	rasterExtRegex = regexp.MustCompile(`(?i)\.(jpe?g|png|gif)$`)
+)
+
+// srcsetFor returns a srcset attribute value offering thumbnails of
+// src (relative to dir), or "" if src isn't a local raster image.
+func srcsetFor(dir string, src string) string {
+	if strings.Contains(src, ":") || !rasterExtRegex.MatchString(src) {
+		return ""
+	}
+	if !strings.HasPrefix(src, "/") {
+		src = path.Join(dir, src)
+	}
+	var candidates []string
+	for _, w := range srcsetWidths {
+		candidates = append(candidates, fmt.Sprintf("/_thumbs/%dx0%s %dw", w, src, w))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// addSrcset adds srcset attributes to the img tags in body, and (for
+// Markdown) turns images into img tags so they can carry one.  name
+// is the path the body was served from, used to resolve relative
+// image paths.
+func addSrcset(name string, body []byte, isMarkdown bool) []byte {
+	dir := path.Dir(name)
+	if isMarkdown {
+		body = mdImageRegexp.ReplaceAllFunc(body, func(m []byte) []byte {
+			parts := mdImageRegexp.FindSubmatch(m)
+			srcset := srcsetFor(dir, string(parts[2]))
+			if srcset == "" {
+				return m
+			}
+			tag := fmt.Sprintf(`<img src="%s" alt="%s"`, html.EscapeString(string(parts[2])), html.EscapeString(string(parts[1])))
+			if len(parts[3]) > 0 {
+				tag += fmt.Sprintf(` title="%s"`, html.EscapeString(string(parts[3])))
+			}
+			return []byte(tag + fmt.Sprintf(` srcset="%s">`, html.EscapeString(srcset)))
+		})
+	}
+	return imgTagRegexp.ReplaceAllFunc(body, func(tag []byte) []byte {
+		if strings.Contains(string(tag), "srcset=") {
+			return tag
+		}
+		src := imgSrcRegexp.FindSubmatch(tag)
+		if src == nil {
+			return tag
+		}
+		srcset := srcsetFor(dir, string(src[1]))
+		if srcset == "" {
+			return tag
+		}
+		return []byte(strings.Replace(string(tag), "<img", `<img srcset="`+srcset+`"`, 1))
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Markdown images become img tags whose attributes can't be broken out
+// of.
+func TestAddSrcsetEscapes(t *testing.T) {
+	got := string(addSrcset("/docs/page.md", []byte(`![a "quoted" <alt>](pic.png "a <b> title")`), true))
+	if strings.Contains(got, `"quoted"`) || strings.Contains(got, "<alt>") || strings.Contains(got, "<b>") {
+		t.Errorf("unescaped alt text or title in %s", got)
+	}
+	if !strings.Contains(got, `alt="a &#34;quoted&#34; &lt;alt&gt;"`) {
+		t.Errorf("alt text mangled in %s", got)
+	}
+}
+
+// Only the sizes the server links to are cached.
+func TestThumbnailCache(t *testing.T) {
+	dir := t.TempDir()
+	content, cache := filepath.Join(dir, "content"), filepath.Join(dir, "cache")
+	if err := os.Mkdir(content, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(content, "pic.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 2000, 1000)))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ThumbnailServer(http.Dir(content), cache)
+
+	for size, cached := range map[string]bool{"480x0": true, "123x0": false, "7x7": false} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/_thumbs/"+size+"/pic.png", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: %d", size, w.Code)
+		}
+		if _, err := png.Decode(w.Body); err != nil {
+			t.Errorf("GET %s: %s", size, err)
+		}
+		if _, err := os.Stat(filepath.Join(cache, size, "pic.png")); (err == nil) != cached {
+			t.Errorf("the %s thumbnail cached is %t, want %t", size, err == nil, cached)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// a [TOC] marker, on a line of its own
+var tocMarkerRegexp = regexp.MustCompile(`(?i)^[ \t]*\[TOC\][ \t]*$`)
+
+// headingSlug turns a heading into an id the way GitHub does: plain
+// text, lower case, punctuation dropped and spaces made hyphens.
+func headingSlug(text string) string {
+	text = summaryLinkRegexp.ReplaceAllString(text, "$1")
+	text = summaryMarkupRegexp.ReplaceAllString(text, "")
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(text)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsNumber(r) || r == '-' || r == '_':
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// processTOC replaces a [TOC] marker with a list of links to the
+// page's headings, down to the toc_depth level, and gives the headings
+// the ids the links lead to.  With heading_anchors the headings get
+// ids whether or not there's a marker.
+func processTOC(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	settings := ctx.Settings
+	lines := strings.SplitAfter(string(in), "\n")
+	marker := -1
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		} else if !inFence && tocMarkerRegexp.MatchString(strings.TrimRight(line, "\r\n")) {
+			marker = i
+			break
+		}
+	}
+	if marker < 0 && !settings.headingAnchors {
+		return in, nil
+	}
+
+	var toc bytes.Buffer
+	used := make(map[string]int)
+	inFence = false
+	top := 0
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		m := indexHeadingRegexp.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if inFence || m == nil {
+			continue
+		}
+		level, text := len(m[1]), m[2]
+		slug := headingSlug(text)
+		if n := used[slug]; n > 0 {
+			used[slug] = n + 1
+			slug += "-" + strconv.Itoa(n)
+		} else {
+			used[slug] = 1
+		}
+		lines[i] = fmt.Sprintf("%s <a id=\"%s\"></a>%s\n", m[1], slug, text)
+
+		if marker < 0 || i < marker || level > settings.tocDepth {
+			continue
+		}
+		if top == 0 || level < top {
+			top = level
+		}
+		title := summaryLinkRegexp.ReplaceAllString(text, "$1")
+		fmt.Fprintf(&toc, "%s- [%s](#!%s#%s)\n", strings.Repeat("  ", level-1), title, ctx.Path, slug)
+	}
+
+	if marker >= 0 {
+		// indented relative to the shallowest heading listed
+		var list bytes.Buffer
+		for _, item := range strings.SplitAfter(toc.String(), "\n") {
+			list.WriteString(strings.TrimPrefix(item, strings.Repeat("  ", top-1)))
+		}
+		lines[marker] = list.String()
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
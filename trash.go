@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// Files deleted through the server (over -sftp, or by an agent with
+// -sync) are moved to .trash in the content directory rather than
+// removed, so that they can be restored from /_api/trash.  With
+// -protect, pages deleted any other way while the server's running go
+// there too, as they were when last seen: the diff baseline has them.
+// Other files deleted behind the server's back are beyond saving.
+// Each file in the trash is a directory with the file, as content, and
+// an entry.json saying what it was.
+
+// trashDirName is the trash, below the content directory; being a dot
+// directory it's neither served nor watched.
+const trashDirName = ".trash"
+
+// A trashEntry is a file in the trash.
+type trashEntry struct {
+	ID   string    `json:"id"`
+	Path string    `json:"path"` // where it was, relative to the content directory
+	Time time.Time `json:"time"` // when it was deleted
+	User string    `json:"user,omitempty"`
+	Size int64     `json:"size"`
+}
+
+// trashed remembers what the server has itself moved to the trash
+// lately, so that -protect doesn't save it again when the watcher
+// reports it gone.
+var trashed = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+func trashDir() string {
+	return filepath.Join(*flagContentDir, trashDirName)
+}
+
+// newTrashEntry makes the directory for a file deleted now.
+func newTrashEntry(rel string, user string) (trashEntry, string, error) {
+	e := trashEntry{ID: time.Now().Format("20060102-150405.000000"), Path: rel, Time: time.Now(), User: user}
+	dir := filepath.Join(trashDir(), e.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return e, "", err
+	}
+	return e, dir, nil
+}
+
+// writeTrashEntry finishes putting a file in the trash.
+func writeTrashEntry(e trashEntry, dir string) error {
+	b, err := json.MarshalIndent(e, "", "  ")
+	maybeBail(err)
+	if err := ioutil.WriteFile(filepath.Join(dir, "entry.json"), b, 0644); err != nil {
+		return err
+	}
+	log.Notice("moved %s to the trash as %s", e.Path, e.ID)
+	return nil
+}
+
+// moveToTrash deletes the file rel, below the content directory, by
+// moving it to the trash.
+func moveToTrash(rel string, user string) error {
+	name := filepath.Join(*flagContentDir, filepath.FromSlash(rel))
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", rel)
+	}
+	e, dir, err := newTrashEntry(rel, user)
+	if err != nil {
+		return err
+	}
+	e.Size = info.Size()
+	trashed.Lock()
+	trashed.at[rel] = time.Now()
+	trashed.Unlock()
+	if err := os.Rename(name, filepath.Join(dir, "content")); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return writeTrashEntry(e, dir)
+}
+
+// protectDeletion is the content handler that, with -protect, saves
+// the pages deleted behind the server's back.  It has to run before
+// updateDiff forgets them.  With -read-only it saves nothing, the
+// trash being below the content directory.
+func protectDeletion(event fsnotify.Event, rel string) {
+	if *flagReadOnly || event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 || path.Ext(rel) != ".md" {
+		return
+	}
+	if _, err := os.Lstat(event.Name); err == nil {
+		return
+	}
+	trashed.Lock()
+	at, ok := trashed.at[rel]
+	delete(trashed.at, rel)
+	trashed.Unlock()
+	if ok && time.Since(at) < time.Minute {
+		return
+	}
+	diffs.Lock()
+	md, ok := diffs.content[rel]
+	diffs.Unlock()
+	if !ok {
+		return
+	}
+
+	e, dir, err := newTrashEntry(rel, "")
+	if err == nil {
+		e.Size = int64(len(md))
+		err = ioutil.WriteFile(filepath.Join(dir, "content"), []byte(md), 0644)
+	}
+	if err == nil {
+		err = writeTrashEntry(e, dir)
+	}
+	if err != nil {
+		log.Error("unable to keep deleted %s in the trash: %s", rel, err)
+	}
+}
+
+// trashEntries returns what's in the trash, newest first.
+func trashEntries() ([]trashEntry, error) {
+	infos, err := ioutil.ReadDir(trashDir())
+	if os.IsNotExist(err) {
+		return []trashEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []trashEntry{}
+	for _, info := range infos {
+		if e, err := loadTrashEntry(info.Name()); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	return entries, nil
+}
+
+// loadTrashEntry reads what the trash entry id is.
+func loadTrashEntry(id string) (trashEntry, error) {
+	var e trashEntry
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return e, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(filepath.Join(trashDir(), id, "entry.json"))
+	if err != nil {
+		return e, err
+	}
+	return e, json.Unmarshal(b, &e)
+}
+
+// restoreFromTrash puts a file in the trash back where it was,
+// unless something has taken its place.
+func restoreFromTrash(e trashEntry) error {
+	name := filepath.Join(*flagContentDir, filepath.FromSlash(e.Path))
+	if _, err := os.Lstat(name); err == nil {
+		return fmt.Errorf("%s already exists", e.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	dir := filepath.Join(trashDir(), e.ID)
+	if err := os.Rename(filepath.Join(dir, "content"), name); err != nil {
+		return err
+	}
+	log.Notice("restored %s from the trash", e.Path)
+	return os.RemoveAll(dir)
+}
+
+// trashHandler serves /_api/trash, what's in the trash (that the user
+// may read), and POST /_api/trash/<id>/restore, which puts a file back.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_api/trash"), "/")
+	var v interface{}
+	if rest == "" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := trashEntries()
+		if err != nil {
+			log.Error("unable to read the trash: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		readable := []trashEntry{}
+		for _, e := range entries {
+			if canRead(r, e.Path) {
+				readable = append(readable, e)
+			}
+		}
+		v = readable
+	} else {
+		id := strings.TrimSuffix(rest, "/restore")
+		if id == rest {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if refuseReadOnly(w) {
+			return
+		}
+		e, err := loadTrashEntry(id)
+		if err != nil || !canRead(r, e.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		if !canEdit(r, e.Path) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if err := restoreFromTrash(e); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		recordMutation(r, mutation{Action: "restore", Path: e.Path})
+		v = e
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	maybeBail(err)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	maybeBail(err)
+}
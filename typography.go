@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// typographyRule is one of the config file's find and replace rules,
+// applied to the text of pages (not their code, tags or link targets)
+// in -render pages and exports.
+type typographyRule struct {
+	Find    string `yaml:"find"`
+	Replace string `yaml:"replace"`
+	Regexp  bool   `yaml:"regexp"` // Find is a regexp, and Replace can use $1 and so on
+}
+
+// the config file's typography rules, compiled
+var typographyRules []*regexp.Regexp
+
+// compileTypography checks and compiles the config file's typography
+// rules.
+func compileTypography() error {
+	for i, r := range cfg.Typography {
+		pattern := r.Find
+		if !r.Regexp {
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("typography rule %d: %s", i+1, err)
+		}
+		typographyRules = append(typographyRules, re)
+	}
+	return nil
+}
+
+var (
+	// the parts of a line that aren't text: code spans, tags and
+	// link targets
+	typographySkipRegexp = regexp.MustCompile("`+[^`]*`+|<[^>]*>|\\]\\([^)]*\\)|https?://\\S+")
+
+	// horizontal rules, setext underlines and table delimiter rows
+	typographyRuleLineRegexp = regexp.MustCompile(`^[ \t]*[-|:=* \t]+$`)
+
+	smartPunctuation = strings.NewReplacer("---", "—", "--", "—", "...", "…")
+)
+
+// smarten curls the quotes in a piece of text and makes em dashes and
+// ellipses of -- (or ---) and ....  before is the character preceding
+// it.
+func smarten(text string, before rune) string {
+	text = smartPunctuation.Replace(text)
+	var b strings.Builder
+	prev := before
+	for _, r := range text {
+		opening := prev == 0 || strings.ContainsRune(" \t\n([{“‘—–>*_", prev)
+		switch {
+		case r == '"' && opening:
+			b.WriteRune('“')
+		case r == '"':
+			b.WriteRune('”')
+		case r == '\'' && opening:
+			b.WriteRune('‘')
+		case r == '\'':
+			b.WriteRune('’')
+		default:
+			b.WriteRune(r)
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// typesetText applies -smartypants and the typography rules to text.
+func typesetText(text string, before rune) string {
+	if *flagSmartypants {
+		text = smarten(text, before)
+	}
+	for i, re := range typographyRules {
+		if cfg.Typography[i].Regexp {
+			text = re.ReplaceAllString(text, cfg.Typography[i].Replace)
+		} else {
+			text = re.ReplaceAllLiteralString(text, cfg.Typography[i].Replace)
+		}
+	}
+	return text
+}
+
+// processTypography polishes the text of a page for -render and
+// exports, leaving fenced code blocks alone.
+func processTypography(in []byte, ctx *ProcessorContext) ([]byte, error) {
+	if !(*flagSmartypants || len(typographyRules) > 0) || !(ctx.Export || *flagRender) {
+		return in, nil
+	}
+	lines := strings.SplitAfter(string(in), "\n")
+	inFence := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence || typographyRuleLineRegexp.MatchString(strings.TrimRight(line, "\r\n")) {
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		var before rune
+		for _, m := range typographySkipRegexp.FindAllStringIndex(line, -1) {
+			b.WriteString(typesetText(line[last:m[0]], before))
+			b.WriteString(line[m[0]:m[1]])
+			before = rune(line[m[1]-1])
+			last = m[1]
+		}
+		b.WriteString(typesetText(line[last:], before))
+		lines[i] = b.String()
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
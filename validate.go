@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/html"
+)
+
+// The validate command renders each page as MDwiki is sent it and
+// checks the HTML, mostly the HTML written into the Markdown, for what
+// browsers silently repair, which leaves MDwiki's layout subtly wrong:
+// elements that are never closed, or closed out of order, end tags with
+// nothing to end, blocks inside paragraphs (which end the paragraph),
+// links inside links, and ids used twice.  With -nu the pages are sent
+// to a Nu HTML checker (https://validator.w3.org/nu/, or a local one)
+// as well, for full HTML5 conformance.
+
+// the elements that have no end tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// the elements whose end tags may be left out
+var optionalEndElements = map[string]bool{
+	"p": true, "li": true, "dt": true, "dd": true, "tr": true, "td": true, "th": true, "thead": true,
+	"tbody": true, "tfoot": true, "option": true, "optgroup": true, "colgroup": true, "caption": true,
+	"rt": true, "rp": true, "html": true, "head": true, "body": true,
+}
+
+// impliedEnds are the open elements each element's start tag ends.
+var impliedEnds = map[string][]string{
+	"li":     {"li"},
+	"dt":     {"dt", "dd"},
+	"dd":     {"dt", "dd"},
+	"tr":     {"tr", "td", "th"},
+	"td":     {"td", "th"},
+	"th":     {"td", "th"},
+	"thead":  {"thead", "tbody", "tfoot", "tr", "td", "th"},
+	"tbody":  {"thead", "tbody", "tfoot", "tr", "td", "th"},
+	"tfoot":  {"thead", "tbody", "tfoot", "tr", "td", "th"},
+	"option": {"option"},
+}
+
+// the elements that end an open paragraph
+var paragraphEnders = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "details": true, "div": true,
+	"dl": true, "fieldset": true, "figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "header": true, "hr": true,
+	"main": true, "nav": true, "ol": true, "p": true, "pre": true, "section": true, "table": true, "ul": true,
+}
+
+// the elements a paragraph can't be ended from inside of
+var paragraphScope = map[string]bool{
+	"td": true, "th": true, "caption": true, "button": true, "object": true, "table": true,
+}
+
+// the elements that only belong inside certain others
+var requiredParents = map[string][]string{
+	"li": {"ul", "ol", "menu"},
+	"tr": {"table", "thead", "tbody", "tfoot"},
+	"td": {"tr"},
+	"th": {"tr"},
+	"dt": {"dl"},
+	"dd": {"dl"},
+}
+
+// an element validateHTML has seen start
+type openElement struct {
+	name string
+	line int // in the Markdown
+}
+
+// validateHTML checks the HTML rendered from the Markdown page rel,
+// md.  The lines reported are the Markdown's, where HTML written into
+// it can be found there, or the nearest line before.  It also returns
+// the Markdown line for each line of the HTML, from 1.
+func validateHTML(rel string, md []byte, rendered []byte) ([]diagnostic, []int) {
+	found := []diagnostic{}
+	report := func(line int, code string, format string, args ...interface{}) {
+		found = append(found, diagnostic{rel, line, 1, "validate", code, fmt.Sprintf(format, args...)})
+	}
+
+	var stack []openElement
+	ids := make(map[string]int)
+	lines := []int{0, 1}
+	mdLine, mdAt := 1, 0
+	placed := false // whether lines has this line of the HTML's place yet
+	z := html.NewTokenizer(bytes.NewReader(rendered))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		tok := z.Token()
+		name := tok.Data
+		// where this came from in the Markdown, if it's there as it is
+		// (a tag) or nearly (text) in this block or the next
+		find := raw
+		if tt == html.TextToken {
+			find = strings.SplitN(strings.TrimSpace(tok.Data), "\n", 2)[0]
+		}
+		if len(find) >= 3 {
+			if i := bytes.Index(md[mdAt:nextBlockEnd(md, mdAt)], []byte(find)); i >= 0 {
+				mdLine += bytes.Count(md[mdAt:mdAt+i], []byte("\n"))
+				mdAt += i
+				if !placed {
+					lines[len(lines)-1], placed = mdLine, true
+				}
+			}
+		}
+		for n := strings.Count(raw, "\n"); n > 0; n-- {
+			lines = append(lines, mdLine)
+			placed = false
+		}
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			for _, a := range tok.Attr {
+				if a.Key != "id" {
+					continue
+				}
+				if line, ok := ids[a.Val]; ok {
+					report(mdLine, "duplicate-id", "id %q is already used, on line %d", a.Val, line)
+				} else {
+					ids[a.Val] = mdLine
+				}
+			}
+			for len(stack) > 0 && contains(impliedEnds[name], stack[len(stack)-1].name) {
+				stack = stack[:len(stack)-1]
+			}
+			if paragraphEnders[name] {
+				for i := len(stack) - 1; i >= 0 && !paragraphScope[stack[i].name]; i-- {
+					if stack[i].name == "p" {
+						if name != "p" || i != len(stack)-1 {
+							report(mdLine, "nesting", "<%s> inside the paragraph from line %d, which ends it", name, stack[i].line)
+						}
+						stack = stack[:i]
+						break
+					}
+				}
+			}
+			if name == "a" {
+				for _, e := range stack {
+					if e.name == "a" {
+						report(mdLine, "nesting", "<a> inside the <a> from line %d", e.line)
+						break
+					}
+				}
+			}
+			if parents, ok := requiredParents[name]; ok {
+				placed := false
+				for i := len(stack) - 1; i >= 0 && !placed; i-- {
+					placed = contains(parents, stack[i].name)
+				}
+				if !placed {
+					report(mdLine, "nesting", "<%s> outside <%s>", name, strings.Join(parents, "> or <"))
+				}
+			}
+			if voidElements[name] {
+				continue
+			}
+			if tt == html.SelfClosingTagToken {
+				report(mdLine, "self-closing", "<%s/> isn't closed: HTML ignores the / on all but void elements", name)
+			}
+			stack = append(stack, openElement{name, mdLine})
+		case html.EndTagToken:
+			if voidElements[name] {
+				report(mdLine, "stray-end-tag", "</%s>: <%s> has no end tag", name, name)
+				continue
+			}
+			i := len(stack) - 1
+			for i >= 0 && stack[i].name != name {
+				i--
+			}
+			if i < 0 {
+				report(mdLine, "stray-end-tag", "</%s> with no <%s> open", name, name)
+				continue
+			}
+			for _, e := range stack[i+1:] {
+				if !optionalEndElements[e.name] {
+					report(e.line, "unclosed", "<%s> isn't closed before the </%s> on line %d", e.name, name, mdLine)
+				}
+			}
+			stack = stack[:i]
+		}
+	}
+	for _, e := range stack {
+		if !optionalEndElements[e.name] {
+			report(e.line, "unclosed", "<%s> is never closed", e.name)
+		}
+	}
+	return found, lines
+}
+
+// nextBlockEnd is where the block of md after the one at at ends.
+func nextBlockEnd(md []byte, at int) int {
+	end := at
+	for blocks := 0; blocks < 2; blocks++ {
+		i := bytes.Index(md[end:], []byte("\n\n"))
+		if i < 0 {
+			return len(md)
+		}
+		end += i + 2
+		for end < len(md) && md[end] == '\n' {
+			end++
+		}
+	}
+	return end
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// nuDocument is what's sent to the Nu checker: the rendered page in a
+// document, as MDwiki's is.
+const nuDocument = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+</head>
+<body>
+%s</body>
+</html>
+`
+
+// nuPrefixLines is the number of lines of nuDocument before the page.
+const nuPrefixLines = 7
+
+// nuCheck sends the page rel, rendered, to the Nu checker at url,
+// reporting its errors at the Markdown lines lines maps them to.
+func nuCheck(client *http.Client, url string, rel string, rendered []byte, lines []int) ([]diagnostic, error) {
+	doc := fmt.Sprintf(nuDocument, rel, rendered)
+	req, err := http.NewRequest("POST", url+"?out=json", strings.NewReader(doc))
+	maybeBail(err)
+	req.Header.Set("Content-Type", "text/html; charset=utf-8")
+	req.Header.Set("User-Agent", "mdwiki-dev-server")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the Nu checker at %s said %s", url, resp.Status)
+	}
+	var result struct {
+		Messages []struct {
+			Type     string `json:"type"`
+			LastLine int    `json:"lastLine"`
+			Message  string `json:"message"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("the Nu checker at %s: %s", url, err)
+	}
+	found := []diagnostic{}
+	for _, m := range result.Messages {
+		if m.Type != "error" {
+			continue
+		}
+		line := 1
+		if n := m.LastLine - nuPrefixLines; n >= 1 && n < len(lines) {
+			line = lines[n]
+		}
+		found = append(found, diagnostic{rel, line, 1, "validate", "nu", m.Message})
+	}
+	return found, nil
+}
+
+// validate implements the validate command, which reports what's wrong
+// with the HTML every Markdown page in the content directory renders
+// as.
+func validate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	format := flags.String("format", "text", "output format, text or json")
+	nu := flags.String("nu", "", "also check the pages with the Nu HTML checker at this URL, e.g. https://validator.w3.org/nu/")
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	var err error
+	site, err = newSiteIndex(*flagContentDir)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	found := []diagnostic{}
+	err = walkMarkdown(*flagContentDir, func(rel string, md []byte) error {
+		processed, err := process(md, newProcessorContext(rel, "", false))
+		if err != nil {
+			return fmt.Errorf("%s: %s", rel, err)
+		}
+		rendered, err := markdownToHTML(processed)
+		if err != nil {
+			return fmt.Errorf("%s: %s", rel, err)
+		}
+		problems, lines := validateHTML(rel, md, rendered)
+		found = append(found, problems...)
+		if *nu != "" {
+			problems, err := nuCheck(client, *nu, rel, rendered, lines)
+			if err != nil {
+				return err
+			}
+			found = append(found, problems...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *format == "text" && *flagDiagnosticsFormat != "":
+		printDiagnostics(found, *flagDiagnosticsFormat)
+	case *format == "json":
+		b, err := json.MarshalIndent(found, "", "  ")
+		maybeBail(err)
+		fmt.Println(string(b))
+	default:
+		for _, d := range found {
+			fmt.Printf("%s:%d:%d: %s\n", d.Path, d.Line, d.Column, d.Message)
+		}
+	}
+	if len(found) > 0 {
+		return fmt.Errorf("found %d HTML problems", len(found))
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// content is where the server reads the content from, set by -source:
+// the -dir directory by default, or a snapshot of a zip file or a git
+// ref.  Anything that's an fs.FS will do, e.g. an embed.FS, or an
+// fstest.MapFS in a test.  The build and the commands that write to
+// the content (mv, deploy, spelling's word list, ...) still work on
+// the directory itself.
+var content fs.FS
+
+// contentFiles returns the content source, the -dir directory unless
+// -source says otherwise.
+func contentFiles() fs.FS {
+	if content != nil {
+		return content
+	}
+	return os.DirFS(*flagContentDir)
+}
+
+// contentOnDisk reports whether the content is being read straight
+// from the -dir directory.
+func contentOnDisk() bool {
+	return content == nil
+}
+
+// contentFileSystem returns the content source for serving.
+func contentFileSystem() http.FileSystem {
+	if contentOnDisk() {
+		return http.Dir(*flagContentDir)
+	}
+	return http.FS(content)
+}
+
+// readContent reads rel, a path relative to the content directory, or
+// its editor preview if it has one.
+func readContent(rel string) ([]byte, error) {
+	if data, _, ok := previewContent(rel); ok {
+		return data, nil
+	}
+	return fs.ReadFile(contentFiles(), strings.TrimPrefix(path.Clean("/"+rel), "/"))
+}
+
+// statContent describes rel, a path relative to the content directory.
+func statContent(rel string) (fs.FileInfo, error) {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if f := openPreview(rel); f != nil {
+		return f.info, nil
+	}
+	if rel == "" {
+		rel = "."
+	}
+	return fs.Stat(contentFiles(), rel)
+}
+
+// openContentSource sets the content source from -source: "" for the
+// -dir directory, zip:FILE for a zip file, or git:REF for a branch,
+// tag or commit of the git repository at -dir.
+func openContentSource(source string) error {
+	var s *snapshotSource
+	switch {
+	case source == "":
+		return nil
+	case strings.HasPrefix(source, "zip:"):
+		s = zipSource(strings.TrimPrefix(source, "zip:"))
+	case strings.HasPrefix(source, "git:"):
+		s = gitSource(*flagContentDir, strings.TrimPrefix(source, "git:"))
+	default:
+		return fmt.Errorf("-source must be zip:FILE or git:REF, not %q", source)
+	}
+	if _, err := s.refresh(); err != nil {
+		return fmt.Errorf("-source %s: %s", source, err)
+	}
+	log.Info("reading content from %s", s.name)
+	content = s
+	return nil
+}
+
+// A snapshotSource is content that's read all at once, as a zip file,
+// and read again whenever its version changes.
+type snapshotSource struct {
+	name    string
+	version func() (string, error)
+	load    func() ([]byte, error) // the zip file
+
+	sync.RWMutex
+	files   fs.FS
+	current string
+}
+
+func (s *snapshotSource) Open(name string) (fs.File, error) {
+	s.RLock()
+	files := s.files
+	s.RUnlock()
+	return files.Open(name)
+}
+
+// refresh reads the source again if its version has changed, returning
+// the files it replaced, or nil if nothing changed (or there was
+// nothing to replace).
+func (s *snapshotSource) refresh() (fs.FS, error) {
+	version, err := s.version()
+	if err != nil {
+		return nil, err
+	}
+	s.RLock()
+	old, current := s.files, s.current
+	s.RUnlock()
+	if version == current {
+		return nil, nil
+	}
+	data, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	files, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	s.files, s.current = files, version
+	s.Unlock()
+	return old, nil
+}
+
+// zipSource is the content of a zip file.
+func zipSource(name string) *snapshotSource {
+	return &snapshotSource{
+		name: name,
+		version: func() (string, error) {
+			info, err := os.Stat(name)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d@%d", info.Size(), info.ModTime().UnixNano()), nil
+		},
+		load: func() ([]byte, error) { return ioutil.ReadFile(name) },
+	}
+}
+
+// gitSource is the content of the git repository at dir as of ref.
+func gitSource(dir string, ref string) *snapshotSource {
+	var commit string
+	return &snapshotSource{
+		name: dir + " at " + ref,
+		version: func() (string, error) {
+			out, err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+			if err != nil {
+				return "", fmt.Errorf("no commit %s in %s", ref, dir)
+			}
+			commit = strings.TrimSpace(string(out))
+			return commit, nil
+		},
+		load: func() ([]byte, error) {
+			var stderr bytes.Buffer
+			cmd := exec.Command("git", "-C", dir, "archive", "--format=zip", commit)
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				return nil, fmt.Errorf("git archive: %s: %s", err, strings.TrimSpace(stderr.String()))
+			}
+			return out, nil
+		},
+	}
+}
+
+// snapshotHashes returns a hash of each file in a snapshot, other than
+// those in dot directories.
+func snapshotHashes(files fs.FS) map[string][sha256.Size]byte {
+	hashes := make(map[string][sha256.Size]byte)
+	fs.WalkDir(files, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if rel != "." && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if data, err := fs.ReadFile(files, rel); err == nil {
+			hashes[rel] = sha256.Sum256(data)
+		}
+		return nil
+	})
+	return hashes
+}
+
+// newSnapshotWatcher looks for a new version of the source every
+// interval and reports the files that differ as changes below dir,
+// where they'd be if the snapshot were the content directory.
+func newSnapshotWatcher(s *snapshotSource, dir string, matcher *regexp.Regexp, interval time.Duration) (chan fsnotify.Event, chan interface{}) {
+	notifier := make(chan fsnotify.Event)
+	notifierShutdown := make(chan interface{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-notifierShutdown:
+				return
+			}
+			old, err := s.refresh()
+			if err != nil {
+				log.Error("unable to read %s: %s", s.name, err)
+				continue
+			}
+			if old == nil {
+				continue
+			}
+			log.Notice("%s has changed", s.name)
+			before, after := snapshotHashes(old), snapshotHashes(s)
+			var events []fsnotify.Event
+			for rel, h := range after {
+				name := filepath.Join(dir, filepath.FromSlash(rel))
+				if oldHash, ok := before[rel]; !ok {
+					events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Create})
+				} else if oldHash != h {
+					events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Write})
+				}
+			}
+			for rel := range before {
+				if _, ok := after[rel]; !ok {
+					events = append(events, fsnotify.Event{Name: filepath.Join(dir, filepath.FromSlash(rel)), Op: fsnotify.Remove})
+				}
+			}
+			for _, event := range events {
+				if !watchMatches(matcher, event.Name) {
+					continue
+				}
+				select {
+				case notifier <- event:
+				case <-notifierShutdown:
+					return
+				}
+			}
+		}
+	}()
+	return notifier, notifierShutdown
+}
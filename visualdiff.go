@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The visual-diff command takes screenshots of the pages, as the
+// screenshots command does, and compares them with a baseline, the
+// screenshots command's of a version known to look right, to catch
+// layout broken by a stylesheet or theme change.  It reports pages
+// whose pixels differ, writing an image of each with what's changed
+// in red, and the headings, paragraphs and so on that have moved,
+// changed size, or come or gone.
+
+// channelTolerance is how far a colour channel may be off before a
+// pixel counts as different, for anti-aliasing.
+const channelTolerance = 24
+
+// maxLayoutChanges is the most layout changes reported for a page.
+const maxLayoutChanges = 10
+
+// comparePixels compares a page's screenshot now with its baseline,
+// returning how many pixels differ (those outside the smaller of the
+// two included), and an image of the baseline, faded, with them red.
+func comparePixels(baseline image.Image, now image.Image) (int, *image.RGBA) {
+	b, n := baseline.Bounds(), now.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if n.Dx() > w {
+		w = n.Dx()
+	}
+	if n.Dy() > h {
+		h = n.Dy()
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	red := color.RGBA{255, 0, 0, 255}
+	differ := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			inBaseline := x < b.Dx() && y < b.Dy()
+			if !inBaseline || x >= n.Dx() || y >= n.Dy() {
+				differ++
+				out.Set(x, y, red)
+				continue
+			}
+			c1 := color.RGBAModel.Convert(baseline.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+			c2 := color.RGBAModel.Convert(now.At(n.Min.X+x, n.Min.Y+y)).(color.RGBA)
+			if far(c1.R, c2.R) || far(c1.G, c2.G) || far(c1.B, c2.B) {
+				differ++
+				out.Set(x, y, red)
+				continue
+			}
+			gray := uint8((299*int(c1.R)+587*int(c1.G)+114*int(c1.B))/1000/4 + 192)
+			out.Set(x, y, color.RGBA{gray, gray, gray, 255})
+		}
+	}
+	return differ, out
+}
+
+func far(a uint8, b uint8) bool {
+	return int(a)-int(b) > channelTolerance || int(b)-int(a) > channelTolerance
+}
+
+// compareLayouts describes how a page's blocks have moved, changed
+// size, or come or gone, ignoring moves of slack pixels or less.
+// Blocks are matched by their tag and text.
+func compareLayouts(baseline []layoutBox, now []layoutBox, slack int) []string {
+	key := func(boxes []layoutBox) (map[string]layoutBox, []string) {
+		m := make(map[string]layoutBox)
+		var order []string
+		seen := make(map[string]int)
+		for _, box := range boxes {
+			k := box.Tag + "\x00" + box.Text
+			seen[k]++
+			k = fmt.Sprintf("%s\x00%d", k, seen[k])
+			m[k] = box
+			order = append(order, k)
+		}
+		return m, order
+	}
+	old, oldOrder := key(baseline)
+	cur, curOrder := key(now)
+	name := func(box layoutBox) string {
+		if box.Text == "" {
+			return box.Tag
+		}
+		return fmt.Sprintf("%s “%s”", box.Tag, box.Text)
+	}
+	off := func(a int, b int) bool {
+		return a-b > slack || b-a > slack
+	}
+
+	var changes []string
+	for _, k := range oldOrder {
+		o := old[k]
+		c, ok := cur[k]
+		switch {
+		case !ok:
+			changes = append(changes, "no "+name(o)+" now")
+		case off(o.X, c.X) || off(o.Y, c.Y):
+			changes = append(changes, fmt.Sprintf("%s moved from %d,%d to %d,%d", name(o), o.X, o.Y, c.X, c.Y))
+		case off(o.W, c.W) || off(o.H, c.H):
+			changes = append(changes, fmt.Sprintf("%s resized from %dx%d to %dx%d", name(o), o.W, o.H, c.W, c.H))
+		}
+	}
+	for _, k := range curOrder {
+		if _, ok := old[k]; !ok {
+			changes = append(changes, "new "+name(cur[k]))
+		}
+	}
+	return changes
+}
+
+// loadBaseline reads the baseline's screenshot of rel, and its layout
+// if it has one.
+func loadBaseline(dir string, rel string) (image.Image, []layoutBox, error) {
+	name := shotName(dir, rel)
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", name, err)
+	}
+	var layout []layoutBox
+	if b, err := ioutil.ReadFile(strings.TrimSuffix(name, ".png") + ".json"); err == nil {
+		if err := json.Unmarshal(b, &layout); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return img, layout, nil
+}
+
+// visualDiff implements the visual-diff command.
+func visualDiff(args []string) error {
+	flags := flag.NewFlagSet("visual-diff", flag.ExitOnError)
+	baseline := flags.String("baseline", "", "the screenshots command's -out directory, of how the pages should look")
+	url := flags.String("url", "", "server to take the screenshots from; by default one is started in-process")
+	width := flags.Int("width", screenshotWidth, "viewport width, in pixels, as the baseline was taken")
+	out := flags.String("out", "visual-diff", "directory to write an image of each page that differs to")
+	threshold := flags.Float64("threshold", 0.001, "fraction of a page's pixels that may differ")
+	slack := flags.Int("slack", 2, "pixels a block may move or grow by unreported")
+	flags.Parse(args)
+	if *baseline == "" || flags.NArg() != 0 {
+		return fmt.Errorf("usage: visual-diff -baseline DIR [-url URL] [-out DIR]")
+	}
+
+	pages, differ := 0, 0
+	seen := make(map[string]bool)
+	err := shootPages(*url, *width, func(rel string, s shot) error {
+		pages++
+		seen[shotName(*baseline, rel)] = true
+		var report []string
+		img, layout, err := loadBaseline(*baseline, rel)
+		if os.IsNotExist(err) {
+			report = append(report, "not in the baseline")
+		} else if err != nil {
+			return err
+		} else {
+			now, err := png.Decode(bytes.NewReader(s.PNG))
+			maybeBail(err)
+			if b, n := img.Bounds(), now.Bounds(); b.Size() != n.Size() {
+				report = append(report, fmt.Sprintf("size %dx%d, %dx%d in the baseline", n.Dx(), n.Dy(), b.Dx(), b.Dy()))
+			}
+			n, diff := comparePixels(img, now)
+			area := diff.Bounds().Dx() * diff.Bounds().Dy()
+			if area > 0 && float64(n)/float64(area) > *threshold {
+				name := shotName(*out, rel)
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					return err
+				}
+				var buf bytes.Buffer
+				maybeBail(png.Encode(&buf, diff))
+				if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+					return err
+				}
+				report = append(report, fmt.Sprintf("%.2f%% of the pixels differ (%s)", 100*float64(n)/float64(area), name))
+			}
+			if layout != nil {
+				changes := compareLayouts(layout, s.Layout, *slack)
+				if len(changes) > maxLayoutChanges {
+					changes = append(changes[:maxLayoutChanges], fmt.Sprintf("and %d more layout changes", len(changes)-maxLayoutChanges))
+				}
+				report = append(report, changes...)
+			}
+		}
+		if len(report) > 0 {
+			differ++
+			for _, line := range report {
+				fmt.Printf("%s: %s\n", rel, line)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(*baseline, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(name) != ".png" || seen[name] {
+			return err
+		}
+		rel, err := filepath.Rel(*baseline, name)
+		maybeBail(err)
+		differ++
+		fmt.Printf("%s: in the baseline, but not a page now\n", filepath.ToSlash(strings.TrimSuffix(rel, ".png"))+".md")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if differ > 0 {
+		return fmt.Errorf("%d of %d pages differ from the baseline", differ, pages)
+	}
+	fmt.Printf("%d pages look as they did\n", pages)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// A wasmPlugin runs a WASI module as a plugin.  Each file gets a fresh
+// instance with the content on stdin and the context in its
+// environment, just like a command plugin, but no access to the file
+// system or the network, a memory limit and a deadline.  The module is
+// compiled again when it changes.
+type wasmPlugin struct {
+	pluginConfig
+
+	sync.Mutex
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	modTime  time.Time
+}
+
+// wasm pages are 64KiB
+const wasmPagesPerMB = 16
+
+func newWasmPlugin(pc pluginConfig) *wasmPlugin {
+	return &wasmPlugin{pluginConfig: pc}
+}
+
+// module returns the compiled module, compiling it if it's new or has
+// changed.
+func (w *wasmPlugin) module(ctx context.Context) (wazero.Runtime, wazero.CompiledModule, error) {
+	name := w.Wasm
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(*flagContentDir, name)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.compiled != nil && fi.ModTime().Equal(w.modTime) {
+		return w.runtime, w.compiled, nil
+	}
+	if w.runtime != nil {
+		// this cuts short any instances of the old module still running
+		w.runtime.Close(context.Background())
+	}
+
+	code, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := wazero.NewRuntimeWithConfig(context.Background(), wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(w.MemoryMB*wasmPagesPerMB).
+		WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(context.Background(), r)
+	compiled, err := r.CompileModule(ctx, code)
+	if err != nil {
+		r.Close(context.Background())
+		w.runtime, w.compiled = nil, nil
+		return nil, nil, err
+	}
+	log.Info("compiled plugin %s from %s", w.Name, w.Wasm)
+	w.runtime, w.compiled, w.modTime = r, compiled, fi.ModTime()
+	return r, compiled, nil
+}
+
+func (w *wasmPlugin) run(in []byte, pluginContext []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	r, compiled, err := w.module(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(w.Name).
+		WithEnv("MDWIKI_DEV_CONTEXT", string(pluginContext)).
+		WithStdin(bytes.NewReader(in)).
+		WithStdout(&stdout).
+		WithStderr(&stderr)
+	mod, err := r.InstantiateModule(ctx, compiled, config)
+	if mod != nil {
+		mod.Close(ctx)
+	}
+	var exit *sys.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %s", w.Timeout)
+		}
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
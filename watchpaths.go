@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// watchMatches reports whether a watcher's pattern matches the file an
+// event is about.  Patterns are written with slashes, whatever the
+// platform, so that a pattern like docs/.*\.md works on Windows too,
+// where event names have backslashes.
+func watchMatches(re *regexp.Regexp, name string) bool {
+	return re.MatchString(filepath.ToSlash(name))
+}
+
+// Windows (ReadDirectoryChangesW) reports a save as a burst of
+// identical writes, several as the file is flushed, so repeats of an
+// event this close together are dropped there.
+const coalesceWindow = 50 * time.Millisecond
+
+// An eventCoalescer drops repeats of the last event it was shown.
+type eventCoalescer struct {
+	last     fsnotify.Event
+	lastSeen time.Time
+}
+
+// repeat reports whether event is a repeat that should be dropped.
+func (c *eventCoalescer) repeat(event fsnotify.Event) bool {
+	if runtime.GOOS != "windows" {
+		return false
+	}
+	now := time.Now()
+	repeated := event == c.last && now.Sub(c.lastSeen) < coalesceWindow
+	c.last, c.lastSeen = event, now
+	return repeated
+}
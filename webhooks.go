@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// changes are gathered for this long before the webhooks hear about
+// them, so that a checkout or a save-all is one message and not dozens
+const webhookDelay = 10 * time.Second
+
+// webhookConfig is a webhook told about content changes.  Format is
+// "slack" or "discord" for their incoming webhooks; anything else gets
+// a JSON object with the text and the list of changes.
+type webhookConfig struct {
+	URL    string `yaml:"url"`
+	Format string `yaml:"format"`
+}
+
+// A webhookChange is a file that changed, as the webhooks hear of it.
+type webhookChange struct {
+	File    string `json:"file"`
+	Op      string `json:"op"`
+	Author  string `json:"author,omitempty"`  // who last committed it
+	Added   int    `json:"added,omitempty"`   // uncommitted lines added
+	Removed int    `json:"removed,omitempty"` // and removed
+}
+
+// the changes waiting to be sent
+var webhookBatch struct {
+	sync.Mutex
+	changes []webhookChange
+	timer   *time.Timer
+}
+
+// notifyWebhooks is the content handler that queues changes for the
+// webhooks.
+func notifyWebhooks(event fsnotify.Event, rel string) {
+	if !settingsFor(rel).watches(rel) {
+		return
+	}
+	webhookBatch.Lock()
+	defer webhookBatch.Unlock()
+	for i, c := range webhookBatch.changes {
+		if c.File == rel {
+			webhookBatch.changes = append(webhookBatch.changes[:i], webhookBatch.changes[i+1:]...)
+			break
+		}
+	}
+	webhookBatch.changes = append(webhookBatch.changes, webhookChange{File: rel, Op: event.Op.String()})
+	if webhookBatch.timer == nil {
+		webhookBatch.timer = time.AfterFunc(webhookDelay, sendWebhooks)
+	}
+}
+
+// gitAuthor returns who last committed a file, or "" if nobody has.
+func gitAuthor(dir string, rel string) string {
+	out, err := exec.Command("git", "-C", dir, "log", "-1", "--format=%an", "--", rel).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitNumstat returns the number of lines added to and removed from a
+// file since it was last committed.
+func gitNumstat(dir string, rel string) (added int, removed int) {
+	out, err := exec.Command("git", "-C", dir, "diff", "--numstat", "--", rel).Output()
+	if err == nil {
+		fmt.Sscan(string(out), &added, &removed)
+	}
+	return added, removed
+}
+
+// webhookText describes the changes in a line or so each.
+func webhookText(host string, changes []webhookChange) string {
+	var b strings.Builder
+	if len(changes) == 1 {
+		fmt.Fprintf(&b, "1 file changed on %s:\n", host)
+	} else {
+		fmt.Fprintf(&b, "%d files changed on %s:\n", len(changes), host)
+	}
+	for _, c := range changes {
+		fmt.Fprintf(&b, "• %s %s", c.File, strings.ToLower(c.Op))
+		if c.Author != "" {
+			fmt.Fprintf(&b, ", last committed by %s", c.Author)
+		}
+		if c.Added > 0 || c.Removed > 0 {
+			fmt.Fprintf(&b, " (+%d −%d)", c.Added, c.Removed)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// sendWebhooks posts the waiting changes to each webhook.
+func sendWebhooks() {
+	webhookBatch.Lock()
+	changes := webhookBatch.changes
+	webhookBatch.changes = nil
+	webhookBatch.timer = nil
+	webhookBatch.Unlock()
+	if len(changes) == 0 {
+		return
+	}
+
+	for i := range changes {
+		changes[i].Author = gitAuthor(*flagContentDir, changes[i].File)
+		changes[i].Added, changes[i].Removed = gitNumstat(*flagContentDir, changes[i].File)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = *flagAddr
+	}
+	text := webhookText(host+":"+*flagPort, changes)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, hook := range cfg.Webhooks {
+		var payload interface{}
+		switch hook.Format {
+		case "slack":
+			payload = map[string]string{"text": text}
+		case "discord":
+			payload = map[string]string{"content": text}
+		default:
+			payload = struct {
+				Text    string          `json:"text"`
+				Changes []webhookChange `json:"changes"`
+			}{text, changes}
+		}
+		b, err := json.Marshal(payload)
+		maybeBail(err)
+		resp, err := client.Post(hook.URL, "application/json", bytes.NewReader(b))
+		if err != nil {
+			log.Warning("unable to notify webhook %s: %s", hook.URL, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Warning("webhook %s answered %s", hook.URL, resp.Status)
+			continue
+		}
+		log.Info("told webhook %s about %d changes", hook.URL, len(changes))
+	}
+}